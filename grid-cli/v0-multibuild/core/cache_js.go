@@ -0,0 +1,96 @@
+//go:build js && wasm
+
+package core
+
+import (
+	"errors"
+	"syscall/js"
+)
+
+// cacheStore is the IndexedDB object store holding the cache.
+const cacheStore = "cache"
+
+// IndexedDBCacheStorage keeps the cache in the browser's IndexedDB,
+// so that it survives page reloads.  IndexedDB is asynchronous; its
+// methods block the calling goroutine until the browser answers, so
+// they must not be called from a JavaScript callback's own goroutine.
+type IndexedDBCacheStorage struct {
+	db js.Value
+}
+
+// OpenIndexedDB opens, creating if needed, the IndexedDB database
+// named name.
+func OpenIndexedDB(name string) (*IndexedDBCacheStorage, error) {
+	idb := js.Global().Get("indexedDB")
+	if !idb.Truthy() {
+		return nil, ErrNotSupported
+	}
+	req := idb.Call("open", name, 1)
+	upgrade := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		req.Get("result").Call("createObjectStore", cacheStore)
+		return nil
+	})
+	defer upgrade.Release()
+	req.Set("onupgradeneeded", upgrade)
+	db, err := await(req)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexedDBCacheStorage{db: db}, nil
+}
+
+// store returns the cache's object store in a new transaction.
+func (ics *IndexedDBCacheStorage) store(mode string) js.Value {
+	return ics.db.Call("transaction", cacheStore, mode).Call("objectStore", cacheStore)
+}
+
+func (ics *IndexedDBCacheStorage) Save(hash string, data []byte) error {
+	buf := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buf, data)
+	_, err := await(ics.store("readwrite").Call("put", buf, hash))
+	return err
+}
+
+func (ics *IndexedDBCacheStorage) Load(hash string) ([]byte, error) {
+	val, err := await(ics.store("readonly").Call("get", hash))
+	if err != nil {
+		return nil, err
+	}
+	if val.IsUndefined() {
+		return nil, ErrNotFound
+	}
+	data := make([]byte, val.Get("length").Int())
+	js.CopyBytesToGo(data, val)
+	return data, nil
+}
+
+// await waits for an IndexedDB request to succeed or fail, returning
+// its result.
+func await(req js.Value) (js.Value, error) {
+	done := make(chan error, 1)
+	success := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- nil
+		return nil
+	})
+	defer success.Release()
+	failure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- jsError(req.Get("error"))
+		return nil
+	})
+	defer failure.Release()
+	req.Set("onsuccess", success)
+	req.Set("onerror", failure)
+	err := <-done
+	if err != nil {
+		return js.Undefined(), err
+	}
+	return req.Get("result"), nil
+}
+
+// jsError converts a JavaScript error or DOMException to a Go error.
+func jsError(v js.Value) error {
+	if !v.Truthy() {
+		return errors.New("unknown error")
+	}
+	return errors.New(v.Get("message").String())
+}
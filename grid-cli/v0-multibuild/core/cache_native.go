@@ -0,0 +1,41 @@
+//go:build !js
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// NativeCacheStorage keeps the cache as files in a directory.
+type NativeCacheStorage struct {
+	cacheDir string
+}
+
+// NewNativeCacheStorage returns a cache in dir, creating dir if
+// needed.
+func NewNativeCacheStorage(dir string) (*NativeCacheStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &NativeCacheStorage{cacheDir: dir}, nil
+}
+
+// Path returns the file holding hash.
+func (ncs *NativeCacheStorage) Path(hash string) string {
+	return filepath.Join(ncs.cacheDir, hash)
+}
+
+func (ncs *NativeCacheStorage) Save(hash string, data []byte) error {
+	// modules are executed in place
+	return os.WriteFile(ncs.Path(hash), data, 0755)
+}
+
+func (ncs *NativeCacheStorage) Load(hash string) ([]byte, error) {
+	data, err := os.ReadFile(ncs.Path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
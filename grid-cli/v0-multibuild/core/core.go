@@ -0,0 +1,256 @@
+// Package core is the part of grid shared by the native command line
+// tool and the browser peer.  Everything that differs between the two
+// -- where the cache lives, how modules run, how peers are reached --
+// sits behind an interface, with native implementations built for
+// every platform except js and browser implementations built for
+// js/wasm.
+//
+// Nodes speak the v0 protocol: a query is just the hash wanted, with
+// no capability or signature.  A v0 node therefore only fetches from
+// v0 servers, such as another node's Serve; v1 servers refuse its
+// queries.
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrNotFound is returned by a CacheStorage that does not hold the
+// requested hash.
+var ErrNotFound = errors.New("not found in cache")
+
+// ErrNotSupported is returned by operations the platform cannot
+// perform, such as running a native module in a browser.
+var ErrNotSupported = errors.New("not supported on this platform")
+
+// CacheStorage keeps content by its hex multihash.
+type CacheStorage interface {
+	Save(hash string, data []byte) error
+	Load(hash string) ([]byte, error)
+}
+
+// CommandExecutor runs modules that are in the cache, by hash.
+type CommandExecutor interface {
+	ExecuteCommand(hash string, args []string) error
+	ShowPromise(hash string) (string, error)
+}
+
+// Message types, numbered as in the WebSocket protocol.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// Conn is a message-oriented connection to a peer.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// Transport connects to peers' websocket servers.
+type Transport interface {
+	Dial(url string) (Conn, error)
+}
+
+// Grid is one grid node.
+type Grid struct {
+	Cache     CacheStorage
+	Executor  CommandExecutor
+	Transport Transport
+	// SymbolTable is the hash of the table mapping subcommands to
+	// modules.
+	SymbolTable string
+
+	mu    sync.Mutex
+	peers map[string]Conn
+}
+
+// NewGrid returns a node with no peers.
+func NewGrid(cache CacheStorage, executor CommandExecutor, transport Transport) *Grid {
+	return &Grid{
+		Cache:     cache,
+		Executor:  executor,
+		Transport: transport,
+		peers:     make(map[string]Conn),
+	}
+}
+
+// Connect dials a peer and adds it to the peers asked for content the
+// cache does not hold.
+func (g *Grid) Connect(url string) error {
+	conn, err := g.Transport.Dial(url)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to peer %s: %v", url, err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if old, ok := g.peers[url]; ok {
+		old.Close()
+	}
+	g.peers[url] = conn
+	return nil
+}
+
+// Close disconnects from every peer.
+func (g *Grid) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for url, conn := range g.peers {
+		conn.Close()
+		delete(g.peers, url)
+	}
+	return nil
+}
+
+// Fetch returns the content for a hex multihash from the cache, or
+// else from the first peer that has it, verifying and caching it.
+func (g *Grid) Fetch(hash string) ([]byte, error) {
+	_, err := ParseHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := g.Cache.Load(hash)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	data, err = g.queryPeers(hash)
+	if err != nil {
+		return nil, err
+	}
+	err = Verify(hash, data)
+	if err != nil {
+		return nil, err
+	}
+	err = g.Cache.Save(hash, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// queryPeers asks each peer in turn for hash.  Peers send content as a
+// binary message and refusals as a text message.  Queries are made one
+// at a time, so that each reply can be matched to its query.  A query
+// carries no capability, so only v0 peers answer it.
+func (g *Grid) queryPeers(hash string) ([]byte, error) {
+	query, err := json.Marshal(map[string]string{"hash": hash})
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var reasons []string
+	for url, conn := range g.peers {
+		err := conn.WriteMessage(TextMessage, query)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", url, err))
+			continue
+		}
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", url, err))
+			continue
+		}
+		if mt != BinaryMessage {
+			var reply map[string]string
+			json.Unmarshal(data, &reply)
+			reasons = append(reasons, fmt.Sprintf("%s: %s", url, reply["error"]))
+			continue
+		}
+		return data, nil
+	}
+	if len(reasons) == 0 {
+		return nil, fmt.Errorf("Failed to fetch %s: no peers.", hash)
+	}
+	return nil, fmt.Errorf("Failed to fetch %s: %s", hash, strings.Join(reasons, "; "))
+}
+
+// ParseHash decodes a hex multihash.  Hashes name cache files, so
+// anything else is refused before it gets near a cache.
+func ParseHash(hash string) (*multihash.DecodedMultihash, error) {
+	mBuf, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash %q: %v", hash, err)
+	}
+	decoded, err := multihash.Decode(mBuf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash %q: %v", hash, err)
+	}
+	return decoded, nil
+}
+
+// Verify checks that data matches a hex multihash.
+func Verify(hash string, data []byte) error {
+	decoded, err := ParseHash(hash)
+	if err != nil {
+		return err
+	}
+	mBuf, _ := hex.DecodeString(hash)
+	sum, err := multihash.Sum(data, decoded.Code, decoded.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, mBuf) {
+		return fmt.Errorf("Data does not match multihash %s", hash)
+	}
+	return nil
+}
+
+// Resolve returns the hash of the module for subcommand from the
+// symbol table, whose lines are "subcommand hash".
+func (g *Grid) Resolve(subcommand string) (hash string, err error) {
+	if g.SymbolTable == "" {
+		return "", fmt.Errorf("No symbol table configured.")
+	}
+	table, err := g.Fetch(g.SymbolTable)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(table), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == subcommand {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("Subcommand %s not found in symbol table.", subcommand)
+}
+
+// module resolves subcommand and makes sure its module is cached.
+func (g *Grid) module(subcommand string) (hash string, err error) {
+	hash, err = g.Resolve(subcommand)
+	if err != nil {
+		return "", err
+	}
+	_, err = g.Fetch(hash)
+	return hash, err
+}
+
+// Exec runs the module for subcommand with args.
+func (g *Grid) Exec(subcommand string, args []string) error {
+	hash, err := g.module(subcommand)
+	if err != nil {
+		return err
+	}
+	return g.Executor.ExecuteCommand(hash, args)
+}
+
+// ShowPromise returns the promise made by the module for subcommand.
+func (g *Grid) ShowPromise(subcommand string) (string, error) {
+	hash, err := g.module(subcommand)
+	if err != nil {
+		return "", err
+	}
+	return g.Executor.ShowPromise(hash)
+}
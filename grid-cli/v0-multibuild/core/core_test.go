@@ -0,0 +1,124 @@
+//go:build !js
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// memCache is an in-memory CacheStorage.
+type memCache map[string][]byte
+
+func (c memCache) Save(hash string, data []byte) error {
+	c[hash] = data
+	return nil
+}
+
+func (c memCache) Load(hash string) ([]byte, error) {
+	data, ok := c[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func hashOf(t *testing.T, data []byte) string {
+	h, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("Sum returned an error: %v", err)
+	}
+	return hex.EncodeToString(h)
+}
+
+// servePeer serves cache on a loopback port and returns a node with
+// an empty cache connected to it.
+func servePeer(t *testing.T, cache CacheStorage) *Grid {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go NewGrid(cache, nil, nil).Serve(ln)
+
+	g := NewGrid(memCache{}, nil, NativeTransport{})
+	t.Cleanup(func() { g.Close() })
+	err = g.Connect(fmt.Sprintf("ws://%s/ws", ln.Addr()))
+	if err != nil {
+		t.Fatalf("Connect returned an error: %v", err)
+	}
+	return g
+}
+
+func TestFetch(t *testing.T) {
+	data := []byte("hello")
+	hash := hashOf(t, data)
+	g := servePeer(t, memCache{hash: data})
+
+	got, err := g.Fetch(hash)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("Fetch returned %q, %v", got, err)
+	}
+	if cached, _ := g.Cache.Load(hash); string(cached) != "hello" {
+		t.Errorf("fetched content was not cached")
+	}
+
+	_, err = g.Fetch(hashOf(t, []byte("missing")))
+	if err == nil || !strings.Contains(err.Error(), ErrNotFound.Error()) {
+		t.Errorf("expected the peer's refusal, got %v", err)
+	}
+}
+
+func TestFetchVerifies(t *testing.T) {
+	hash := hashOf(t, []byte("hello"))
+	g := servePeer(t, memCache{hash: []byte("forged")})
+	_, err := g.Fetch(hash)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected forged content to be refused, got %v", err)
+	}
+}
+
+func TestFetchInvalidHash(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewNativeCacheStorage(dir + "/cache")
+	if err != nil {
+		t.Fatalf("NewNativeCacheStorage returned an error: %v", err)
+	}
+	g := NewGrid(cache, nil, NativeTransport{})
+	for _, hash := range []string{"../secret", "zz", "1220"} {
+		_, err = g.Fetch(hash)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %q to be refused as a hash, got %v", hash, err)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewNativeCacheStorage(dir)
+	if err != nil {
+		t.Fatalf("NewNativeCacheStorage returned an error: %v", err)
+	}
+	module := []byte("#!/bin/sh\necho I promise to greet.\n")
+	moduleHash := hashOf(t, module)
+	table := []byte("greet " + moduleHash + "\n")
+	g := servePeer(t, memCache{moduleHash: module, hashOf(t, table): table})
+	g.Cache = cache
+	g.Executor = &NativeCommandExecutor{Cache: cache}
+	g.SymbolTable = hashOf(t, table)
+
+	promise, err := g.ShowPromise("greet")
+	if err != nil || promise != "I promise to greet.\n" {
+		t.Errorf("ShowPromise returned %q, %v", promise, err)
+	}
+	_, err = g.ShowPromise("wave")
+	if err == nil {
+		t.Errorf("expected an unknown subcommand to fail")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build js && wasm
+
+package core
+
+// BrowserCommandExecutor stands in for an executor in the browser,
+// which cannot run native modules.
+type BrowserCommandExecutor struct{}
+
+func (BrowserCommandExecutor) ExecuteCommand(hash string, args []string) error {
+	return ErrNotSupported
+}
+
+func (BrowserCommandExecutor) ShowPromise(hash string) (string, error) {
+	return "", ErrNotSupported
+}
@@ -0,0 +1,28 @@
+//go:build !js
+
+package core
+
+import (
+	"os"
+	"os/exec"
+)
+
+// NativeCommandExecutor runs modules as host executables, in place in
+// a NativeCacheStorage.
+type NativeCommandExecutor struct {
+	Cache *NativeCacheStorage
+}
+
+func (nce *NativeCommandExecutor) ExecuteCommand(hash string, args []string) error {
+	cmd := exec.Command(nce.Cache.Path(hash), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func (nce *NativeCommandExecutor) ShowPromise(hash string) (string, error) {
+	cmd := exec.Command(nce.Cache.Path(hash), "--show-promise")
+	output, err := cmd.Output()
+	return string(output), err
+}
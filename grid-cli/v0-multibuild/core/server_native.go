@@ -0,0 +1,63 @@
+//go:build !js
+
+package core
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	. "github.com/stevegt/goadapt"
+)
+
+// Serve answers peers' queries for cached content on ln, at /ws.
+// Queries are v0 queries, so any peer may fetch any cached content.
+// Browser peers are served from any origin, since the page that runs
+// them is usually served from elsewhere.
+func (g *Grid) Serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", g.handleWebSocket)
+	return http.Serve(ln, mux)
+}
+
+// refuse tells the peer why a query was not served.  Content is
+// always sent as a binary message, so a text message is a refusal.
+func refuse(conn *websocket.Conn, reason error) error {
+	reply, _ := json.Marshal(map[string]string{"error": reason.Error()})
+	return conn.WriteMessage(websocket.TextMessage, reply)
+}
+
+func (g *Grid) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Pf("Failed to upgrade to websocket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var query map[string]string
+		err = json.Unmarshal(message, &query)
+		if err == nil {
+			_, err = ParseHash(query["hash"])
+		}
+		if err != nil {
+			err = refuse(conn, err)
+		} else if data, lerr := g.Cache.Load(query["hash"]); lerr != nil {
+			err = refuse(conn, lerr)
+		} else {
+			err = conn.WriteMessage(websocket.BinaryMessage, data)
+		}
+		if err != nil {
+			Pf("Failed to write message: %v\n", err)
+			return
+		}
+	}
+}
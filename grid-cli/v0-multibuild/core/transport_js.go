@@ -0,0 +1,144 @@
+//go:build js && wasm
+
+package core
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall/js"
+)
+
+// BrowserTransport dials peers with the browser's WebSocket API.
+type BrowserTransport struct{}
+
+// browserMessage is one message received on a browserConn.
+type browserMessage struct {
+	mt   int
+	data []byte
+}
+
+// browserConn adapts a browser WebSocket, whose events arrive as
+// callbacks on the browser's event loop, to the blocking Conn
+// interface.  The callbacks never block: they queue what they
+// receive and wake up any waiting reader.
+type browserConn struct {
+	ws    js.Value
+	funcs []js.Func
+
+	mu     sync.Mutex
+	queue  []browserMessage
+	closed bool
+	wake   chan struct{} // signalled when queue or closed changes
+}
+
+func (BrowserTransport) Dial(url string) (Conn, error) {
+	ws := js.Global().Get("WebSocket").New(url)
+	ws.Set("binaryType", "arraybuffer")
+	c := &browserConn{ws: ws, wake: make(chan struct{}, 1)}
+	opened := make(chan error, 1)
+	c.on("open", func(js.Value) {
+		opened <- nil
+	})
+	c.on("message", func(event js.Value) {
+		m := browserMessage{mt: BinaryMessage}
+		data := event.Get("data")
+		if data.Type() == js.TypeString {
+			m.mt, m.data = TextMessage, []byte(data.String())
+		} else {
+			buf := js.Global().Get("Uint8Array").New(data)
+			m.data = make([]byte, buf.Get("length").Int())
+			js.CopyBytesToGo(m.data, buf)
+		}
+		c.mu.Lock()
+		c.queue = append(c.queue, m)
+		c.mu.Unlock()
+		c.signal()
+	})
+	c.on("close", func(js.Value) {
+		select {
+		case opened <- errors.New("connection closed"):
+		default:
+		}
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		c.signal()
+	})
+	err := <-opened
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// on adds a handler for a WebSocket event.
+func (c *browserConn) on(event string, handler func(event js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handler(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Call("addEventListener", event, f)
+}
+
+func (c *browserConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *browserConn) release() {
+	for _, f := range c.funcs {
+		f.Release()
+	}
+	c.funcs = nil
+}
+
+// ReadMessage returns the next message, waiting for one if needed.
+// Messages received before the connection closed are still returned.
+func (c *browserConn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			m := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return m.mt, m.data, nil
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return 0, nil, io.EOF
+		}
+		<-c.wake
+	}
+}
+
+func (c *browserConn) WriteMessage(mt int, data []byte) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+	if mt == TextMessage {
+		c.ws.Call("send", string(data))
+		return nil
+	}
+	buf := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buf, data)
+	c.ws.Call("send", buf)
+	return nil
+}
+
+func (c *browserConn) Close() error {
+	c.ws.Call("close")
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.signal()
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !js
+
+package core
+
+import "github.com/gorilla/websocket"
+
+// NativeTransport dials peers with gorilla/websocket.
+type NativeTransport struct{}
+
+func (NativeTransport) Dial(url string) (Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -2,4 +2,19 @@ module grid
 
 go 1.22.1
 
-require github.com/stevegt/goadapt v0.7.0
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/multiformats/go-multihash v0.2.3
+	github.com/stevegt/goadapt v0.7.0
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/minio/sha256-simd v1.0.0 // indirect
+	github.com/mr-tron/base58 v1.2.0 // indirect
+	github.com/multiformats/go-varint v0.0.6 // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
+	golang.org/x/sys v0.1.0 // indirect
+	lukechampine.com/blake3 v1.1.6 // indirect
+)
@@ -1,36 +1,94 @@
+//go:build !js
+
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"grid/core"
 
 	. "github.com/stevegt/goadapt"
 )
 
+const (
+	gridDir    = ".grid"
+	configFile = ".grid/config"
+	cacheDir   = ".grid/cache"
+	peerList   = ".grid/peers"
+)
+
+func usage() {
+	fmt.Println("Usage: grid {subcommand} [args...]")
+	fmt.Println("       grid --show {subcommand}")
+	fmt.Println("       grid start-server")
+	os.Exit(1)
+}
+
 func main() {
 	args := os.Args
 	if len(args) < 2 {
-		fmt.Println("Usage: grid {subcommand} [args...]")
-		fmt.Println("       grid --show {subcommand}")
-		os.Exit(1)
+		usage()
 	}
 
-	ensureDirectories()
-	loadPeers()
-	connectToPeers()
+	home := os.Getenv("HOME")
+	cache, err := core.NewNativeCacheStorage(filepath.Join(home, cacheDir))
+	Ck(err)
+	g := core.NewGrid(cache, &core.NativeCommandExecutor{Cache: cache}, core.NativeTransport{})
+	defer g.Close()
 
 	switch args[1] {
 	case "--show":
 		if len(args) < 3 {
-			fmt.Println("Usage: grid --show {subcommand}")
-			os.Exit(1)
+			usage()
 		}
-		subcommand := args[2]
-		showPromise(subcommand)
+		connectToPeers(g, home)
+		promise, err := g.ShowPromise(args[2])
+		Ck(err)
+		fmt.Print(promise)
 	case "start-server":
-		startWebSocketServer()
+		ln, err := net.Listen("tcp", ":8080")
+		Ck(err)
+		Pl("WebSocket server started on :8080")
+		Ck(g.Serve(ln))
 	default:
-		subcommand := args[1]
-		executeSubcommand(subcommand, args[2:])
+		connectToPeers(g, home)
+		Ck(g.Exec(args[1], args[2:]))
+	}
+}
+
+// connectToPeers configures g from the files under home/.grid: the
+// symbol table hash from the config file, and the peers, one
+// websocket URL per line, from the peers file.
+func connectToPeers(g *core.Grid, home string) {
+	config, err := os.ReadFile(filepath.Join(home, configFile))
+	Ck(err)
+	for _, line := range strings.Split(string(config), "\n") {
+		if val, ok := strings.CutPrefix(line, "symbol_table_hash="); ok {
+			g.SymbolTable = strings.TrimSpace(val)
+		}
+	}
+
+	file, err := os.Open(filepath.Join(home, peerList))
+	if os.IsNotExist(err) {
+		return
+	}
+	Ck(err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url == "" {
+			continue
+		}
+		err := g.Connect(url)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
 	}
+	Ck(scanner.Err())
 }
@@ -0,0 +1,80 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"grid/core"
+)
+
+// main runs grid as a browser peer.  It keeps its cache in IndexedDB
+// and fetches what the cache lacks from the websocket server named by
+// the page's "peer" query parameter, by default port 8080 on the
+// page's host.  The page calls gridFetch(hash), which returns a
+// Promise of a Uint8Array.
+func main() {
+	cache, err := core.OpenIndexedDB("grid")
+	if err != nil {
+		fmt.Println("Failed to open IndexedDB:", err)
+		return
+	}
+	g := core.NewGrid(cache, core.BrowserCommandExecutor{}, core.BrowserTransport{})
+
+	location := js.Global().Get("location")
+	peer := js.Global().Get("URLSearchParams").New(location.Get("search")).Call("get", "peer")
+	url := "ws://" + location.Get("hostname").String() + ":8080/ws"
+	if !peer.IsNull() {
+		url = peer.String()
+	}
+	err = g.Connect(url)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	js.Global().Set("gridFetch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 {
+			return reject(fmt.Errorf("usage: gridFetch(hash)"))
+		}
+		hash := args[0].String()
+		return promise(func() (js.Value, error) {
+			data, err := g.Fetch(hash)
+			if err != nil {
+				return js.Undefined(), err
+			}
+			buf := js.Global().Get("Uint8Array").New(len(data))
+			js.CopyBytesToJS(buf, data)
+			return buf, nil
+		})
+	}))
+
+	// keep the exported functions alive
+	select {}
+}
+
+// promise returns a JavaScript Promise settled by running fn in its
+// own goroutine, since fn may block and callbacks from JavaScript
+// must not.
+func promise(fn func() (js.Value, error)) js.Value {
+	var executor js.Func
+	executor = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, rejectFn := args[0], args[1]
+		go func() {
+			defer executor.Release()
+			val, err := fn()
+			if err != nil {
+				rejectFn.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(val)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+// reject returns a Promise that has already failed with err.
+func reject(err error) js.Value {
+	return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+}
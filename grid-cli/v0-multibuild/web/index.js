@@ -0,0 +1,22 @@
+// Start the grid browser peer, then fetch content by hash from the
+// form.  Add ?peer=ws://host:port/ws to the page URL to choose the
+// websocket server to fetch from.
+async function init() {
+	const go = new Go();
+	let result = await WebAssembly.instantiateStreaming(fetch("grid.wasm"), go.importObject);
+	go.run(result.instance);
+
+	const output = document.getElementById("output");
+	document.getElementById("fetch").addEventListener("submit", async (event) => {
+		event.preventDefault();
+		const hash = document.getElementById("hash").value.trim();
+		try {
+			const data = await gridFetch(hash);
+			output.textContent = new TextDecoder().decode(data);
+		} catch (err) {
+			output.textContent = err.message;
+		}
+	});
+}
+
+init();
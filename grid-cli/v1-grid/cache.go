@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// accessFlushInterval is how long cache accesses may wait in memory
+// before they are written to the cache index.
+const accessFlushInterval = time.Minute
+
+// defaultCacheMaxBytes bounds the cache when neither the gc command
+// line nor the cache_max_bytes configuration key says otherwise.
+const defaultCacheMaxBytes = 1 << 30
+
+// CacheEntry is the metadata kept for each object in the cache.
+type CacheEntry struct {
+	Size     int64 `json:"size"`
+	Accessed int64 `json:"accessed"` // unix nanoseconds
+	Pinned   bool  `json:"pinned,omitempty"`
+}
+
+// CacheIndex maps the hex multihash of each cached object to its
+// metadata.
+type CacheIndex map[string]*CacheEntry
+
+// loadCacheIndex reads the cache index and reconciles it with the
+// contents of the cache directory: files that are missing from the
+// index are added using their size and modification time, index
+// entries whose file is gone are dropped, and accesses not yet
+// written are applied.  The caller must hold g.cacheMu.
+func (g *Grid) loadCacheIndex() (index CacheIndex, err error) {
+	index = make(CacheIndex)
+	buf, err := g.k.ReadFile(g.path(cacheIndex))
+	if err == nil {
+		err = json.Unmarshal(buf, &index)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse cache index: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	dir, err := g.k.Open(g.path(cacheDir))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		fn := info.Name()
+		present[fn] = true
+		entry, ok := index[fn]
+		if !ok {
+			entry = &CacheEntry{Accessed: info.ModTime().UnixNano()}
+			index[fn] = entry
+		}
+		entry.Size = info.Size()
+	}
+	for fn := range index {
+		if !present[fn] {
+			delete(index, fn)
+		}
+	}
+	for fn, at := range g.accessed {
+		if entry, ok := index[fn]; ok && at > entry.Accessed {
+			entry.Accessed = at
+		}
+	}
+	return index, nil
+}
+
+// saveCacheIndex writes the cache index, which holds every access
+// recorded so far.  The caller must hold g.cacheMu.
+func (g *Grid) saveCacheIndex(index CacheIndex) error {
+	buf, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = g.k.WriteFile(g.path(cacheIndex), buf, 0644)
+	if err != nil {
+		return err
+	}
+	g.accessed = make(map[string]int64)
+	g.flushed = g.now()
+	return nil
+}
+
+// updateCacheEntry applies fn to the index entry for fn, creating the
+// entry if needed, and saves the index.
+func (g *Grid) updateCacheEntry(fn string, update func(entry *CacheEntry)) error {
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	index, err := g.loadCacheIndex()
+	if err != nil {
+		return err
+	}
+	entry, ok := index[fn]
+	if !ok {
+		entry = &CacheEntry{}
+		index[fn] = entry
+	}
+	update(entry)
+	return g.saveCacheIndex(index)
+}
+
+// touch records an access to the cached object fn.  Accesses are
+// kept in memory and written to the index with the next change to it,
+// or once accessFlushInterval has passed since it was last written,
+// so that reads do not each rewrite the index.
+func (g *Grid) touch(fn string) error {
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	now := g.now()
+	g.accessed[fn] = now.UnixNano()
+	if now.Sub(g.flushed) < accessFlushInterval {
+		return nil
+	}
+	index, err := g.loadCacheIndex()
+	if err != nil {
+		return err
+	}
+	return g.saveCacheIndex(index)
+}
+
+// storeData writes data to the cache under its hex multihash fn and
+// records it in the index.
+func (g *Grid) storeData(fn string, data []byte, perm os.FileMode) error {
+	err := g.k.WriteFile(g.path(cacheDir, fn), data, perm)
+	if err != nil {
+		return err
+	}
+	return g.updateCacheEntry(fn, func(entry *CacheEntry) {
+		entry.Size = int64(len(data))
+		entry.Accessed = g.now().UnixNano()
+	})
+}
+
+// parseHash decodes a hex multihash given on the command line, in
+// either case.
+func parseHash(mStr string) (mBuf []byte, err error) {
+	mBuf, err = hex.DecodeString(mStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid multihash %s: %v", mStr, err)
+	}
+	_, err = multihash.Decode(mBuf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid multihash %s: %v", mStr, err)
+	}
+	return
+}
+
+// verifyHash checks that data hashes to mBuf.
+func verifyHash(mBuf, data []byte) error {
+	decoded, err := multihash.Decode(mBuf)
+	if err != nil {
+		return err
+	}
+	sum, err := multihash.Sum(data, decoded.Code, decoded.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, mBuf) {
+		return fmt.Errorf("Data does not match multihash %x", mBuf)
+	}
+	return nil
+}
+
+// Put stores the content of the file at path in the cache and
+// returns its hex multihash.
+func (g *Grid) Put(path string) (mStr string, err error) {
+	data, err := g.k.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	mBuf, err := GenerateHash(multihash.SHA2_256, data)
+	if err != nil {
+		return "", err
+	}
+	mStr = hex.EncodeToString(mBuf)
+	err = g.storeData(mStr, data, 0644)
+	return
+}
+
+// Get returns the content for a hex multihash, looking in the local
+// cache first and then asking peers.  Content fetched from peers is
+// verified against the hash and cached.
+func (g *Grid) Get(mStr string) (data []byte, err error) {
+	mBuf, err := parseHash(mStr)
+	if err != nil {
+		return nil, err
+	}
+	// the cache names objects in lower case
+	mStr = hex.EncodeToString(mBuf)
+	data, err = g.fetchLocalData(mBuf)
+	if err == nil {
+		g.log.Debug(EventCacheHit, "hash", mStr)
+		return data, nil
+	}
+	g.log.Debug(EventCacheMiss, "hash", mStr)
+	reply, err := g.queryPeers(mStr)
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(reply)
+	err = g.storeData(mStr, data, 0644)
+	return
+}
+
+// Pin protects a cached object from garbage collection.
+func (g *Grid) Pin(mStr string) error {
+	return g.setPinned(mStr, true)
+}
+
+// Unpin makes a cached object eligible for garbage collection again.
+func (g *Grid) Unpin(mStr string) error {
+	return g.setPinned(mStr, false)
+}
+
+func (g *Grid) setPinned(mStr string, pinned bool) error {
+	mBuf, err := parseHash(mStr)
+	if err != nil {
+		return err
+	}
+	mStr = hex.EncodeToString(mBuf)
+	if _, err := g.k.Stat(g.path(cacheDir, mStr)); err != nil {
+		return fmt.Errorf("Not in cache: %s", mStr)
+	}
+	return g.updateCacheEntry(mStr, func(entry *CacheEntry) {
+		entry.Pinned = pinned
+	})
+}
+
+// cacheMaxBytes returns the cache size limit from the configuration.
+func (g *Grid) cacheMaxBytes() (max int64, err error) {
+	val, err := g.getConfig("cache_max_bytes")
+	if err != nil {
+		return defaultCacheMaxBytes, nil
+	}
+	max, err = strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid cache_max_bytes %q: %v", val, err)
+	}
+	return
+}
+
+// GC evicts unpinned objects, least recently accessed first, until
+// the total size of the cache is at most maxBytes.  It returns the
+// hashes of the evicted objects and the number of bytes freed.
+func (g *Grid) GC(maxBytes int64) (evicted []string, freed int64, err error) {
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	index, err := g.loadCacheIndex()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	var candidates []string
+	for fn, entry := range index {
+		total += entry.Size
+		if !entry.Pinned {
+			candidates = append(candidates, fn)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := index[candidates[i]], index[candidates[j]]
+		if a.Accessed != b.Accessed {
+			return a.Accessed < b.Accessed
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	for _, fn := range candidates {
+		if total <= maxBytes {
+			break
+		}
+		err = g.k.Remove(g.path(cacheDir, fn))
+		if err != nil {
+			return
+		}
+		size := index[fn].Size
+		total -= size
+		freed += size
+		evicted = append(evicted, fn)
+		delete(index, fn)
+	}
+	err = g.saveCacheIndex(index)
+	return
+}
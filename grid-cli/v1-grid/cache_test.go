@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+// setupCacheEnv returns a grid with a fake clock that advances one
+// second on every call.
+func setupCacheEnv(t *testing.T) (g *Grid, k *KernelMem) {
+	k = NewKernelMem(nil)
+	g, err := NewGrid(k, "/home/user")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	clock := time.Unix(1700000000, 0)
+	g.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	return
+}
+
+// putString stores s in g's cache via a temporary file.
+func putString(t *testing.T, g *Grid, k *KernelMem, s string) string {
+	err := k.WriteFile("/tmp/in", []byte(s), 0644)
+	Tassert(t, err == nil, "Failed to write input: %v", err)
+	mStr, err := g.Put("/tmp/in")
+	Tassert(t, err == nil, "Put returned an error: %v", err)
+	return mStr
+}
+
+func TestPutGet(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	mStr := putString(t, g, k, "some content")
+
+	expected, err := GenerateHash(multihash.SHA2_256, []byte("some content"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	Tassert(t, mStr == hex.EncodeToString(expected), "unexpected hash %s", mStr)
+
+	data, err := g.Get(mStr)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	Tassert(t, string(data) == "some content", "unexpected data %q", data)
+
+	g.cacheMu.Lock()
+	index, err := g.loadCacheIndex()
+	g.cacheMu.Unlock()
+	Tassert(t, err == nil, "loadCacheIndex returned an error: %v", err)
+	Tassert(t, index[mStr].Size == int64(len("some content")), "unexpected size %d", index[mStr].Size)
+}
+
+func TestGetFromPeer(t *testing.T) {
+	client, ck, sk := setupPeerPair(t)
+	server, err := NewGrid(sk, "/srv")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	err = sk.WriteFile("/tmp/in", []byte("remote content"), 0644)
+	Tassert(t, err == nil, "Failed to write input: %v", err)
+	mStr, err := server.Put("/tmp/in")
+	Tassert(t, err == nil, "Put returned an error: %v", err)
+
+	data, err := client.Get(mStr)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	Tassert(t, string(data) == "remote content", "unexpected data %q", data)
+
+	// now cached locally
+	_, err = ck.Stat(client.path(cacheDir, mStr))
+	Tassert(t, err == nil, "expected %s to be cached: %v", mStr, err)
+}
+
+func TestGetRejectsBadData(t *testing.T) {
+	client, _, sk := setupPeerPair(t)
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte("the real thing"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	mStr := hex.EncodeToString(mBuf)
+	err = sk.WriteFile("/srv/"+cacheDir+"/"+mStr, []byte("an impostor"), 0644)
+	Tassert(t, err == nil, "Failed to write data: %v", err)
+
+	_, err = client.Get(mStr)
+	Tassert(t, err != nil, "expected Get to reject data that does not match its hash")
+}
+
+func TestExecRejectsBadModule(t *testing.T) {
+	client, ck, sk := setupPeerPair(t)
+	mBuf, err := GenerateHash(multihash.SHA2_256, helloModule.code)
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	mStr := hex.EncodeToString(mBuf)
+	err = sk.WriteFile("/srv/"+cacheDir+"/"+mStr, []byte("an impostor"), 0755)
+	Tassert(t, err == nil, "Failed to write data: %v", err)
+
+	err = client.Exec("hello", nil)
+	Tassert(t, err != nil, "expected Exec to reject a module that does not match its hash")
+	_, err = ck.Stat(client.path(cacheDir, mStr))
+	Tassert(t, err != nil, "expected the impostor not to be cached")
+	Tassert(t, len(ck.callsTo("Exec", client.path(cacheDir)+"/")) == 0, "a module was executed: %v", ck.Calls)
+}
+
+func TestPinUnpin(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	mStr := putString(t, g, k, "pinned")
+	err := g.Pin(mStr)
+	Tassert(t, err == nil, "Pin returned an error: %v", err)
+
+	evicted, _, err := g.GC(0)
+	Tassert(t, err == nil, "GC returned an error: %v", err)
+	Tassert(t, len(evicted) == 0, "pinned entry was evicted: %v", evicted)
+
+	err = g.Unpin(mStr)
+	Tassert(t, err == nil, "Unpin returned an error: %v", err)
+	evicted, _, err = g.GC(0)
+	Tassert(t, err == nil, "GC returned an error: %v", err)
+	Tassert(t, len(evicted) == 1 && evicted[0] == mStr, "unexpected evictions: %v", evicted)
+
+	err = g.Pin(mStr)
+	Tassert(t, err != nil, "expected Pin of an evicted entry to fail")
+}
+
+func TestGCEvictsLeastRecentlyUsed(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	a := putString(t, g, k, strings.Repeat("a", 100))
+	b := putString(t, g, k, strings.Repeat("b", 100))
+	c := putString(t, g, k, strings.Repeat("c", 100))
+	d := putString(t, g, k, strings.Repeat("d", 100))
+
+	// a is now the most recently used; b is the oldest
+	_, err := g.Get(a)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	err = g.Pin(b)
+	Tassert(t, err == nil, "Pin returned an error: %v", err)
+
+	evicted, freed, err := g.GC(250)
+	Tassert(t, err == nil, "GC returned an error: %v", err)
+	Tassert(t, freed == 200, "unexpected bytes freed: %d", freed)
+	Tassert(t, strings.Join(evicted, " ") == c+" "+d, "unexpected evictions: %v", evicted)
+
+	for _, mStr := range []string{a, b} {
+		data, err := g.Get(mStr)
+		Tassert(t, err == nil, "Get %s returned an error: %v", mStr, err)
+		Tassert(t, len(data) == 100, "unexpected data length %d", len(data))
+	}
+}
+
+func TestCacheIndexReconcile(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte("untracked"))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	mStr := hex.EncodeToString(mBuf)
+
+	// written behind the index's back
+	err = k.WriteFile(g.path(cacheDir, mStr), []byte("untracked"), 0644)
+	Tassert(t, err == nil, "Failed to write data: %v", err)
+
+	evicted, freed, err := g.GC(0)
+	Tassert(t, err == nil, "GC returned an error: %v", err)
+	Tassert(t, len(evicted) == 1 && freed == int64(len("untracked")), "unexpected evictions: %v %d", evicted, freed)
+
+	buf, err := k.ReadFile(g.path(cacheIndex))
+	Tassert(t, err == nil, "Failed to read index: %v", err)
+	Tassert(t, !bytes.Contains(buf, []byte(mStr)), "evicted entry still in index: %s", buf)
+}
+
+// savedIndex returns the cache index as written to disk.
+func savedIndex(t *testing.T, g *Grid, k *KernelMem) (index CacheIndex) {
+	buf, err := k.ReadFile(g.path(cacheIndex))
+	Tassert(t, err == nil, "Failed to read cache index: %v", err)
+	err = json.Unmarshal(buf, &index)
+	Tassert(t, err == nil, "Failed to parse cache index: %v", err)
+	return
+}
+
+func TestCacheAccessBatched(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	mStr := putString(t, g, k, "read often")
+	written := savedIndex(t, g, k)[mStr].Accessed
+
+	// reads within accessFlushInterval are not written at once...
+	for i := 0; i < 3; i++ {
+		_, err := g.Get(mStr)
+		Tassert(t, err == nil, "Get returned an error: %v", err)
+	}
+	Tassert(t, savedIndex(t, g, k)[mStr].Accessed == written, "expected reads not to rewrite the index")
+
+	// ...but count for GC, and are written with the next change
+	g.cacheMu.Lock()
+	index, err := g.loadCacheIndex()
+	g.cacheMu.Unlock()
+	Tassert(t, err == nil, "loadCacheIndex returned an error: %v", err)
+	Tassert(t, index[mStr].Accessed > written, "expected pending reads to count")
+	Tassert(t, g.Pin(mStr) == nil, "Pin failed")
+	Tassert(t, savedIndex(t, g, k)[mStr].Accessed == index[mStr].Accessed, "expected pending reads to be written")
+
+	// a read after accessFlushInterval is written
+	g.flushed = g.flushed.Add(-accessFlushInterval)
+	_, err = g.Get(mStr)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	Tassert(t, savedIndex(t, g, k)[mStr].Accessed > index[mStr].Accessed, "expected a late read to be written")
+}
+
+func TestCacheHashCase(t *testing.T) {
+	g, k := setupCacheEnv(t)
+	mStr := putString(t, g, k, "mixed case")
+	upper := strings.ToUpper(mStr)
+
+	data, err := g.Get(upper)
+	Tassert(t, err == nil && string(data) == "mixed case", "Get(%s) returned %q, %v", upper, data, err)
+	Tassert(t, g.Pin(upper) == nil, "Pin failed")
+	index := savedIndex(t, g, k)
+	Tassert(t, len(index) == 1 && index[mStr].Pinned, "expected one pinned entry, got %v", index)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Capability is a signed promise by Issuer that Subject may fetch
+// any object whose hex multihash starts with Scope until Expires.  An
+// empty Scope covers everything.  A capability may be delegated: the
+// subject of a capability can issue a child capability, embedding
+// the parent, with a scope and expiry no wider than the parent's.
+//
+// This is the capability-as-promise model from
+// grid-cli/v2-syscall-tree/DESIGN.md: a token is a promise that can
+// either be fulfilled or revoked.
+type Capability struct {
+	Issuer    string      `json:"issuer"`  // hex ed25519 public key
+	Subject   string      `json:"subject"` // hex ed25519 public key
+	Scope     string      `json:"scope"`   // hex multihash prefix
+	Promise   string      `json:"promise"` // what the subject promises in return
+	Expires   int64       `json:"expires"` // unix seconds
+	Parent    *Capability `json:"parent,omitempty"`
+	Signature string      `json:"signature"`
+}
+
+// signingBytes returns the canonical bytes covered by the issuer's
+// signature: the JSON encoding of the capability with an empty
+// signature.
+func (c *Capability) signingBytes() []byte {
+	unsigned := *c
+	unsigned.Signature = ""
+	buf, err := json.Marshal(&unsigned)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// ID returns the hex sha256 of the signed capability.  It is the
+// handle used to revoke a capability.
+func (c *Capability) ID() string {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// Covers returns true if the capability's scope includes mStr.
+func (c *Capability) Covers(mStr string) bool {
+	return strings.HasPrefix(mStr, c.Scope)
+}
+
+// IssueCapability creates a capability signed by key.  If parent is
+// not nil, the new capability is a delegation of parent, and key must
+// belong to the parent's subject.
+func IssueCapability(key ed25519.PrivateKey, subject, scope, promise string, expires time.Time, parent *Capability) (c *Capability, err error) {
+	issuer := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	c = &Capability{
+		Issuer:  issuer,
+		Subject: subject,
+		Scope:   scope,
+		Promise: promise,
+		Expires: expires.Unix(),
+		Parent:  parent,
+	}
+	if parent != nil {
+		if parent.Subject != issuer {
+			return nil, fmt.Errorf("Cannot delegate a capability issued to %s", parent.Subject)
+		}
+		if !strings.HasPrefix(scope, parent.Scope) {
+			return nil, fmt.Errorf("Scope %q is wider than parent scope %q", scope, parent.Scope)
+		}
+		if c.Expires > parent.Expires {
+			c.Expires = parent.Expires
+		}
+	}
+	c.Signature = hex.EncodeToString(ed25519.Sign(key, c.signingBytes()))
+	return c, nil
+}
+
+// CapabilityPolicy decides which capabilities a server honors.
+type CapabilityPolicy struct {
+	Now     time.Time
+	Trusted func(issuer string) bool
+	Revoked func(id string) bool
+}
+
+// Verify checks every link of the capability's delegation chain and
+// returns an error if the capability does not grant access to mStr
+// under policy.
+func (c *Capability) Verify(mStr string, policy CapabilityPolicy) error {
+	if !c.Covers(mStr) {
+		return fmt.Errorf("Capability scope %q does not cover %s", c.Scope, mStr)
+	}
+	for link := c; link != nil; link = link.Parent {
+		pub, err := hex.DecodeString(link.Issuer)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("Invalid capability issuer %q", link.Issuer)
+		}
+		sig, err := hex.DecodeString(link.Signature)
+		if err != nil || !ed25519.Verify(pub, link.signingBytes(), sig) {
+			return fmt.Errorf("Invalid capability signature from %s", link.Issuer)
+		}
+		if policy.Now.Unix() > link.Expires {
+			return fmt.Errorf("Capability %s expired", link.ID())
+		}
+		if policy.Revoked != nil && policy.Revoked(link.ID()) {
+			return fmt.Errorf("Capability %s revoked", link.ID())
+		}
+		parent := link.Parent
+		if parent == nil {
+			if policy.Trusted == nil || !policy.Trusted(link.Issuer) {
+				return fmt.Errorf("Capability issuer %s not trusted", link.Issuer)
+			}
+			continue
+		}
+		if link.Issuer != parent.Subject {
+			return fmt.Errorf("Capability issuer %s is not the subject of its parent", link.Issuer)
+		}
+		if !strings.HasPrefix(link.Scope, parent.Scope) {
+			return fmt.Errorf("Capability scope %q is wider than parent scope %q", link.Scope, parent.Scope)
+		}
+		if link.Expires > parent.Expires {
+			return fmt.Errorf("Capability outlives its parent")
+		}
+	}
+	return nil
+}
+
+// requestWindow is how far the time of a signed request may be from
+// the server's clock.  A server remembers the nonces of the requests
+// it accepted within the window, and refuses a nonce it has seen.
+const requestWindow = time.Minute
+
+// newNonce returns a random hex nonce for a request.
+func newNonce() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestSigningBytes returns the bytes a client signs to prove that
+// it holds the subject key of the capability attached to a request.
+// The time and nonce keep the signature from being replayed.
+func requestSigningBytes(mStr string, at int64, nonce string) []byte {
+	return []byte(fmt.Sprintf("grid-get:%s:%d:%s", mStr, at, nonce))
+}
+
+// signRequest proves possession of key for a request for mStr made at
+// unix time at with nonce.
+func signRequest(key ed25519.PrivateKey, mStr string, at int64, nonce string) string {
+	return hex.EncodeToString(ed25519.Sign(key, requestSigningBytes(mStr, at, nonce)))
+}
+
+// verifyRequest checks that sigStr was made by the capability's
+// subject for a request for mStr made at unix time at with nonce.
+func verifyRequest(c *Capability, mStr string, at int64, nonce, sigStr string) error {
+	pub, err := hex.DecodeString(c.Subject)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid capability subject %q", c.Subject)
+	}
+	sig, err := hex.DecodeString(sigStr)
+	if err != nil || !ed25519.Verify(pub, requestSigningBytes(mStr, at, nonce), sig) {
+		return fmt.Errorf("Request not signed by capability subject")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
+)
+
+func newKey(t *testing.T) (key ed25519.PrivateKey, pub string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Tassert(t, err == nil, "GenerateKey returned an error: %v", err)
+	return key, hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func TestCapabilityVerify(t *testing.T) {
+	root, rootPub := newKey(t)
+	alice, alicePub := newKey(t)
+	_, bobPub := newKey(t)
+	now := time.Unix(1700000000, 0)
+	policy := CapabilityPolicy{
+		Now:     now,
+		Trusted: func(issuer string) bool { return issuer == rootPub },
+	}
+
+	c, err := IssueCapability(root, alicePub, "1220ab", "p", now.Add(time.Hour), nil)
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+
+	// delegation to bob with a narrower scope
+	d, err := IssueCapability(alice, bobPub, "1220abcd", "p", now.Add(2*time.Hour), c)
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+	Tassert(t, d.Expires == c.Expires, "delegation outlives its parent")
+
+	// delegation cannot widen the scope
+	_, err = IssueCapability(alice, bobPub, "12", "p", now.Add(time.Hour), c)
+	Tassert(t, err != nil, "expected an error when widening scope")
+
+	// bob cannot delegate alice's capability
+	bob, _ := newKey(t)
+	_, err = IssueCapability(bob, alicePub, "1220ab", "p", now.Add(time.Hour), c)
+	Tassert(t, err != nil, "expected an error when delegating someone else's capability")
+
+	tampered := *c
+	tampered.Scope = ""
+
+	forged := *d
+	forged.Parent = &Capability{}
+	*forged.Parent = *c
+	forged.Parent.Subject = bobPub
+
+	cases := []struct {
+		name   string
+		c      *Capability
+		mStr   string
+		policy CapabilityPolicy
+		ok     bool
+	}{
+		{"direct", c, "1220ab99", policy, true},
+		{"delegated", d, "1220abcd99", policy, true},
+		{"out of scope", c, "1220ff", policy, false},
+		{"delegated out of scope", d, "1220ab99", policy, false},
+		{"expired", c, "1220ab99", CapabilityPolicy{Now: now.Add(2 * time.Hour), Trusted: policy.Trusted}, false},
+		{"untrusted", c, "1220ab99", CapabilityPolicy{Now: now, Trusted: func(string) bool { return false }}, false},
+		{"tampered", &tampered, "1220ab99", policy, false},
+		{"forged chain", &forged, "1220abcd99", policy, false},
+		{"revoked", c, "1220ab99", CapabilityPolicy{Now: now, Trusted: policy.Trusted, Revoked: func(id string) bool { return id == c.ID() }}, false},
+		{"parent revoked", d, "1220abcd99", CapabilityPolicy{Now: now, Trusted: policy.Trusted, Revoked: func(id string) bool { return id == c.ID() }}, false},
+	}
+	for _, tc := range cases {
+		err := tc.c.Verify(tc.mStr, tc.policy)
+		Tassert(t, (err == nil) == tc.ok, "%s: Verify returned %v", tc.name, err)
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	_, rootPub := newKey(t)
+	alice, alicePub := newKey(t)
+	mallory, _ := newKey(t)
+	c := &Capability{Issuer: rootPub, Subject: alicePub}
+
+	err := verifyRequest(c, "1220ab", 100, "n", signRequest(alice, "1220ab", 100, "n"))
+	Tassert(t, err == nil, "verifyRequest returned an error: %v", err)
+	err = verifyRequest(c, "1220ab", 100, "n", signRequest(mallory, "1220ab", 100, "n"))
+	Tassert(t, err != nil, "expected a request signed by another key to be refused")
+	err = verifyRequest(c, "1220cd", 100, "n", signRequest(alice, "1220ab", 100, "n"))
+	Tassert(t, err != nil, "expected a signature for another hash to be refused")
+	err = verifyRequest(c, "1220ab", 101, "n", signRequest(alice, "1220ab", 100, "n"))
+	Tassert(t, err != nil, "expected a signature for another time to be refused")
+	err = verifyRequest(c, "1220ab", 100, "m", signRequest(alice, "1220ab", 100, "n"))
+	Tassert(t, err != nil, "expected a signature for another nonce to be refused")
+}
+
+func TestServerRefusesReplay(t *testing.T) {
+	client, _, sk := setupPeerPair(t)
+	server, mStr := putOnServer(t, sk, "once")
+	query := func() map[string]string {
+		buf, err := client.buildQuery(mStr, "span")
+		Tassert(t, err == nil, "buildQuery returned an error: %v", err)
+		var q map[string]string
+		err = json.Unmarshal(buf, &q)
+		Tassert(t, err == nil, "Failed to unmarshal query: %v", err)
+		return q
+	}
+
+	q := query()
+	err := server.authorize(mStr, q)
+	Tassert(t, err == nil, "authorize returned an error: %v", err)
+	err = server.authorize(mStr, q)
+	Tassert(t, err != nil, "expected a replayed request to be refused")
+
+	// a request signed long ago is stale
+	client.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	err = server.authorize(mStr, query())
+	Tassert(t, err != nil, "expected a stale request to be refused")
+}
+
+// putOnServer stores s on the server of a peer pair and returns its
+// hash.
+func putOnServer(t *testing.T, sk *KernelMem, s string) (server *Grid, mStr string) {
+	server, err := NewGrid(sk, "/srv")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	mBuf, err := GenerateHash(multihash.SHA2_256, []byte(s))
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	mStr = hex.EncodeToString(mBuf)
+	err = server.storeData(mStr, []byte(s), 0644)
+	Tassert(t, err == nil, "storeData returned an error: %v", err)
+	return
+}
+
+func TestServerRequiresCapability(t *testing.T) {
+	client, ck, sk := setupPeerPair(t)
+	server, mStr := putOnServer(t, sk, "guarded")
+
+	// without a capability in the wallet the server refuses
+	err := ck.Remove(client.path(walletTokens))
+	Tassert(t, err == nil, "Remove returned an error: %v", err)
+	_, err = client.Get(mStr)
+	Tassert(t, err != nil, "expected Get without a capability to fail")
+
+	// a capability scoped to other data is not enough
+	clientKey, err := client.PublicKey()
+	Tassert(t, err == nil, "PublicKey returned an error: %v", err)
+	other, err := server.IssueCapability(clientKey, "1220ffff", "p", time.Hour, "")
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+	err = client.AddCapability(other)
+	Tassert(t, err == nil, "AddCapability returned an error: %v", err)
+	_, err = client.Get(mStr)
+	Tassert(t, err != nil, "expected Get with an out-of-scope capability to fail")
+
+	// a capability for exactly this hash works
+	c, err := server.IssueCapability(clientKey, mStr, "p", time.Hour, "")
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+	err = client.AddCapability(c)
+	Tassert(t, err == nil, "AddCapability returned an error: %v", err)
+	data, err := client.Get(mStr)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	Tassert(t, string(data) == "guarded", "unexpected data %q", data)
+}
+
+func TestServerHonorsRevocation(t *testing.T) {
+	client, _, sk := setupPeerPair(t)
+	server, mStr := putOnServer(t, sk, "revocable")
+
+	wallet, err := client.walletCapabilities()
+	Tassert(t, err == nil, "walletCapabilities returned an error: %v", err)
+	Tassert(t, len(wallet) == 1, "unexpected wallet %v", wallet)
+	err = server.Revoke(wallet[0].ID())
+	Tassert(t, err == nil, "Revoke returned an error: %v", err)
+
+	_, err = client.Get(mStr)
+	Tassert(t, err != nil, "expected Get with a revoked capability to fail")
+}
+
+func TestDelegatedCapabilityOverWire(t *testing.T) {
+	client, _, sk := setupPeerPair(t)
+	_, mStr := putOnServer(t, sk, "shared")
+
+	// the client delegates its capability to a third node
+	net := client.k.(*KernelMem).net
+	tk := NewKernelMem(net)
+	third, err := NewGrid(tk, "/third")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	thirdKey, err := third.PublicKey()
+	Tassert(t, err == nil, "PublicKey returned an error: %v", err)
+	wallet, err := client.walletCapabilities()
+	Tassert(t, err == nil, "walletCapabilities returned an error: %v", err)
+	d, err := client.IssueCapability(thirdKey, mStr[:8], "p", time.Minute, wallet[0].ID())
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+	err = third.AddCapability(d)
+	Tassert(t, err == nil, "AddCapability returned an error: %v", err)
+
+	err = tk.WriteFile(third.path(peerList), []byte("ws://server/ws\n"), 0644)
+	Tassert(t, err == nil, "Failed to write peers: %v", err)
+	err = third.loadPeers()
+	Tassert(t, err == nil, "loadPeers returned an error: %v", err)
+	third.connectToPeers()
+
+	data, err := third.Get(mStr)
+	Tassert(t, err == nil, "Get returned an error: %v", err)
+	Tassert(t, string(data) == "shared", "unexpected data %q", data)
+}
@@ -3,73 +3,134 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
-func connectToPeers() {
+func (g *Grid) connectToPeers() {
 	var wg sync.WaitGroup
-	for _, peer := range Peers {
+	for _, peer := range g.Peers {
 		wg.Add(1)
 		go func(peer *Peer) {
 			defer wg.Done()
-			connectToPeer(peer)
+			g.connectToPeer(peer)
 		}(peer)
 	}
 	wg.Wait()
 }
 
-func connectToPeer(peer *Peer) {
-	conn, _, err := websocket.DefaultDialer.Dial(peer.Address, nil)
+func (g *Grid) connectToPeer(peer *Peer) {
+	conn, err := g.k.Dial(peer.Address)
 	if err != nil {
-		fmt.Printf("Failed to connect to peer %s: %v\n", peer.Address, err)
+		g.log.Warn(EventPeerConnect, "peer", peer.Address, "err", err)
 		return
 	}
-	mu.Lock()
+	g.log.Info(EventPeerConnect, "peer", peer.Address)
+	g.mu.Lock()
 	peer.Conn = conn
-	mu.Unlock()
+	g.mu.Unlock()
 }
 
-func queryPeers(hash, promise string) string {
-	query := map[string]string{"hash": hash, "promise": promise}
-	queryJSON, _ := json.Marshal(query)
+// buildQuery returns the request for mStr in the given span, with the
+// best matching capability from the wallet and proof that we hold its
+// subject key.
+func (g *Grid) buildQuery(mStr, span string) (queryJSON []byte, err error) {
+	query := map[string]string{"hash": mStr, "span": span}
+	c, err := g.findCapability(mStr)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		key, err := g.nodeKey()
+		if err != nil {
+			return nil, err
+		}
+		capJSON, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		query["capability"] = string(capJSON)
+		query["promise"] = c.Promise
+		at, nonce := g.now().Unix(), newNonce()
+		query["time"] = strconv.FormatInt(at, 10)
+		query["nonce"] = nonce
+		query["sig"] = signRequest(key, mStr, at, nonce)
+	}
+	return json.Marshal(query)
+}
+
+// queryPeers asks each peer in turn for the content with the given
+// hex multihash, and returns the first reply that matches the hash.
+func (g *Grid) queryPeers(hash string) (string, error) {
+	mBuf, err := parseHash(hash)
+	if err != nil {
+		return "", err
+	}
+	span := newSpanID()
+	queryJSON, err := g.buildQuery(hash, span)
+	if err != nil {
+		return "", err
+	}
 
-	for _, peer := range Peers {
+	for _, peer := range g.Peers {
 		if peer.Conn == nil {
 			continue
 		}
+		g.log.Debug(EventPeerQuery, "span", span, "peer", peer.Address, "hash", hash)
 		err := peer.Conn.WriteMessage(websocket.TextMessage, queryJSON)
 		if err != nil {
-			fmt.Printf("Failed to write to peer %s: %v\n", peer.Address, err)
+			g.log.Warn(EventError, "span", span, "op", "write", "peer", peer.Address, "err", err)
 			continue
 		}
 
-		_, message, err := peer.Conn.ReadMessage()
+		messageType, message, err := peer.Conn.ReadMessage()
+		if err != nil {
+			g.log.Warn(EventError, "span", span, "op", "read", "peer", peer.Address, "err", err)
+			continue
+		}
+		if messageType != websocket.BinaryMessage {
+			// refusals come back as text
+			var reply map[string]string
+			json.Unmarshal(message, &reply)
+			g.log.Warn(EventReject, "span", span, "peer", peer.Address, "hash", hash, "reason", reply["error"])
+			continue
+		}
+		err = verifyHash(mBuf, message)
 		if err != nil {
-			fmt.Printf("Failed to read from peer %s: %v\n", peer.Address, err)
+			g.log.Warn(EventError, "span", span, "op", "verify", "peer", peer.Address, "err", err)
 			continue
 		}
-		return string(message)
+		return string(message), nil
 	}
 
-	fmt.Println("Failed to fetch data from peers.")
-	os.Exit(1)
-	return ""
+	return "", fmt.Errorf("Failed to fetch data from peers.")
 }
 
-func fetchSymbolTable(hash string) string {
-	return queryPeers(hash, "I promise to use the symbol table responsibly.")
+func (g *Grid) fetchSymbolTable(hash string) (string, error) {
+	return g.queryPeers(hash)
 }
 
-func (sys *KernelNative) fetchModule(hash string) string {
-	cachePath := filepath.Join(sys.baseDir, cacheDir, hash)
-	if _, err := sys.fs.Stat(cachePath); os.IsNotExist(err) {
-		data := queryPeers(hash, "I promise to use this module responsibly.")
-		ioutil.WriteFile(cachePath, []byte(data), 0755)
+func (g *Grid) fetchModule(hash string) (string, error) {
+	cachePath := g.path(cacheDir, hash)
+	if _, err := g.k.Stat(cachePath); os.IsNotExist(err) {
+		g.log.Debug(EventCacheMiss, "hash", hash)
+		data, err := g.queryPeers(hash)
+		if err != nil {
+			return "", err
+		}
+		err = g.storeData(hash, []byte(data), 0755)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		g.log.Debug(EventCacheHit, "hash", hash)
+		err = g.touch(hash)
+		if err != nil {
+			return "", err
+		}
 	}
-	return cachePath
+	return cachePath, nil
 }
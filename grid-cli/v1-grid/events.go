@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+const (
+	logDir       = ".grid/log"
+	eventLogFile = ".grid/log/events.jsonl"
+)
+
+// Names of the events the grid logs.
+const (
+	EventPeerConnect   = "peer.connect"
+	EventPeerQuery     = "peer.query"
+	EventRequest       = "request"
+	EventCacheHit      = "cache.hit"
+	EventCacheMiss     = "cache.miss"
+	EventRoute         = "route"
+	EventAccept        = "promise.accept"
+	EventReject        = "promise.reject"
+	EventBrokenPromise = "promise.broken"
+	EventServerStart   = "server.start"
+	EventError         = "error"
+)
+
+// newSpanID returns a random ID for the span of one request, which
+// peers log alongside their own events so that the request can be
+// traced across them.
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// openLog sets up the grid's event log.  Warnings and errors go to
+// the kernel's stderr as text, keeping them apart from subcommand
+// output.  If the event_log configuration key is set to a level such
+// as "debug" or "info", events at that level and above are also
+// appended as JSON lines to .grid/log/events.jsonl.
+func (g *Grid) openLog() error {
+	var h slog.Handler = slog.NewTextHandler(g.k.Stderr(), &slog.HandlerOptions{Level: slog.LevelWarn})
+	val, err := g.getConfig("event_log")
+	if err == nil {
+		var level slog.Level
+		err = level.UnmarshalText([]byte(val))
+		if err != nil {
+			return fmt.Errorf("Invalid event_log: %v", err)
+		}
+		err = g.k.MkdirAll(g.path(logDir), 0755)
+		if err != nil {
+			return err
+		}
+		sink := slog.NewJSONHandler(&appendWriter{g.k, g.path(eventLogFile)}, &slog.HandlerOptions{Level: level})
+		h = teeHandler{h, sink}
+	}
+	g.log = slog.New(h)
+	return nil
+}
+
+// appendWriter appends each write to a file through the kernel.  The
+// JSON handler writes each record in one call, so records are never
+// split.
+type appendWriter struct {
+	k    Kernel
+	path string
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	err := w.k.AppendFile(w.path, p, os.FileMode(0644))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// teeHandler sends each record to every handler that is enabled for
+// its level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		err := h.Handle(ctx, r.Clone())
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	u := make(teeHandler, len(t))
+	for i, h := range t {
+		u[i] = h.WithAttrs(attrs)
+	}
+	return u
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	u := make(teeHandler, len(t))
+	for i, h := range t {
+		u[i] = h.WithGroup(name)
+	}
+	return u
+}
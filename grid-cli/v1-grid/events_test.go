@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// readEvents returns the records in g's JSONL event log.
+func readEvents(t *testing.T, g *Grid) (events []map[string]interface{}) {
+	buf, err := g.k.ReadFile(g.path(eventLogFile))
+	Tassert(t, err == nil, "Failed to read event log: %v", err)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		var e map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		Tassert(t, err == nil, "Invalid event %q: %v", scanner.Text(), err)
+		events = append(events, e)
+	}
+	return
+}
+
+// findEvent returns the first event named msg.
+func findEvent(events []map[string]interface{}, msg string) map[string]interface{} {
+	for _, e := range events {
+		if e["msg"] == msg {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestEventLog(t *testing.T) {
+	client, ck, sk := setupPeerPair(t)
+	config, err := ck.ReadFile(client.path(configFile))
+	Tassert(t, err == nil, "Failed to read config: %v", err)
+	err = ck.WriteFile(client.path(configFile), append(config, "event_log=debug\n"...), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	err = client.openLog()
+	Tassert(t, err == nil, "openLog returned an error: %v", err)
+
+	err = client.Exec("hello", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+	events := readEvents(t, client)
+	for _, name := range []string{EventRoute, EventCacheMiss, EventPeerQuery} {
+		Tassert(t, findEvent(events, name) != nil, "no %s event in %v", name, events)
+	}
+	Tassert(t, ck.stderr.Len() == 0, "debug events leaked to stderr: %q", ck.stderr.String())
+
+	// the server logs its refusal with the span of the client's query
+	_, err = client.Get("1220" + strings.Repeat("00", 32))
+	Tassert(t, err != nil, "expected Get of a missing hash to fail")
+	var span string
+	for _, e := range readEvents(t, client) {
+		if e["msg"] == EventPeerQuery {
+			span, _ = e["span"].(string)
+		}
+	}
+	Tassert(t, span != "", "peer query has no span")
+	Tassert(t, strings.Contains(sk.stderr.String(), "span="+span), "server did not log the query's span %s: %q", span, sk.stderr.String())
+	Tassert(t, strings.Contains(ck.stderr.String(), EventReject), "client did not warn of the refusal: %q", ck.stderr.String())
+
+	err = ck.WriteFile(client.path(configFile), []byte("event_log=loud\n"), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	Tassert(t, client.openLog() != nil, "expected an error for an invalid event_log level")
+}
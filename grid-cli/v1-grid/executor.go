@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	wsys "github.com/tetratelabs/wazero/sys"
+)
+
+// ModuleKind identifies how a cached module is to be executed.  It
+// comes from the platforms listed in the module's manifest; a module
+// without a manifest is native, which is what the grid has always
+// run.
+type ModuleKind string
+
+const (
+	ModuleNative ModuleKind = "native"
+	ModuleWasm   ModuleKind = "wasm"
+	ModuleOCI    ModuleKind = "oci"
+)
+
+// ociPrefix may start the first line of an OCI module, which is a
+// reference to a container image rather than executable code, e.g.
+// "oci:docker.io/library/alpine:3.19".
+const ociPrefix = "oci:"
+
+// Executor runs a module that has already been fetched into the
+// cache.  The path is relative to the kernel's filesystem.  A run
+// that exceeds quota fails with a *QuotaError.
+type Executor interface {
+	Exec(path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// NativeExecutor runs a module as a host executable.  CPU and memory
+// quotas are enforced with rlimits and, where available, cgroups.  A
+// native module cannot be confined to paths, so Paths are ignored.
+type NativeExecutor struct{}
+
+func (e *NativeExecutor) Exec(path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	ctx, cancel := quota.deadline()
+	defer cancel()
+	out := newLimitWriter(quota, cancel)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = out.wrap(stdout)
+	cmd.Stderr = out.wrap(stderr)
+	if !quota.allows(CapEnv) {
+		cmd.Env = []string{}
+	}
+	cmd.WaitDelay = time.Second
+	killGroup(cmd)
+	check, err := limitCommand(cmd, quota)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		check(nil)
+		return err
+	}
+	err = cmd.Wait()
+	if qerr := check(cmd.ProcessState); qerr != nil {
+		return qerr
+	}
+	return quotaErr(quota, err, ctx, out)
+}
+
+// WasmMount grants a WASI module access to one host directory.
+type WasmMount struct {
+	HostDir  string
+	GuestDir string
+	ReadOnly bool
+}
+
+// WasmExecutor runs WASI modules in an embedded, pure-Go runtime.  A
+// module can see only the directories listed in Mounts, or in its
+// quota's Paths; it has no network access and no access to the host
+// environment.  The guest runs on the caller's thread, so its CPU
+// time quota is enforced as wall time.
+type WasmExecutor struct {
+	fs     afero.Fs
+	Mounts []WasmMount
+}
+
+// NewWasmExecutor returns a WasmExecutor that reads module bytes
+// from fs and exposes the given mounts to the guest.
+func NewWasmExecutor(fs afero.Fs, mounts ...WasmMount) *WasmExecutor {
+	return &WasmExecutor{fs: fs, Mounts: mounts}
+}
+
+func (e *WasmExecutor) Exec(path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) (err error) {
+	code, err := afero.ReadFile(e.fs, path)
+	if err != nil {
+		return fmt.Errorf("Failed to read WASM module %s: %v", path, err)
+	}
+
+	timeLimit := &QuotaError{Resource: "wall", Limit: quota.WallTime.String()}
+	if quota.CPUTime > 0 && (quota.WallTime == 0 || quota.CPUTime < quota.WallTime) {
+		quota.WallTime = quota.CPUTime
+		timeLimit = &QuotaError{Resource: "cpu", Limit: quota.CPUTime.String()}
+	}
+	ctx, cancel := quota.deadline()
+	defer cancel()
+	rtConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if quota.Memory > 0 {
+		pages := quota.Memory / 65536
+		if pages < 1 {
+			pages = 1
+		}
+		if pages > 65536 {
+			pages = 65536
+		}
+		rtConfig = rtConfig.WithMemoryLimitPages(uint32(pages))
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, rtConfig)
+	defer r.Close(context.Background())
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	mounts := e.Mounts
+	if quota.Paths != nil {
+		mounts = nil
+		for _, p := range quota.Paths {
+			mounts = append(mounts, WasmMount{HostDir: p, GuestDir: p})
+		}
+	}
+	if !quota.allows(CapFsRead) && !quota.allows(CapFsWrite) {
+		mounts = nil
+	}
+	out := newLimitWriter(quota, cancel)
+	fsConfig := wazero.NewFSConfig()
+	for _, m := range mounts {
+		if m.ReadOnly || !quota.allows(CapFsWrite) {
+			fsConfig = fsConfig.WithReadOnlyDirMount(m.HostDir, m.GuestDir)
+		} else {
+			fsConfig = fsConfig.WithDirMount(m.HostDir, m.GuestDir)
+		}
+	}
+
+	config := wazero.NewModuleConfig().
+		WithArgs(append([]string{path}, args...)...).
+		WithStdin(stdin).
+		WithStdout(out.wrap(stdout)).
+		WithStderr(out.wrap(stderr)).
+		WithFSConfig(fsConfig).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+
+	_, err = r.InstantiateWithConfig(ctx, code, config)
+	if exitErr, ok := err.(*wsys.ExitError); ok && exitErr.ExitCode() == 0 {
+		return nil
+	}
+	if err != nil && !out.Exceeded() && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return timeLimit
+	}
+	return quotaErr(quota, err, ctx, out)
+}
+
+// ContainerRuntime starts a container from an OCI image, applying
+// quota to it.
+type ContainerRuntime interface {
+	Run(image string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// CLIContainerRuntime is a local stand-in for a real OCI runtime: it
+// shells out to a docker-compatible command line tool.
+type CLIContainerRuntime struct {
+	Command string
+}
+
+// NewCLIContainerRuntime returns a runtime that uses podman or docker,
+// whichever is found first in PATH.  If neither is installed the
+// returned runtime fails at Run time.
+func NewCLIContainerRuntime() *CLIContainerRuntime {
+	for _, cmd := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(cmd); err == nil {
+			return &CLIContainerRuntime{Command: cmd}
+		}
+	}
+	return &CLIContainerRuntime{}
+}
+
+// Run starts the container under a name of its own, so that when the
+// quota's deadline passes the container itself is killed and not just
+// the command line tool attached to it.
+func (rt *CLIContainerRuntime) Run(image string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	if rt.Command == "" {
+		return fmt.Errorf("No container runtime available to run %s", image)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("grid-%x", id)
+	cmdArgs := append([]string{"run", "--rm", "-i", "--name=" + name}, containerQuotaArgs(quota)...)
+	cmdArgs = append(append(cmdArgs, image), args...)
+	ctx, cancel := quota.deadline()
+	defer cancel()
+	out := newLimitWriter(quota, cancel)
+	cmd := exec.CommandContext(ctx, rt.Command, cmdArgs...)
+	cmd.Cancel = func() error {
+		exec.Command(rt.Command, "kill", name).Run()
+		return cmd.Process.Kill()
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = out.wrap(stdout)
+	cmd.Stderr = out.wrap(stderr)
+	err := cmd.Run()
+	return quotaErr(quota, err, ctx, out)
+}
+
+// containerQuotaArgs returns the docker-compatible run options that
+// apply quota's CPU, memory, path and capability limits.
+func containerQuotaArgs(quota Quota) (args []string) {
+	if !quota.allows(CapNet) {
+		args = append(args, "--network=none")
+	}
+	if quota.CPUTime > 0 {
+		secs := (quota.CPUTime + time.Second - 1) / time.Second
+		args = append(args, fmt.Sprintf("--ulimit=cpu=%d", secs))
+	}
+	if quota.Memory > 0 {
+		args = append(args, fmt.Sprintf("--memory=%d", quota.Memory))
+	}
+	if !quota.allows(CapFsRead) && !quota.allows(CapFsWrite) {
+		return
+	}
+	for _, p := range quota.Paths {
+		if quota.allows(CapFsWrite) {
+			args = append(args, fmt.Sprintf("--volume=%s:%s", p, p))
+		} else {
+			args = append(args, fmt.Sprintf("--volume=%s:%s:ro", p, p))
+		}
+	}
+	return
+}
+
+// ContainerExecutor runs modules whose content is an OCI image
+// reference.
+type ContainerExecutor struct {
+	fs      afero.Fs
+	runtime ContainerRuntime
+}
+
+// NewContainerExecutor returns a ContainerExecutor that reads image
+// references from fs and starts them with runtime.
+func NewContainerExecutor(fs afero.Fs, runtime ContainerRuntime) *ContainerExecutor {
+	return &ContainerExecutor{fs: fs, runtime: runtime}
+}
+
+func (e *ContainerExecutor) Exec(path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	data, err := afero.ReadFile(e.fs, path)
+	if err != nil {
+		return fmt.Errorf("Failed to read container module %s: %v", path, err)
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	image := strings.TrimSpace(strings.TrimPrefix(line, ociPrefix))
+	if image == "" {
+		return fmt.Errorf("Container module %s has no image reference", path)
+	}
+	return e.runtime.Run(image, args, quota, stdin, stdout, stderr)
+}
+
+// execModule runs the cached module at path with the executor for
+// its kind.
+func (sys *KernelNative) execModule(kind ModuleKind, path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	executor, ok := sys.executors[kind]
+	if !ok {
+		return fmt.Errorf("No executor for %s module %s", kind, path)
+	}
+	return executor.Exec(path, args, quota, stdin, stdout, stderr)
+}
+
+// defaultExecutors returns the executors a native kernel starts with.
+// WASM modules see no host directories unless their quota grants
+// them Paths.
+func defaultExecutors(fs afero.Fs) map[ModuleKind]Executor {
+	return map[ModuleKind]Executor{
+		ModuleNative: &NativeExecutor{},
+		ModuleWasm:   NewWasmExecutor(fs),
+		ModuleOCI:    NewContainerExecutor(fs, NewCLIContainerRuntime()),
+	}
+}
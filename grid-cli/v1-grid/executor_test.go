@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+func TestManifestKind(t *testing.T) {
+	native := runtime.GOOS + "/" + runtime.GOARCH
+	cases := []struct {
+		platforms []string
+		want      ModuleKind
+	}{
+		{[]string{"wasip1/wasm"}, ModuleWasm},
+		{[]string{"plan9/mips", "oci"}, ModuleOCI},
+		{[]string{native, "wasip1/wasm"}, ModuleNative},
+		{nil, ModuleNative},
+	}
+	for _, c := range cases {
+		got := (&Manifest{Platforms: c.platforms}).Kind()
+		Tassert(t, got == c.want, "Kind of %v = %s, want %s", c.platforms, got, c.want)
+	}
+}
+
+// fakeRuntime records the container it was asked to run.
+type fakeRuntime struct {
+	image string
+	args  []string
+}
+
+func (rt *fakeRuntime) Run(image string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	rt.image = image
+	rt.args = args
+	_, err := io.Copy(stdout, stdin)
+	return err
+}
+
+func TestContainerExecutor(t *testing.T) {
+	g, sys := setupTestEnv()
+	rt := &fakeRuntime{}
+	sys.executors[ModuleOCI] = NewContainerExecutor(sys.fs, rt)
+
+	path := g.path(cacheDir, "container")
+	err := sys.util.WriteFile(path, []byte("oci:example.com/grid/hello:1\n"), 0644)
+	Tassert(t, err == nil, "Failed to write module: %v", err)
+
+	stdout := &bytes.Buffer{}
+	err = sys.execModule(ModuleOCI, path, []string{"a", "b"}, Quota{}, strings.NewReader("hi"), stdout, io.Discard)
+	Tassert(t, err == nil, "execModule returned an error: %v", err)
+	Tassert(t, rt.image == "example.com/grid/hello:1", "unexpected image %q", rt.image)
+	Tassert(t, strings.Join(rt.args, " ") == "a b", "unexpected args %v", rt.args)
+	Tassert(t, stdout.String() == "hi", "unexpected stdout %q", stdout.String())
+}
+
+func TestNativeExecutor(t *testing.T) {
+	dir := t.TempDir()
+	sys := NewKernelNative(afero.NewOsFs())
+	g, err := NewGrid(sys, dir)
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	path := g.path(cacheDir, "native")
+	err = os.WriteFile(path, []byte("#!/bin/sh\necho \"$@\"\ncat\n"), 0755)
+	Tassert(t, err == nil, "Failed to write module: %v", err)
+
+	stdout := &bytes.Buffer{}
+	err = sys.execModule(ModuleNative, path, []string{"hello"}, Quota{}, strings.NewReader("world\n"), stdout, io.Discard)
+	Tassert(t, err == nil, "execModule returned an error: %v", err)
+	Tassert(t, stdout.String() == "hello\nworld\n", "unexpected stdout %q", stdout.String())
+}
+
+// buildWasiEcho compiles testdata/wasi-echo for wasip1 and returns the
+// module bytes.
+func buildWasiEcho(t *testing.T) []byte {
+	if testing.Short() {
+		t.Skip("skipping WASM build in short mode")
+	}
+	out := filepath.Join(t.TempDir(), "echo.wasm")
+	cmd := exec.Command("go", "build", "-o", out, "./testdata/wasi-echo")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if buf, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("cannot build wasip1 test module: %v\n%s", err, buf)
+	}
+	code, err := os.ReadFile(out)
+	Tassert(t, err == nil, "Failed to read wasm module: %v", err)
+	return code
+}
+
+func TestWasmExecutor(t *testing.T) {
+	code := buildWasiEcho(t)
+	g, sys := setupTestEnv()
+
+	// the guest sees only this directory
+	hostDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(hostDir, "visible.txt"), nil, 0644)
+	Tassert(t, err == nil, "Failed to write mount contents: %v", err)
+	sys.executors[ModuleWasm] = NewWasmExecutor(sys.fs, WasmMount{HostDir: hostDir, GuestDir: "/", ReadOnly: true})
+
+	path := g.path(cacheDir, "echo")
+	err = sys.util.WriteFile(path, code, 0644)
+	Tassert(t, err == nil, "Failed to write module: %v", err)
+
+	stdout := &bytes.Buffer{}
+	err = sys.execModule(ModuleWasm, path, []string{"x", "y"}, Quota{}, strings.NewReader("from stdin\n"), stdout, io.Discard)
+	Tassert(t, err == nil, "execModule returned an error: %v", err)
+	want := "x y\nfrom stdin\nvisible.txt\n"
+	Tassert(t, stdout.String() == want, "unexpected stdout %q, want %q", stdout.String(), want)
+}
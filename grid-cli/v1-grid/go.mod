@@ -7,6 +7,8 @@ require (
 	github.com/multiformats/go-multihash v0.2.3
 	github.com/spf13/afero v1.11.0
 	github.com/stevegt/goadapt v0.7.0
+	github.com/tetratelabs/wazero v1.8.2
+	golang.org/x/sys v0.15.0
 )
 
 require (
@@ -17,7 +19,6 @@ require (
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	golang.org/x/crypto v0.16.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	lukechampine.com/blake3 v1.1.6 // indirect
 )
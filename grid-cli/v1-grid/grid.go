@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
-
-	"github.com/gorilla/websocket"
+	"time"
 	// . "github.com/stevegt/goadapt"
 )
 
@@ -15,24 +18,206 @@ const (
 	configFile = ".grid/config"
 	cacheDir   = ".grid/cache"
 	peerList   = ".grid/peers"
+	cacheIndex = ".grid/cacheindex"
 )
 
 type Peer struct {
 	Address string
-	Conn    *websocket.Conn
+	Conn    Conn
+}
+
+// Grid holds the state of one grid node.  All of its side effects go
+// through the Kernel it was created with.
+type Grid struct {
+	k        Kernel
+	baseDir  string
+	Peers    map[string]*Peer
+	mu       sync.Mutex
+	cacheMu  sync.Mutex
+	accessed map[string]int64 // cache accesses not yet in the index
+	flushed  time.Time        // when accesses were last written to the index
+	walletMu sync.Mutex
+	nonceMu  sync.Mutex
+	nonces   map[string]time.Time // of accepted requests, when seen
+	now      func() time.Time
+	log      *slog.Logger
+}
+
+// NewGrid creates a grid node rooted at baseDir, creating the grid's
+// directories if needed and opening its event log.
+func NewGrid(k Kernel, baseDir string) (g *Grid, err error) {
+	g = &Grid{
+		k:        k,
+		baseDir:  baseDir,
+		Peers:    make(map[string]*Peer),
+		nonces:   make(map[string]time.Time),
+		accessed: make(map[string]int64),
+		now:      time.Now,
+	}
+	err = g.ensureDirectories()
+	if err != nil {
+		return nil, err
+	}
+	err = g.openLog()
+	return
+}
+
+// path returns the kernel path of a file relative to the grid's base
+// directory.
+func (g *Grid) path(rel ...string) string {
+	return filepath.Join(append([]string{g.baseDir}, rel...)...)
 }
 
-var Peers = make(map[string]*Peer)
-var mu sync.Mutex
+func (g *Grid) ensureDirectories() error {
+	directories := []string{gridDir, cacheDir}
+	for _, dir := range directories {
+		if _, err := g.k.Stat(g.path(dir)); os.IsNotExist(err) {
+			err = g.k.MkdirAll(g.path(dir), os.ModePerm)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-func getSubcommandHash(symbolTable, subcommand string) string {
-	lines := strings.Split(symbolTable, "\n")
+// getConfig returns the value of a key=value line in the
+// configuration file.
+func (g *Grid) getConfig(key string) (val string, err error) {
+	data, err := g.k.ReadFile(g.path(configFile))
+	if err != nil {
+		err = fmt.Errorf("Failed to read configuration: %v", err)
+		return "", err
+	}
+	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
-		if strings.HasPrefix(line, subcommand+" ") {
-			return strings.TrimPrefix(line, subcommand+" ")
+		if strings.HasPrefix(line, key+"=") {
+			return strings.TrimPrefix(line, key+"="), nil
+		}
+	}
+	err = fmt.Errorf("%s not found in configuration.", key)
+	return "", err
+}
+
+func (g *Grid) getSymbolTableHash() (hash string, err error) {
+	return g.getConfig("symbol_table_hash")
+}
+
+func (g *Grid) loadPeers() error {
+	file, err := g.k.Open(g.path(peerList))
+	if err != nil {
+		return fmt.Errorf("No peers available.")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		peerAddress := scanner.Text()
+		g.Peers[peerAddress] = &Peer{Address: peerAddress}
+	}
+	return scanner.Err()
+}
+
+func getSubcommandHash(symbolTable, subcommand string) (string, error) {
+	entry, err := lookupSymbol(symbolTable, subcommand)
+	return entry.Module, err
+}
+
+// resolveSymbol looks up subcommand in the symbol table.
+func (g *Grid) resolveSymbol(subcommand string) (entry SymbolEntry, err error) {
+	symbolTableHash, err := g.getSymbolTableHash()
+	if err != nil {
+		return
+	}
+	symbolTable, err := g.fetchSymbolTable(symbolTableHash)
+	if err != nil {
+		return
+	}
+	return lookupSymbol(symbolTable, subcommand)
+}
+
+// Exec runs a grid subcommand with the kernel's standard I/O, within
+// the quota configured for its module.  The module is only fetched
+// and run if its manifest, signed by a trusted author, satisfies local
+// policy; a module without a manifest runs, with no capabilities, only
+// if manifest signatures are not required.
+func (g *Grid) Exec(subcommand string, args []string) (err error) {
+	entry, err := g.resolveSymbol(subcommand)
+	if err != nil {
+		return err
+	}
+	manifest, err := g.fetchManifest(entry)
+	if err != nil {
+		return err
+	}
+	kind := ModuleNative
+	if manifest != nil {
+		err = manifest.CheckPolicy(g.allowedModuleCapabilities())
+		if err != nil {
+			return fmt.Errorf("Refusing to execute %v: %v", subcommand, err)
 		}
+		kind = manifest.Kind()
+	}
+	g.log.Debug(EventRoute, "subcommand", subcommand, "module", entry.Module)
+	quota, err := g.moduleQuota(entry.Module)
+	if err != nil {
+		return err
+	}
+	// a module without a manifest declares no capabilities
+	quota.Capabilities = []string{}
+	if manifest != nil {
+		quota.Capabilities = append(quota.Capabilities, manifest.Capabilities...)
+	}
+	if kind == ModuleNative && quota.Paths != nil {
+		g.log.Warn(EventError, "op", "quota", "module", entry.Module, "err", "native modules cannot be confined to paths; ignoring them")
+		quota.Paths = nil
+	}
+	module, err := g.fetchModule(entry.Module)
+	if err != nil {
+		return err
+	}
+	err = g.k.Exec(kind, module, args, quota, g.k.Stdin(), g.k.Stdout(), g.k.Stderr())
+	var qerr *QuotaError
+	if errors.As(err, &qerr) {
+		qerr.Module = entry.Module
+		g.log.Warn(EventBrokenPromise, "subcommand", subcommand, "module", entry.Module, "err", qerr)
+		return qerr
+	}
+	if err != nil {
+		return fmt.Errorf("Error executing %v %v: %v", subcommand, args, err)
+	}
+	return nil
+}
+
+func (g *Grid) fetchLocalData(mBuf []byte) ([]byte, error) {
+	fn := fmt.Sprintf("%x", mBuf)
+	data, err := g.k.ReadFile(g.path(cacheDir, fn))
+	if err == nil {
+		err = g.touch(fn)
+		return data, err
+	}
+
+	// XXX If data not found in cache, check if it's a known handler
+	// handlerPath := filepath.Join(os.Getenv("HOME"), gridDir, "handlers", hash)
+	// return ioutil.ReadFile(handlerPath)
+
+	return nil, fmt.Errorf("Data not found.")
+}
+
+// showPromise renders the manifest of a subcommand's module.  The
+// module itself is neither fetched nor run.
+func (g *Grid) showPromise(subcommand string) (err error) {
+	entry, err := g.resolveSymbol(subcommand)
+	if err != nil {
+		return err
+	}
+	manifest, err := g.fetchManifest(entry)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("Subcommand %s has no manifest.", subcommand)
 	}
-	fmt.Printf("Subcommand %s not found in symbol table.\n", subcommand)
-	os.Exit(1)
-	return ""
+	manifest.Render(g.k.Stdout())
+	return nil
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io"
 	"os"
+
+	"github.com/spf13/afero"
 )
 
 // XXX Consider always compiling to WASM.
@@ -15,13 +18,33 @@ import (
 // backends, including a native backend that uses the host OS, and a
 // WASM backend that runs in a sandboxed environment.
 type Kernel interface {
+	// filesystem
 	Stat(path string) (os.FileInfo, error)
-	Open(path string) (os.File, error)
-	Close() error
-	Read(p []byte) (n int, err error)
-	Write(p []byte) (n int, err error)
+	Open(path string) (afero.File, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	AppendFile(path string, data []byte, perm os.FileMode) error
 	Remove(path string) error
 	RemoveAll(path string) error
 	MkdirAll(path string, perm os.FileMode) error
-	Exec(name string, args []string) error
+
+	// execution of a module of the given kind, within quota
+	Exec(kind ModuleKind, path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error
+
+	// network
+	Dial(address string) (Conn, error)
+	Listen(address string, handler func(Conn)) error
+
+	// standard I/O of the grid process itself
+	Stdin() io.Reader
+	Stdout() io.Writer
+	Stderr() io.Writer
+}
+
+// Conn is a message-oriented connection to a peer.  It is satisfied
+// by *websocket.Conn.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// Syscall is one call made through a KernelMem.
+type Syscall struct {
+	Name string
+	Args []interface{}
+}
+
+// Program is an in-memory stand-in for an executable module.
+type Program func(args []string, stdin io.Reader, stdout, stderr io.Writer) error
+
+// MemNet connects KernelMem instances to each other.
+type MemNet struct {
+	mu        sync.Mutex
+	listeners map[string]func(Conn)
+}
+
+func NewMemNet() *MemNet {
+	return &MemNet{listeners: make(map[string]func(Conn))}
+}
+
+// KernelMem is a Kernel test double.  It keeps files in memory, runs
+// Programs instead of executables, connects to other KernelMems
+// through a MemNet, and records every syscall it receives.
+type KernelMem struct {
+	fs       afero.Fs
+	util     *afero.Afero
+	net      *MemNet
+	programs map[string]Program
+	stdin    *bytes.Buffer
+	stdout   *bytes.Buffer
+	stderr   *bytes.Buffer
+
+	mu    sync.Mutex
+	Calls []Syscall
+}
+
+func NewKernelMem(net *MemNet) *KernelMem {
+	if net == nil {
+		net = NewMemNet()
+	}
+	fs := afero.NewMemMapFs()
+	return &KernelMem{
+		fs:       fs,
+		util:     &afero.Afero{Fs: fs},
+		net:      net,
+		programs: make(map[string]Program),
+		stdin:    &bytes.Buffer{},
+		stdout:   &bytes.Buffer{},
+		stderr:   &bytes.Buffer{},
+	}
+}
+
+// AddProgram registers prog to run whenever a module whose content is
+// exactly code is executed.
+func (k *KernelMem) AddProgram(code []byte, prog Program) {
+	k.programs[string(code)] = prog
+}
+
+func (k *KernelMem) record(name string, args ...interface{}) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Calls = append(k.Calls, Syscall{Name: name, Args: args})
+}
+
+// CallNames returns the names of all recorded syscalls, in order.
+func (k *KernelMem) CallNames() (names []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, c := range k.Calls {
+		names = append(names, c.Name)
+	}
+	return
+}
+
+// callsTo returns the positions in Calls of syscalls with the given
+// name whose first argument is a path starting with prefix.
+func (k *KernelMem) callsTo(name, prefix string) (idx []int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, c := range k.Calls {
+		if c.Name != name || len(c.Args) == 0 {
+			continue
+		}
+		if path, ok := c.Args[0].(string); ok && strings.HasPrefix(path, prefix) {
+			idx = append(idx, i)
+		}
+	}
+	return
+}
+
+func (k *KernelMem) Stat(path string) (os.FileInfo, error) {
+	k.record("Stat", path)
+	return k.fs.Stat(path)
+}
+
+func (k *KernelMem) Open(path string) (afero.File, error) {
+	k.record("Open", path)
+	return k.fs.Open(path)
+}
+
+func (k *KernelMem) ReadFile(path string) ([]byte, error) {
+	k.record("ReadFile", path)
+	return k.util.ReadFile(path)
+}
+
+func (k *KernelMem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	k.record("WriteFile", path, perm)
+	return k.util.WriteFile(path, data, perm)
+}
+
+func (k *KernelMem) AppendFile(path string, data []byte, perm os.FileMode) error {
+	k.record("AppendFile", path, perm)
+	f, err := k.fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func (k *KernelMem) Remove(path string) error {
+	k.record("Remove", path)
+	return k.fs.Remove(path)
+}
+
+func (k *KernelMem) RemoveAll(path string) error {
+	k.record("RemoveAll", path)
+	return k.fs.RemoveAll(path)
+}
+
+func (k *KernelMem) MkdirAll(path string, perm os.FileMode) error {
+	k.record("MkdirAll", path, perm)
+	return k.fs.MkdirAll(path, perm)
+}
+
+func (k *KernelMem) Exec(kind ModuleKind, path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	k.record("Exec", path, args, quota, kind)
+	code, err := k.util.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	prog, ok := k.programs[string(code)]
+	if !ok {
+		return fmt.Errorf("no program registered for %s", path)
+	}
+	if stdin == nil {
+		stdin = &bytes.Buffer{}
+	}
+	return prog(args, stdin, stdout, stderr)
+}
+
+func (k *KernelMem) Dial(address string) (Conn, error) {
+	k.record("Dial", address)
+	k.net.mu.Lock()
+	handler, ok := k.net.listeners[address]
+	k.net.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("connection refused: %s", address)
+	}
+	client, server := memConnPair()
+	go func() {
+		defer server.Close()
+		handler(server)
+	}()
+	return client, nil
+}
+
+// Listen registers handler on the MemNet and returns immediately.
+func (k *KernelMem) Listen(address string, handler func(Conn)) error {
+	k.record("Listen", address)
+	k.net.mu.Lock()
+	defer k.net.mu.Unlock()
+	k.net.listeners[address] = handler
+	return nil
+}
+
+func (k *KernelMem) Stdin() io.Reader  { return k.stdin }
+func (k *KernelMem) Stdout() io.Writer { return k.stdout }
+func (k *KernelMem) Stderr() io.Writer { return k.stderr }
+
+type memMessage struct {
+	messageType int
+	data        []byte
+}
+
+// memConn is one end of an in-memory message connection.
+type memConn struct {
+	in     <-chan memMessage
+	out    chan<- memMessage
+	closed chan struct{}
+	peer   *memConn
+	once   sync.Once
+}
+
+func memConnPair() (a, b *memConn) {
+	ab := make(chan memMessage, 16)
+	ba := make(chan memMessage, 16)
+	a = &memConn{in: ba, out: ab, closed: make(chan struct{})}
+	b = &memConn{in: ab, out: ba, closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return
+}
+
+func (c *memConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.messageType, m.data, nil
+	case <-c.closed:
+	case <-c.peer.closed:
+	}
+	// drain anything the peer wrote before it closed
+	select {
+	case m := <-c.in:
+		return m.messageType, m.data, nil
+	default:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *memConn) WriteMessage(messageType int, data []byte) error {
+	buf := append([]byte(nil), data...)
+	select {
+	case c.out <- memMessage{messageType, buf}:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	case <-c.peer.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
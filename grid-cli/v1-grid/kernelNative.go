@@ -1,123 +1,119 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
 
+	"github.com/gorilla/websocket"
 	"github.com/spf13/afero"
-	. "github.com/stevegt/goadapt"
 )
 
+// KernelNative implements Kernel using the host's filesystem (through
+// afero), CPU, and network stack.
 type KernelNative struct {
-	fs      afero.Fs
-	baseDir string
-	util    *afero.Afero
+	fs        afero.Fs
+	util      *afero.Afero
+	executors map[ModuleKind]Executor
+	stdin     io.Reader
+	stdout    io.Writer
+	stderr    io.Writer
 }
 
 // NewKernelNative creates a new Kernel instance that uses the native
 // filesystem, CPU, and network stack.
-func NewKernelNative(fs afero.Fs, baseDir string) *KernelNative {
+func NewKernelNative(fs afero.Fs) *KernelNative {
 	sys := &KernelNative{
-		fs:      fs,
-		baseDir: baseDir,
-		util:    &afero.Afero{Fs: fs},
+		fs:        fs,
+		util:      &afero.Afero{Fs: fs},
+		executors: defaultExecutors(fs),
+		stdin:     os.Stdin,
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
 	}
-	sys.ensureDirectories()
 	return sys
 }
 
-func (sys *KernelNative) ensureDirectories() {
-	directories := []string{gridDir, cacheDir}
-	for _, dir := range directories {
-		if _, err := sys.fs.Stat(filepath.Join(sys.baseDir, dir)); os.IsNotExist(err) {
-			sys.fs.MkdirAll(filepath.Join(sys.baseDir, dir), os.ModePerm)
-		}
-	}
+func (sys *KernelNative) Stat(path string) (os.FileInfo, error) {
+	return sys.fs.Stat(path)
 }
 
-func (sys *KernelNative) getSymbolTableHash() (hash string, err error) {
-	configPath := filepath.Join(sys.baseDir, configFile)
-	data, err := sys.util.ReadFile(configPath)
-	if err != nil {
-		err = fmt.Errorf("Failed to read configuration: %v", err)
-		return "", err
-	}
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "symbol_table_hash=") {
-			return strings.TrimPrefix(line, "symbol_table_hash="), nil
-		}
-	}
-	err = fmt.Errorf("Symbol table hash not found in configuration.")
-	return "", err
+func (sys *KernelNative) Open(path string) (afero.File, error) {
+	return sys.fs.Open(path)
+}
+
+func (sys *KernelNative) ReadFile(path string) ([]byte, error) {
+	return sys.util.ReadFile(path)
+}
+
+func (sys *KernelNative) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return sys.util.WriteFile(path, data, perm)
 }
 
-func (sys *KernelNative) loadPeers() {
-	peersPath := filepath.Join(sys.baseDir, peerList)
-	file, err := sys.fs.Open(peersPath)
+// AppendFile appends data to the file at path, creating it with perm
+// if needed.
+func (sys *KernelNative) AppendFile(path string, data []byte, perm os.FileMode) error {
+	f, err := sys.fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
 	if err != nil {
-		fmt.Println("No peers available.")
-		os.Exit(1)
+		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		peerAddress := scanner.Text()
-		Peers[peerAddress] = &Peer{Address: peerAddress}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
 
-func (sys *KernelNative) Exec(subcommand string, args []string) (err error) {
-	symbolTableHash, err := sys.getSymbolTableHash()
-	Ck(err)
-	symbolTable := fetchSymbolTable(symbolTableHash)
-	subcommandHash := getSubcommandHash(symbolTable, subcommand)
-	module := sys.fetchModule(subcommandHash)
-	cmd := exec.Command(module, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error executing %v %v: %v", subcommand, args, err)
-	}
-	return nil
+func (sys *KernelNative) Remove(path string) error {
+	return sys.fs.Remove(path)
 }
 
-func (sys *KernelNative) fetchLocalData(mBuf []byte) ([]byte, error) {
-	fn := fmt.Sprintf("%x", mBuf)
-	cachePath := filepath.Join(sys.baseDir, cacheDir, fn)
-	data, err := sys.util.ReadFile(cachePath)
-	if err == nil {
-		return data, nil
-	}
+func (sys *KernelNative) RemoveAll(path string) error {
+	return sys.fs.RemoveAll(path)
+}
 
-	// XXX If data not found in cache, check if it's a known handler
-	// handlerPath := filepath.Join(os.Getenv("HOME"), gridDir, "handlers", hash)
-	// return ioutil.ReadFile(handlerPath)
+func (sys *KernelNative) MkdirAll(path string, perm os.FileMode) error {
+	return sys.fs.MkdirAll(path, perm)
+}
 
-	return nil, fmt.Errorf("Data not found.")
+// Exec runs the module at path, within quota, with the executor for
+// its kind.
+func (sys *KernelNative) Exec(kind ModuleKind, path string, args []string, quota Quota, stdin io.Reader, stdout, stderr io.Writer) error {
+	return sys.execModule(kind, path, args, quota, stdin, stdout, stderr)
 }
 
-func (sys *KernelNative) showPromise(subcommand string) {
-	symbolTableHash, err := sys.getSymbolTableHash()
+// Dial opens a websocket connection to a peer.
+func (sys *KernelNative) Dial(address string) (Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(address, nil)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
+	return conn, nil
+}
 
-	symbolTable := fetchSymbolTable(symbolTableHash)
-	subcommandHash := getSubcommandHash(symbolTable, subcommand)
-	module := sys.fetchModule(subcommandHash)
-	cmd := exec.Command(module, "--show-promise")
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Println("Error executing subcommand:", err)
-		os.Exit(1)
+// Listen serves websocket connections on address at /ws, calling
+// handler for each one.  It does not return unless the server fails.
+func (sys *KernelNative) Listen(address string, handler func(Conn)) error {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
 	}
-	fmt.Println(string(output))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Fprintln(sys.stderr, "Failed to upgrade to websocket:", err)
+			return
+		}
+		defer conn.Close()
+		handler(conn)
+	})
+	return http.ListenAndServe(address, mux)
 }
+
+func (sys *KernelNative) Stdin() io.Reader  { return sys.stdin }
+func (sys *KernelNative) Stdout() io.Writer { return sys.stdout }
+func (sys *KernelNative) Stderr() io.Writer { return sys.stderr }
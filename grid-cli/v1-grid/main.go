@@ -1,25 +1,107 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/spf13/afero"
 	. "github.com/stevegt/goadapt"
 )
 
+func usage() {
+	fmt.Println("Usage: grid {subcommand} [args...]")
+	fmt.Println("       grid --show {subcommand}")
+	fmt.Println("       grid put {file}")
+	fmt.Println("       grid get {multihash}")
+	fmt.Println("       grid pin {multihash}")
+	fmt.Println("       grid unpin {multihash}")
+	fmt.Println("       grid gc [max-bytes]")
+	fmt.Println("       grid cap key")
+	fmt.Println("       grid cap issue {subject-key} {scope} {ttl} {promise} [parent-id]")
+	fmt.Println("       grid cap add {capability-file}")
+	fmt.Println("       grid cap trust {issuer-key}")
+	fmt.Println("       grid cap revoke {capability-id}")
+	fmt.Println("       grid manifest sign {manifest-file}")
+	os.Exit(1)
+}
+
 func main() {
 	args := os.Args
 	if len(args) < 2 {
-		fmt.Println("Usage: grid {subcommand} [args...]")
-		fmt.Println("       grid --show {subcommand}")
-		os.Exit(1)
+		usage()
 	}
 
-	sys := NewKernelNative(afero.NewOsFs(), os.Getenv("HOME"))
+	k := NewKernelNative(afero.NewOsFs())
+	g, err := NewGrid(k, os.Getenv("HOME"))
+	Ck(err)
+
+	// commands that only touch the local cache
+	switch args[1] {
+	case "put":
+		if len(args) < 3 {
+			usage()
+		}
+		mStr, err := g.Put(args[2])
+		Ck(err)
+		fmt.Fprintln(k.Stdout(), mStr)
+		return
+	case "pin":
+		if len(args) < 3 {
+			usage()
+		}
+		Ck(g.Pin(args[2]))
+		return
+	case "unpin":
+		if len(args) < 3 {
+			usage()
+		}
+		Ck(g.Unpin(args[2]))
+		return
+	case "gc":
+		var maxBytes int64
+		if len(args) > 2 {
+			maxBytes, err = strconv.ParseInt(args[2], 10, 64)
+		} else {
+			maxBytes, err = g.cacheMaxBytes()
+		}
+		Ck(err)
+		evicted, freed, err := g.GC(maxBytes)
+		Ck(err)
+		fmt.Fprintf(k.Stdout(), "evicted %d entries, freed %d bytes\n", len(evicted), freed)
+		return
+	case "cap":
+		if len(args) < 3 {
+			usage()
+		}
+		Ck(capCommand(g, args[2], args[3:]))
+		return
+	case "manifest":
+		if len(args) < 4 || args[2] != "sign" {
+			usage()
+		}
+		Ck(signManifest(g, args[3]))
+		return
+	case "get":
+		if len(args) < 3 {
+			usage()
+		}
+		// peers are only needed on a local cache miss
+		if g.loadPeers() == nil {
+			g.connectToPeers()
+		}
+		data, err := g.Get(args[2])
+		Ck(err)
+		_, err = k.Stdout().Write(data)
+		Ck(err)
+		return
+	}
 
-	sys.loadPeers()
-	connectToPeers()
+	err = g.loadPeers()
+	Ck(err)
+	g.connectToPeers()
 
 	switch args[1] {
 	case "--show":
@@ -28,12 +110,83 @@ func main() {
 			os.Exit(1)
 		}
 		subcommand := args[2]
-		sys.showPromise(subcommand)
+		err = g.showPromise(subcommand)
 	case "start-server":
-		sys.startWebSocketServer()
+		err = g.startWebSocketServer()
 	default:
 		subcommand := args[1]
-		err := sys.Exec(subcommand, args[2:])
-		Ck(err)
+		err = g.Exec(subcommand, args[2:])
+	}
+	Ck(err)
+}
+
+// capCommand implements the "grid cap" subcommands.
+func capCommand(g *Grid, cmd string, args []string) (err error) {
+	need := map[string]int{"key": 0, "issue": 4, "add": 1, "trust": 1, "revoke": 1}
+	n, ok := need[cmd]
+	if !ok || len(args) < n {
+		usage()
+	}
+	switch cmd {
+	case "key":
+		var pub string
+		pub, err = g.PublicKey()
+		if err == nil {
+			fmt.Fprintln(g.k.Stdout(), pub)
+		}
+	case "issue":
+		var ttl time.Duration
+		ttl, err = time.ParseDuration(args[2])
+		if err != nil {
+			return
+		}
+		parentID := ""
+		if len(args) > 4 {
+			parentID = args[4]
+		}
+		var c *Capability
+		c, err = g.IssueCapability(args[0], args[1], args[3], ttl, parentID)
+		if err == nil {
+			err = json.NewEncoder(g.k.Stdout()).Encode(c)
+		}
+	case "add":
+		var buf []byte
+		buf, err = g.k.ReadFile(args[0])
+		if err != nil {
+			return
+		}
+		c := &Capability{}
+		err = json.Unmarshal(buf, c)
+		if err == nil {
+			err = g.AddCapability(c)
+		}
+		if err == nil {
+			fmt.Fprintln(g.k.Stdout(), c.ID())
+		}
+	case "trust":
+		err = g.Trust(args[0])
+	case "revoke":
+		err = g.Revoke(args[0])
+	}
+	return
+}
+
+// signManifest signs the manifest in file with this node's key and
+// writes the result to stdout, ready for "grid put".
+func signManifest(g *Grid, file string) (err error) {
+	buf, err := g.k.ReadFile(file)
+	if err != nil {
+		return
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return
+	}
+	key, err := g.nodeKey()
+	if err != nil {
+		return
 	}
+	m.Sign(key)
+	return json.NewEncoder(g.k.Stdout()).Encode(m)
 }
@@ -13,17 +13,19 @@ import (
 	. "github.com/stevegt/goadapt"
 )
 
-func setupTestEnv() (sys *KernelNative) {
-	sys = NewKernelNative(afero.NewMemMapFs(), "/tmp/foo")
+func setupTestEnv() (g *Grid, sys *KernelNative) {
+	sys = NewKernelNative(afero.NewMemMapFs())
+	g, err := NewGrid(sys, "/tmp/foo")
+	Ck(err)
 	return
 }
 
 func TestEnsureDirectories(t *testing.T) {
-	sys := setupTestEnv()
+	g, sys := setupTestEnv()
 
 	expectedDirs := []string{gridDir, cacheDir}
 	for _, dir := range expectedDirs {
-		_, err := sys.fs.Stat(filepath.Join(sys.baseDir, dir))
+		_, err := sys.fs.Stat(filepath.Join(g.baseDir, dir))
 		if os.IsNotExist(err) {
 			t.Errorf("Directory %s was not created", dir)
 		}
@@ -31,7 +33,7 @@ func TestEnsureDirectories(t *testing.T) {
 }
 
 func TestFetchLocalData(t *testing.T) {
-	sys := setupTestEnv()
+	g, sys := setupTestEnv()
 
 	expectedData := []byte("test data")
 	// generate a sha256 multihash for the test data
@@ -45,14 +47,14 @@ func TestFetchLocalData(t *testing.T) {
 	fn2 := fmt.Sprintf("%s", hex.EncodeToString(mBuf))
 	Tassert(t, fn == fn2, "Mismatched hash strings: %s != %s", fn, fn2)
 
-	cachePath := filepath.Join(sys.baseDir, cacheDir, fn)
+	cachePath := filepath.Join(g.baseDir, cacheDir, fn)
 
 	err = sys.util.WriteFile(cachePath, []byte(expectedData), 0644)
 	if err != nil {
 		t.Fatalf("Failed to write test data to %s: %v", cachePath, err)
 	}
 
-	data, err := sys.fetchLocalData(mBuf)
+	data, err := g.fetchLocalData(mBuf)
 	if err != nil {
 		t.Errorf("fetchLocalData returned an error: %v", err)
 	}
@@ -66,9 +68,9 @@ func TestFetchLocalData(t *testing.T) {
 
 // Test the scenario where file is not found
 func TestFetchLocalData_NotFound(t *testing.T) {
-	sys := setupTestEnv()
+	g, _ := setupTestEnv()
 
-	_, err := sys.fetchLocalData([]byte("non-existent"))
+	_, err := g.fetchLocalData([]byte("non-existent"))
 	if err == nil {
 		t.Error("Expected an error for non-existent data, but got nil")
 	}
@@ -76,10 +78,10 @@ func TestFetchLocalData_NotFound(t *testing.T) {
 
 // Ensure test setup includes expected environment
 func TestGetSymbolTableHash_NonExistentFile(t *testing.T) {
-	sys := setupTestEnv()
+	g, _ := setupTestEnv()
 
 	// Intentionally not creating the file to trigger the file not found path
-	_, err := sys.getSymbolTableHash()
+	_, err := g.getSymbolTableHash()
 	if err == nil {
 		t.Fatal("Expected error when configuration file does not exist, got nil")
 	}
@@ -87,37 +89,37 @@ func TestGetSymbolTableHash_NonExistentFile(t *testing.T) {
 
 // test loadPeers
 func TestLoadPeers(t *testing.T) {
-	sys := setupTestEnv()
+	g, sys := setupTestEnv()
 
 	// create a test file with some peers
 	peerData := []byte("peer1\npeer2\npeer3")
-	err := sys.util.WriteFile(filepath.Join(sys.baseDir, peerList), peerData, 0644)
+	err := sys.util.WriteFile(filepath.Join(g.baseDir, peerList), peerData, 0644)
 	if err != nil {
 		t.Fatalf("Failed to write test data to peers.txt: %v", err)
 	}
 
-	sys.loadPeers()
+	err = g.loadPeers()
 	if err != nil {
 		t.Fatalf("loadPeers returned an error: %v", err)
 	}
-	if len(Peers) != 3 {
-		t.Errorf("loadPeers returned unexpected number of peers: got %d want 3", len(Peers))
+	if len(g.Peers) != 3 {
+		t.Errorf("loadPeers returned unexpected number of peers: got %d want 3", len(g.Peers))
 	}
 }
 
 // test getSymbolTableHash
 func TestGetSymbolTableHash(t *testing.T) {
-	sys := setupTestEnv()
+	g, sys := setupTestEnv()
 
 	// create a test configuration file with symbol_table_hash set
 	expectedHash := "testhash"
 	line := []byte(fmt.Sprintf("symbol_table_hash=%s", expectedHash))
-	err := sys.util.WriteFile(filepath.Join(sys.baseDir, configFile), line, 0644)
+	err := sys.util.WriteFile(filepath.Join(g.baseDir, configFile), line, 0644)
 	if err != nil {
 		t.Fatalf("Failed to write test data to symbol_table_hash: %v", err)
 	}
 
-	hash, err := sys.getSymbolTableHash()
+	hash, err := g.getSymbolTableHash()
 	if err != nil {
 		t.Fatalf("getSymbolTableHash returned an error: %v", err)
 	}
@@ -133,7 +135,10 @@ func TestGetSubcommandHash(t *testing.T) {
 	// each entry is a line with the format: <subcommand> <hash>
 	symbolTable := "subcommand1 testhash1\nsubcommand2 testhash2\nsubcommand3 testhash3"
 
-	hash := getSubcommandHash(symbolTable, "subcommand2")
+	hash, err := getSubcommandHash(symbolTable, "subcommand2")
+	if err != nil {
+		t.Fatalf("getSubcommandHash returned an error: %v", err)
+	}
 	if hash != "testhash2" {
 		t.Errorf("getSubcommandHash returned unexpected hash: got %v want testhash1", hash)
 	}
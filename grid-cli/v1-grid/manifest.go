@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+)
+
+// Capabilities a module can declare in its manifest.
+const (
+	CapFsRead  = "fs:read"
+	CapFsWrite = "fs:write"
+	CapNet     = "net"
+	CapExec    = "exec"
+	CapEnv     = "env"
+)
+
+// defaultModuleCapabilities is the local policy used when the
+// configuration has no module_capabilities key.
+var defaultModuleCapabilities = []string{CapFsRead, CapFsWrite}
+
+// Manifest describes a module.  It is stored in the CAS like any
+// other object, and the symbol table refers to it by hash in an
+// optional third column:
+//
+//	<subcommand> <module hash> [<manifest hash>]
+//
+// so that a module's metadata can be read without running it.
+type Manifest struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version"`
+	Module       string          `json:"module"` // hex multihash
+	Author       string          `json:"author,omitempty"`
+	Promise      string          `json:"promise"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	Platforms    []string        `json:"platforms,omitempty"` // e.g. linux/amd64, wasip1/wasm, oci
+	Input        json.RawMessage `json:"input,omitempty"`     // JSON schema
+	Output       json.RawMessage `json:"output,omitempty"`    // JSON schema
+	Signature    string          `json:"signature,omitempty"`
+}
+
+func (m *Manifest) signingBytes() []byte {
+	unsigned := *m
+	unsigned.Signature = ""
+	buf, err := json.Marshal(&unsigned)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// Sign sets the manifest's author to key's public key and signs it.
+func (m *Manifest) Sign(key ed25519.PrivateKey) {
+	m.Author = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	m.Signature = hex.EncodeToString(ed25519.Sign(key, m.signingBytes()))
+}
+
+// Verify checks that the manifest describes module mStr and that its
+// author signed it and is trusted.  An unsigned manifest verifies only
+// if allowUnsigned is true, in which case the author of a signed one
+// need not be trusted either.
+func (m *Manifest) Verify(mStr string, allowUnsigned bool, trusted func(author string) bool) error {
+	if m.Module != mStr {
+		return fmt.Errorf("Manifest describes module %s, not %s", m.Module, mStr)
+	}
+	if m.Author == "" && m.Signature == "" && allowUnsigned {
+		return nil
+	}
+	pub, err := hex.DecodeString(m.Author)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid manifest author %q", m.Author)
+	}
+	sig, err := hex.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(pub, m.signingBytes(), sig) {
+		return fmt.Errorf("Manifest not signed by its author %s", m.Author)
+	}
+	if !allowUnsigned && (trusted == nil || !trusted(m.Author)) {
+		return fmt.Errorf("Manifest author %s not trusted", m.Author)
+	}
+	return nil
+}
+
+// localPlatforms returns the platforms this node can run.
+func localPlatforms() []string {
+	return []string{runtime.GOOS + "/" + runtime.GOARCH, "wasip1/wasm", "oci"}
+}
+
+// CheckPolicy returns an error if the module needs a capability that
+// is not in allowed, or lists platforms none of which this node
+// supports.
+func (m *Manifest) CheckPolicy(allowed []string) error {
+	ok := make(map[string]bool)
+	for _, c := range allowed {
+		ok[c] = true
+	}
+	var denied []string
+	for _, c := range m.Capabilities {
+		if !ok[c] {
+			denied = append(denied, c)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("Module %s needs capabilities not allowed by local policy: %s", m.Name, strings.Join(denied, ", "))
+	}
+	if len(m.Platforms) == 0 {
+		return nil
+	}
+	for _, want := range m.Platforms {
+		for _, have := range localPlatforms() {
+			if want == have {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Module %s does not support this platform (needs one of %s)", m.Name, strings.Join(m.Platforms, ", "))
+}
+
+// Kind returns the kind of module the manifest describes: that of the
+// first platform it lists that this node can run, or native if it
+// lists none.
+func (m *Manifest) Kind() ModuleKind {
+	native := runtime.GOOS + "/" + runtime.GOARCH
+	for _, p := range m.Platforms {
+		switch p {
+		case "wasip1/wasm":
+			return ModuleWasm
+		case "oci":
+			return ModuleOCI
+		case native:
+			return ModuleNative
+		}
+	}
+	return ModuleNative
+}
+
+// Render writes the manifest in human-readable form.
+func (m *Manifest) Render(w io.Writer) {
+	line := func(label, val string) {
+		if val != "" {
+			fmt.Fprintf(w, "%-14s %s\n", label+":", val)
+		}
+	}
+	line("name", m.Name)
+	line("version", m.Version)
+	line("module", m.Module)
+	line("author", m.Author)
+	line("promise", m.Promise)
+	line("capabilities", strings.Join(m.Capabilities, ", "))
+	line("platforms", strings.Join(m.Platforms, ", "))
+	line("input", string(m.Input))
+	line("output", string(m.Output))
+}
+
+// SymbolEntry is one line of a symbol table.
+type SymbolEntry struct {
+	Module   string
+	Manifest string
+}
+
+// lookupSymbol finds subcommand in a symbol table.
+func lookupSymbol(symbolTable, subcommand string) (entry SymbolEntry, err error) {
+	for _, line := range strings.Split(symbolTable, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != subcommand {
+			continue
+		}
+		entry.Module = fields[1]
+		if len(fields) > 2 {
+			entry.Manifest = fields[2]
+		}
+		return entry, nil
+	}
+	return entry, fmt.Errorf("Subcommand %s not found in symbol table.", subcommand)
+}
+
+// fetchManifest gets and verifies the manifest for a symbol table
+// entry.  It returns nil if the entry has no manifest, which is an
+// error while manifest signatures are required.
+func (g *Grid) fetchManifest(entry SymbolEntry) (m *Manifest, err error) {
+	if entry.Manifest == "" {
+		if g.manifestSignatureRequired() {
+			return nil, fmt.Errorf("Module %s has no signed manifest", entry.Module)
+		}
+		return nil, nil
+	}
+	buf, err := g.Get(entry.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch manifest %s: %v", entry.Manifest, err)
+	}
+	m = &Manifest{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %v", entry.Manifest, err)
+	}
+	trusted, err := g.trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	err = m.Verify(entry.Module, !g.manifestSignatureRequired(), trusted)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// manifestSignatureRequired returns false only if the configuration
+// sets manifest_signature_required=false.
+func (g *Grid) manifestSignatureRequired() bool {
+	val, err := g.getConfig("manifest_signature_required")
+	return err != nil || val != "false"
+}
+
+// allowedModuleCapabilities returns the local policy from the
+// module_capabilities configuration key, a comma-separated list.
+func (g *Grid) allowedModuleCapabilities() []string {
+	val, err := g.getConfig("module_capabilities")
+	if err != nil {
+		return defaultModuleCapabilities
+	}
+	var caps []string
+	for _, c := range strings.Split(val, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLookupSymbol(t *testing.T) {
+	symbolTable := "a 1220aa\nb 1220bb 1220cc\n\nc\n"
+	cases := []struct {
+		subcommand string
+		want       SymbolEntry
+		ok         bool
+	}{
+		{"a", SymbolEntry{Module: "1220aa"}, true},
+		{"b", SymbolEntry{Module: "1220bb", Manifest: "1220cc"}, true},
+		{"c", SymbolEntry{}, false},
+		{"d", SymbolEntry{}, false},
+	}
+	for _, c := range cases {
+		got, err := lookupSymbol(symbolTable, c.subcommand)
+		Tassert(t, (err == nil) == c.ok, "%s: unexpected error %v", c.subcommand, err)
+		Tassert(t, got == c.want, "%s: got %+v want %+v", c.subcommand, got, c.want)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	key, pub := newKey(t)
+	m := &Manifest{Name: "x", Module: "1220aa", Promise: "p"}
+	Tassert(t, m.Verify("1220aa", false, nil) != nil, "unsigned manifest should not verify")
+	Tassert(t, m.Verify("1220aa", true, nil) == nil, "unsigned manifest should verify when allowed")
+	Tassert(t, m.Verify("1220bb", true, nil) != nil, "manifest for another module should not verify")
+
+	m.Sign(key)
+	Tassert(t, m.Author == pub, "unexpected author %s", m.Author)
+	trusted := func(author string) bool { return author == pub }
+	Tassert(t, m.Verify("1220aa", false, trusted) == nil, "signed manifest should verify")
+	_, other := newKey(t)
+	untrusted := func(author string) bool { return author == other }
+	Tassert(t, m.Verify("1220aa", false, untrusted) != nil, "manifest by an untrusted author should not verify")
+	Tassert(t, m.Verify("1220aa", false, nil) != nil, "manifest should not verify with no trusted authors")
+
+	m.Capabilities = []string{CapNet}
+	Tassert(t, m.Verify("1220aa", true, nil) != nil, "tampered manifest should not verify")
+}
+
+func TestManifestCheckPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		m       Manifest
+		allowed []string
+		ok      bool
+	}{
+		{"nothing needed", Manifest{}, nil, true},
+		{"within policy", Manifest{Capabilities: []string{CapFsRead}}, []string{CapFsRead, CapFsWrite}, true},
+		{"exceeds policy", Manifest{Capabilities: []string{CapFsRead, CapNet}}, []string{CapFsRead}, false},
+		{"wasm platform", Manifest{Platforms: []string{"plan9/mips", "wasip1/wasm"}}, nil, true},
+		{"foreign platform", Manifest{Platforms: []string{"plan9/mips"}}, nil, false},
+	}
+	for _, c := range cases {
+		err := c.m.CheckPolicy(c.allowed)
+		Tassert(t, (err == nil) == c.ok, "%s: CheckPolicy returned %v", c.name, err)
+	}
+}
+
+func TestManifestRender(t *testing.T) {
+	m := &Manifest{
+		Name:         "hello",
+		Version:      "1.0.0",
+		Promise:      "I promise to say hello.",
+		Capabilities: []string{CapFsRead, CapNet},
+		Input:        []byte(`{"type":"string"}`),
+	}
+	buf := &bytes.Buffer{}
+	m.Render(buf)
+	want := "name:          hello\n" +
+		"version:       1.0.0\n" +
+		"promise:       I promise to say hello.\n" +
+		"capabilities:  fs:read, net\n" +
+		"input:         {\"type\":\"string\"}\n"
+	Tassert(t, buf.String() == want, "unexpected rendering:\n%s", buf.String())
+}
+
+func TestExecEnforcesManifestPolicy(t *testing.T) {
+	greedy := testModule{
+		name:     "greedy",
+		code:     []byte("greedy module"),
+		manifest: &Manifest{Name: "greedy", Capabilities: []string{CapNet, CapExec}},
+		sign:     true,
+	}
+	alien := testModule{
+		name:     "alien",
+		code:     []byte("alien module"),
+		manifest: &Manifest{Name: "alien", Platforms: []string{"plan9/mips"}},
+		sign:     true,
+	}
+	forged := testModule{
+		name:     "forged",
+		code:     []byte("forged module"),
+		manifest: &Manifest{Name: "forged", Author: strings.Repeat("00", 32)},
+	}
+	unsigned := testModule{
+		name:     "unsigned",
+		code:     []byte("unsigned module"),
+		manifest: &Manifest{Name: "unsigned"},
+	}
+	legacy := testModule{name: "legacy", code: []byte("legacy module")}
+	wasm := testModule{
+		name:     "wasm",
+		code:     []byte("wasm module"),
+		manifest: &Manifest{Name: "wasm", Platforms: []string{"wasip1/wasm"}},
+		sign:     true,
+	}
+	strangerKey, _ := newKey(t)
+	stranger := testModule{
+		name:     "stranger",
+		code:     []byte("stranger module"),
+		manifest: &Manifest{Name: "stranger"},
+		sign:     true,
+		signer:   strangerKey,
+	}
+	client, ck, _ := setupPeerPairWith(t, helloModule, greedy, alien, forged, unsigned, legacy, wasm, stranger)
+
+	for _, name := range []string{"greedy", "alien", "forged", "unsigned", "legacy", "stranger"} {
+		err := client.Exec(name, nil)
+		Tassert(t, err != nil, "expected %s to be refused", name)
+	}
+	// refused modules are never fetched or run
+	Tassert(t, len(ck.callsTo("Exec", client.path(cacheDir)+"/")) == 0, "a module was executed: %v", ck.Calls)
+
+	// the manifest, not the content, decides how a module runs
+	err := client.Exec("wasm", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+	execs := ck.callsTo("Exec", client.path(cacheDir)+"/")
+	kind := ck.Calls[execs[len(execs)-1]].Args[3].(ModuleKind)
+	Tassert(t, kind == ModuleWasm, "expected the wasm module to run as %s, got %s", ModuleWasm, kind)
+
+	// widening local policy lets greedy run
+	config, err := ck.ReadFile(client.path(configFile))
+	Tassert(t, err == nil, "Failed to read config: %v", err)
+	config = append(config, []byte("module_capabilities=fs:read,net,exec\n")...)
+	err = ck.WriteFile(client.path(configFile), config, 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	err = client.Exec("greedy", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+
+	// the declared capabilities reach the executor
+	execs = ck.callsTo("Exec", client.path(cacheDir)+"/")
+	quota := ck.Calls[execs[len(execs)-1]].Args[2].(Quota)
+	Tassert(t, reflect.DeepEqual(quota.Capabilities, []string{CapNet, CapExec}), "unexpected capabilities %v", quota.Capabilities)
+
+	// and local policy may accept unsigned manifests
+	config = append(config, []byte("manifest_signature_required=false\n")...)
+	err = ck.WriteFile(client.path(configFile), config, 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	err = client.Exec("unsigned", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+
+	// and modules without one, which declare no capabilities
+	err = client.Exec("legacy", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+	Tassert(t, strings.Contains(ck.stdout.String(), "legacy"), "unexpected stdout %q", ck.stdout.String())
+	execs = ck.callsTo("Exec", client.path(cacheDir)+"/")
+	quota = ck.Calls[execs[len(execs)-1]].Args[2].(Quota)
+	Tassert(t, quota.Capabilities != nil && len(quota.Capabilities) == 0, "expected no capabilities, got %v", quota.Capabilities)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota limits what one run of a module may consume.  Zero fields
+// are unlimited.
+type Quota struct {
+	CPUTime  time.Duration
+	WallTime time.Duration
+	Memory   int64 // bytes
+	Output   int64 // bytes written to stdout and stderr together
+	// Paths are the host directories the module may access.  Nil
+	// means the executor's default.
+	Paths []string
+	// Capabilities are those the module declared in its manifest,
+	// none if it has no manifest.
+	// The container executor withholds what a module did not declare:
+	// directories without fs:read or fs:write, write access without
+	// fs:write, and the network without net.  The native executor
+	// only withholds the host environment without env; it cannot
+	// confine a native module's paths or network.  Nil lets the
+	// module use every capability, and only the other fields limit
+	// it.
+	Capabilities []string
+}
+
+// allows returns true if the quota lets the module use capability c.
+func (q Quota) allows(c string) bool {
+	if q.Capabilities == nil {
+		return true
+	}
+	for _, have := range q.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaError reports a module that exceeded its quota.  A module that
+// exceeds its quota has broken its promise to handle the call.
+type QuotaError struct {
+	Module   string
+	Resource string // "cpu", "wall", "memory" or "output"
+	Limit    string
+}
+
+func (e *QuotaError) Error() string {
+	module := e.Module
+	if module == "" {
+		module = "module"
+	}
+	return fmt.Sprintf("Broken promise: %s exceeded its %s quota of %s", module, e.Resource, e.Limit)
+}
+
+// quotaKeys are the configuration keys, after "quota.<module>.", of
+// each quota field.
+var quotaKeys = []string{"cpu", "wall", "memory", "output", "paths"}
+
+// moduleQuota returns the quota for the module with the given hash.
+// Each field comes from the configuration key
+// quota.<hash>.<resource>, falling back to quota.default.<resource>.
+// Durations use time.ParseDuration syntax, sizes take an optional K,
+// M or G suffix, and paths are comma-separated.
+func (g *Grid) moduleQuota(hash string) (q Quota, err error) {
+	for _, key := range quotaKeys {
+		val, cerr := g.getConfig("quota." + hash + "." + key)
+		if cerr != nil {
+			val, cerr = g.getConfig("quota.default." + key)
+		}
+		if cerr != nil {
+			continue
+		}
+		err = q.set(key, strings.TrimSpace(val))
+		if err != nil {
+			return Quota{}, fmt.Errorf("Invalid quota.%s: %v", key, err)
+		}
+	}
+	return
+}
+
+// set parses one configured quota field.
+func (q *Quota) set(key, val string) (err error) {
+	switch key {
+	case "cpu":
+		q.CPUTime, err = time.ParseDuration(val)
+	case "wall":
+		q.WallTime, err = time.ParseDuration(val)
+	case "memory":
+		q.Memory, err = parseSize(val)
+	case "output":
+		q.Output, err = parseSize(val)
+	case "paths":
+		q.Paths = []string{}
+		for _, p := range strings.Split(val, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				q.Paths = append(q.Paths, p)
+			}
+		}
+	}
+	return
+}
+
+// parseSize parses a byte count such as "512", "64K", "16M" or "1G".
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// deadline returns a context that ends when the quota's wall time
+// runs out.
+func (q Quota) deadline() (context.Context, context.CancelFunc) {
+	if q.WallTime > 0 {
+		return context.WithTimeout(context.Background(), q.WallTime)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// errOutputQuota is returned by a limitWriter that is full.
+var errOutputQuota = errors.New("output quota exceeded")
+
+// limitWriter enforces an output quota shared by several writers,
+// calling stop when the quota is exceeded.
+type limitWriter struct {
+	mu       sync.Mutex
+	left     int64
+	exceeded bool
+	stop     func()
+}
+
+// newLimitWriter returns a limiter for quota q, or nil if q has no
+// output limit.
+func newLimitWriter(q Quota, stop func()) *limitWriter {
+	if q.Output <= 0 {
+		return nil
+	}
+	return &limitWriter{left: q.Output, stop: stop}
+}
+
+// wrap returns a writer that passes at most the remaining quota to w.
+func (l *limitWriter) wrap(w io.Writer) io.Writer {
+	if l == nil || w == nil {
+		return w
+	}
+	return writerFunc(func(p []byte) (int, error) {
+		l.mu.Lock()
+		if int64(len(p)) > l.left {
+			n := l.left
+			l.left = 0
+			l.exceeded = true
+			l.mu.Unlock()
+			w.Write(p[:n])
+			l.stop()
+			return int(n), errOutputQuota
+		}
+		l.left -= int64(len(p))
+		l.mu.Unlock()
+		return w.Write(p)
+	})
+}
+
+// Exceeded returns true if anything was written past the quota.
+func (l *limitWriter) Exceeded() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// quotaErr classifies the failure of a run under quota q.  It returns
+// a *QuotaError if the run ended because a limit was hit, and err
+// otherwise.
+func quotaErr(q Quota, err error, ctx context.Context, out *limitWriter) error {
+	switch {
+	case out.Exceeded():
+		return &QuotaError{Resource: "output", Limit: fmt.Sprintf("%d bytes", q.Output)}
+	case q.WallTime > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &QuotaError{Resource: "wall", Limit: q.WallTime.String()}
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// killGroup runs cmd in its own process group, and makes cancelling
+// it kill the whole group, so that a module's children die with it.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// rlimitExec is the first argument with which the grid runs itself
+// to start a module under rlimits: the grid process sets the limits
+// on itself and then execs the module, so that they are in place
+// before the module's first instruction.
+const rlimitExec = "__grid-rlimit-exec"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == rlimitExec {
+		err := execLimited(os.Args[2:])
+		fmt.Fprintf(os.Stderr, "grid: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// execLimited sets the CPU and memory rlimits given in args and then
+// execs the module that follows them.  It returns only on failure.
+func execLimited(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: %s {cpu-seconds} {memory-bytes} {path} [args...]", rlimitExec)
+	}
+	secs, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	mem, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	if secs > 0 {
+		err = unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: secs, Max: secs + 1})
+		if err != nil {
+			return fmt.Errorf("Failed to limit CPU time: %v", err)
+		}
+	}
+	if mem > 0 {
+		err = unix.Setrlimit(unix.RLIMIT_DATA, &unix.Rlimit{Cur: mem, Max: mem})
+		if err != nil {
+			return fmt.Errorf("Failed to limit memory: %v", err)
+		}
+	}
+	return unix.Exec(args[2], args[2:], os.Environ())
+}
+
+// limitCommand arranges for cmd, not yet started, to run under q's
+// CPU and memory limits: rlimits always, set between fork and exec
+// by running the module through the grid executable, and a cgroup v2
+// memory limit where the kernel lets us create cgroups.  The returned
+// function reports whether the exited process was killed for
+// exceeding one of the limits, and releases the cgroup.
+func limitCommand(cmd *exec.Cmd, q Quota) (check func(state *os.ProcessState) *QuotaError, err error) {
+	if cmd.Err != nil {
+		return nil, cmd.Err
+	}
+	var secs uint64
+	if q.CPUTime > 0 {
+		secs = uint64((q.CPUTime + time.Second - 1) / time.Second)
+	}
+	var mem uint64
+	if q.Memory > 0 {
+		mem = uint64(q.Memory)
+	}
+	var cgroup *os.File
+	if secs > 0 || mem > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot apply quota: %v", err)
+		}
+		args := append([]string{self, rlimitExec, strconv.FormatUint(secs, 10), strconv.FormatUint(mem, 10), cmd.Path}, cmd.Args[1:]...)
+		cmd.Path, cmd.Args = self, args
+	}
+	if mem > 0 {
+		cgroup = memoryCgroup(q.Memory)
+	}
+	if cgroup != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	return func(state *os.ProcessState) *QuotaError {
+		if cgroup != nil {
+			defer os.Remove(cgroup.Name())
+			defer cgroup.Close()
+		}
+		if state == nil {
+			return nil
+		}
+		ws, _ := state.Sys().(syscall.WaitStatus)
+		if !ws.Signaled() {
+			return nil
+		}
+		// the soft limit sends SIGXCPU, and the hard limit a second
+		// later SIGKILL, which is otherwise how a cancelled module dies
+		if secs > 0 && (ws.Signal() == syscall.SIGXCPU ||
+			ws.Signal() == syscall.SIGKILL && state.UserTime()+state.SystemTime() >= q.CPUTime) {
+			return &QuotaError{Resource: "cpu", Limit: q.CPUTime.String()}
+		}
+		if cgroup != nil && ws.Signal() == syscall.SIGKILL && oomKilled(cgroup.Name()) {
+			return &QuotaError{Resource: "memory", Limit: fmt.Sprintf("%d bytes", q.Memory)}
+		}
+		return nil
+	}, nil
+}
+
+// memoryCgroup creates a cgroup limited to max bytes of memory and
+// returns it open, for a process to be started in, or nil if cgroups
+// are not available.
+func memoryCgroup(max int64) *os.File {
+	dir, err := os.MkdirTemp(cgroupRoot, "grid-")
+	if err != nil {
+		return nil
+	}
+	err = os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(max, 10)), 0644)
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(dir)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return nil
+	}
+	return f
+}
+
+// oomKilled returns true if the kernel killed a process in cgroup for
+// running out of memory.
+func oomKilled(cgroup string) bool {
+	data, err := os.ReadFile(filepath.Join(cgroup, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
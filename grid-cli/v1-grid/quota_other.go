@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// killGroup does nothing on this platform: cancelling cmd kills only
+// the module's own process.
+func killGroup(cmd *exec.Cmd) {}
+
+// limitCommand cannot limit a process's CPU time or memory on this
+// platform; only the wall time and output quotas apply.
+func limitCommand(cmd *exec.Cmd, q Quota) (check func(state *os.ProcessState) *QuotaError, err error) {
+	return func(state *os.ProcessState) *QuotaError { return nil }, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+	. "github.com/stevegt/goadapt"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"0": 0, "512": 512, "64K": 64 << 10, "16M": 16 << 20, "2G": 2 << 30}
+	for in, want := range cases {
+		got, err := parseSize(in)
+		Tassert(t, err == nil && got == want, "parseSize(%q) = %d, %v, want %d", in, got, err, want)
+	}
+	for _, in := range []string{"", "M", "-1", "1T"} {
+		_, err := parseSize(in)
+		Tassert(t, err != nil, "expected an error parsing %q", in)
+	}
+}
+
+func TestModuleQuota(t *testing.T) {
+	g, sys := setupTestEnv()
+	config := strings.Join([]string{
+		"quota.default.wall=30s",
+		"quota.default.output=1M",
+		"quota.abc.wall=5s",
+		"quota.abc.cpu=2s",
+		"quota.abc.memory=64M",
+		"quota.abc.paths=/tmp, /data",
+	}, "\n")
+	err := sys.util.WriteFile(g.path(configFile), []byte(config), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+
+	q, err := g.moduleQuota("abc")
+	Tassert(t, err == nil, "moduleQuota returned an error: %v", err)
+	want := Quota{CPUTime: 2 * time.Second, WallTime: 5 * time.Second, Memory: 64 << 20, Output: 1 << 20, Paths: []string{"/tmp", "/data"}}
+	Tassert(t, reflect.DeepEqual(q, want), "moduleQuota(abc) = %+v, want %+v", q, want)
+
+	q, err = g.moduleQuota("other")
+	Tassert(t, err == nil, "moduleQuota returned an error: %v", err)
+	want = Quota{WallTime: 30 * time.Second, Output: 1 << 20}
+	Tassert(t, reflect.DeepEqual(q, want), "moduleQuota(other) = %+v, want %+v", q, want)
+
+	err = sys.util.WriteFile(g.path(configFile), []byte("quota.default.wall=soon\n"), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	_, err = g.moduleQuota("abc")
+	Tassert(t, err != nil, "expected an error for an invalid quota")
+}
+
+// runNative runs a shell script as a native module under quota.
+func runNative(t *testing.T, script string, quota Quota) (stdout string, err error) {
+	path := t.TempDir() + "/module"
+	err = os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	Tassert(t, err == nil, "Failed to write module: %v", err)
+	buf := &bytes.Buffer{}
+	err = (&NativeExecutor{}).Exec(path, nil, quota, strings.NewReader(""), buf, io.Discard)
+	return buf.String(), err
+}
+
+func TestNativeExecutorQuota(t *testing.T) {
+	var qerr *QuotaError
+
+	out, err := runNative(t, "echo ok", Quota{WallTime: 5 * time.Second, Output: 10})
+	Tassert(t, err == nil && out == "ok\n", "unexpected result %q: %v", out, err)
+
+	start := time.Now()
+	_, err = runNative(t, "sleep 10", Quota{WallTime: 100 * time.Millisecond})
+	Tassert(t, errors.As(err, &qerr) && qerr.Resource == "wall", "expected a wall time QuotaError, got %v", err)
+	Tassert(t, time.Since(start) < 5*time.Second, "module was not stopped at its deadline")
+	Tassert(t, strings.HasPrefix(err.Error(), "Broken promise"), "unexpected error text %q", err)
+
+	out, err = runNative(t, "while :; do echo 0123456789; done", Quota{Output: 100})
+	Tassert(t, errors.As(err, &qerr) && qerr.Resource == "output", "expected an output QuotaError, got %v", err)
+	Tassert(t, len(out) == 100, "expected output to be cut at the quota, got %d bytes", len(out))
+
+	if !testing.Short() {
+		_, err = runNative(t, "while :; do :; done", Quota{CPUTime: time.Second, WallTime: 20 * time.Second})
+		Tassert(t, errors.As(err, &qerr) && qerr.Resource == "cpu", "expected a CPU QuotaError, got %v", err)
+	}
+
+	// the host environment is withheld from a module that did not
+	// declare env
+	out, err = runNative(t, "echo \"$HOME\"", Quota{Capabilities: []string{}})
+	Tassert(t, err == nil && out == "\n", "unexpected result %q: %v", out, err)
+
+	// a successful run is not a CPU violation, however long it ran
+	out, err = runNative(t, "echo ok", Quota{CPUTime: time.Nanosecond})
+	Tassert(t, err == nil && out == "ok\n", "unexpected result %q: %v", out, err)
+
+	out, err = runNative(t, "echo ok", Quota{Paths: []string{"/tmp"}})
+	Tassert(t, err == nil && out == "ok\n", "expected native modules to ignore paths, got %q: %v", out, err)
+}
+
+func TestWasmExecutorQuota(t *testing.T) {
+	code := buildWasiEcho(t)
+	fs := afero.NewMemMapFs()
+	err := afero.WriteFile(fs, "/echo", code, 0644)
+	Tassert(t, err == nil, "Failed to write module: %v", err)
+	hidden := t.TempDir()
+	err = os.WriteFile(hidden+"/hidden.txt", nil, 0644)
+	Tassert(t, err == nil, "Failed to write mount contents: %v", err)
+	e := NewWasmExecutor(fs, WasmMount{HostDir: hidden, GuestDir: "/"})
+
+	// the quota's paths replace the executor's mounts
+	stdout := &bytes.Buffer{}
+	e.Exec("/echo", []string{"a"}, Quota{Paths: []string{t.TempDir()}}, strings.NewReader(""), stdout, io.Discard)
+	Tassert(t, strings.HasPrefix(stdout.String(), "a\n"), "unexpected output %q", stdout.String())
+	Tassert(t, !strings.Contains(stdout.String(), "hidden.txt"), "module saw a directory outside its quota")
+
+	var qerr *QuotaError
+	stdout.Reset()
+	err = e.Exec("/echo", []string{"too", "much", "output"}, Quota{Output: 4}, strings.NewReader(""), stdout, io.Discard)
+	Tassert(t, errors.As(err, &qerr) && qerr.Resource == "output", "expected an output QuotaError, got %v", err)
+	Tassert(t, stdout.String() == "too ", "unexpected output %q", stdout.String())
+}
+
+func TestContainerQuotaArgs(t *testing.T) {
+	args := containerQuotaArgs(Quota{CPUTime: 1500 * time.Millisecond, Memory: 1 << 20, Paths: []string{"/data"}})
+	want := []string{"--ulimit=cpu=2", "--memory=1048576", "--volume=/data:/data"}
+	Tassert(t, reflect.DeepEqual(args, want), "containerQuotaArgs = %v, want %v", args, want)
+
+	// a module gets only what its manifest declares
+	args = containerQuotaArgs(Quota{Paths: []string{"/data"}, Capabilities: []string{CapFsRead}})
+	want = []string{"--network=none", "--volume=/data:/data:ro"}
+	Tassert(t, reflect.DeepEqual(args, want), "containerQuotaArgs = %v, want %v", args, want)
+	args = containerQuotaArgs(Quota{Paths: []string{"/data"}, Capabilities: []string{}})
+	want = []string{"--network=none"}
+	Tassert(t, reflect.DeepEqual(args, want), "containerQuotaArgs = %v, want %v", args, want)
+}
+
+// TestContainerRuntimeDeadline checks that a container that outlives
+// its wall time quota is killed by name, not just its command line
+// tool.
+func TestContainerRuntimeDeadline(t *testing.T) {
+	dir := t.TempDir()
+	cli := filepath.Join(dir, "docker")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = kill ]; then echo "$2" > %[1]s/killed; exit 0; fi
+for a; do case $a in --name=*) echo "${a#--name=}" > %[1]s/name;; esac; done
+exec sleep 10
+`, dir)
+	err := os.WriteFile(cli, []byte(script), 0755)
+	Tassert(t, err == nil, "Failed to write fake runtime: %v", err)
+
+	rt := &CLIContainerRuntime{Command: cli}
+	start := time.Now()
+	err = rt.Run("example.com/hang", nil, Quota{WallTime: 200 * time.Millisecond}, strings.NewReader(""), io.Discard, io.Discard)
+	var qerr *QuotaError
+	Tassert(t, errors.As(err, &qerr) && qerr.Resource == "wall", "expected a wall QuotaError, got %v", err)
+	Tassert(t, time.Since(start) < 5*time.Second, "Run waited for the container to exit")
+	name, err := os.ReadFile(filepath.Join(dir, "name"))
+	Tassert(t, err == nil && len(name) > 0, "container was not started with a name: %v", err)
+	killed, err := os.ReadFile(filepath.Join(dir, "killed"))
+	Tassert(t, err == nil && string(killed) == string(name), "expected container %q to be killed, got %q: %v", name, killed, err)
+}
+
+func TestExecQuota(t *testing.T) {
+	greedy := testModule{name: "greedy", code: []byte("greedy module")}
+	client, ck, _ := setupPeerPairWith(t, greedy)
+	hash, err := GenerateHash(multihash.SHA2_256, greedy.code)
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	mStr := fmt.Sprintf("%x", hash)
+
+	config, err := ck.ReadFile(client.path(configFile))
+	Tassert(t, err == nil, "Failed to read config: %v", err)
+	config = append(config, []byte("quota."+mStr+".wall=2s\nmanifest_signature_required=false\n")...)
+	err = ck.WriteFile(client.path(configFile), config, 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	ck.AddProgram(greedy.code, func(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+		return &QuotaError{Resource: "wall", Limit: "2s"}
+	})
+
+	err = client.Exec("greedy", nil)
+	var qerr *QuotaError
+	Tassert(t, errors.As(err, &qerr), "expected a QuotaError, got %v", err)
+	Tassert(t, qerr.Module == mStr, "expected the error to name the module hash, got %q", qerr.Module)
+
+	execs := ck.callsTo("Exec", client.path(cacheDir)+"/")
+	Tassert(t, len(execs) == 1, "expected one Exec call, got %v", ck.Calls)
+	quota := ck.Calls[execs[0]].Args[2].(Quota)
+	Tassert(t, quota.WallTime == 2*time.Second, "expected the configured quota to be passed to Exec, got %+v", quota)
+	kind := ck.Calls[execs[0]].Args[3].(ModuleKind)
+	Tassert(t, kind == ModuleNative, "expected a module without a manifest to run natively, got %s", kind)
+}
@@ -3,61 +3,60 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"net/http"
 
 	"github.com/gorilla/websocket"
-	. "github.com/stevegt/goadapt"
 )
 
-func (sys *KernelNative) startWebSocketServer() {
-	http.HandleFunc("/ws", sys.handleWebSocket)
-	fmt.Println("Starting WebSocket server on :8080")
-	http.ListenAndServe(":8080", nil)
+func (g *Grid) startWebSocketServer() error {
+	g.log.Info(EventServerStart, "addr", ":8080")
+	return g.k.Listen(":8080", g.handleWebSocket)
 }
 
-func (sys *KernelNative) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		fmt.Println("Failed to upgrade to websocket:", err)
-		return
-	}
-	defer conn.Close()
+// refuse tells the peer why a query was not served.  Data is always
+// sent as a binary message, so a text message is a refusal.
+func refuse(conn Conn, reason error) error {
+	reply, _ := json.Marshal(map[string]string{"error": reason.Error()})
+	return conn.WriteMessage(websocket.TextMessage, reply)
+}
 
+func (g *Grid) handleWebSocket(conn Conn) {
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Println("Failed to read message:", err)
+			g.log.Error(EventError, "op", "read", "err", err)
 			break
 		}
 
 		var query map[string]string
 		if err := json.Unmarshal(message, &query); err != nil {
-			fmt.Println("Failed to unmarshal query:", err)
+			g.log.Error(EventError, "op", "unmarshal", "err", err)
 			continue
 		}
 
-		mStr := query["hash"]
+		mStr, span := query["hash"], query["span"]
+		g.log.Debug(EventRequest, "span", span, "hash", mStr)
 		// convert multihash hex string to byte slice
 		mBuf, err := hex.DecodeString(mStr)
-		Ck(err)
-
-		// promise := query["promise"]
-
-		// Check if the requested hash is for a module or handler
-		data, err := sys.fetchLocalData(mBuf)
 		if err != nil {
-			fmt.Println("Failed to read data:", err)
-			continue
+			g.log.Warn(EventReject, "span", span, "hash", mStr, "reason", err)
+			err = refuse(conn, err)
+		} else if err = g.authorize(mStr, query); err != nil {
+			g.log.Warn(EventReject, "span", span, "hash", mStr, "reason", err)
+			err = refuse(conn, err)
+		} else {
+			// Check if the requested hash is for a module or handler
+			var data []byte
+			data, err = g.fetchLocalData(mBuf)
+			if err != nil {
+				g.log.Warn(EventReject, "span", span, "hash", mStr, "reason", err)
+				err = refuse(conn, err)
+			} else {
+				g.log.Debug(EventAccept, "span", span, "hash", mStr)
+				err = conn.WriteMessage(websocket.BinaryMessage, data)
+			}
 		}
-
-		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			fmt.Println("Failed to write message:", err)
+		if err != nil {
+			g.log.Error(EventError, "span", span, "op", "write", "err", err)
 			break
 		}
 	}
@@ -0,0 +1,24 @@
+// wasi-echo is a tiny WASI module used by the executor tests.  It
+// prints its arguments, copies stdin to stdout, and lists the root
+// directory it was given.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	fmt.Println(strings.Join(os.Args[1:], " "))
+	io.Copy(os.Stdout, os.Stdin)
+	entries, err := os.ReadDir("/")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+	for _, e := range entries {
+		fmt.Println(e.Name())
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The wallet holds this node's signing key and the capabilities it
+// has been granted.  The trust and revocation lists hold the issuer
+// keys and capability IDs this node honors or refuses when serving.
+const (
+	walletDir    = ".grid/wallet"
+	walletKey    = ".grid/wallet/key"
+	walletTokens = ".grid/wallet/tokens"
+	trustedList  = ".grid/trusted"
+	revokedList  = ".grid/revoked"
+)
+
+// nodeKey returns this node's ed25519 key, creating it on first use.
+func (g *Grid) nodeKey() (key ed25519.PrivateKey, err error) {
+	g.walletMu.Lock()
+	defer g.walletMu.Unlock()
+	buf, err := g.k.ReadFile(g.path(walletKey))
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("Invalid key in %s", walletKey)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = g.k.MkdirAll(g.path(walletDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = g.k.WriteFile(g.path(walletKey), []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+	return
+}
+
+// PublicKey returns the hex public key of this node.
+func (g *Grid) PublicKey() (string, error) {
+	key, err := g.nodeKey()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// walletCapabilities returns the capabilities held in the wallet.
+func (g *Grid) walletCapabilities() (caps []*Capability, err error) {
+	buf, err := g.k.ReadFile(g.path(walletTokens))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &caps)
+	return
+}
+
+// AddCapability stores a capability granted to this node in the
+// wallet.
+func (g *Grid) AddCapability(c *Capability) error {
+	pub, err := g.PublicKey()
+	if err != nil {
+		return err
+	}
+	if c.Subject != pub {
+		return fmt.Errorf("Capability was issued to %s, not to this node", c.Subject)
+	}
+	g.walletMu.Lock()
+	defer g.walletMu.Unlock()
+	caps, err := g.walletCapabilities()
+	if err != nil {
+		return err
+	}
+	caps = append(caps, c)
+	buf, err := json.MarshalIndent(caps, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = g.k.MkdirAll(g.path(walletDir), 0700)
+	if err != nil {
+		return err
+	}
+	return g.k.WriteFile(g.path(walletTokens), buf, 0600)
+}
+
+// findCapability returns an unexpired capability from the wallet that
+// covers mStr, preferring the one with the narrowest scope, or nil if
+// there is none.
+func (g *Grid) findCapability(mStr string) (best *Capability, err error) {
+	g.walletMu.Lock()
+	caps, err := g.walletCapabilities()
+	g.walletMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	now := g.now().Unix()
+	for _, c := range caps {
+		if !c.Covers(mStr) || now > c.Expires {
+			continue
+		}
+		if best == nil || len(c.Scope) > len(best.Scope) {
+			best = c
+		}
+	}
+	return
+}
+
+// IssueCapability grants subject access to objects under scope for
+// ttl, in return for promise.  If parentID is not empty, the new
+// capability is delegated from the wallet capability with that ID.
+func (g *Grid) IssueCapability(subject, scope, promise string, ttl time.Duration, parentID string) (c *Capability, err error) {
+	key, err := g.nodeKey()
+	if err != nil {
+		return nil, err
+	}
+	var parent *Capability
+	if parentID != "" {
+		caps, err := g.walletCapabilities()
+		if err != nil {
+			return nil, err
+		}
+		for _, pc := range caps {
+			if pc.ID() == parentID {
+				parent = pc
+			}
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("Capability %s not in wallet", parentID)
+		}
+	}
+	return IssueCapability(key, subject, scope, promise, g.now().Add(ttl), parent)
+}
+
+// readList returns the non-empty lines of a list file.
+func (g *Grid) readList(rel string) (items map[string]bool, err error) {
+	items = make(map[string]bool)
+	buf, err := g.k.ReadFile(g.path(rel))
+	if os.IsNotExist(err) {
+		return items, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			items[line] = true
+		}
+	}
+	return
+}
+
+// appendList adds item to a list file.
+func (g *Grid) appendList(rel, item string) error {
+	g.walletMu.Lock()
+	defer g.walletMu.Unlock()
+	items, err := g.readList(rel)
+	if err != nil {
+		return err
+	}
+	if items[item] {
+		return nil
+	}
+	buf, _ := g.k.ReadFile(g.path(rel))
+	buf = append(buf, []byte(item+"\n")...)
+	return g.k.WriteFile(g.path(rel), buf, 0644)
+}
+
+// Trust makes this node honor capabilities issued by, and module
+// manifests signed by, the key issuer.
+func (g *Grid) Trust(issuer string) error {
+	pub, err := hex.DecodeString(issuer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid public key %q", issuer)
+	}
+	return g.appendList(trustedList, issuer)
+}
+
+// Revoke makes this node refuse the capability with the given ID and
+// every capability delegated from it.
+func (g *Grid) Revoke(id string) error {
+	return g.appendList(revokedList, id)
+}
+
+// trustedKeys returns a function reporting whether this node trusts
+// a key: its own, or one added with Trust.
+func (g *Grid) trustedKeys() (trusted func(key string) bool, err error) {
+	self, err := g.PublicKey()
+	if err != nil {
+		return
+	}
+	g.walletMu.Lock()
+	defer g.walletMu.Unlock()
+	list, err := g.readList(trustedList)
+	if err != nil {
+		return
+	}
+	return func(key string) bool { return key == self || list[key] }, nil
+}
+
+// capabilityPolicy returns the policy this node applies to incoming
+// requests.  A node always trusts capabilities it issued itself.
+func (g *Grid) capabilityPolicy() (policy CapabilityPolicy, err error) {
+	trusted, err := g.trustedKeys()
+	if err != nil {
+		return
+	}
+	g.walletMu.Lock()
+	defer g.walletMu.Unlock()
+	revoked, err := g.readList(revokedList)
+	if err != nil {
+		return
+	}
+	policy = CapabilityPolicy{
+		Now:     g.now(),
+		Trusted: trusted,
+		Revoked: func(id string) bool { return revoked[id] },
+	}
+	return
+}
+
+// capabilityRequired returns false only if the configuration sets
+// capability_required=false.
+func (g *Grid) capabilityRequired() bool {
+	val, err := g.getConfig("capability_required")
+	return err != nil || val != "false"
+}
+
+// authorize checks the capability attached to a query for mStr.
+func (g *Grid) authorize(mStr string, query map[string]string) error {
+	if !g.capabilityRequired() {
+		return nil
+	}
+	capJSON, ok := query["capability"]
+	if !ok {
+		return fmt.Errorf("No capability presented for %s", mStr)
+	}
+	c := &Capability{}
+	err := json.Unmarshal([]byte(capJSON), c)
+	if err != nil {
+		return fmt.Errorf("Invalid capability: %v", err)
+	}
+	policy, err := g.capabilityPolicy()
+	if err != nil {
+		return err
+	}
+	err = c.Verify(mStr, policy)
+	if err != nil {
+		return err
+	}
+	at, err := strconv.ParseInt(query["time"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid request time %q", query["time"])
+	}
+	err = verifyRequest(c, mStr, at, query["nonce"], query["sig"])
+	if err != nil {
+		return err
+	}
+	return g.checkFresh(at, query["nonce"])
+}
+
+// checkFresh refuses a request made outside the request window of
+// this node's clock, or whose nonce was already used.
+func (g *Grid) checkFresh(at int64, nonce string) error {
+	now := g.now()
+	skew := now.Sub(time.Unix(at, 0))
+	if skew > requestWindow || skew < -requestWindow {
+		return fmt.Errorf("Request time %d is outside the request window", at)
+	}
+	if nonce == "" {
+		return fmt.Errorf("Request has no nonce")
+	}
+	g.nonceMu.Lock()
+	defer g.nonceMu.Unlock()
+	for n, seen := range g.nonces {
+		if now.Sub(seen) > 2*requestWindow {
+			delete(g.nonces, n)
+		}
+	}
+	if _, ok := g.nonces[nonce]; ok {
+		return fmt.Errorf("Request nonce %s was already used", nonce)
+	}
+	g.nonces[nonce] = now
+	return nil
+}
@@ -1,21 +1,169 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	. "github.com/stevegt/goadapt"
 )
 
+// testModule is a module published by the server in a peer pair.
+type testModule struct {
+	name     string
+	code     []byte
+	manifest *Manifest          // nil for none; Module is filled in
+	sign     bool               // sign the manifest with the server's key
+	signer   ed25519.PrivateKey // signs instead of the server, if set
+}
+
+// helloModule is the module every peer pair publishes.
+var helloModule = testModule{
+	name: "hello",
+	code: []byte("hello module"),
+	manifest: &Manifest{
+		Name:         "hello",
+		Version:      "1.0.0",
+		Promise:      "I promise to say hello.",
+		Capabilities: []string{CapFsRead},
+	},
+	sign: true,
+}
+
+// setupPeerPair creates a server node holding a symbol table and the
+// module for subcommand "hello", and a client node configured to use
+// that symbol table and to fetch from the server.
+func setupPeerPair(t *testing.T) (client *Grid, ck *KernelMem, sk *KernelMem) {
+	return setupPeerPairWith(t, helloModule)
+}
+
+// setupPeerPairWith is setupPeerPair with a symbol table holding the
+// given modules.
+func setupPeerPairWith(t *testing.T, modules ...testModule) (client *Grid, ck *KernelMem, sk *KernelMem) {
+	net := NewMemNet()
+
+	// server
+	sk = NewKernelMem(net)
+	server, err := NewGrid(sk, "/srv")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	serverKey, err := server.nodeKey()
+	Tassert(t, err == nil, "nodeKey returned an error: %v", err)
+
+	symbolTable := []byte{}
+	for _, mod := range modules {
+		moduleHash, err := GenerateHash(multihash.SHA2_256, mod.code)
+		Tassert(t, err == nil, "Failed to generate hash: %v", err)
+		err = sk.WriteFile(server.path(cacheDir, fmt.Sprintf("%x", moduleHash)), mod.code, 0755)
+		Tassert(t, err == nil, "Failed to write module: %v", err)
+		line := fmt.Sprintf("%s %x", mod.name, moduleHash)
+		if mod.manifest != nil {
+			m := *mod.manifest
+			m.Module = fmt.Sprintf("%x", moduleHash)
+			if mod.sign && mod.signer != nil {
+				m.Sign(mod.signer)
+			} else if mod.sign {
+				m.Sign(serverKey)
+			}
+			buf, err := json.Marshal(&m)
+			Tassert(t, err == nil, "Failed to marshal manifest: %v", err)
+			manifestHash, err := GenerateHash(multihash.SHA2_256, buf)
+			Tassert(t, err == nil, "Failed to generate hash: %v", err)
+			err = sk.WriteFile(server.path(cacheDir, fmt.Sprintf("%x", manifestHash)), buf, 0644)
+			Tassert(t, err == nil, "Failed to write manifest: %v", err)
+			line += fmt.Sprintf(" %x", manifestHash)
+		}
+		symbolTable = append(symbolTable, []byte(line+"\n")...)
+	}
+	symbolTableHash, err := GenerateHash(multihash.SHA2_256, symbolTable)
+	Tassert(t, err == nil, "Failed to generate hash: %v", err)
+	err = sk.WriteFile(server.path(cacheDir, fmt.Sprintf("%x", symbolTableHash)), symbolTable, 0644)
+	Tassert(t, err == nil, "Failed to write symbol table: %v", err)
+	err = sk.Listen("ws://server/ws", server.handleWebSocket)
+	Tassert(t, err == nil, "Listen returned an error: %v", err)
+
+	// client
+	ck = NewKernelMem(net)
+	client, err = NewGrid(ck, "/home/user")
+	Tassert(t, err == nil, "NewGrid returned an error: %v", err)
+	config := fmt.Sprintf("symbol_table_hash=%x\n", symbolTableHash)
+	err = ck.WriteFile(client.path(configFile), []byte(config), 0644)
+	Tassert(t, err == nil, "Failed to write config: %v", err)
+	err = ck.WriteFile(client.path(peerList), []byte("ws://server/ws\n"), 0644)
+	Tassert(t, err == nil, "Failed to write peers: %v", err)
+	serverPub, err := server.PublicKey()
+	Tassert(t, err == nil, "PublicKey returned an error: %v", err)
+	err = client.Trust(serverPub)
+	Tassert(t, err == nil, "Trust returned an error: %v", err)
+	for _, mod := range modules {
+		name := mod.name
+		ck.AddProgram(mod.code, func(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+			in, _ := io.ReadAll(stdin)
+			fmt.Fprintf(stdout, "%s %s %s", name, strings.Join(args, " "), in)
+			return nil
+		})
+	}
+
+	// the server grants the client read access to everything
+	clientKey, err := client.PublicKey()
+	Tassert(t, err == nil, "PublicKey returned an error: %v", err)
+	c, err := server.IssueCapability(clientKey, "", "I promise to use this data responsibly.", time.Hour, "")
+	Tassert(t, err == nil, "IssueCapability returned an error: %v", err)
+	err = client.AddCapability(c)
+	Tassert(t, err == nil, "AddCapability returned an error: %v", err)
+
+	err = client.loadPeers()
+	Tassert(t, err == nil, "loadPeers returned an error: %v", err)
+	client.connectToPeers()
+	return
+}
+
 // Test execution of a subcommand with valid symbol table hash, subcommand hash, and localities
 func TestExecuteSubcommand_ValidScenario(t *testing.T) {
-	// This test requires setting up a mocked environment that simulates:
-	// 1. A valid symbol table hash within the configuration.
-	// 2. Corresponding symbol table data that includes a testable subcommand.
-	// 3. Mock the response for fetching a module based on the subcommand hash.
-	// 4. Ensure the fetched module (binary/script) can be executed.
-	// As executing a subcommand involves network calls and executing binaries,
-	// this would typically involve mocking network responses and the execution environment.
-
-	// The implementation of this test would depend on the ability to mock or simulate
-	// the necessary components within the test environment. This can be complex and require
-	// a comprehensive setup, possibly involving interfaces and dependency injection for network calls
-	// and external dependencies.
+	client, ck, _ := setupPeerPair(t)
+	ck.stdin.WriteString("from stdin")
+
+	err := client.Exec("hello", []string{"world"})
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+	Tassert(t, ck.stdout.String() == "hello world from stdin", "unexpected stdout %q", ck.stdout.String())
+
+	// the module was fetched from the peer, cached, and executed, all
+	// through the kernel
+	calls := strings.Join(ck.CallNames(), " ")
+	Tassert(t, strings.Contains(calls, "Dial"), "expected a Dial syscall: %s", calls)
+	execs := ck.callsTo("Exec", client.path(cacheDir)+"/")
+	Tassert(t, len(execs) == 1, "expected the cached module to be executed: %v", ck.Calls)
+	modulePath := ck.Calls[execs[0]].Args[0].(string)
+	writes := ck.callsTo("WriteFile", modulePath)
+	Tassert(t, len(writes) == 1 && writes[0] < execs[0], "expected the module to be cached before it ran: %v", ck.Calls)
+
+	// a second run uses the cached module and manifest
+	ck.Calls = nil
+	err = client.Exec("hello", nil)
+	Tassert(t, err == nil, "Exec returned an error: %v", err)
+	writes = ck.callsTo("WriteFile", client.path(cacheDir)+"/")
+	Tassert(t, len(writes) == 0, "expected nothing to be fetched again: %v", ck.Calls)
+}
+
+func TestExecuteSubcommand_UnknownSubcommand(t *testing.T) {
+	client, _, _ := setupPeerPair(t)
+	err := client.Exec("nosuch", nil)
+	Tassert(t, err != nil, "expected an error for an unknown subcommand")
+}
+
+func TestShowPromise(t *testing.T) {
+	client, ck, _ := setupPeerPair(t)
+	err := client.showPromise("hello")
+	Tassert(t, err == nil, "showPromise returned an error: %v", err)
+	out := ck.stdout.String()
+	Tassert(t, strings.Contains(out, "promise:       I promise to say hello.\n"), "unexpected stdout %q", out)
+	Tassert(t, strings.Contains(out, "version:       1.0.0\n"), "unexpected stdout %q", out)
+
+	// showing the promise neither fetches nor runs the module
+	Tassert(t, len(ck.callsTo("Exec", client.path(cacheDir)+"/")) == 0, "module was executed: %v", ck.Calls)
+	Tassert(t, len(ck.callsTo("WriteFile", client.path(cacheDir)+"/")) == 1, "expected only the manifest to be cached: %v", ck.Calls)
 }
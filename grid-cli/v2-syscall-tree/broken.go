@@ -0,0 +1,234 @@
+package v2
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Files kept in the kernel's state directory.
+const (
+	keyFile    = "key"
+	brokenFile = "broken.jsonl"
+)
+
+// DefaultRetryTimeout bounds how long consultModules keeps rerouting
+// a message after broken promises.
+const DefaultRetryTimeout = 10 * time.Second
+
+// DefaultMaxBrokenPromises bounds how many broken promise records a
+// kernel keeps in memory.
+const DefaultMaxBrokenPromises = 1000
+
+// BrokenPromise records that a module accepted a message and then
+// failed to handle it.  The kernel that observed it signs the record
+// so it can be shared with peers as evidence.
+type BrokenPromise struct {
+	Module    string   `json:"module"`
+	Parms     []string `json:"parms"` // canonical parm keys
+	Error     string   `json:"error"`
+	Time      int64    `json:"time"`   // unix nanoseconds
+	Kernel    string   `json:"kernel"` // hex ed25519 public key
+	Signature string   `json:"signature"`
+}
+
+func (b *BrokenPromise) signingBytes() []byte {
+	unsigned := *b
+	unsigned.Signature = ""
+	buf, err := json.Marshal(&unsigned)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// Verify checks the record's signature.
+func (b *BrokenPromise) Verify() error {
+	pub, err := hex.DecodeString(b.Kernel)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid kernel key %q", b.Kernel)
+	}
+	sig, err := hex.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(pub, b.signingBytes(), sig) {
+		return fmt.Errorf("invalid broken promise signature")
+	}
+	return nil
+}
+
+// Reliability is the kernel's running account of one module.
+type Reliability struct {
+	Module  string  `json:"module"`
+	Rejects int     `json:"rejects"`
+	Accepts int     `json:"accepts"`
+	Fulfils int     `json:"fulfils"`
+	Broken  int     `json:"broken"`
+	Trust   float64 `json:"trust"` // 0..1; starts at 1
+}
+
+// Trust adjustments: a broken promise halves a module's trust, and
+// each fulfilled promise recovers a tenth of what was lost.
+const (
+	trustPenalty  = 0.5
+	trustRecovery = 0.1
+)
+
+// loadKey loads the kernel's signing key from its state directory,
+// creating it if needed.  A kernel without a state directory gets an
+// ephemeral key.
+func loadKey(fs afero.Fs, stateDir string) (key ed25519.PrivateKey, err error) {
+	if stateDir == "" {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		return
+	}
+	path := filepath.Join(stateDir, keyFile)
+	buf, err := afero.ReadFile(fs, path)
+	if err == nil {
+		seed, err := hex.DecodeString(string(buf))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid kernel key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = afero.WriteFile(fs, path, []byte(hex.EncodeToString(key.Seed())), 0600)
+	return
+}
+
+// PublicKey returns the hex public key the kernel signs records with.
+func (k *Kernel) PublicKey() string {
+	return hex.EncodeToString(k.key.Public().(ed25519.PublicKey))
+}
+
+// account returns the reliability entry for a module.  The caller
+// must hold k.relMu.
+func (k *Kernel) account(name string) *Reliability {
+	r, ok := k.reliability[name]
+	if !ok {
+		r = &Reliability{Module: name, Trust: 1}
+		k.reliability[name] = r
+	}
+	return r
+}
+
+// count updates a module's reliability for an outcome.
+func (k *Kernel) count(name string, outcome Outcome) {
+	k.relMu.Lock()
+	defer k.relMu.Unlock()
+	r := k.account(name)
+	switch outcome {
+	case Rejected:
+		r.Rejects++
+	case Accepted:
+		r.Accepts++
+	case Fulfilled:
+		r.Fulfils++
+		r.Trust += (1 - r.Trust) * trustRecovery
+	}
+}
+
+// trust returns a module's current trust.
+func (k *Kernel) trust(name string) float64 {
+	k.relMu.Lock()
+	defer k.relMu.Unlock()
+	if r, ok := k.reliability[name]; ok {
+		return r.Trust
+	}
+	return 1
+}
+
+// brokenPromise signs and logs a broken promise by module name for a
+// message with parms, and lowers the module's trust.
+func (k *Kernel) brokenPromise(name string, parms []interface{}, cause error) *BrokenPromise {
+	keys, _ := parmKeys(parms)
+	b := &BrokenPromise{
+		Module: name,
+		Parms:  keys,
+		Error:  cause.Error(),
+		Time:   k.now().UnixNano(),
+		Kernel: k.PublicKey(),
+	}
+	b.Signature = hex.EncodeToString(ed25519.Sign(k.key, b.signingBytes()))
+
+	k.relMu.Lock()
+	r := k.account(name)
+	r.Broken++
+	r.Trust *= trustPenalty
+	k.broken = append(k.broken, b)
+	if k.MaxBrokenPromises > 0 && len(k.broken) > k.MaxBrokenPromises {
+		k.broken = append([]*BrokenPromise(nil), k.broken[len(k.broken)-k.MaxBrokenPromises:]...)
+	}
+	k.relMu.Unlock()
+
+	if k.stateDir != "" {
+		err := k.appendBroken(b)
+		if err != nil {
+			k.event(slog.LevelError, EventError, nil, "op", "broken.append", "module", name, "err", err)
+		}
+	}
+	if k.OnBrokenPromise != nil {
+		k.OnBrokenPromise(b)
+	}
+	return b
+}
+
+// appendBroken appends a record to the broken promise log.
+func (k *Kernel) appendBroken(b *BrokenPromise) error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	k.saveMu.Lock()
+	defer k.saveMu.Unlock()
+	err = k.fs.MkdirAll(k.stateDir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := k.fs.OpenFile(filepath.Join(k.stateDir, brokenFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(buf, '\n'))
+	return err
+}
+
+// BrokenPromises returns the broken promises observed since the
+// kernel started, at most MaxBrokenPromises of the most recent.
+func (k *Kernel) BrokenPromises() []*BrokenPromise {
+	k.relMu.Lock()
+	defer k.relMu.Unlock()
+	return append([]*BrokenPromise(nil), k.broken...)
+}
+
+// ReliabilityReport returns the reliability of every module the
+// kernel has consulted, sorted by module name.
+func (k *Kernel) ReliabilityReport() (report []Reliability) {
+	k.relMu.Lock()
+	defer k.relMu.Unlock()
+	for _, r := range k.reliability {
+		report = append(report, *r)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Module < report[j].Module
+	})
+	return
+}
@@ -0,0 +1,204 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// hangModule accepts everything and then blocks until its context is
+// done.
+type hangModule struct{}
+
+func (hangModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// retractModule accepts everything and then replies that it will not
+// handle it after all.
+type retractModule struct{}
+
+func (retractModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	return &Message{Parms: []interface{}{test}}, nil
+}
+
+func TestBrokenPromiseRecord(t *testing.T) {
+	k := NewKernel()
+	broken := newStub("broken", "p1")
+	broken.fail = true
+	k.RegisterModule("broken", broken, "p1")
+	k.RegisterModule("backup", newStub("backup", "p1"))
+
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", 7}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "backup" {
+		t.Errorf("expected the message to be rerouted to backup, got %v", out.Parms)
+	}
+
+	records := k.BrokenPromises()
+	if len(records) != 1 {
+		t.Fatalf("expected one broken promise, got %d", len(records))
+	}
+	b := records[0]
+	if b.Module != "broken" || b.Error != "broken failed" || b.Kernel != k.PublicKey() {
+		t.Errorf("unexpected broken promise record: %+v", b)
+	}
+	if strings.Join(b.Parms, " ") != "s:p1 i:7" {
+		t.Errorf("unexpected parms in record: %v", b.Parms)
+	}
+	if err := b.Verify(); err != nil {
+		t.Errorf("Verify returned an error: %v", err)
+	}
+	forged := *b
+	forged.Module = "backup"
+	if err := forged.Verify(); err == nil {
+		t.Errorf("expected a forged record to fail verification")
+	}
+
+	report := k.ReliabilityReport()
+	if len(report) != 2 {
+		t.Fatalf("expected two modules in the report, got %+v", report)
+	}
+	if r := report[0]; r.Module != "backup" || r.Accepts != 1 || r.Fulfils != 1 || r.Broken != 0 || r.Trust != 1 {
+		t.Errorf("unexpected reliability for backup: %+v", r)
+	}
+	if r := report[1]; r.Module != "broken" || r.Accepts != 1 || r.Fulfils != 0 || r.Broken != 1 || r.Trust != trustPenalty {
+		t.Errorf("unexpected reliability for broken: %+v", r)
+	}
+}
+
+func TestBrokenPromiseLowersTrust(t *testing.T) {
+	k := NewKernel()
+	flaky := newStub("flaky", "p1")
+	flaky.fail = true
+	backup := newStub("backup", "p1")
+	k.RegisterModule("flaky", flaky, "p1")
+	k.RegisterModule("backup", backup, "p1")
+
+	k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", "a"}})
+	flaky.fail = false
+
+	// a message with different parms has no history to go on, so
+	// only trust puts backup ahead of flaky
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", "b"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "backup" || flaky.tested != 1 {
+		t.Errorf("expected backup to be consulted before flaky, got %v with flaky tested %d times", out.Parms, flaky.tested)
+	}
+}
+
+func TestBrokenPromiseUnfulfilled(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("retract", retractModule{}, "p1")
+	k.RegisterModule("backup", newStub("backup", "p1"))
+
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "backup" {
+		t.Errorf("expected the message to be rerouted to backup, got %v", out.Parms)
+	}
+	records := k.BrokenPromises()
+	if len(records) != 1 || records[0].Module != "retract" || records[0].Error != errUnfulfilled.Error() {
+		t.Errorf("expected retract's broken promise to be recorded, got %+v", records)
+	}
+	for _, r := range k.ReliabilityReport() {
+		if r.Module == "retract" && (r.Fulfils != 0 || r.Broken != 1) {
+			t.Errorf("unexpected reliability for retract: %+v", r)
+		}
+	}
+}
+
+func TestBrokenPromiseLimit(t *testing.T) {
+	k := NewKernel()
+	k.MaxBrokenPromises = 2
+	broken := newStub("broken", "p1")
+	broken.fail = true
+	k.RegisterModule("broken", broken, "p1")
+	for i := 0; i < 5; i++ {
+		k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", i}})
+	}
+	records := k.BrokenPromises()
+	if len(records) != 2 {
+		t.Fatalf("expected the two most recent broken promises, got %d", len(records))
+	}
+	if records[0].Parms[1] != "i:3" || records[1].Parms[1] != "i:4" {
+		t.Errorf("expected the most recent records to be kept, got %v and %v", records[0].Parms, records[1].Parms)
+	}
+}
+
+func TestBrokenPromiseDeadline(t *testing.T) {
+	k := NewKernel()
+	k.RetryTimeout = 50 * time.Millisecond
+	k.RegisterModule("hang", hangModule{}, "p1")
+	backup := newStub("backup", "p1")
+	k.RegisterModule("backup", backup)
+
+	start := time.Now()
+	_, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("consultModules took %v, expected it to give up after the deadline", elapsed)
+	}
+	if backup.tested != 0 {
+		t.Errorf("backup should not have been consulted after the deadline")
+	}
+	if records := k.BrokenPromises(); len(records) != 1 || records[0].Module != "hang" {
+		t.Errorf("expected hang's broken promise to be recorded, got %+v", records)
+	}
+}
+
+func TestBrokenPromisePersistence(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	stateDir := "/home/user/.grid/kernel"
+	k, err := NewKernelWithFs(fs, stateDir)
+	if err != nil {
+		t.Fatalf("NewKernelWithFs returned an error: %v", err)
+	}
+	var published []*BrokenPromise
+	k.OnBrokenPromise = func(b *BrokenPromise) { published = append(published, b) }
+	broken := newStub("broken", "p1")
+	broken.fail = true
+	k.RegisterModule("broken", broken)
+	k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if len(published) != 1 {
+		t.Errorf("expected OnBrokenPromise to be called once, got %d", len(published))
+	}
+
+	buf, err := afero.ReadFile(fs, filepath.Join(stateDir, brokenFile))
+	if err != nil {
+		t.Fatalf("broken promise log not written: %v", err)
+	}
+	var b BrokenPromise
+	if err := json.Unmarshal(buf, &b); err != nil {
+		t.Fatalf("failed to parse broken promise log: %v", err)
+	}
+	if err := b.Verify(); err != nil || b.Module != "broken" {
+		t.Errorf("unexpected logged record %+v: %v", b, err)
+	}
+
+	k2, err := NewKernelWithFs(fs, stateDir)
+	if err != nil {
+		t.Fatalf("NewKernelWithFs returned an error: %v", err)
+	}
+	if k2.PublicKey() != k.PublicKey() {
+		t.Errorf("expected the kernel key to persist")
+	}
+}
@@ -0,0 +1,411 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/spf13/afero"
+)
+
+// DefaultCacheTTL bounds how long a hit from a later cache in the
+// chain is copied into the caches ahead of it.
+const DefaultCacheTTL = 10 * time.Minute
+
+// DefaultCacheSize bounds the bytes of entries a kernel's own cache
+// holds.
+const DefaultCacheSize = 64 << 20
+
+// kernelCacheDir is where a kernel with a state directory keeps its cache,
+// relative to that directory.
+const kernelCacheDir = "cache"
+
+// cacheLeaf is the name of the file holding the entry for a parms
+// path.  Path components are tagged parm keys, so they never collide
+// with it.
+const cacheLeaf = "@"
+
+// Cache stores messages by the parms of the request they answer.
+// A cache lookup is a hashed function call: from the caller's point
+// of view a hit is indistinguishable from a module handling the
+// request.
+type Cache interface {
+	// Get returns the unexpired entry for parms and how long it has
+	// left.
+	Get(parms []interface{}) (msg *Message, ttl time.Duration, ok bool, err error)
+	// Put stores msg for parms until ttl passes.
+	Put(parms []interface{}, msg *Message, ttl time.Duration) error
+	// Invalidate removes the entry for parms and every entry whose
+	// parms begin with them.
+	Invalidate(parms []interface{}) error
+}
+
+// CachePath returns the cache path for parms: each parm's canonical
+// key, URL-encoded, joined by '/'.
+func CachePath(parms []interface{}) (string, error) {
+	keys, err := parmKeys(parms)
+	if err != nil {
+		return "", err
+	}
+	for i, key := range keys {
+		keys[i] = url.PathEscape(key)
+	}
+	return path.Join(keys...), nil
+}
+
+// cacheEntry is a cached message as stored.
+type cacheEntry struct {
+	Expires int64  `cbor:"1,keyasint"` // unix nanoseconds
+	Message []byte `cbor:"2,keyasint"` // canonical CBOR
+}
+
+// cacheStat is what a LocalCacheModule with a size bound knows of
+// one of its entries.
+type cacheStat struct {
+	size    int64
+	expires int64 // unix nanoseconds
+}
+
+// LocalCacheModule is a cache kept in a directory tree on an afero
+// filesystem, laid out by CachePath.  It is also a module: it accepts
+// exactly the requests it has unexpired entries for.
+type LocalCacheModule struct {
+	fs       afero.Fs
+	cacheDir string
+	mu       sync.RWMutex
+	now      func() time.Time
+	entries  map[string]cacheStat // by leaf; nil until counted
+	size     int64                // of entries
+
+	// MaxSize bounds the bytes of entries the cache holds.  When a
+	// Put exceeds it, the entries closest to expiry, expired ones
+	// first, are removed until the cache holds three quarters of
+	// MaxSize.  Zero means no bound.
+	MaxSize int64
+}
+
+// NewLocalCacheModule returns a cache rooted at cacheDir on fs.
+func NewLocalCacheModule(fs afero.Fs, cacheDir string) *LocalCacheModule {
+	return &LocalCacheModule{fs: fs, cacheDir: cacheDir, now: time.Now}
+}
+
+func (m *LocalCacheModule) dir(parms []interface{}) (string, error) {
+	p, err := CachePath(parms)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(m.cacheDir, p), nil
+}
+
+// Get returns the unexpired entry for parms and how long it has
+// left.  Expired entries are removed.
+func (m *LocalCacheModule) Get(parms []interface{}) (msg *Message, ttl time.Duration, ok bool, err error) {
+	dir, err := m.dir(parms)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	leaf := path.Join(dir, cacheLeaf)
+	m.mu.RLock()
+	buf, err := afero.ReadFile(m.fs, leaf)
+	m.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var entry cacheEntry
+	err = decMode.Unmarshal(buf, &entry)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("corrupt cache entry %s: %w", leaf, err)
+	}
+	now := m.now().UnixNano()
+	if now >= entry.Expires {
+		m.mu.Lock()
+		m.remove(leaf)
+		m.mu.Unlock()
+		return nil, 0, false, nil
+	}
+	msg = &Message{}
+	err = msg.UnmarshalCBOR(entry.Message)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("corrupt cache entry %s: %w", leaf, err)
+	}
+	return msg, time.Duration(entry.Expires - now), true, nil
+}
+
+// Put stores msg for parms until ttl passes.
+func (m *LocalCacheModule) Put(parms []interface{}, msg *Message, ttl time.Duration) error {
+	dir, err := m.dir(parms)
+	if err != nil {
+		return err
+	}
+	body, err := msg.CanonicalBytes()
+	if err != nil {
+		return err
+	}
+	expires := m.now().Add(ttl).UnixNano()
+	buf, err := encMode.Marshal(&cacheEntry{
+		Expires: expires,
+		Message: body,
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = m.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	leaf := path.Join(dir, cacheLeaf)
+	tmp := leaf + ".tmp"
+	err = afero.WriteFile(m.fs, tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = m.fs.Rename(tmp, leaf)
+	if err != nil {
+		return err
+	}
+	if m.MaxSize <= 0 && m.entries == nil {
+		return nil
+	}
+	if m.entries == nil {
+		m.count()
+	}
+	m.size += int64(len(buf)) - m.entries[leaf].size
+	m.entries[leaf] = cacheStat{int64(len(buf)), expires}
+	if m.MaxSize > 0 && m.size > m.MaxSize {
+		m.evict(m.MaxSize * 3 / 4)
+	}
+	return nil
+}
+
+// count finds the entries already in the cache directory.  The caller
+// must hold m.mu.
+func (m *LocalCacheModule) count() {
+	m.entries = make(map[string]cacheStat)
+	m.size = 0
+	afero.Walk(m.fs, m.cacheDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path.Base(p) != cacheLeaf {
+			return nil
+		}
+		// an unreadable entry counts as expired
+		var entry cacheEntry
+		buf, err := afero.ReadFile(m.fs, p)
+		if err == nil {
+			decMode.Unmarshal(buf, &entry)
+		}
+		m.entries[p] = cacheStat{info.Size(), entry.Expires}
+		m.size += info.Size()
+		return nil
+	})
+}
+
+// evict removes the entries closest to expiry until the cache holds
+// at most size bytes.  The caller must hold m.mu.
+func (m *LocalCacheModule) evict(size int64) {
+	leaves := make([]string, 0, len(m.entries))
+	for leaf := range m.entries {
+		leaves = append(leaves, leaf)
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return m.entries[leaves[i]].expires < m.entries[leaves[j]].expires
+	})
+	for _, leaf := range leaves {
+		if m.size <= size {
+			return
+		}
+		m.remove(leaf)
+	}
+}
+
+// remove removes the entry at leaf.  The caller must hold m.mu.
+func (m *LocalCacheModule) remove(leaf string) {
+	m.fs.Remove(leaf)
+	if st, ok := m.entries[leaf]; ok {
+		m.size -= st.size
+		delete(m.entries, leaf)
+	}
+}
+
+// Invalidate removes the entry for parms and everything under it.
+func (m *LocalCacheModule) Invalidate(parms []interface{}) error {
+	dir, err := m.dir(parms)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for leaf, st := range m.entries {
+		if strings.HasPrefix(leaf, prefix) {
+			m.size -= st.size
+			delete(m.entries, leaf)
+		}
+	}
+	return m.fs.RemoveAll(dir)
+}
+
+// HandleMessage accepts a message if the cache has an entry for its
+// parms, and handles it by returning the entry.
+func (m *LocalCacheModule) HandleMessage(ctx context.Context, test bool, in *Message) (out *Message, err error) {
+	out, _, ok, err := m.Get(in.Parms)
+	if err != nil {
+		return nil, err
+	}
+	if test {
+		return &Message{Parms: []interface{}{ok}}, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("cache miss")
+	}
+	return out, nil
+}
+
+// cacheKey returns the parms a message is cached under: its parms
+// followed by the multihash of its payload, so that requests that
+// differ only in their payload are cached apart.  Invalidating a
+// request's parms invalidates it for every payload.
+func cacheKey(in *Message) ([]interface{}, error) {
+	buf, err := encMode.Marshal(in.Payload)
+	if err != nil {
+		return nil, err
+	}
+	h, err := multihash.Sum(buf, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]interface{}(nil), in.Parms...), Multihash(h)), nil
+}
+
+// SetCacheTTL opts the module registered as name in to caching: its
+// results are cached for ttl.  A zero ttl, the default, leaves them
+// uncached.
+func (k *Kernel) SetCacheTTL(name string, ttl time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cacheTTLs == nil {
+		k.cacheTTLs = make(map[string]time.Duration)
+	}
+	k.cacheTTLs[name] = ttl
+}
+
+// cacheTTL returns how long results from the module registered as
+// name are cached.
+func (k *Kernel) cacheTTL(name string) time.Duration {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cacheTTLs[name]
+}
+
+// cacheLink is one cache in the kernel's chain.
+type cacheLink struct {
+	name  string
+	cache Cache
+}
+
+// AddCache appends a module-provided cache to the chain the kernel
+// consults, after its own cache, before consulting modules.
+func (k *Kernel) AddCache(name string, cache Cache) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, l := range k.caches {
+		if l.name == name {
+			return fmt.Errorf("cache %s already added", name)
+		}
+	}
+	k.caches = append(k.caches, cacheLink{name, cache})
+	return nil
+}
+
+// RemoveCache removes a cache from the chain.
+func (k *Kernel) RemoveCache(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, l := range k.caches {
+		if l.name == name {
+			k.caches = append(k.caches[:i:i], k.caches[i+1:]...)
+			return
+		}
+	}
+}
+
+// chain returns the kernel's cache followed by the module-provided
+// caches.
+func (k *Kernel) chain() []cacheLink {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]cacheLink{{"kernel", k.cache}}, k.caches...)
+}
+
+// Invalidate removes the entries for parms, and every entry under
+// them, from every cache in the chain.
+func (k *Kernel) Invalidate(parms ...interface{}) error {
+	for _, l := range k.chain() {
+		err := l.cache.Invalidate(parms)
+		if err != nil {
+			return fmt.Errorf("cache %s: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+// handleMessage answers a message from the first cache in the chain
+// that has it, copying the entry into the caches ahead of that one
+// for what is left of its TTL, at most CacheTTL.  On a miss it consults modules, and caches
+// the result in the kernel's cache if the module that handled the
+// message opted in with SetCacheTTL.
+func (k *Kernel) handleMessage(ctx context.Context, in *Message) (*Message, error) {
+	if k.CacheTTL <= 0 {
+		return k.consultModules(ctx, in)
+	}
+	key, err := cacheKey(in)
+	if err != nil {
+		return nil, err
+	}
+	links := k.chain()
+	for i, l := range links {
+		out, ttl, ok, err := l.cache.Get(key)
+		if err != nil {
+			k.event(slog.LevelError, EventError, in, "op", "cache.get", "cache", l.name, "err", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		k.event(slog.LevelDebug, EventCacheHit, in, "cache", l.name)
+		if ttl > k.CacheTTL {
+			ttl = k.CacheTTL
+		}
+		for _, ahead := range links[:i] {
+			err = ahead.cache.Put(key, out, ttl)
+			if err != nil {
+				k.event(slog.LevelError, EventError, in, "op", "cache.put", "cache", ahead.name, "err", err)
+			}
+		}
+		return out, nil
+	}
+
+	k.event(slog.LevelDebug, EventCacheMiss, in)
+	out, handler, err := k.consult(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if ttl := k.cacheTTL(handler); ttl > 0 && accepted(out) {
+		err = k.cache.Put(key, out, ttl)
+		if err != nil {
+			k.event(slog.LevelError, EventError, in, "op", "cache.put", "cache", "kernel", "err", err)
+		}
+	}
+	return out, nil
+}
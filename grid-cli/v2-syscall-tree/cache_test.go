@@ -0,0 +1,246 @@
+package v2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestCachePath(t *testing.T) {
+	cases := []struct {
+		parms []interface{}
+		want  string
+	}{
+		{nil, ""},
+		{[]interface{}{"p1", "m1"}, "s:p1/s:m1"},
+		{[]interface{}{"a/b", "..", 3}, "s:a%2Fb/s:../i:3"},
+		{[]interface{}{"sp ace", []byte{1}}, "s:sp%20ace/x:01"},
+		{[]interface{}{Multihash{0x12, 0x00}}, "h:1200"},
+	}
+	for _, c := range cases {
+		got, err := CachePath(c.parms)
+		if err != nil {
+			t.Errorf("CachePath(%v) returned an error: %v", c.parms, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("CachePath(%v) = %q, want %q", c.parms, got, c.want)
+		}
+	}
+}
+
+func TestLocalCacheModule(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m := NewLocalCacheModule(fs, "/cache")
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+
+	short := []interface{}{"p1", "m1"}
+	long := []interface{}{"p1", "m1", "arg"}
+	m.Put(short, &Message{Parms: []interface{}{true, "short"}}, time.Minute)
+	m.Put(long, &Message{Parms: []interface{}{true, "long"}}, time.Hour)
+
+	if ok, _ := afero.Exists(fs, "/cache/s:p1/s:m1/s:arg/@"); !ok {
+		t.Errorf("expected the entry to be stored under its cache path")
+	}
+	out, ttl, ok, err := m.Get(long)
+	if err != nil || !ok || out.Parms[1] != "long" || ttl != time.Hour {
+		t.Errorf("unexpected Get result %+v %v %v %v", out, ttl, ok, err)
+	}
+
+	// the module interface accepts exactly the cached requests
+	promise, _ := m.HandleMessage(context.Background(), true, &Message{Parms: short})
+	if !accepted(promise) {
+		t.Errorf("expected the cache module to accept a cached request")
+	}
+	promise, _ = m.HandleMessage(context.Background(), true, &Message{Parms: []interface{}{"p2"}})
+	if accepted(promise) {
+		t.Errorf("expected the cache module to reject an uncached request")
+	}
+
+	// entries expire
+	now = now.Add(2 * time.Minute)
+	if _, _, ok, _ := m.Get(short); ok {
+		t.Errorf("expected the short entry to have expired")
+	}
+	if _, _, ok, _ := m.Get(long); !ok {
+		t.Errorf("expected the long entry to survive")
+	}
+
+	// invalidating a prefix removes everything under it
+	m.Put(short, &Message{Parms: []interface{}{true, "short"}}, time.Minute)
+	m.Invalidate([]interface{}{"p1"})
+	for _, parms := range [][]interface{}{short, long} {
+		if _, _, ok, _ := m.Get(parms); ok {
+			t.Errorf("expected %v to be invalidated", parms)
+		}
+	}
+}
+
+func TestLocalCacheModuleSize(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m := NewLocalCacheModule(fs, "/cache")
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+	m.MaxSize = 1 << 20
+	for i := 1; i <= 4; i++ {
+		m.Put([]interface{}{"p", i}, &Message{Parms: []interface{}{true, i}}, time.Duration(i)*time.Minute)
+	}
+	entry := m.size / 4
+
+	// a bound is applied to the entries already on disk, and a Put
+	// over it evicts the entries closest to expiry
+	m = NewLocalCacheModule(fs, "/cache")
+	m.now = func() time.Time { return now }
+	m.MaxSize = 4 * entry
+	m.Put([]interface{}{"p", 5}, &Message{Parms: []interface{}{true, 5}}, 5*time.Minute)
+	if m.size > m.MaxSize*3/4 {
+		t.Errorf("expected the cache to shrink to %d bytes, holds %d", m.MaxSize*3/4, m.size)
+	}
+	for i := 1; i <= 5; i++ {
+		_, _, ok, _ := m.Get([]interface{}{"p", i})
+		if want := i > 2; ok != want {
+			t.Errorf("entry %d: expected cached %v, got %v", i, want, ok)
+		}
+	}
+
+	m.Invalidate([]interface{}{"p"})
+	if m.size != 0 || len(m.entries) != 0 {
+		t.Errorf("expected invalidated entries to be forgotten, %d left in %d bytes", len(m.entries), m.size)
+	}
+}
+
+func TestKernelCache(t *testing.T) {
+	k, clock := newClockKernel(t, afero.NewMemMapFs())
+	m := newStub("m", "p1")
+	k.RegisterModule("m", m)
+
+	// results are cached only for modules that opt in
+	in := &Message{Parms: []interface{}{"p1", "x"}}
+	k.handleMessage(context.Background(), in)
+	k.handleMessage(context.Background(), in)
+	if m.handled != 2 {
+		t.Fatalf("expected results not to be cached by default, module handled %d", m.handled)
+	}
+	m.handled = 0
+	ttl := 10 * time.Minute
+	k.SetCacheTTL("m", ttl)
+
+	for i := 0; i < 3; i++ {
+		out, err := k.handleMessage(context.Background(), in)
+		if err != nil || out.Parms[1] != "m" {
+			t.Fatalf("unexpected result %+v: %v", out, err)
+		}
+	}
+	if m.handled != 1 {
+		t.Errorf("expected later requests to be served from the cache, module handled %d", m.handled)
+	}
+
+	// the cache lives in the kernel's state directory, keyed on the
+	// parms and the payload's hash
+	key, err := cacheKey(in)
+	if err != nil {
+		t.Fatalf("cacheKey returned an error: %v", err)
+	}
+	path, _ := CachePath(key)
+	if ok, _ := afero.Exists(k.fs, "/state/cache/"+path+"/@"); !ok {
+		t.Errorf("expected the result to be cached in the state directory")
+	}
+
+	// a different payload is a different request
+	other := &Message{Parms: in.Parms, Payload: map[string]interface{}{"a": "b"}}
+	k.handleMessage(context.Background(), other)
+	if m.handled != 2 {
+		t.Errorf("expected a request with another payload to miss the cache")
+	}
+	m.handled = 1
+
+	*clock = clock.Add(ttl)
+	k.handleMessage(context.Background(), in)
+	if m.handled != 2 {
+		t.Errorf("expected an expired entry to be refreshed from the module")
+	}
+
+	k.Invalidate("p1")
+	k.handleMessage(context.Background(), in)
+	if m.handled != 3 {
+		t.Errorf("expected an invalidated entry to be refreshed from the module")
+	}
+
+	// rejections are not cached
+	rejected := &Message{Parms: []interface{}{"p2"}}
+	k.handleMessage(context.Background(), rejected)
+	key, _ = cacheKey(rejected)
+	if _, _, ok, _ := k.cache.Get(key); ok {
+		t.Errorf("expected a rejection not to be cached")
+	}
+}
+
+func TestKernelCacheChain(t *testing.T) {
+	k := NewKernel()
+	m := newStub("m", "p1")
+	k.RegisterModule("m", m)
+
+	provided := NewLocalCacheModule(afero.NewMemMapFs(), "/")
+	parms := []interface{}{"p1", "y"}
+	key, err := cacheKey(&Message{Parms: parms})
+	if err != nil {
+		t.Fatalf("cacheKey returned an error: %v", err)
+	}
+	provided.Put(key, &Message{Parms: []interface{}{true, "provided"}}, time.Hour)
+	if err := k.AddCache("provided", provided); err != nil {
+		t.Fatalf("AddCache returned an error: %v", err)
+	}
+	if err := k.AddCache("provided", provided); err == nil {
+		t.Errorf("expected an error adding a cache twice")
+	}
+
+	out, err := k.handleMessage(context.Background(), &Message{Parms: parms})
+	if err != nil || out.Parms[1] != "provided" {
+		t.Fatalf("expected the module-provided cache to answer, got %+v: %v", out, err)
+	}
+	if m.tested != 0 {
+		t.Errorf("expected no module to be consulted on a cache hit")
+	}
+	if _, _, ok, _ := k.cache.Get(key); !ok {
+		t.Errorf("expected the hit to be copied into the kernel cache")
+	}
+
+	k.RemoveCache("provided")
+	k.Invalidate(parms...)
+	out, _ = k.handleMessage(context.Background(), &Message{Parms: parms})
+	if out.Parms[1] != "m" {
+		t.Errorf("expected the module to answer once the cache is gone, got %+v", out)
+	}
+	if _, _, ok, _ := provided.Get(key); !ok {
+		t.Errorf("expected a removed cache to be left alone by Invalidate")
+	}
+}
+
+func TestKernelCacheChainTTL(t *testing.T) {
+	k, clock := newClockKernel(t, afero.NewMemMapFs())
+	provided := NewLocalCacheModule(afero.NewMemMapFs(), "/")
+	provided.now = k.now
+	k.AddCache("provided", provided)
+	parms := []interface{}{"p1", "z"}
+	key, err := cacheKey(&Message{Parms: parms})
+	if err != nil {
+		t.Fatalf("cacheKey returned an error: %v", err)
+	}
+	provided.Put(key, &Message{Parms: []interface{}{true, "provided"}}, time.Hour)
+
+	// a hit is copied ahead for what is left of it, however long
+	// CacheTTL is
+	*clock = clock.Add(59 * time.Minute)
+	k.CacheTTL = time.Hour
+	k.handleMessage(context.Background(), &Message{Parms: parms})
+	if _, ttl, ok, _ := k.cache.Get(key); !ok || ttl != time.Minute {
+		t.Errorf("expected the hit to be copied for its remaining minute, got %v %v", ttl, ok)
+	}
+	*clock = clock.Add(time.Minute)
+	if _, _, ok, _ := k.cache.Get(key); ok {
+		t.Errorf("expected the copy to expire with the original")
+	}
+}
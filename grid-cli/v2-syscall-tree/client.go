@@ -0,0 +1,166 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned for calls on a closed client.
+var ErrClosed = errors.New("client closed")
+
+// RejectError is returned by Client.Call when the kernel declines a
+// request.
+type RejectError struct {
+	Reply *Message
+}
+
+func (e *RejectError) Error() string {
+	if msg, ok := e.Reply.Payload["error"].(string); ok {
+		return "request rejected: " + msg
+	}
+	return "request rejected"
+}
+
+// Client sends messages to a kernel's WebSocket server as CBOR and
+// matches the responses to them.  It is safe for concurrent use, and
+// any number of calls may be in flight at once.
+type Client struct {
+	// Log receives errors from the connection.
+	Log *slog.Logger
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *Message
+	err     error // why the connection stopped; nil while it is up
+}
+
+// Dial connects to the kernel WebSocket server at url, e.g.
+// "ws://localhost:8080/ws".
+func Dial(url string) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		Log:     slog.Default(),
+		conn:    conn,
+		pending: make(map[string]chan *Message),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop delivers each response to the call waiting for it.
+func (c *Client) readLoop() {
+	for {
+		mt, buf, err := c.conn.ReadMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		reply, err := decodeMessage(mt, buf)
+		if err != nil {
+			c.Log.Error(EventError, "op", "decode", "err", err)
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[reply.InReplyTo]
+		delete(c.pending, reply.InReplyTo)
+		c.mu.Unlock()
+		if ok {
+			ch <- reply
+		}
+	}
+}
+
+// fail stops the client, releasing every waiting call.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Call sends a message to the kernel and waits for the response.  The
+// message's ID is assigned by the client.  If the kernel rejects the
+// message, Call returns the reject message along with a *RejectError.
+func (c *Client) Call(ctx context.Context, in *Message) (*Message, error) {
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req := *in
+	req.ID = id
+	req.InReplyTo = ""
+	buf, err := req.MarshalCBOR()
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+	c.writeMu.Lock()
+	err = c.conn.WriteMessage(websocket.BinaryMessage, buf)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			return nil, err
+		}
+		if !accepted(reply) {
+			return reply, &RejectError{Reply: reply}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// forget stops waiting for the response to id.
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Close closes the connection.  Calls still waiting return ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	c.mu.Unlock()
+	c.writeMu.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,205 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoModule accepts everything and replies with the message's parms.
+type echoModule struct{}
+
+func (echoModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	return &Message{Parms: append([]interface{}{true}, in.Parms...)}, nil
+}
+
+// gateModule accepts everything and replies once its gate is closed.
+type gateModule struct {
+	gate chan struct{}
+}
+
+func (m gateModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	select {
+	case <-m.gate:
+		return &Message{Parms: []interface{}{true, "gate"}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// countModule is a gateModule that counts the messages it is handling.
+type countModule struct {
+	gateModule
+	n, max *atomic.Int32
+}
+
+func (m countModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return m.gateModule.HandleMessage(ctx, test, in)
+	}
+	n := m.n.Add(1)
+	defer m.n.Add(-1)
+	for {
+		max := m.max.Load()
+		if n <= max || m.max.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	return m.gateModule.HandleMessage(ctx, test, in)
+}
+
+// serve runs k's WebSocket server on a loopback port and returns a
+// client connected to it.
+func serve(t *testing.T, k *Kernel) *Client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %v", err)
+	}
+	go k.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	c, err := Dial(fmt.Sprintf("ws://%s/ws", ln.Addr()))
+	if err != nil {
+		t.Fatalf("Dial returned an error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientCall(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("m", newStub("m", "p1"))
+	c := serve(t, k)
+
+	out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"p1", 2}})
+	if err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if out.InReplyTo != "1" || len(out.Parms) != 2 || out.Parms[1] != "m" {
+		t.Errorf("unexpected response: %+v", out)
+	}
+}
+
+func TestClientReject(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("m", newStub("m", "p1"))
+	c := serve(t, k)
+
+	out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"p2"}})
+	var reject *RejectError
+	if !errors.As(err, &reject) {
+		t.Fatalf("expected a RejectError, got %v", err)
+	}
+	if accepted(out) || !strings.Contains(err.Error(), ErrNoModule.Error()) {
+		t.Errorf("unexpected reject message %+v: %v", out, err)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	k := NewKernel()
+	gate := gateModule{gate: make(chan struct{})}
+	k.RegisterModule("gate", gate, "slow")
+	k.RegisterModule("echo", echoModule{}, "fast")
+	c := serve(t, k)
+
+	slow := make(chan error, 1)
+	go func() {
+		out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"slow"}})
+		if err == nil && out.Parms[1] != "gate" {
+			err = fmt.Errorf("unexpected response: %+v", out)
+		}
+		slow <- err
+	}()
+
+	// fast requests complete while the slow one is still in flight
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"fast", i}})
+			if err != nil {
+				t.Errorf("Call %d returned an error: %v", i, err)
+				return
+			}
+			if out.Parms[2] != int64(i) {
+				t.Errorf("Call %d got the response to another call: %+v", i, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case err := <-slow:
+		t.Fatalf("slow call returned before its gate opened: %v", err)
+	default:
+	}
+
+	close(gate.gate)
+	select {
+	case err := <-slow:
+		if err != nil {
+			t.Errorf("slow call failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("slow call never returned")
+	}
+}
+
+func TestClientInFlight(t *testing.T) {
+	k := NewKernel()
+	k.MaxInFlight = 2
+	m := countModule{gateModule{make(chan struct{})}, new(atomic.Int32), new(atomic.Int32)}
+	k.RegisterModule("count", m)
+	c := serve(t, k)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Call(context.Background(), &Message{Parms: []interface{}{"x", i}})
+			if err != nil {
+				t.Errorf("Call %d returned an error: %v", i, err)
+			}
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := m.n.Load(); n != 2 {
+		t.Errorf("expected 2 messages in flight, got %d", n)
+	}
+	close(m.gate)
+	wg.Wait()
+	if max := m.max.Load(); max > 2 {
+		t.Errorf("expected at most 2 messages in flight, got %d", max)
+	}
+}
+
+func TestClientCancelAndClose(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("gate", gateModule{gate: make(chan struct{})})
+	c := serve(t, k)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.Call(ctx, &Message{Parms: []interface{}{"x"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+
+	c.Close()
+	_, err = c.Call(context.Background(), &Message{Parms: []interface{}{"x"}})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
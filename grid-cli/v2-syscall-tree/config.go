@@ -0,0 +1,77 @@
+package v2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// logDir is where the event log is kept, relative to the directory
+// holding the grid configuration file.
+const logDir = "log"
+
+// readConfig returns the key=value lines of a grid configuration file
+// on fs.  A missing file is an empty configuration.
+func readConfig(fs afero.Fs, path string) (map[string]string, error) {
+	config := make(map[string]string)
+	buf, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), "=")
+		if ok {
+			config[key] = strings.TrimSpace(val)
+		}
+	}
+	return config, scanner.Err()
+}
+
+// LoadConfig applies a grid configuration file on the kernel's
+// filesystem: the module quotas described at LoadQuotas, cache
+// lifetimes for modules that opt in to caching, as lines of the form
+// cache.<module>=<duration>, and, if
+// event_log is set to a level such as "debug" or "info", a JSONL
+// event log in the log directory beside the file.
+func (k *Kernel) LoadConfig(path string) error {
+	err := k.LoadQuotas(path)
+	if err != nil {
+		return err
+	}
+	config, err := readConfig(k.fs, path)
+	if err != nil {
+		return err
+	}
+	for key, val := range config {
+		name, ok := strings.CutPrefix(key, "cache.")
+		if !ok || name == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		k.SetCacheTTL(name, ttl)
+	}
+	val, ok := config["event_log"]
+	if !ok {
+		return nil
+	}
+	var level slog.Level
+	err = level.UnmarshalText([]byte(val))
+	if err != nil {
+		return fmt.Errorf("event_log: %w", err)
+	}
+	return k.OpenEventLog(filepath.Join(filepath.Dir(path), logDir), level)
+}
@@ -0,0 +1,430 @@
+package v2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/multiformats/go-multihash"
+)
+
+// multihashTag is the CBOR tag that marks a byte string as a
+// multihash parm.  It is in the first-come-first-served range and not
+// registered with IANA.
+const multihashTag = 0x6d68 // "mh"
+
+// Multihash is a message parm holding a multihash, such as the
+// promise hash and module hash that lead a request.
+type Multihash []byte
+
+// ParseMultihash decodes a hex multihash.
+func ParseMultihash(s string) (Multihash, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multihash %q: %w", s, err)
+	}
+	_, err = multihash.Cast(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multihash %q: %w", s, err)
+	}
+	return Multihash(buf), nil
+}
+
+// String returns the multihash in hex.
+func (h Multihash) String() string {
+	return hex.EncodeToString(h)
+}
+
+// MarshalJSON encodes the multihash as {"/": {"multihash": "<hex>"}}.
+func (h Multihash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonTyped{jsonTypedValue{Multihash: h.String()}})
+}
+
+var (
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	encMode, err = cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	decMode, err = cbor.DecOptions{
+		DupMapKey:        cbor.DupMapKeyEnforcedAPF,
+		IndefLength:      cbor.IndefLengthForbidden,
+		IntDec:           cbor.IntDecConvertSignedOrFail,
+		DefaultMapType:   reflect.TypeOf(map[string]interface{}(nil)),
+		MaxNestedLevels:  32,
+		MaxArrayElements: 1 << 16,
+		MaxMapPairs:      1 << 16,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// wireMessage is the CBOR layout of a Message.  Integer keys keep the
+// encoding compact; core deterministic encoding sorts them.
+type wireMessage struct {
+	Parms     []interface{}          `cbor:"1,keyasint"`
+	Payload   map[string]interface{} `cbor:"2,keyasint,omitempty"`
+	ID        string                 `cbor:"3,keyasint,omitempty"`
+	InReplyTo string                 `cbor:"4,keyasint,omitempty"`
+	Trace     string                 `cbor:"5,keyasint,omitempty"`
+	Span      string                 `cbor:"6,keyasint,omitempty"`
+}
+
+// canonicalParm converts a parm to the value it is encoded as: nil,
+// bool, int64, string, []byte, or a tagged multihash.  Integral
+// floats, as decoded from JSON, become integers.
+func canonicalParm(parm interface{}) (interface{}, error) {
+	switch p := parm.(type) {
+	case nil, bool, string, int64:
+		return p, nil
+	case Multihash:
+		return cbor.Tag{Number: multihashTag, Content: []byte(p)}, nil
+	case []byte:
+		return p, nil
+	case int:
+		return int64(p), nil
+	case int8:
+		return int64(p), nil
+	case int16:
+		return int64(p), nil
+	case int32:
+		return int64(p), nil
+	case uint:
+		return canonicalUint(uint64(p))
+	case uint8:
+		return int64(p), nil
+	case uint16:
+		return int64(p), nil
+	case uint32:
+		return int64(p), nil
+	case uint64:
+		return canonicalUint(p)
+	case float32:
+		return canonicalFloat(float64(p))
+	case float64:
+		return canonicalFloat(p)
+	case json.Number:
+		if i, err := p.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := p.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return canonicalFloat(f)
+	}
+	return nil, fmt.Errorf("unsupported parm type %T", parm)
+}
+
+func canonicalUint(u uint64) (interface{}, error) {
+	if u > math.MaxInt64 {
+		return nil, fmt.Errorf("parm %d out of range", u)
+	}
+	return int64(u), nil
+}
+
+func canonicalFloat(f float64) (interface{}, error) {
+	if f != math.Trunc(f) || math.Abs(f) >= 1<<53 {
+		return nil, fmt.Errorf("non-integral number parm %v", f)
+	}
+	return int64(f), nil
+}
+
+// parmFromWire converts a decoded CBOR value back to a parm.
+func parmFromWire(v interface{}) (interface{}, error) {
+	switch p := v.(type) {
+	case nil, bool, string, int64, []byte:
+		return p, nil
+	case cbor.Tag:
+		content, ok := p.Content.([]byte)
+		if p.Number != multihashTag || !ok {
+			return nil, fmt.Errorf("unsupported CBOR tag %d in parms", p.Number)
+		}
+		_, err := multihash.Cast(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multihash parm: %w", err)
+		}
+		return Multihash(content), nil
+	}
+	return nil, fmt.Errorf("unsupported parm type %T", v)
+}
+
+// MarshalCBOR returns the message's deterministic CBOR encoding.
+func (m *Message) MarshalCBOR() ([]byte, error) {
+	w := wireMessage{
+		Parms:     make([]interface{}, len(m.Parms)),
+		Payload:   m.Payload,
+		ID:        m.ID,
+		InReplyTo: m.InReplyTo,
+		Trace:     m.Trace,
+		Span:      m.Span,
+	}
+	for i, p := range m.Parms {
+		c, err := canonicalParm(p)
+		if err != nil {
+			return nil, fmt.Errorf("parm %d: %w", i, err)
+		}
+		w.Parms[i] = c
+	}
+	return encMode.Marshal(&w)
+}
+
+// UnmarshalCBOR decodes a message encoded by MarshalCBOR.
+func (m *Message) UnmarshalCBOR(buf []byte) error {
+	var w wireMessage
+	err := decMode.Unmarshal(buf, &w)
+	if err != nil {
+		return err
+	}
+	parms := make([]interface{}, len(w.Parms))
+	for i, v := range w.Parms {
+		parms[i], err = parmFromWire(v)
+		if err != nil {
+			return fmt.Errorf("parm %d: %w", i, err)
+		}
+	}
+	*m = Message{
+		ID:        w.ID,
+		InReplyTo: w.InReplyTo,
+		Trace:     w.Trace,
+		Span:      w.Span,
+		Parms:     parms,
+		Payload:   w.Payload,
+	}
+	return nil
+}
+
+// CanonicalBytes returns the encoding that identifies the message:
+// its deterministic CBOR without the request, response and tracing
+// IDs, which belong to the transport rather than the content.
+func (m *Message) CanonicalBytes() ([]byte, error) {
+	c := *m
+	c.ID, c.InReplyTo, c.Trace, c.Span = "", "", "", ""
+	return c.MarshalCBOR()
+}
+
+// Hash returns the message's content address, the sha2-256 multihash
+// of its canonical bytes.
+func (m *Message) Hash() (Multihash, error) {
+	buf, err := m.CanonicalBytes()
+	if err != nil {
+		return nil, err
+	}
+	h, err := multihash.Sum(buf, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	return Multihash(h), nil
+}
+
+// PromiseHash returns the multihash of the promise leading a request.
+func (m *Message) PromiseHash() (Multihash, bool) {
+	return m.hashParm(0)
+}
+
+// ModuleHash returns the multihash of the module that follows the
+// promise hash in a request.
+func (m *Message) ModuleHash() (Multihash, bool) {
+	return m.hashParm(1)
+}
+
+func (m *Message) hashParm(i int) (Multihash, bool) {
+	if len(m.Parms) <= i {
+		return nil, false
+	}
+	h, ok := m.Parms[i].(Multihash)
+	return h, ok
+}
+
+// jsonTyped is the JSON form of a parm that JSON has no type for.  As
+// in DAG-JSON, the value sits under the reserved key "/", which no
+// other parm uses: parms are never objects.
+type jsonTyped struct {
+	Value jsonTypedValue `json:"/"`
+}
+
+type jsonTypedValue struct {
+	Bytes     *[]byte `json:"bytes,omitempty"`
+	Multihash string  `json:"multihash,omitempty"`
+}
+
+// jsonMessage is the JSON layout of a Message.
+type jsonMessage struct {
+	ID        string                 `json:"id,omitempty"`
+	InReplyTo string                 `json:"inReplyTo,omitempty"`
+	Trace     string                 `json:"trace,omitempty"`
+	Span      string                 `json:"span,omitempty"`
+	Parms     []interface{}          `json:"parms"`
+	Payload   map[string]interface{} `json:"payload"`
+}
+
+// MarshalJSON encodes the message as JSON for debugging and for
+// clients that cannot speak CBOR.  Byte string parms encode as
+// {"/": {"bytes": "<base64>"}} and multihashes as
+// {"/": {"multihash": "<hex>"}}.
+func (m Message) MarshalJSON() ([]byte, error) {
+	j := jsonMessage{
+		ID:        m.ID,
+		InReplyTo: m.InReplyTo,
+		Trace:     m.Trace,
+		Span:      m.Span,
+		Parms:     make([]interface{}, len(m.Parms)),
+		Payload:   m.Payload,
+	}
+	for i, p := range m.Parms {
+		if b, ok := p.([]byte); ok {
+			p = jsonTyped{jsonTypedValue{Bytes: &b}}
+		}
+		j.Parms[i] = p
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes the JSON form of a message.  Integral numbers
+// decode as int64 rather than float64, so that a message decoded from
+// JSON has the same content address as one decoded from CBOR.
+func (m *Message) UnmarshalJSON(buf []byte) error {
+	var j struct {
+		ID        string            `json:"id"`
+		InReplyTo string            `json:"inReplyTo"`
+		Trace     string            `json:"trace"`
+		Span      string            `json:"span"`
+		Parms     []json.RawMessage `json:"parms"`
+		Payload   json.RawMessage   `json:"payload"`
+	}
+	err := json.Unmarshal(buf, &j)
+	if err != nil {
+		return err
+	}
+	var parms []interface{}
+	if j.Parms != nil {
+		parms = make([]interface{}, len(j.Parms))
+	}
+	for i, raw := range j.Parms {
+		parms[i], err = parmFromJSON(raw)
+		if err != nil {
+			return fmt.Errorf("parm %d: %w", i, err)
+		}
+	}
+	var payload map[string]interface{}
+	if len(j.Payload) > 0 {
+		v, err := decodeJSON(j.Payload)
+		if err != nil {
+			return fmt.Errorf("payload: %w", err)
+		}
+		if v != nil {
+			var ok bool
+			payload, ok = v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("payload is not an object")
+			}
+		}
+	}
+	*m = Message{
+		ID:        j.ID,
+		InReplyTo: j.InReplyTo,
+		Trace:     j.Trace,
+		Span:      j.Span,
+		Parms:     parms,
+		Payload:   payload,
+	}
+	return nil
+}
+
+// parmFromJSON decodes a parm, recognizing the JSON forms of byte
+// strings and multihashes.  It refuses anything canonicalParm would,
+// such as arrays, other objects and non-integral numbers.
+func parmFromJSON(raw json.RawMessage) (interface{}, error) {
+	v, err := decodeJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := v.(map[string]interface{}); ok {
+		typed, _ := p["/"].(map[string]interface{})
+		if len(p) != 1 || len(typed) != 1 {
+			return nil, fmt.Errorf("object parms must be {\"/\": {\"bytes\"|\"multihash\": ...}}")
+		}
+		if s, ok := typed["multihash"].(string); ok {
+			return ParseMultihash(s)
+		}
+		if s, ok := typed["bytes"].(string); ok {
+			return base64.StdEncoding.DecodeString(s)
+		}
+		return nil, fmt.Errorf("unknown typed parm %v", typed)
+	}
+	return canonicalParm(v)
+}
+
+// decodeJSON decodes a JSON value as encoding/json would, except that
+// integral numbers become int64.
+func decodeJSON(raw json.RawMessage) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return fromJSONNumbers(v)
+}
+
+func fromJSONNumbers(v interface{}) (interface{}, error) {
+	var err error
+	switch p := v.(type) {
+	case json.Number:
+		if i, err := p.Int64(); err == nil {
+			return i, nil
+		}
+		return p.Float64()
+	case []interface{}:
+		for i := range p {
+			p[i], err = fromJSONNumbers(p[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k := range p {
+			p[k], err = fromJSONNumbers(p[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// encodeMessage encodes a message for a WebSocket frame of type mt:
+// binary frames carry CBOR and text frames carry JSON.
+func encodeMessage(mt int, m *Message) ([]byte, error) {
+	if mt == websocket.BinaryMessage {
+		return m.MarshalCBOR()
+	}
+	return json.Marshal(m)
+}
+
+// decodeMessage decodes a WebSocket frame of type mt.
+func decodeMessage(mt int, buf []byte) (m *Message, err error) {
+	m = &Message{}
+	if mt == websocket.BinaryMessage {
+		err = m.UnmarshalCBOR(buf)
+	} else {
+		err = json.Unmarshal(buf, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,213 @@
+package v2
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+func sum(t testing.TB, s string) Multihash {
+	h, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("multihash.Sum returned an error: %v", err)
+	}
+	return Multihash(h)
+}
+
+func request(t testing.TB) *Message {
+	return &Message{
+		ID:    "7",
+		Parms: []interface{}{sum(t, "promise"), sum(t, "module"), "arg", int64(-3), []byte{0, 1, 2}, true, nil},
+		Payload: map[string]interface{}{
+			"b": "two",
+			"a": int64(1),
+		},
+	}
+}
+
+func TestMessageCBORRoundTrip(t *testing.T) {
+	in := request(t)
+	buf, err := in.MarshalCBOR()
+	if err != nil {
+		t.Fatalf("MarshalCBOR returned an error: %v", err)
+	}
+	var out Message
+	if err := out.UnmarshalCBOR(buf); err != nil {
+		t.Fatalf("UnmarshalCBOR returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(in, &out) {
+		t.Errorf("round trip changed the message:\n got %#v\nwant %#v", &out, in)
+	}
+	if h, ok := out.PromiseHash(); !ok || !bytes.Equal(h, sum(t, "promise")) {
+		t.Errorf("unexpected promise hash %v", h)
+	}
+	if h, ok := out.ModuleHash(); !ok || !bytes.Equal(h, sum(t, "module")) {
+		t.Errorf("unexpected module hash %v", h)
+	}
+}
+
+func TestMessageCBORCanonical(t *testing.T) {
+	// Go integer kinds and integral floats encode alike
+	a := &Message{Parms: []interface{}{1, uint8(2), float64(3)}}
+	b := &Message{Parms: []interface{}{int64(1), int64(2), json.Number("3")}}
+	bufA, err := a.MarshalCBOR()
+	if err != nil {
+		t.Fatalf("MarshalCBOR returned an error: %v", err)
+	}
+	bufB, _ := b.MarshalCBOR()
+	if !bytes.Equal(bufA, bufB) {
+		t.Errorf("expected equal encodings, got %x and %x", bufA, bufB)
+	}
+
+	// bytes, strings and multihashes stay distinct
+	h := sum(t, "x")
+	encodings := map[string]bool{}
+	for _, p := range []interface{}{h, []byte(h), string(h)} {
+		buf, err := (&Message{Parms: []interface{}{p}}).MarshalCBOR()
+		if err != nil {
+			t.Fatalf("MarshalCBOR returned an error: %v", err)
+		}
+		encodings[string(buf)] = true
+	}
+	if len(encodings) != 3 {
+		t.Errorf("expected multihash, bytes and string parms to encode differently")
+	}
+
+	for _, p := range []interface{}{1.5, uint64(1 << 63), []string{"a"}, struct{}{}} {
+		if _, err := (&Message{Parms: []interface{}{p}}).MarshalCBOR(); err == nil {
+			t.Errorf("expected an error encoding parm %#v", p)
+		}
+	}
+}
+
+func TestMessageHash(t *testing.T) {
+	m := request(t)
+	h1, err := m.Hash()
+	if err != nil {
+		t.Fatalf("Hash returned an error: %v", err)
+	}
+	if _, err := multihash.Decode(h1); err != nil {
+		t.Errorf("Hash did not return a multihash: %v", err)
+	}
+
+	// transport IDs are not part of the content
+	m.ID, m.InReplyTo = "99", "3"
+	h2, _ := m.Hash()
+	if !bytes.Equal(h1, h2) {
+		t.Errorf("expected IDs not to change the hash")
+	}
+
+	// the same content decoded from JSON has the same address
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+	var fromJSON Message
+	if err := json.Unmarshal(buf, &fromJSON); err != nil {
+		t.Fatalf("json.Unmarshal returned an error: %v", err)
+	}
+	h3, err := fromJSON.Hash()
+	if err != nil {
+		t.Fatalf("Hash returned an error: %v", err)
+	}
+	if !bytes.Equal(h1, h3) {
+		t.Errorf("expected the JSON round trip to keep the hash")
+	}
+
+	m.Parms = append(m.Parms, "more")
+	h4, _ := m.Hash()
+	if bytes.Equal(h1, h4) {
+		t.Errorf("expected different content to hash differently")
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	in := request(t)
+	buf, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+	var out Message
+	if err := json.Unmarshal(buf, &out); err != nil {
+		t.Fatalf("json.Unmarshal returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(in, &out) {
+		t.Errorf("round trip changed the message:\n got %#v\nwant %#v\nJSON %s", &out, in, buf)
+	}
+
+	var hand Message
+	err = json.Unmarshal([]byte(`{"parms":[{"/":{"multihash":"`+sum(t, "p").String()+`"}},2,2.0,{"/":{"bytes":"AAE="}}],"payload":{"bytes":"x"}}`), &hand)
+	if err != nil {
+		t.Fatalf("json.Unmarshal returned an error: %v", err)
+	}
+	want := []interface{}{sum(t, "p"), int64(2), int64(2), []byte{0, 1}}
+	if !reflect.DeepEqual(hand.Parms, want) {
+		t.Errorf("unexpected parms %#v", hand.Parms)
+	}
+
+	// parms the kernel could route but not encode are refused up
+	// front, and an object is a typed parm only under "/"
+	for _, bad := range []string{
+		`{"parms":[{"/":{"multihash":"zz"}}]}`,
+		`{"parms":[2.5]}`,
+		`{"parms":[["a"]]}`,
+		`{"parms":[{"bytes":"AAE="}]}`,
+		`{"parms":[{"/":{"other":"x"}}]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &hand); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func FuzzMessageCBOR(f *testing.F) {
+	seed, _ := request(f).MarshalCBOR()
+	f.Add(seed)
+	f.Add([]byte{0xa1, 0x01, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Message
+		if err := m.UnmarshalCBOR(data); err != nil {
+			return
+		}
+		buf1, err := m.MarshalCBOR()
+		if err != nil {
+			t.Fatalf("failed to re-encode a decoded message %#v: %v", m, err)
+		}
+		var m2 Message
+		if err := m2.UnmarshalCBOR(buf1); err != nil {
+			t.Fatalf("failed to decode a canonical encoding %x: %v", buf1, err)
+		}
+		buf2, err := m2.MarshalCBOR()
+		if err != nil {
+			t.Fatalf("failed to re-encode: %v", err)
+		}
+		if !bytes.Equal(buf1, buf2) {
+			t.Errorf("encoding is not stable: %x != %x", buf1, buf2)
+		}
+	})
+}
+
+func FuzzMessageJSON(f *testing.F) {
+	seed, _ := json.Marshal(request(f))
+	f.Add(seed)
+	f.Add([]byte(`{"parms":[1,"a",{"/":{"bytes":""}}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		// whatever JSON decodes to must either encode canonically
+		// or be refused, never panic
+		buf, err := m.MarshalCBOR()
+		if err != nil {
+			return
+		}
+		var m2 Message
+		if err := m2.UnmarshalCBOR(buf); err != nil {
+			t.Fatalf("failed to decode a canonical encoding %x: %v", buf, err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package v2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Names of the events the kernel logs.
+const (
+	EventPeerConnect    = "peer.connect"
+	EventPeerDisconnect = "peer.disconnect"
+	EventRequest        = "request"
+	EventCacheHit       = "cache.hit"
+	EventCacheMiss      = "cache.miss"
+	EventRoute          = "route"
+	EventAccept         = "promise.accept"
+	EventReject         = "promise.reject"
+	EventFulfil         = "promise.fulfil"
+	EventBrokenPromise  = "promise.broken"
+	EventModuleRestart  = "module.restart"
+	EventError          = "error"
+)
+
+// eventLogFile is the JSONL event log in the log directory.
+const eventLogFile = "events.jsonl"
+
+// newSpanID returns a random trace or span ID.
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// event logs a kernel event about message in, tagged with the
+// message's trace and span, to Log and to the event log if one is
+// open.
+func (k *Kernel) event(level slog.Level, event string, in *Message, args ...any) {
+	if in != nil && in.Trace != "" {
+		args = append([]any{"trace", in.Trace, "span", in.Span}, args...)
+	}
+	k.Log.Log(context.Background(), level, event, args...)
+	k.eventsMu.RLock()
+	defer k.eventsMu.RUnlock()
+	if k.events != nil {
+		k.events.Log(context.Background(), level, event, args...)
+	}
+}
+
+// logs returns true if an event at level would be logged anywhere.
+func (k *Kernel) logs(level slog.Level) bool {
+	ctx := context.Background()
+	if k.Log.Enabled(ctx, level) {
+		return true
+	}
+	k.eventsMu.RLock()
+	defer k.eventsMu.RUnlock()
+	return k.events != nil && k.events.Enabled(ctx, level)
+}
+
+// OpenEventLog opens an event log that appends the kernel's events at
+// level and above, as JSON lines, to a file in dir on the kernel's
+// filesystem.  Events still go to Log as well.  An event log opened
+// earlier is closed; Close closes the last one.
+func (k *Kernel) OpenEventLog(dir string, level slog.Level) error {
+	err := k.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := k.fs.OpenFile(filepath.Join(dir, eventLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	k.eventsMu.Lock()
+	old := k.eventFile
+	k.events = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level}))
+	k.eventFile = f
+	k.eventsMu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package v2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// readEvents returns the records in the kernel's JSONL event log.
+func readEvents(t *testing.T, k *Kernel) (events []map[string]interface{}) {
+	buf, err := afero.ReadFile(k.fs, "/grid/log/"+eventLogFile)
+	if err != nil {
+		t.Fatalf("Failed to read event log: %v", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		var e map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("Invalid event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return
+}
+
+// find returns the first event named msg.
+func find(events []map[string]interface{}, msg string) map[string]interface{} {
+	for _, e := range events {
+		if e["msg"] == msg {
+			return e
+		}
+	}
+	return nil
+}
+
+// newLogKernel returns a kernel logging debug events to a JSONL sink
+// configured in /grid/config, which also opts the module "backup" in
+// to caching.
+func newLogKernel(t *testing.T) *Kernel {
+	k := NewKernel()
+	k.fs = afero.NewMemMapFs()
+	k.Log = slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	afero.WriteFile(k.fs, "/grid/config", []byte("event_log=debug\ncache.backup=1m\n"), 0644)
+	if err := k.LoadConfig("/grid/config"); err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	return k
+}
+
+func TestEventLog(t *testing.T) {
+	k := newLogKernel(t)
+	broken := newStub("broken", "p1")
+	broken.fail = true
+	k.RegisterModule("broken", broken, "p1")
+	k.RegisterModule("backup", newStub("backup", "p1"))
+
+	in := &Message{Parms: []interface{}{"p1"}, Trace: "t1", Span: "s1"}
+	for i := 0; i < 2; i++ {
+		if _, err := k.handleMessage(context.Background(), in); err != nil {
+			t.Fatalf("handleMessage returned an error: %v", err)
+		}
+	}
+
+	events := readEvents(t, k)
+	for _, name := range []string{EventCacheMiss, EventRoute, EventAccept, EventBrokenPromise, EventFulfil, EventCacheHit} {
+		e := find(events, name)
+		if e == nil {
+			t.Errorf("no %s event in %v", name, events)
+			continue
+		}
+		if e["trace"] != "t1" || e["span"] != "s1" {
+			t.Errorf("%s event is not tagged with the message's span: %v", name, e)
+		}
+	}
+	if e := find(events, EventBrokenPromise); e != nil && (e["module"] != "broken" || e["level"] != "WARN") {
+		t.Errorf("unexpected broken promise event: %v", e)
+	}
+	if e := find(events, EventFulfil); e != nil && e["module"] != "backup" {
+		t.Errorf("unexpected fulfil event: %v", e)
+	}
+}
+
+func TestEventLogReopen(t *testing.T) {
+	k := NewKernel()
+	k.fs = afero.NewMemMapFs()
+	k.Log = slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if err := k.OpenEventLog("/a", slog.LevelInfo); err != nil {
+		t.Fatalf("OpenEventLog returned an error: %v", err)
+	}
+	first := k.eventFile
+
+	// events may be logged while the log is reopened
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			k.event(slog.LevelInfo, EventRequest, nil, "i", i)
+		}
+	}()
+	if err := k.OpenEventLog("/b", slog.LevelInfo); err != nil {
+		t.Fatalf("OpenEventLog returned an error: %v", err)
+	}
+	wg.Wait()
+	if _, err := first.Write([]byte("x")); err == nil {
+		t.Errorf("expected the replaced event log to be closed")
+	}
+
+	k.event(slog.LevelInfo, EventModuleRestart, nil)
+	if err := k.Close(); err != nil {
+		t.Errorf("Close returned an error: %v", err)
+	}
+	k.event(slog.LevelInfo, EventError, nil)
+	buf, _ := afero.ReadFile(k.fs, "/b/"+eventLogFile)
+	if !bytes.Contains(buf, []byte(EventModuleRestart)) || bytes.Contains(buf, []byte(EventError)) {
+		t.Errorf("expected events up to Close in the new log, got %s", buf)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	k := newLogKernel(t)
+	k.RegisterModule("m", newStub("m", "p1"))
+	c := serve(t, k)
+
+	out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"p1"}, Trace: "t1", Span: "upstream"})
+	if err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if out.Trace != "t1" || out.Span == "" || out.Span == "upstream" {
+		t.Errorf("expected the reply to carry the kernel's span of trace t1, got %q/%q", out.Trace, out.Span)
+	}
+	e := find(readEvents(t, k), EventRequest)
+	if e == nil || e["parent"] != "upstream" || e["span"] != out.Span {
+		t.Errorf("expected a request event with parent upstream, got %v", e)
+	}
+
+	// a message without a trace starts one
+	out, err = c.Call(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if out.Trace == "" || out.Trace == "t1" {
+		t.Errorf("expected a new trace, got %q", out.Trace)
+	}
+}
+
+func TestTraceNotContent(t *testing.T) {
+	m := &Message{Parms: []interface{}{"p1"}}
+	traced := &Message{Parms: []interface{}{"p1"}, Trace: "t1", Span: "s1"}
+	a, err := m.Hash()
+	if err != nil {
+		t.Fatalf("Hash returned an error: %v", err)
+	}
+	b, err := traced.Hash()
+	if err != nil {
+		t.Fatalf("Hash returned an error: %v", err)
+	}
+	if a.String() != b.String() {
+		t.Errorf("tracing IDs changed the message's hash")
+	}
+
+	buf, err := traced.MarshalCBOR()
+	if err != nil {
+		t.Fatalf("MarshalCBOR returned an error: %v", err)
+	}
+	var got Message
+	if err := got.UnmarshalCBOR(buf); err != nil {
+		t.Fatalf("UnmarshalCBOR returned an error: %v", err)
+	}
+	if got.Trace != "t1" || got.Span != "s1" {
+		t.Errorf("tracing IDs lost in CBOR round trip: %+v", got)
+	}
+}
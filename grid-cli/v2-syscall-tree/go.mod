@@ -3,8 +3,21 @@ module v2
 go 1.22.1
 
 require (
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/multiformats/go-multihash v0.2.3
 	github.com/spf13/afero v1.11.0
+	golang.org/x/sys v0.15.0
 )
 
-require golang.org/x/text v0.14.0 // indirect
+require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/minio/sha256-simd v1.0.0 // indirect
+	github.com/mr-tron/base58 v1.2.0 // indirect
+	github.com/multiformats/go-varint v0.0.6 // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	lukechampine.com/blake3 v1.1.6 // indirect
+)
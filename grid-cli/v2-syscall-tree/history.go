@@ -0,0 +1,291 @@
+package v2
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Defaults for acceptance history decay and rejection skipping.
+const (
+	DefaultHalfLife        = time.Hour
+	DefaultRejectThreshold = 3.0
+	DefaultMaxHistory      = 10000
+)
+
+// historyFile is where the kernel keeps acceptance history, relative
+// to its state directory.
+const historyFile = "history.json"
+
+// Outcome is what happened when the kernel consulted a module.
+type Outcome int
+
+const (
+	Rejected  Outcome = iota // the module declined the message
+	Accepted                 // the module promised to handle the message
+	Fulfilled                // the module handled the message it accepted
+)
+
+// Acceptance is the decayed history of one module at one syscall
+// tree node.  Counts decay exponentially toward zero so that recent
+// behavior outweighs old behavior.
+type Acceptance struct {
+	Accepts float64 `json:"accepts"`
+	Rejects float64 `json:"rejects"`
+	Fulfils float64 `json:"fulfils"`
+	Updated int64   `json:"updated"` // unix nanoseconds
+}
+
+// decay ages the counts to now.
+func (a *Acceptance) decay(now time.Time, halfLife time.Duration) {
+	if a.Updated != 0 && halfLife > 0 {
+		dt := float64(now.UnixNano() - a.Updated)
+		if dt > 0 {
+			f := math.Pow(0.5, dt/float64(halfLife))
+			a.Accepts *= f
+			a.Rejects *= f
+			a.Fulfils *= f
+		}
+	}
+	a.Updated = now.UnixNano()
+}
+
+// record ages the counts to now and then counts outcome.
+func (a *Acceptance) record(outcome Outcome, now time.Time, halfLife time.Duration) {
+	a.decay(now, halfLife)
+	switch outcome {
+	case Rejected:
+		a.Rejects++
+	case Accepted:
+		a.Accepts++
+	case Fulfilled:
+		a.Fulfils++
+	}
+}
+
+// Likelihood estimates the probability that consulting the module
+// ends with the message handled.  A module with no history scores
+// 0.5.
+func (a Acceptance) Likelihood() float64 {
+	return (a.Fulfils + 1) / (a.Accepts + a.Rejects + 2)
+}
+
+// Shunned returns true if the module has recently rejected at least
+// threshold more messages than it accepted.
+func (a Acceptance) Shunned(threshold float64) bool {
+	return a.Rejects-a.Accepts >= threshold
+}
+
+// weight returns the total of the counts decayed to now.
+func (a Acceptance) weight(now time.Time, halfLife time.Duration) float64 {
+	a.decay(now, halfLife)
+	return a.Accepts + a.Rejects + a.Fulfils
+}
+
+// Record counts an outcome for the named module at the node for
+// parms, creating nodes as needed.  When the tree holds more than
+// MaxHistory records, the lightest quarter are pruned.
+func (t *SyscallTree) Record(name string, outcome Outcome, now time.Time, parms ...interface{}) error {
+	keys, err := parmKeys(parms)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := t.root
+	for _, key := range keys {
+		child, ok := node.children[key]
+		if !ok {
+			child = newSyscallNode()
+			node.children[key] = child
+		}
+		node = child
+	}
+	if node.history == nil {
+		node.history = make(map[string]*Acceptance)
+	}
+	a, ok := node.history[name]
+	if !ok {
+		a = &Acceptance{}
+		node.history[name] = a
+		t.records++
+	}
+	a.record(outcome, now, t.HalfLife)
+	if t.MaxHistory > 0 && t.records > t.MaxHistory {
+		t.prune(now, t.MaxHistory*3/4)
+	}
+	return nil
+}
+
+// prune drops the history records with the least weight decayed to
+// now until at most keep remain, and removes nodes left empty.  The
+// caller holds t.mu.
+func (t *SyscallTree) prune(now time.Time, keep int) {
+	type entry struct {
+		node   *SyscallNode
+		name   string
+		weight float64
+	}
+	var entries []entry
+	var walk func(n *SyscallNode)
+	walk = func(n *SyscallNode) {
+		for name, a := range n.history {
+			entries = append(entries, entry{n, name, a.weight(now, t.HalfLife)})
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(t.root)
+	if len(entries) <= keep {
+		t.records = len(entries)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].weight < entries[j].weight })
+	for _, e := range entries[:len(entries)-keep] {
+		delete(e.node.history, e.name)
+	}
+	t.records = keep
+	t.root.pruneEmpty()
+}
+
+// pruneEmpty removes n's descendants that have no modules, children
+// or history, and reports whether n is now empty.
+func (n *SyscallNode) pruneEmpty() (empty bool) {
+	for key, child := range n.children {
+		if child.pruneEmpty() {
+			delete(n.children, key)
+		}
+	}
+	return len(n.modules) == 0 && len(n.children) == 0 && len(n.history) == 0
+}
+
+// rank orders candidates by the likelihood learned from their most
+// specific history along the path of parms, most likely first, and
+// drops shunned modules.  Candidates with equal likelihood keep their
+// longest-match order.
+func (t *SyscallTree) rank(candidates []Candidate, now time.Time, parms ...interface{}) (ranked []Candidate, err error) {
+	keys, err := parmKeys(parms)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	path := []*SyscallNode{t.root}
+	node := t.root
+	for _, key := range keys {
+		child, ok := node.children[key]
+		if !ok {
+			break
+		}
+		node = child
+		path = append(path, node)
+	}
+	for _, c := range candidates {
+		for i := len(path) - 1; i >= 0; i-- {
+			if a, ok := path[i].history[c.Name]; ok {
+				c.History = *a
+				c.History.decay(now, t.HalfLife)
+				break
+			}
+		}
+		if c.History.Shunned(t.RejectThreshold) {
+			continue
+		}
+		ranked = append(ranked, c)
+	}
+	t.mu.RUnlock()
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].History.Likelihood() > ranked[j].History.Likelihood()
+	})
+	return
+}
+
+// historyRecord is one node's history for one module, as persisted.
+type historyRecord struct {
+	Path   []string   `json:"path"` // canonical parm keys
+	Module string     `json:"module"`
+	Acc    Acceptance `json:"acceptance"`
+}
+
+// SaveHistory writes the tree's acceptance history to path on fs.
+func (t *SyscallTree) SaveHistory(fs afero.Fs, path string) error {
+	var records []historyRecord
+	t.mu.RLock()
+	var walk func(n *SyscallNode, keys []string)
+	walk = func(n *SyscallNode, keys []string) {
+		for name, a := range n.history {
+			records = append(records, historyRecord{
+				Path:   append([]string(nil), keys...),
+				Module: name,
+				Acc:    *a,
+			})
+		}
+		for key, child := range n.children {
+			walk(child, append(keys, key))
+		}
+	}
+	walk(t.root, nil)
+	t.mu.RUnlock()
+
+	buf, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = afero.WriteFile(fs, tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(tmp, path)
+}
+
+// LoadHistory merges acceptance history from path on fs into the
+// tree.  A missing file is not an error.
+func (t *SyscallTree) LoadHistory(fs afero.Fs, path string) error {
+	buf, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []historyRecord
+	err = json.Unmarshal(buf, &records)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range records {
+		node := t.root
+		for _, key := range r.Path {
+			child, ok := node.children[key]
+			if !ok {
+				child = newSyscallNode()
+				node.children[key] = child
+			}
+			node = child
+		}
+		if node.history == nil {
+			node.history = make(map[string]*Acceptance)
+		}
+		if _, ok := node.history[r.Module]; !ok {
+			t.records++
+		}
+		a := r.Acc
+		node.history[r.Module] = &a
+	}
+	if t.MaxHistory > 0 && t.records > t.MaxHistory {
+		t.prune(time.Now(), t.MaxHistory)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package v2
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestAcceptanceDecay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := &Acceptance{}
+	a.record(Rejected, now, time.Hour)
+	a.record(Rejected, now, time.Hour)
+	a.record(Accepted, now, time.Hour)
+	if a.Rejects != 2 || a.Accepts != 1 {
+		t.Fatalf("unexpected counts %+v", a)
+	}
+	a.decay(now.Add(2*time.Hour), time.Hour)
+	if math.Abs(a.Rejects-0.5) > 1e-9 || math.Abs(a.Accepts-0.25) > 1e-9 {
+		t.Errorf("unexpected decayed counts %+v", a)
+	}
+}
+
+func TestAcceptanceLikelihood(t *testing.T) {
+	cases := []struct {
+		name string
+		a    Acceptance
+		want float64
+	}{
+		{"no history", Acceptance{}, 0.5},
+		{"always fulfils", Acceptance{Accepts: 8, Fulfils: 8}, 0.9},
+		{"always rejects", Acceptance{Rejects: 8}, 0.1},
+		{"breaks promises", Acceptance{Accepts: 8}, 0.1},
+	}
+	for _, c := range cases {
+		if got := c.a.Likelihood(); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s: Likelihood() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// newClockKernel returns a kernel whose clock is controlled by the
+// returned pointer.
+func newClockKernel(t *testing.T, fs afero.Fs) (k *Kernel, clock *time.Time) {
+	k, err := NewKernelWithFs(fs, "/state")
+	if err != nil {
+		t.Fatalf("NewKernelWithFs returned an error: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	clock = &now
+	k.now = func() time.Time { return *clock }
+	return
+}
+
+func TestConsultModulesLearnsOrder(t *testing.T) {
+	k, _ := newClockKernel(t, afero.NewMemMapFs())
+	picky := newStub("picky", "p2")
+	eager := newStub("eager", "p1")
+	k.RegisterModule("picky", picky)
+	k.RegisterModule("eager", eager)
+
+	msg := &Message{Parms: []interface{}{"p1", "x"}}
+	if _, err := k.consultModules(context.Background(), msg); err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if picky.tested != 1 {
+		t.Fatalf("expected picky to be consulted first, tested %d times", picky.tested)
+	}
+
+	// eager has a history of handling such messages, so it is now
+	// consulted first even from a less specific prefix
+	k.tree.Remove("eager")
+	k.tree.Add("eager", eager)
+	for i := 0; i < 3; i++ {
+		k.tree.Record("eager", Accepted, k.now(), msg.Parms...)
+		k.tree.Record("eager", Fulfilled, k.now(), msg.Parms...)
+	}
+	picky.tested = 0
+	if _, err := k.consultModules(context.Background(), msg); err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if picky.tested != 0 {
+		t.Errorf("expected eager to be consulted before picky")
+	}
+}
+
+func TestConsultModulesShunsRejecters(t *testing.T) {
+	k, clock := newClockKernel(t, afero.NewMemMapFs())
+	picky := newStub("picky", "p2")
+	eager := newStub("eager", "p1")
+	k.RegisterModule("picky", picky)
+	k.RegisterModule("eager", eager)
+
+	msg := &Message{Parms: []interface{}{"p1"}}
+	for i := 0; i < 5; i++ {
+		if _, err := k.consultModules(context.Background(), msg); err != nil {
+			t.Fatalf("consultModules returned an error: %v", err)
+		}
+	}
+	// eager moves ahead after the first success, so picky is asked
+	// only once
+	if picky.tested != 1 || eager.handled != 5 {
+		t.Fatalf("unexpected consultations: picky tested %d, eager handled %d", picky.tested, eager.handled)
+	}
+
+	// picky rejects p3 repeatedly and is then shunned for it
+	msg = &Message{Parms: []interface{}{"p3"}}
+	for i := 0; i < 5; i++ {
+		k.consultModules(context.Background(), msg)
+	}
+	if got := k.tree.root.children["s:p3"].history["picky"].Rejects; got != DefaultRejectThreshold {
+		t.Errorf("expected picky to be consulted until shunned, got %v rejections", got)
+	}
+
+	// after the rejections decay, picky is consulted again
+	*clock = clock.Add(4 * DefaultHalfLife)
+	k.consultModules(context.Background(), msg)
+	if got := k.tree.root.children["s:p3"].history["picky"].Rejects; got < 1 || got > 1.5 {
+		t.Errorf("expected picky to be consulted again after decay, rejections %v", got)
+	}
+}
+
+func TestHistoryPersists(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	k, _ := newClockKernel(t, fs)
+	k.RegisterModule("eager", newStub("eager", "p1"))
+	msg := &Message{Parms: []interface{}{"p1", 7, []byte{1, 2}}}
+	if _, err := k.consultModules(context.Background(), msg); err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if ok, _ := afero.Exists(fs, k.historyPath()); ok {
+		t.Errorf("expected history to be saved only when flushed")
+	}
+	if err := k.FlushHistory(); err != nil {
+		t.Fatalf("FlushHistory returned an error: %v", err)
+	}
+
+	// a new kernel on the same fs starts with the old history
+	k2, _ := newClockKernel(t, fs)
+	routes, _ := k2.tree.Route(msg.Parms...)
+	if len(routes) != 0 {
+		t.Errorf("expected no modules before registration, got %+v", routes)
+	}
+	k2.RegisterModule("eager", newStub("eager", "p1"))
+	routes, _ = k2.tree.Route(msg.Parms...)
+	ranked, err := k2.tree.rank(routes, k2.now(), msg.Parms...)
+	if err != nil {
+		t.Fatalf("rank returned an error: %v", err)
+	}
+	if len(ranked) != 1 || ranked[0].History.Fulfils != 1 || ranked[0].History.Accepts != 1 {
+		t.Errorf("expected restored history, got %+v", ranked)
+	}
+}
+
+func TestHistoryCap(t *testing.T) {
+	tree := NewSyscallTree()
+	tree.MaxHistory = 8
+	now := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		tree.Record("busy", Fulfilled, now, "p1")
+	}
+	for i := 0; i < 100; i++ {
+		tree.Record("m", Rejected, now, "p2", i)
+	}
+	if tree.records > tree.MaxHistory {
+		t.Errorf("expected at most %d records, got %d", tree.MaxHistory, tree.records)
+	}
+	if _, ok := tree.root.children["s:p1"].history["busy"]; !ok {
+		t.Errorf("expected the heaviest record to survive pruning")
+	}
+	if n := len(tree.root.children["s:p2"].children); n > tree.MaxHistory {
+		t.Errorf("expected empty nodes to be pruned, %d remain", n)
+	}
+}
+
+func TestHistoryFlushFailure(t *testing.T) {
+	k, _ := newClockKernel(t, afero.NewMemMapFs())
+	k.fs = afero.NewReadOnlyFs(k.fs)
+	k.RegisterModule("eager", newStub("eager", "p1"))
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if err != nil || out == nil {
+		t.Fatalf("expected the message to be handled, got %v, %v", out, err)
+	}
+	if err := k.FlushHistory(); err == nil {
+		t.Errorf("expected FlushHistory to fail on a read-only fs")
+	}
+	if !k.historyDirty.Load() {
+		t.Errorf("expected history to stay dirty after a failed save")
+	}
+}
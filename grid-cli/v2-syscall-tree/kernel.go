@@ -2,82 +2,451 @@ package v2
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/spf13/afero"
 )
 
-// SyscallNode represents a node in the hierarchical syscall tree
-type SyscallNode struct {
-	modules  []Module
-	children map[string]*SyscallNode
-}
+// ErrNoModule is returned when no module accepts a message.
+var ErrNoModule = errors.New("no module could handle the request")
+
+// errUnfulfilled is the cause recorded when a module that accepted a
+// message replies without fulfilling it.
+var errUnfulfilled = errors.New("module replied without fulfilling its promise")
+
+// DefaultMaxInFlight bounds how many messages from one WebSocket
+// connection a kernel handles at once.
+const DefaultMaxInFlight = 64
+
+// DefaultHistoryFlushInterval is how often a serving kernel saves
+// changed acceptance history.
+const DefaultHistoryFlushInterval = time.Minute
 
 // Kernel struct with the syscall tree root and file system abstraction
 type Kernel struct {
-	root    *SyscallNode
-	fs      afero.Fs
-	modules map[string]Module // Known modules
+	tree     *SyscallTree
+	fs       afero.Fs
+	stateDir string // where history is persisted; "" for none
+	mu       sync.RWMutex
+	saveMu   sync.Mutex
+	// historyDirty is set when history changes and cleared when it
+	// is saved.
+	historyDirty atomic.Bool
+	modules      map[string]Module        // Known modules
+	quotas       map[string]Quota         // by module name, with "default"
+	cacheTTLs    map[string]time.Duration // by module name; see SetCacheTTL
+	now          func() time.Time
+	key          ed25519.PrivateKey // signs broken promise records
+	cache        *LocalCacheModule  // checked before consulting modules
+	caches       []cacheLink        // module-provided caches, after cache
+
+	relMu       sync.Mutex
+	reliability map[string]*Reliability
+	broken      []*BrokenPromise
+
+	// RetryTimeout bounds how long a message is rerouted to other
+	// modules after broken promises.  Zero means no bound beyond the
+	// caller's context.
+	RetryTimeout time.Duration
+	// MaxBrokenPromises bounds how many broken promise records
+	// BrokenPromises keeps in memory; older ones are only in the
+	// state directory's log.  Zero means no bound.
+	MaxBrokenPromises int
+	// MaxInFlight bounds how many messages from one WebSocket
+	// connection are handled at once; the connection is not read
+	// while that many are in flight.  Zero means no bound.
+	MaxInFlight int
+	// HistoryFlushInterval is how often Serve saves acceptance
+	// history that has changed.
+	HistoryFlushInterval time.Duration
+	// CacheTTL bounds how long a hit from a module-provided cache is
+	// copied into the caches ahead of it.  Zero disables the cache
+	// chain.  Module results are cached only for modules that opt in
+	// with SetCacheTTL.
+	CacheTTL time.Duration
+	// OnBrokenPromise, if set, is called with each signed broken
+	// promise record, e.g. to publish it to peers.
+	OnBrokenPromise func(*BrokenPromise)
+	// Log receives the kernel's events: peer connections, cache hits
+	// and misses, routing decisions, accepts, rejects and broken
+	// promises.
+	Log *slog.Logger
+
+	eventsMu  sync.RWMutex
+	events    *slog.Logger // the event log opened by OpenEventLog
+	eventFile afero.File   // that the event log writes to
 }
 
 // NewKernel initializes a new Kernel instance with embedded modules
 func NewKernel() *Kernel {
-	return &Kernel{
-		root: &SyscallNode{
-			children: make(map[string]*SyscallNode),
-		},
-		fs:      afero.NewOsFs(),
-		modules: make(map[string]Module), // Initialize with known modules
+	key, err := loadKey(nil, "")
+	if err != nil {
+		panic(err)
 	}
+	k := &Kernel{
+		tree:                 NewSyscallTree(),
+		fs:                   afero.NewOsFs(),
+		modules:              make(map[string]Module), // Initialize with known modules
+		now:                  time.Now,
+		key:                  key,
+		reliability:          make(map[string]*Reliability),
+		RetryTimeout:         DefaultRetryTimeout,
+		MaxBrokenPromises:    DefaultMaxBrokenPromises,
+		MaxInFlight:          DefaultMaxInFlight,
+		HistoryFlushInterval: DefaultHistoryFlushInterval,
+		CacheTTL:             DefaultCacheTTL,
+		Log:                  slog.Default(),
+	}
+	k.setCache(afero.NewMemMapFs(), "/")
+	return k
 }
 
-// HandleWebSocket handles incoming WebSocket connections and messages
+// Close releases the kernel's resources.  It closes the event log,
+// if one is open.
+func (k *Kernel) Close() error {
+	k.eventsMu.Lock()
+	defer k.eventsMu.Unlock()
+	k.events = nil
+	if k.eventFile == nil {
+		return nil
+	}
+	err := k.eventFile.Close()
+	k.eventFile = nil
+	return err
+}
+
+// setCache gives the kernel a cache at dir on fs that follows the
+// kernel's clock and holds at most DefaultCacheSize bytes.
+func (k *Kernel) setCache(fs afero.Fs, dir string) {
+	k.cache = NewLocalCacheModule(fs, dir)
+	k.cache.now = func() time.Time { return k.now() }
+	k.cache.MaxSize = DefaultCacheSize
+}
+
+// NewKernelWithFs returns a kernel that keeps its state, such as
+// acceptance history, its signing key, its broken promise log and its
+// cache, in stateDir on fs, loading any state saved by a previous
+// kernel.
+func NewKernelWithFs(fs afero.Fs, stateDir string) (k *Kernel, err error) {
+	k = NewKernel()
+	k.fs = fs
+	k.stateDir = stateDir
+	k.setCache(fs, filepath.Join(stateDir, kernelCacheDir))
+	k.key, err = loadKey(fs, stateDir)
+	if err != nil {
+		return nil, err
+	}
+	err = k.tree.LoadHistory(fs, k.historyPath())
+	return
+}
+
+func (k *Kernel) historyPath() string {
+	return filepath.Join(k.stateDir, historyFile)
+}
+
+// SaveHistory persists the syscall tree's acceptance history.  It is
+// a no-op for a kernel without a state directory.
+func (k *Kernel) SaveHistory() error {
+	if k.stateDir == "" {
+		return nil
+	}
+	k.saveMu.Lock()
+	defer k.saveMu.Unlock()
+	k.historyDirty.Store(false)
+	err := k.tree.SaveHistory(k.fs, k.historyPath())
+	if err != nil {
+		k.historyDirty.Store(true)
+	}
+	return err
+}
+
+// FlushHistory saves acceptance history if it has changed since it
+// was last saved.
+func (k *Kernel) FlushHistory() error {
+	if !k.historyDirty.Load() {
+		return nil
+	}
+	return k.SaveHistory()
+}
+
+// flushHistoryEvery flushes history every interval until stop is
+// closed, logging failures, and flushes it once more on the way out.
+func (k *Kernel) flushHistoryEvery(interval time.Duration, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for done := false; !done; {
+		select {
+		case <-tick:
+		case <-stop:
+			done = true
+		}
+		if err := k.FlushHistory(); err != nil {
+			k.event(slog.LevelError, EventError, nil, "op", "history.save", "err", err)
+		}
+	}
+}
+
+// RegisterModule makes a module known to the kernel under name and
+// attaches it to the syscall tree at the given parms prefix.  A
+// module registered with no prefix is consulted for every message
+// that no more specific module handles.  A module may be registered
+// at several prefixes by calling RegisterModule more than once.
+func (k *Kernel) RegisterModule(name string, module Module, prefix ...interface{}) error {
+	k.mu.Lock()
+	if existing, ok := k.modules[name]; ok && existing != module {
+		k.mu.Unlock()
+		return fmt.Errorf("module %s already registered", name)
+	}
+	k.modules[name] = module
+	k.mu.Unlock()
+	if s, ok := module.(QuotaSetter); ok {
+		s.SetQuota(k.quota(name))
+	}
+	return k.tree.Add(name, module, prefix...)
+}
+
+// UnregisterModule removes a module from the kernel and from every
+// node of the syscall tree.
+func (k *Kernel) UnregisterModule(name string) {
+	k.mu.Lock()
+	delete(k.modules, name)
+	k.mu.Unlock()
+	k.tree.Remove(name)
+}
+
+// Module returns the module registered under name.
+func (k *Kernel) Module(name string) (module Module, ok bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	module, ok = k.modules[name]
+	return
+}
+
+// HandleWebSocket handles incoming WebSocket connections and messages.
+// Up to MaxInFlight messages per connection are handled concurrently,
+// and each response is written back on the same connection with
+// InReplyTo set to the message's ID, as CBOR in a binary frame or,
+// for debugging, as JSON in a text frame, matching the request.
 func (k *Kernel) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Printf("Failed to upgrade to WebSocket: %v\n", err)
+		k.event(slog.LevelError, EventError, nil, "op", "upgrade", "peer", r.RemoteAddr, "err", err)
 		return
 	}
 	defer conn.Close()
+	k.event(slog.LevelInfo, EventPeerConnect, nil, "peer", r.RemoteAddr)
+	defer k.event(slog.LevelInfo, EventPeerDisconnect, nil, "peer", r.RemoteAddr)
 
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var writeMu sync.Mutex // gorilla allows one writer at a time
+	var slots chan struct{}
+	if k.MaxInFlight > 0 {
+		slots = make(chan struct{}, k.MaxInFlight)
+	}
 	for {
-		_, message, err := conn.ReadMessage()
+		mt, message, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Printf("Failed to read message: %v\n", err)
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				k.event(slog.LevelError, EventError, nil, "op", "read", "peer", r.RemoteAddr, "err", err)
+			}
 			break
 		}
-		k.processMessage(context.Background(), message)
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			reply := k.processMessage(ctx, mt, message)
+			buf, err := encodeMessage(mt, reply)
+			if err != nil {
+				buf, _ = encodeMessage(mt, rejectMessage(reply.InReplyTo, err))
+			}
+			writeMu.Lock()
+			err = conn.WriteMessage(mt, buf)
+			writeMu.Unlock()
+			if err != nil {
+				k.event(slog.LevelError, EventError, nil, "op", "write", "peer", r.RemoteAddr, "err", err)
+			}
+		}()
 	}
 }
 
-// processMessage processes a message, performing routing and handling using the syscall tree
-func (k *Kernel) processMessage(ctx context.Context, message []byte) {
-	var msg Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		fmt.Printf("Failed to unmarshal message: %v\n", err)
-		return
+// processMessage processes a message from a WebSocket frame of type
+// mt, answering it from the cache chain or by routing it through the
+// syscall tree, and returns the response.  Failures are returned as
+// reject messages.  The message is handled in a new span of its
+// trace, or of a new trace if it has none, and the reply carries the
+// trace and span.
+func (k *Kernel) processMessage(ctx context.Context, mt int, message []byte) *Message {
+	msg, err := decodeMessage(mt, message)
+	if err != nil {
+		return rejectMessage("", fmt.Errorf("invalid message: %w", err))
+	}
+	parent := msg.Span
+	if msg.Trace == "" {
+		msg.Trace = newSpanID()
 	}
+	msg.Span = newSpanID()
+	k.event(slog.LevelDebug, EventRequest, msg, "id", msg.ID, "parent", parent)
 
-	// Consult modules based on the message parms
-	response, err := k.consultModules(ctx, msg.Parms...)
+	// Consult caches, then modules, based on the message parms
+	out, err := k.handleMessage(ctx, msg)
 	if err != nil {
-		fmt.Printf("Failed to consult modules: %v\n", err)
-		return
+		out = rejectMessage(msg.ID, err)
+	}
+	if out == nil {
+		out = &Message{}
+	}
+	reply := *out
+	reply.ID = ""
+	reply.InReplyTo = msg.ID
+	reply.Trace, reply.Span = msg.Trace, msg.Span
+	return &reply
+}
+
+// Serve runs the kernel's WebSocket server on ln, handling
+// connections at /ws.  While it runs, changed acceptance history is
+// saved every HistoryFlushInterval, and once more when it returns.
+func (k *Kernel) Serve(ln net.Listener) error {
+	stop := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		k.flushHistoryEvery(k.HistoryFlushInterval, stop)
+		close(flushed)
+	}()
+	defer func() {
+		close(stop)
+		<-flushed
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", k.HandleWebSocket)
+	return http.Serve(ln, mux)
+}
+
+// consultModules routes a message to the modules whose syscall tree
+// prefix best matches its parms.  Candidates are consulted in order
+// of the likelihood learned from their acceptance history, weighted
+// by the kernel's trust in them, skipping modules that have recently
+// rejected too many similar messages.  Each candidate is first asked
+// whether it accepts the message; the first one that accepts and then
+// handles it successfully wins.  Modules stay at the prefixes they
+// were registered at; what the kernel learns is recorded as history
+// along the parms path, so that the next such message is offered to
+// the winning module first.  A candidate that accepts and then fails,
+// or replies without a leading true parm, has broken its promise: the
+// kernel signs a record of it, lowers its trust, and reroutes the
+// message to the next candidate until RetryTimeout runs out.
+func (k *Kernel) consultModules(ctx context.Context, in *Message) (out *Message, err error) {
+	out, _, err = k.consult(ctx, in)
+	return
+}
+
+// consult is consultModules, also returning the name of the module
+// that handled the message.
+func (k *Kernel) consult(ctx context.Context, in *Message) (out *Message, handler string, err error) {
+	candidates, err := k.tree.Route(in.Parms...)
+	if err != nil {
+		return nil, "", err
+	}
+	candidates, err = k.tree.rank(candidates, k.now(), in.Parms...)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].History.Likelihood()*k.trust(candidates[i].Name) >
+			candidates[j].History.Likelihood()*k.trust(candidates[j].Name)
+	})
+	if k.logs(slog.LevelDebug) {
+		names := make([]string, len(candidates))
+		for i, c := range candidates {
+			names[i] = c.Name
+		}
+		k.event(slog.LevelDebug, EventRoute, in, "candidates", names)
+	}
+	defer k.historyDirty.Store(true)
+	if k.RetryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.RetryTimeout)
+		defer cancel()
+	}
+
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return nil, "", fmt.Errorf("gave up rerouting message: %w", ctx.Err())
+		}
+		promise, err := c.Module.HandleMessage(ctx, true, in)
+		if err != nil || !accepted(promise) {
+			k.tree.Record(c.Name, Rejected, k.now(), in.Parms...)
+			k.count(c.Name, Rejected)
+			k.event(slog.LevelDebug, EventReject, in, "module", c.Name)
+			continue
+		}
+		k.tree.Record(c.Name, Accepted, k.now(), in.Parms...)
+		k.count(c.Name, Accepted)
+		k.event(slog.LevelDebug, EventAccept, in, "module", c.Name)
+		out, err := k.handleWithin(ctx, c.Name, c.Module, in)
+		if err == nil && !accepted(out) {
+			err = errUnfulfilled
+		}
+		if err != nil {
+			k.brokenPromise(c.Name, in.Parms, err)
+			k.event(slog.LevelWarn, EventBrokenPromise, in, "module", c.Name, "err", err)
+			continue
+		}
+		k.tree.Record(c.Name, Fulfilled, k.now(), in.Parms...)
+		k.count(c.Name, Fulfilled)
+		k.event(slog.LevelDebug, EventFulfil, in, "module", c.Name)
+		return out, c.Name, nil
+	}
+	if ctx.Err() != nil {
+		return nil, "", fmt.Errorf("gave up rerouting message: %w", ctx.Err())
 	}
 
-	// Response handling (omitted for brevity)
-	fmt.Println("Message processed, response generated.", response)
+	return nil, "", ErrNoModule
 }
 
-// consultModules consults modules for handling the message, utilizing the syscall tree for routing
-func (k *Kernel) consultModules(ctx context.Context, parms ...interface{}) ([]byte, error) {
-	// Implementation involves traversing the syscall tree to find best match and consulting modules
-	// Omitted for brevity
-	return nil, nil
+// handle has a module handle a message it accepted, giving up when
+// ctx is done even if the module does not.
+func (k *Kernel) handle(ctx context.Context, module Module, in *Message) (*Message, error) {
+	type result struct {
+		out *Message
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := module.HandleMessage(ctx, false, in)
+		done <- result{out, err}
+	}()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
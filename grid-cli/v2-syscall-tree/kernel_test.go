@@ -0,0 +1,99 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestConsultModulesLongestPrefix(t *testing.T) {
+	k := NewKernel()
+	general := newStub("general", "p1")
+	specific := newStub("specific", "p1")
+	k.RegisterModule("general", general)
+	k.RegisterModule("specific", specific, "p1", "m1")
+
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", "m1", "arg"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "specific" {
+		t.Errorf("expected the specific module to handle the message, got %v", out.Parms)
+	}
+	if general.tested != 0 {
+		t.Errorf("general module should not have been consulted")
+	}
+
+	// a message outside specific's prefix falls back
+	out, err = k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1", "m2"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "general" {
+		t.Errorf("expected the general module to handle the message, got %v", out.Parms)
+	}
+}
+
+func TestConsultModulesKeepsPrefix(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("reject", newStub("reject"))
+	k.RegisterModule("accept", newStub("accept", "p1"))
+
+	parms := []interface{}{"p1", "m1", 42}
+	_, err := k.consultModules(context.Background(), &Message{Parms: parms})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	routes, _ := k.tree.Route(parms...)
+	for _, r := range routes {
+		if r.Depth != 0 {
+			t.Errorf("expected modules to stay at their registered prefix, got %+v", routes)
+		}
+	}
+}
+
+func TestConsultModulesFailover(t *testing.T) {
+	k := NewKernel()
+	broken := newStub("broken", "p1")
+	broken.fail = true
+	k.RegisterModule("broken", broken, "p1")
+	k.RegisterModule("backup", newStub("backup", "p1"))
+
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "backup" {
+		t.Errorf("expected the backup module to handle the message, got %v", out.Parms)
+	}
+}
+
+func TestConsultModulesNoModule(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("m", newStub("m", "p1"))
+	_, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p2"}})
+	if !errors.Is(err, ErrNoModule) {
+		t.Errorf("expected ErrNoModule, got %v", err)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	k := NewKernel()
+	m := newStub("m", "p1")
+	if err := k.RegisterModule("m", m, "p1"); err != nil {
+		t.Fatalf("RegisterModule returned an error: %v", err)
+	}
+	if err := k.RegisterModule("m", m, "p2"); err != nil {
+		t.Errorf("registering the same module at a second prefix returned an error: %v", err)
+	}
+	if err := k.RegisterModule("m", newStub("m")); err == nil {
+		t.Errorf("expected an error registering a different module under the same name")
+	}
+	k.UnregisterModule("m")
+	if _, ok := k.Module("m"); ok {
+		t.Errorf("module still known after UnregisterModule")
+	}
+	if _, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}}); !errors.Is(err, ErrNoModule) {
+		t.Errorf("expected ErrNoModule after UnregisterModule, got %v", err)
+	}
+}
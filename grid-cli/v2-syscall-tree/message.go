@@ -2,7 +2,26 @@ package v2
 
 // Message defines the structure for communication messages.
 // The first element in Parms is the promise of handling or not handling the syscall.
+// Trace and Span let a request be followed across peers: a kernel
+// passing a message on keeps its Trace and sets Span to its own span,
+// which the receiver logs as the parent of its span.
 type Message struct {
-	Parms    []interface{}          `json:"parms"`   // Parameters: first element is the promise
-	Payload  map[string]interface{} `json:"payload"` // Metadata about the promise
+	ID        string                 `json:"id,omitempty"`        // Request ID, chosen by the sender
+	InReplyTo string                 `json:"inReplyTo,omitempty"` // ID of the request this responds to
+	Trace     string                 `json:"trace,omitempty"`     // ID shared by every span of a request
+	Span      string                 `json:"span,omitempty"`      // ID of the span that sent the message
+	Parms     []interface{}          `json:"parms"`               // Parameters: first element is the promise
+	Payload   map[string]interface{} `json:"payload"`             // Metadata about the promise
+}
+
+// rejectMessage returns a promise-shaped reply declining the request
+// with the given ID because of err.
+func rejectMessage(id string, err error) *Message {
+	return &Message{
+		InReplyTo: id,
+		Parms:     []interface{}{false},
+		Payload: map[string]interface{}{
+			"error": err.Error(),
+		},
+	}
 }
@@ -0,0 +1,512 @@
+package v2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRestartDelay is how long a ProcessModule waits before
+// restarting a module process that exited.
+const DefaultRestartDelay = 100 * time.Millisecond
+
+// DefaultMaxRestartDelay bounds how long a ProcessModule backs off
+// before restarting a module process that keeps failing.
+const DefaultMaxRestartDelay = 30 * time.Second
+
+// DefaultMaxFailures is how many times in a row a module process may
+// exit without replying before a ProcessModule gives up on it.
+const DefaultMaxFailures = 10
+
+// maxFrame bounds the size of a frame on a module's stdio.
+const maxFrame = 16 << 20
+
+// ErrModuleExited is returned for calls that were in flight when a
+// module process exited.
+var ErrModuleExited = errors.New("module process exited")
+
+// ErrModuleClosed is returned for calls on a closed ProcessModule.
+var ErrModuleClosed = errors.New("module closed")
+
+// ErrModuleFailed is returned for calls on a ProcessModule that gave
+// up restarting its process.
+var ErrModuleFailed = errors.New("module process keeps failing")
+
+// procFrame is one frame of the stdio module protocol.  The host
+// sends a request frame with a fresh ID; Test marks an accept query,
+// which the module answers with a promise rather than handling the
+// message.  The module replies with a frame carrying the same ID and
+// either a message or an error.  Frames are CBOR, each preceded by
+// its length as a 4-byte big-endian integer.
+type procFrame struct {
+	ID    uint64   `cbor:"1,keyasint"`
+	Test  bool     `cbor:"2,keyasint,omitempty"`
+	Msg   *Message `cbor:"3,keyasint,omitempty"`
+	Error string   `cbor:"4,keyasint,omitempty"`
+}
+
+func writeFrame(w io.Writer, f *procFrame) error {
+	buf, err := encMode.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if len(buf) > maxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds limit", len(buf))
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(buf)))
+	_, err = w.Write(append(hdr[:], buf...))
+	return err
+}
+
+func readFrame(r io.Reader) (*procFrame, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit", n)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	f := &procFrame{}
+	err = decMode.Unmarshal(buf, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ServeModule runs m as an out-of-process module, reading request
+// frames from r and writing replies to w until r is closed.  A module
+// executable written in Go calls it with os.Stdin and os.Stdout.
+// Requests are handled concurrently.
+func ServeModule(m Module, r io.Reader, w io.Writer) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var writeMu sync.Mutex
+	var writeErr error
+	br := bufio.NewReader(r)
+	for {
+		req, err := readFrame(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := &procFrame{ID: req.ID}
+			in := req.Msg
+			if in == nil {
+				in = &Message{}
+			}
+			out, err := m.HandleMessage(context.Background(), req.Test, in)
+			if err != nil {
+				reply.Error = err.Error()
+			} else {
+				reply.Msg = out
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if writeErr == nil {
+				writeErr = writeFrame(w, reply)
+			}
+		}()
+	}
+}
+
+// proc is one run of a module process.
+type proc struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{} // closed when the process has exited
+	// replied is set once the process has replied to a request.
+	replied atomic.Bool
+	// exceeded is set, before done is closed, if the process was
+	// killed for exceeding its quota.
+	exceeded *QuotaError
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *procFrame
+}
+
+// readLoop delivers replies until the process's stdout closes.  A
+// reply to a call that was abandoned is dropped.  A malformed frame
+// means the stream is out of sync, so the process is killed.
+func (p *proc) readLoop(stdout io.Reader) {
+	br := bufio.NewReader(stdout)
+	for {
+		f, err := readFrame(br)
+		if err != nil {
+			if err != io.EOF {
+				p.cmd.Process.Kill()
+			}
+			return
+		}
+		p.replied.Store(true)
+		p.mu.Lock()
+		ch, ok := p.pending[f.ID]
+		delete(p.pending, f.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- f
+		}
+	}
+}
+
+// call sends one request and waits for its reply.  If ctx is done
+// first, the call is abandoned and its reply, if any, dropped.  A
+// failed write may leave part of a frame in the pipe, so it kills
+// the process.
+func (p *proc) call(ctx context.Context, test bool, in *Message) (*Message, error) {
+	ch := make(chan *procFrame, 1)
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = ch
+	p.mu.Unlock()
+	forget := func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}
+
+	p.writeMu.Lock()
+	err := writeFrame(p.stdin, &procFrame{ID: id, Test: test, Msg: in})
+	p.writeMu.Unlock()
+	if err != nil {
+		forget()
+		p.cmd.Process.Kill()
+		return nil, err
+	}
+
+	select {
+	case f := <-ch:
+		if f.Error != "" {
+			return nil, errors.New(f.Error)
+		}
+		return f.Msg, nil
+	case <-p.done:
+		forget()
+		if p.exceeded != nil {
+			return nil, p.exceeded
+		}
+		return nil, ErrModuleExited
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+// idle returns true if no calls are in flight.
+func (p *proc) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending) == 0
+}
+
+// ProcessModule is a module running as an external executable that
+// speaks the stdio module protocol, so that modules can be written in
+// any language.  Like a device driver in a microkernel, it runs
+// outside the kernel: a ProcessModule supervises it, restarting it if
+// it exits, and killing it if a call overruns its deadline, since a
+// module that misses a deadline is presumed hung.  A process that
+// exits without replying to anything is restarted after a delay that
+// doubles each time, and after MaxFailures such exits in a row the
+// module gives up and fails every call.  A call whose
+// context is cancelled is abandoned without disturbing the others.
+// The process serves many calls over its life, so its CPU quota is
+// enforced per call, as a deadline, by the kernel; its memory quota
+// is enforced by a cgroup, where available, shared by every process
+// the module runs.
+type ProcessModule struct {
+	Path string
+	Args []string
+	Env  []string // extra environment variables for the process
+	// RestartDelay is how long to wait before restarting a process
+	// that exited.
+	RestartDelay time.Duration
+	// MaxRestartDelay bounds the backoff for a process that keeps
+	// failing.
+	MaxRestartDelay time.Duration
+	// MaxFailures is how many times in a row the process may exit
+	// without replying before the module gives up.  Zero means it
+	// never does.
+	MaxFailures int
+	// Log receives the module's restarts and failures.
+	Log *slog.Logger
+
+	mu       sync.Mutex
+	current  *proc
+	closed   bool
+	failed   bool // gave up restarting
+	waiting  bool // to restart the process
+	failures int  // exits in a row without a reply
+	restarts int
+	quota    Quota
+	cgroup   *moduleCgroup // nil without a memory quota or cgroups
+}
+
+// NewProcessModule returns a module that runs path with args.  The
+// process is started by the first call.
+func NewProcessModule(path string, args ...string) *ProcessModule {
+	return &ProcessModule{
+		Path:            path,
+		Args:            args,
+		RestartDelay:    DefaultRestartDelay,
+		MaxRestartDelay: DefaultMaxRestartDelay,
+		MaxFailures:     DefaultMaxFailures,
+		Log:             slog.Default(),
+	}
+}
+
+// start launches a process for the module.  The caller must hold
+// m.mu.
+func (m *ProcessModule) start() (*proc, error) {
+	cmd := exec.Command(m.Path, m.Args...)
+	cmd.Env = append(os.Environ(), m.Env...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cgroup := m.confine()
+	if cgroup != nil {
+		started, err := cgroup.confine(cmd)
+		if err != nil {
+			return nil, err
+		}
+		defer started()
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	p := &proc{
+		cmd:     cmd,
+		stdin:   stdin,
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan *procFrame),
+	}
+	go func() {
+		p.readLoop(stdout)
+		cmd.Wait()
+		if cgroup != nil {
+			p.exceeded = cgroup.exceeded(cmd.ProcessState)
+		}
+		close(p.done)
+		m.exited(p)
+	}()
+	m.current = p
+	return p, nil
+}
+
+// confine returns the cgroup that enforces the module's memory quota,
+// creating it or updating its limit as needed, or nil if there is no
+// memory quota or cgroups are unavailable.  The caller must hold m.mu.
+func (m *ProcessModule) confine() *moduleCgroup {
+	if m.quota.Memory <= 0 {
+		return nil
+	}
+	var err error
+	if m.cgroup == nil {
+		m.cgroup, err = newModuleCgroup(m.quota.Memory)
+	} else if m.cgroup.max != m.quota.Memory {
+		err = m.cgroup.setMax(m.quota.Memory)
+	}
+	if err != nil {
+		m.Log.Warn(EventError, "op", "cgroup", "path", m.Path, "err", err)
+	}
+	return m.cgroup
+}
+
+// exited restarts the module if p was its current process, backing
+// off if it exited without replying, unless it has failed too often.
+func (m *ProcessModule) exited(p *proc) {
+	m.mu.Lock()
+	if m.closed || m.current != p {
+		m.mu.Unlock()
+		return
+	}
+	m.current = nil
+	if p.replied.Load() {
+		m.failures = 0
+	} else {
+		m.failures++
+	}
+	if m.MaxFailures > 0 && m.failures >= m.MaxFailures {
+		m.failed = true
+		m.mu.Unlock()
+		m.Log.Error(EventError, "op", "restart", "path", m.Path, "failures", m.failures, "err", ErrModuleFailed)
+		return
+	}
+	delay := m.restartDelay()
+	m.waiting = true
+	m.mu.Unlock()
+
+	time.Sleep(delay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting = false
+	if m.closed || m.current != nil {
+		return
+	}
+	_, err := m.start()
+	if err != nil {
+		m.Log.Error(EventError, "op", "restart", "path", m.Path, "err", err)
+		return
+	}
+	m.restarts++
+	m.Log.Info(EventModuleRestart, "path", m.Path, "restarts", m.restarts)
+}
+
+// restartDelay returns how long to wait before restarting the
+// process: RestartDelay, doubled for each failure in a row, up to
+// MaxRestartDelay.  The caller must hold m.mu.
+func (m *ProcessModule) restartDelay() time.Duration {
+	delay := m.RestartDelay
+	for i := 0; i < m.failures && (m.MaxRestartDelay <= 0 || delay < m.MaxRestartDelay); i++ {
+		delay *= 2
+	}
+	if m.MaxRestartDelay > 0 && delay > m.MaxRestartDelay {
+		delay = m.MaxRestartDelay
+	}
+	return delay
+}
+
+// running returns the running process, starting one if needed.  While
+// a process that exited waits to be restarted, calls fail with
+// ErrModuleExited rather than start it early.
+func (m *ProcessModule) running() (*proc, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrModuleClosed
+	}
+	if m.failed {
+		return nil, ErrModuleFailed
+	}
+	if m.current != nil {
+		return m.current, nil
+	}
+	if m.waiting {
+		return nil, ErrModuleExited
+	}
+	return m.start()
+}
+
+// HandleMessage sends the message to the module process: as an accept
+// query if test is true, otherwise to be handled.
+func (m *ProcessModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	p, err := m.running()
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.call(ctx, test, in)
+	if errors.Is(err, context.DeadlineExceeded) {
+		p.cmd.Process.Kill()
+	}
+	return out, err
+}
+
+// SetQuota sets the limits applied to the module's processes.  A new
+// memory limit takes effect when the module next starts a process.
+func (m *ProcessModule) SetQuota(q Quota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quota = q
+}
+
+// Restarts returns how many times the module process was restarted
+// after exiting.
+func (m *ProcessModule) Restarts() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restarts
+}
+
+// Swap replaces the module's executable without dropping calls: new
+// calls go to a process running path with args, and the old process
+// is shut down once its calls in flight have finished.  Swapping
+// revives a module that gave up on its old executable.
+func (m *ProcessModule) Swap(path string, args ...string) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrModuleClosed
+	}
+	old := m.current
+	m.Path, m.Args = path, args
+	m.failed, m.failures = false, 0
+	_, err := m.start()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		go old.shutdown()
+	}
+	return nil
+}
+
+// shutdown closes the process's stdin once it is idle, which tells
+// a well-behaved module to exit.
+func (p *proc) shutdown() {
+	for !p.idle() {
+		select {
+		case <-p.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	p.stdin.Close()
+}
+
+// Close stops the module process.
+func (m *ProcessModule) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	p := m.current
+	m.current = nil
+	m.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	m.mu.Lock()
+	if m.cgroup != nil {
+		m.cgroup.remove()
+	}
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,244 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// crashModule accepts everything and exits when asked to handle a
+// message.
+type crashModule struct{}
+
+func (crashModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	os.Exit(3)
+	return nil, nil
+}
+
+// spinModule accepts everything and then burns CPU forever.
+type spinModule struct{}
+
+func (spinModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	for {
+	}
+}
+
+// When V2_TEST_MODULE is set, the test binary runs as an out-of-process
+// module instead of running tests.
+func TestMain(m *testing.M) {
+	var module Module
+	switch os.Getenv("V2_TEST_MODULE") {
+	case "":
+		os.Exit(m.Run())
+	case "stub":
+		name := os.Getenv("V2_TEST_NAME")
+		if len(os.Args) > 1 {
+			name = os.Args[1]
+		}
+		module = newStub(name, "p1")
+	case "crash":
+		module = crashModule{}
+	case "exit":
+		os.Exit(2)
+	case "hang":
+		module = hangModule{}
+	case "spin":
+		module = spinModule{}
+	}
+	err := ServeModule(module, os.Stdin, os.Stdout)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// testProcess returns a module that runs the test binary as the named
+// test module.
+func testProcess(t *testing.T, module string, env ...string) *ProcessModule {
+	m := NewProcessModule(os.Args[0])
+	m.Env = append([]string{"V2_TEST_MODULE=" + module}, env...)
+	m.RestartDelay = 10 * time.Millisecond
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestProcessModule(t *testing.T) {
+	m := testProcess(t, "stub", "V2_TEST_NAME=ext")
+	ctx := context.Background()
+
+	promise, err := m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"p1"}})
+	if err != nil || !accepted(promise) {
+		t.Fatalf("expected the module to accept p1, got %+v: %v", promise, err)
+	}
+	promise, err = m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"p2"}})
+	if err != nil || accepted(promise) {
+		t.Errorf("expected the module to reject p2, got %+v: %v", promise, err)
+	}
+
+	out, err := m.HandleMessage(ctx, false, &Message{Parms: []interface{}{"p1", Multihash{0x00, 0x00}}})
+	if err != nil {
+		t.Fatalf("HandleMessage returned an error: %v", err)
+	}
+	if out.Parms[1] != "ext" {
+		t.Errorf("unexpected reply %+v", out)
+	}
+}
+
+func TestProcessModuleKernel(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("ext", testProcess(t, "stub", "V2_TEST_NAME=ext"), "p1")
+	c := serve(t, k)
+
+	out, err := c.Call(context.Background(), &Message{Parms: []interface{}{"p1", "x"}})
+	if err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if out.Parms[1] != "ext" {
+		t.Errorf("unexpected reply %+v", out)
+	}
+}
+
+func TestProcessModuleRestart(t *testing.T) {
+	m := testProcess(t, "crash")
+	ctx := context.Background()
+
+	_, err := m.HandleMessage(ctx, false, &Message{Parms: []interface{}{"x"}})
+	if !errors.Is(err, ErrModuleExited) {
+		t.Errorf("expected ErrModuleExited, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Restarts() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Restarts() == 0 {
+		t.Fatalf("expected the module to be restarted")
+	}
+	promise, err := m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"x"}})
+	if err != nil || !accepted(promise) {
+		t.Errorf("expected the restarted module to answer, got %+v: %v", promise, err)
+	}
+}
+
+func TestProcessModuleGivesUp(t *testing.T) {
+	m := testProcess(t, "exit")
+	m.MaxFailures = 3
+	ctx := context.Background()
+
+	// a module that dies on startup is restarted until it has failed
+	// MaxFailures times in a row
+	_, err := m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"x"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for !errors.Is(err, ErrModuleFailed) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, err = m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"x"}})
+	}
+	if !errors.Is(err, ErrModuleFailed) {
+		t.Fatalf("expected ErrModuleFailed, got %v", err)
+	}
+	if n := m.Restarts(); n != m.MaxFailures-1 {
+		t.Errorf("expected %d restarts, got %d", m.MaxFailures-1, n)
+	}
+
+	// swapping in a working executable revives it
+	m.Env = []string{"V2_TEST_MODULE=stub"}
+	if err := m.Swap(os.Args[0]); err != nil {
+		t.Fatalf("Swap returned an error: %v", err)
+	}
+	promise, err := m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"p1"}})
+	if err != nil || !accepted(promise) {
+		t.Errorf("expected the swapped-in module to answer, got %+v: %v", promise, err)
+	}
+
+	m.Close()
+	_, err = m.HandleMessage(ctx, true, &Message{Parms: []interface{}{"p1"}})
+	if !errors.Is(err, ErrModuleClosed) {
+		t.Errorf("expected ErrModuleClosed, got %v", err)
+	}
+}
+
+func TestProcessModuleRestartDelay(t *testing.T) {
+	m := NewProcessModule("module")
+	m.RestartDelay = time.Second
+	m.MaxRestartDelay = 5 * time.Second
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for failures, d := range want {
+		m.failures = failures
+		if got := m.restartDelay(); got != d {
+			t.Errorf("restartDelay after %d failures = %v, want %v", failures, got, d)
+		}
+	}
+}
+
+func TestProcessModuleTimeout(t *testing.T) {
+	m := testProcess(t, "hang")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := m.HandleMessage(ctx, false, &Message{Parms: []interface{}{"x"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+
+	// the hung process is killed and replaced
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Restarts() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	promise, err := m.HandleMessage(context.Background(), true, &Message{Parms: []interface{}{"x"}})
+	if err != nil || !accepted(promise) {
+		t.Errorf("expected the replacement process to answer, got %+v: %v", promise, err)
+	}
+}
+
+func TestProcessModuleCancel(t *testing.T) {
+	m := testProcess(t, "hang")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := m.HandleMessage(ctx, false, &Message{Parms: []interface{}{"x"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+
+	// the process, shared with other calls, keeps running
+	time.Sleep(50 * time.Millisecond)
+	promise, err := m.HandleMessage(context.Background(), true, &Message{Parms: []interface{}{"x"}})
+	if err != nil || !accepted(promise) {
+		t.Errorf("expected the process to keep answering, got %+v: %v", promise, err)
+	}
+	if m.Restarts() != 0 {
+		t.Errorf("expected a cancelled call not to kill the process")
+	}
+}
+
+func TestProcessModuleSwap(t *testing.T) {
+	m := testProcess(t, "stub", "V2_TEST_NAME=old")
+	ctx := context.Background()
+	in := &Message{Parms: []interface{}{"p1"}}
+
+	out, err := m.HandleMessage(ctx, false, in)
+	if err != nil || out.Parms[1] != "old" {
+		t.Fatalf("unexpected reply %+v: %v", out, err)
+	}
+	if err := m.Swap(os.Args[0], "new"); err != nil {
+		t.Fatalf("Swap returned an error: %v", err)
+	}
+	out, err = m.HandleMessage(ctx, false, in)
+	if err != nil || out.Parms[1] != "new" {
+		t.Errorf("expected the swapped-in module to answer, got %+v: %v", out, err)
+	}
+	if m.Restarts() != 0 {
+		t.Errorf("expected the old process to be retired, not restarted")
+	}
+}
@@ -0,0 +1,200 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota limits what a module may consume.  Zero fields are
+// unlimited.  The kernel enforces WallTime and Output on every call.
+// A module's CPU use cannot be metered per call, whether it runs in
+// the kernel's own process or in a module process shared by many
+// calls, so CPUTime is enforced as wall time too.  Memory is enforced
+// on out-of-process modules with a cgroup, where available.
+type Quota struct {
+	CPUTime  time.Duration
+	WallTime time.Duration
+	Memory   int64 // bytes
+	Output   int64 // bytes of encoded response
+}
+
+// QuotaError reports a module that exceeded its quota, breaking its
+// promise to handle a message.
+type QuotaError struct {
+	Module   string
+	Resource string // "cpu", "wall", "memory" or "output"
+	Limit    string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("broken promise: %s exceeded its %s quota of %s", e.Module, e.Resource, e.Limit)
+}
+
+// QuotaSetter is implemented by modules that enforce quotas of their
+// own, such as ProcessModule.
+type QuotaSetter interface {
+	SetQuota(q Quota)
+}
+
+// defaultQuota is the name under which the quota for modules without
+// one of their own is configured.
+const defaultQuota = "default"
+
+// callLimit returns the deadline the kernel enforces on one call, and
+// which resource it stands for.
+func (q Quota) callLimit() (limit time.Duration, resource string) {
+	limit, resource = q.WallTime, "wall"
+	if q.CPUTime > 0 && (limit == 0 || q.CPUTime < limit) {
+		limit, resource = q.CPUTime, "cpu"
+	}
+	return
+}
+
+// SetQuota sets the quota for the module registered as name; the
+// name "default" sets the quota for modules without one of their own.
+func (k *Kernel) SetQuota(name string, q Quota) {
+	k.mu.Lock()
+	if k.quotas == nil {
+		k.quotas = make(map[string]Quota)
+	}
+	k.quotas[name] = q
+	k.mu.Unlock()
+	k.applyQuotas()
+}
+
+// quota returns the quota for the module registered as name.
+func (k *Kernel) quota(name string) Quota {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if q, ok := k.quotas[name]; ok {
+		return q
+	}
+	return k.quotas[defaultQuota]
+}
+
+// applyQuotas passes each module that enforces its own quota the
+// quota configured for it.
+func (k *Kernel) applyQuotas() {
+	k.mu.RLock()
+	var setters []func()
+	for name, module := range k.modules {
+		if s, ok := module.(QuotaSetter); ok {
+			name := name
+			setters = append(setters, func() { s.SetQuota(k.quota(name)) })
+		}
+	}
+	k.mu.RUnlock()
+	for _, set := range setters {
+		set()
+	}
+}
+
+// LoadQuotas reads module quotas from a grid configuration file on
+// the kernel's filesystem.  Quotas are key=value lines of the form
+// quota.<module>.<resource>, where resource is cpu, wall, memory or
+// output; a module named "default" sets the quota for modules without
+// one of their own.  Durations use time.ParseDuration syntax and sizes
+// take an optional K, M or G suffix.  A missing file is not an error.
+func (k *Kernel) LoadQuotas(path string) error {
+	config, err := readConfig(k.fs, path)
+	if err != nil {
+		return err
+	}
+	quotas := make(map[string]Quota)
+	for key, val := range config {
+		if !strings.HasPrefix(key, "quota.") {
+			continue
+		}
+		i := strings.LastIndex(key, ".")
+		name, resource := key[len("quota."):i], key[i+1:]
+		if name == "" {
+			continue
+		}
+		q := quotas[name]
+		err = q.set(resource, val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		quotas[name] = q
+	}
+	for name, q := range quotas {
+		k.SetQuota(name, q)
+	}
+	return nil
+}
+
+// set parses one configured quota field.  Unknown resources are
+// ignored, since the configuration is shared with other kernels.
+func (q *Quota) set(resource, val string) (err error) {
+	switch resource {
+	case "cpu":
+		q.CPUTime, err = time.ParseDuration(val)
+	case "wall":
+		q.WallTime, err = time.ParseDuration(val)
+	case "memory":
+		q.Memory, err = parseSize(val)
+	case "output":
+		q.Output, err = parseSize(val)
+	}
+	return
+}
+
+// parseSize parses a byte count such as "512", "64K", "16M" or "1G".
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// handleWithin has a module handle a message it accepted within the
+// module's quota.  A call that overruns the quota fails with a
+// *QuotaError.
+func (k *Kernel) handleWithin(ctx context.Context, name string, module Module, in *Message) (*Message, error) {
+	q := k.quota(name)
+	callCtx := ctx
+	limit, resource := q.callLimit()
+	if limit > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	out, err := k.handle(callCtx, module, in)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			return nil, &QuotaError{Module: name, Resource: resource, Limit: limit.String()}
+		}
+		var qerr *QuotaError
+		if errors.As(err, &qerr) && qerr.Module == "" {
+			qerr.Module = name
+		}
+		return nil, err
+	}
+	if q.Output > 0 && out != nil {
+		buf, err := out.MarshalCBOR()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(buf)) > q.Output {
+			return nil, &QuotaError{Module: name, Resource: "output", Limit: fmt.Sprintf("%d bytes", q.Output)}
+		}
+	}
+	return out, nil
+}
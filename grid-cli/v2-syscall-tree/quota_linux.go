@@ -0,0 +1,107 @@
+//go:build linux
+
+package v2
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// moduleCgroup is the cgroup v2 group a ProcessModule runs its
+// processes in.  A module process is long-lived and restarted when it
+// exits, so the group belongs to the module rather than to one
+// process: every process the module runs, and their children, share
+// its memory limit.
+type moduleCgroup struct {
+	dir string
+	max int64
+
+	mu       sync.Mutex
+	oomKills int64 // oom_kill count when last checked
+}
+
+// newModuleCgroup creates a cgroup limited to max bytes of memory.
+func newModuleCgroup(max int64) (*moduleCgroup, error) {
+	dir, err := os.MkdirTemp(cgroupRoot, "grid-module-")
+	if err != nil {
+		return nil, err
+	}
+	c := &moduleCgroup{dir: dir}
+	err = c.setMax(max)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return c, nil
+}
+
+// setMax changes the cgroup's memory limit.
+func (c *moduleCgroup) setMax(max int64) error {
+	err := os.WriteFile(filepath.Join(c.dir, "memory.max"), []byte(strconv.FormatInt(max, 10)), 0644)
+	if err != nil {
+		return err
+	}
+	c.max = max
+	return nil
+}
+
+// confine makes cmd start inside the cgroup.  The returned function
+// closes the cgroup's descriptor once cmd has started.
+func (c *moduleCgroup) confine(cmd *exec.Cmd) (started func(), err error) {
+	f, err := os.Open(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { f.Close() }, nil
+}
+
+// exceeded reports whether a process of the module that exited with
+// state was killed for running the cgroup out of memory.
+func (c *moduleCgroup) exceeded(state *os.ProcessState) *QuotaError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kills := c.readOOMKills()
+	more := kills > c.oomKills
+	c.oomKills = kills
+	ws, _ := state.Sys().(syscall.WaitStatus)
+	if more && ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+		return &QuotaError{Resource: "memory", Limit: fmt.Sprintf("%d bytes", c.max)}
+	}
+	return nil
+}
+
+// readOOMKills returns how many times the kernel has killed a process
+// in the cgroup for running out of memory.
+func (c *moduleCgroup) readOOMKills() int64 {
+	data, err := os.ReadFile(filepath.Join(c.dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// remove deletes the cgroup once its processes have exited.
+func (c *moduleCgroup) remove() {
+	os.Remove(c.dir)
+}
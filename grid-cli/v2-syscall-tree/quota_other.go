@@ -0,0 +1,33 @@
+//go:build !linux
+
+package v2
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// moduleCgroup is unavailable on this platform, so a module process's
+// memory is not limited.
+type moduleCgroup struct {
+	max int64
+}
+
+func newModuleCgroup(max int64) (*moduleCgroup, error) {
+	return nil, errors.New("cgroups are not supported on this platform")
+}
+
+func (c *moduleCgroup) setMax(max int64) error {
+	return nil
+}
+
+func (c *moduleCgroup) confine(cmd *exec.Cmd) (started func(), err error) {
+	return func() {}, nil
+}
+
+func (c *moduleCgroup) exceeded(state *os.ProcessState) *QuotaError {
+	return nil
+}
+
+func (c *moduleCgroup) remove() {}
@@ -0,0 +1,107 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestLoadQuotas(t *testing.T) {
+	k := NewKernel()
+	k.fs = afero.NewMemMapFs()
+	config := strings.Join([]string{
+		"peers=a,b",
+		"quota.default.wall=30s",
+		"quota.default.output=1M",
+		"quota.abc.wall=5s",
+		"quota.abc.cpu=2s",
+		"quota.abc.memory=64M",
+		"quota.abc.paths=/tmp",
+	}, "\n")
+	afero.WriteFile(k.fs, "/config", []byte(config), 0644)
+	if err := k.LoadQuotas("/config"); err != nil {
+		t.Fatalf("LoadQuotas returned an error: %v", err)
+	}
+	want := Quota{CPUTime: 2 * time.Second, WallTime: 5 * time.Second, Memory: 64 << 20}
+	if q := k.quota("abc"); q != want {
+		t.Errorf("quota(abc) = %+v, want %+v", q, want)
+	}
+	want = Quota{WallTime: 30 * time.Second, Output: 1 << 20}
+	if q := k.quota("other"); q != want {
+		t.Errorf("quota(other) = %+v, want %+v", q, want)
+	}
+
+	if err := k.LoadQuotas("/missing"); err != nil {
+		t.Errorf("expected a missing config to be ignored, got %v", err)
+	}
+	afero.WriteFile(k.fs, "/config", []byte("quota.abc.memory=lots\n"), 0644)
+	if err := k.LoadQuotas("/config"); err == nil {
+		t.Errorf("expected an error for an invalid quota")
+	}
+}
+
+func TestQuotaWallTime(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("hang", hangModule{}, "p1")
+	k.RegisterModule("backup", newStub("backup", "p1"))
+	k.SetQuota("hang", Quota{WallTime: 50 * time.Millisecond})
+
+	out, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if err != nil {
+		t.Fatalf("consultModules returned an error: %v", err)
+	}
+	if out.Parms[1] != "backup" {
+		t.Errorf("expected the message to be rerouted to backup, got %v", out.Parms)
+	}
+	records := k.BrokenPromises()
+	if len(records) != 1 || records[0].Module != "hang" {
+		t.Fatalf("expected hang's broken promise to be recorded, got %+v", records)
+	}
+	if want := "broken promise: hang exceeded its wall quota of 50ms"; records[0].Error != want {
+		t.Errorf("unexpected error in record: %q", records[0].Error)
+	}
+}
+
+func TestQuotaOutput(t *testing.T) {
+	k := NewKernel()
+	k.RegisterModule("chatty", newStub("chatty", "p1"), "p1")
+	k.SetQuota(defaultQuota, Quota{Output: 4})
+
+	_, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if !errors.Is(err, ErrNoModule) {
+		t.Errorf("expected ErrNoModule, got %v", err)
+	}
+	records := k.BrokenPromises()
+	if len(records) != 1 || !strings.Contains(records[0].Error, "output quota of 4 bytes") {
+		t.Errorf("expected an output quota violation to be recorded, got %+v", records)
+	}
+}
+
+func TestQuotaProcessModule(t *testing.T) {
+	k := NewKernel()
+	m := testProcess(t, "spin")
+	k.RegisterModule("spin", m, "p1")
+	k.SetQuota("spin", Quota{CPUTime: 100 * time.Millisecond})
+
+	// the call misses its deadline, breaking spin's promise, and the
+	// spinning process is killed and replaced
+	_, err := k.consultModules(context.Background(), &Message{Parms: []interface{}{"p1"}})
+	if !errors.Is(err, ErrNoModule) {
+		t.Errorf("expected ErrNoModule, got %v", err)
+	}
+	records := k.BrokenPromises()
+	if len(records) != 1 || !strings.Contains(records[0].Error, "cpu quota of 100ms") {
+		t.Errorf("expected a CPU quota violation to be recorded, got %+v", records)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Restarts() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Restarts() == 0 {
+		t.Errorf("expected the spinning process to be replaced")
+	}
+}
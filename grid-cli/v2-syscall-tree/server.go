@@ -3,14 +3,34 @@ package v2
 // Simplified overview of the system design based on the discussions
 
 import (
-	"fmt"
-	"net/http"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
 )
 
 func Serve() {
-	kernel := NewKernel()
-	// Start the WebSocket server (implementation simplified)
-	http.HandleFunc("/ws", kernel.HandleWebSocket)
-	fmt.Println("WebSocket server started on :8080")
-	http.ListenAndServe(":8080", nil)
+	gridDir := filepath.Join(os.Getenv("HOME"), ".grid")
+	kernel, err := NewKernelWithFs(afero.NewOsFs(), filepath.Join(gridDir, "kernel"))
+	if err != nil {
+		slog.Error("Failed to load kernel state", "err", err)
+		return
+	}
+	err = kernel.LoadConfig(filepath.Join(gridDir, "config"))
+	if err != nil {
+		kernel.Log.Error("Failed to load configuration", "err", err)
+		return
+	}
+	ln, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		kernel.Log.Error("Failed to listen", "err", err)
+		return
+	}
+	kernel.Log.Info("WebSocket server started", "addr", ln.Addr().String())
+	err = kernel.Serve(ln)
+	if err != nil {
+		kernel.Log.Error("WebSocket server failed", "err", err)
+	}
 }
@@ -0,0 +1,204 @@
+package v2
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// parmKey returns the canonical encoding of a message parameter, used
+// as the key of a syscall tree edge.  The encoding is tagged with the
+// parameter's kind so that, e.g., the string "1" and the integer 1
+// take different paths.  Parms are first converted by canonicalParm,
+// so the kernel routes on exactly the parms it can encode and cache.
+func parmKey(parm interface{}) (key string, err error) {
+	c, err := canonicalParm(parm)
+	if err != nil {
+		return "", fmt.Errorf("cannot route on parm: %w", err)
+	}
+	switch p := c.(type) {
+	case nil:
+		return "n:", nil
+	case string:
+		return "s:" + p, nil
+	case cbor.Tag:
+		return "h:" + hex.EncodeToString(p.Content.([]byte)), nil
+	case []byte:
+		return "x:" + hex.EncodeToString(p), nil
+	case bool:
+		return "b:" + strconv.FormatBool(p), nil
+	case int64:
+		return "i:" + strconv.FormatInt(p, 10), nil
+	}
+	return "", fmt.Errorf("cannot route on parm of type %T", parm)
+}
+
+// parmKeys returns the canonical encodings of parms.
+func parmKeys(parms []interface{}) (keys []string, err error) {
+	keys = make([]string, len(parms))
+	for i, parm := range parms {
+		keys[i], err = parmKey(parm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// registration is a module attached to a syscall tree node.
+type registration struct {
+	name   string
+	module Module
+}
+
+// SyscallNode represents a node in the hierarchical syscall tree.
+// The path from the root to a node is a prefix of message parms; the
+// modules at a node are those known to handle messages with that
+// prefix, and history holds how each module consulted with that
+// prefix has behaved.
+type SyscallNode struct {
+	modules  []registration
+	children map[string]*SyscallNode
+	history  map[string]*Acceptance
+}
+
+func newSyscallNode() *SyscallNode {
+	return &SyscallNode{children: make(map[string]*SyscallNode)}
+}
+
+// SyscallTree is a SyscallNode tree that is safe for concurrent use.
+type SyscallTree struct {
+	mu      sync.RWMutex
+	root    *SyscallNode
+	records int // history records in the tree
+
+	// HalfLife is how long it takes acceptance history to lose half
+	// its weight.
+	HalfLife time.Duration
+	// RejectThreshold is how many more recent rejections than
+	// acceptances make the kernel stop consulting a module.
+	RejectThreshold float64
+	// MaxHistory bounds how many history records, one per module per
+	// node, the tree keeps.  Zero means no bound.
+	MaxHistory int
+}
+
+// NewSyscallTree returns an empty tree.
+func NewSyscallTree() *SyscallTree {
+	return &SyscallTree{
+		root:            newSyscallNode(),
+		HalfLife:        DefaultHalfLife,
+		RejectThreshold: DefaultRejectThreshold,
+		MaxHistory:      DefaultMaxHistory,
+	}
+}
+
+// Add attaches module to the node for the given parms prefix,
+// creating nodes as needed.  Adding a module that is already attached
+// to that node is a no-op.
+func (t *SyscallTree) Add(name string, module Module, parms ...interface{}) error {
+	keys, err := parmKeys(parms)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := t.root
+	for _, key := range keys {
+		child, ok := node.children[key]
+		if !ok {
+			child = newSyscallNode()
+			node.children[key] = child
+		}
+		node = child
+	}
+	for _, reg := range node.modules {
+		if reg.name == name {
+			return nil
+		}
+	}
+	node.modules = append(node.modules, registration{name: name, module: module})
+	return nil
+}
+
+// Remove detaches the named module from every node, forgets its
+// history, and prunes nodes left empty.
+func (t *SyscallTree) Remove(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, dropped := t.root.remove(name)
+	t.records -= dropped
+}
+
+// remove detaches name from n and its descendants, and reports
+// whether n is now empty and how many history records it dropped.
+func (n *SyscallNode) remove(name string) (empty bool, dropped int) {
+	kept := n.modules[:0]
+	for _, reg := range n.modules {
+		if reg.name != name {
+			kept = append(kept, reg)
+		}
+	}
+	n.modules = kept
+	if _, ok := n.history[name]; ok {
+		delete(n.history, name)
+		dropped++
+	}
+	for key, child := range n.children {
+		childEmpty, childDropped := child.remove(name)
+		if childEmpty {
+			delete(n.children, key)
+		}
+		dropped += childDropped
+	}
+	return len(n.modules) == 0 && len(n.children) == 0 && len(n.history) == 0, dropped
+}
+
+// Route returns the modules to consult for a message with the given
+// parms: those at the node with the longest matching prefix first,
+// then those at each shorter prefix back to the root.  A module
+// appears only once, at its longest match.
+func (t *SyscallTree) Route(parms ...interface{}) (routes []Candidate, err error) {
+	keys, err := parmKeys(parms)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	path := []*SyscallNode{t.root}
+	node := t.root
+	for _, key := range keys {
+		child, ok := node.children[key]
+		if !ok {
+			break
+		}
+		node = child
+		path = append(path, node)
+	}
+	seen := make(map[string]bool)
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, reg := range path[i].modules {
+			if seen[reg.name] {
+				continue
+			}
+			seen[reg.name] = true
+			routes = append(routes, Candidate{Name: reg.name, Module: reg.module, Depth: i})
+		}
+	}
+	return
+}
+
+// Candidate is one module returned by SyscallTree.Route.
+type Candidate struct {
+	Name   string
+	Module Module
+	Depth  int // length of the parms prefix the module was found at
+
+	// History is the module's most specific acceptance history along
+	// the path, filled in by rank.
+	History Acceptance
+}
@@ -0,0 +1,182 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// stubModule accepts messages whose leading parm is in accepts, and
+// optionally fails after accepting.
+type stubModule struct {
+	name    string
+	accepts map[interface{}]bool
+	fail    bool
+
+	mu      sync.Mutex
+	handled int
+	tested  int
+}
+
+func newStub(name string, accepts ...interface{}) *stubModule {
+	m := &stubModule{name: name, accepts: make(map[interface{}]bool)}
+	for _, a := range accepts {
+		m.accepts[a] = true
+	}
+	return m
+}
+
+func (m *stubModule) HandleMessage(ctx context.Context, test bool, in *Message) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if test {
+		m.tested++
+	}
+	if len(in.Parms) == 0 || !m.accepts[in.Parms[0]] {
+		return &Message{Parms: []interface{}{false}}, nil
+	}
+	if test {
+		return &Message{Parms: []interface{}{true}}, nil
+	}
+	m.handled++
+	if m.fail {
+		return nil, fmt.Errorf("%s failed", m.name)
+	}
+	return &Message{Parms: []interface{}{true, m.name}}, nil
+}
+
+func TestParmKey(t *testing.T) {
+	cases := []struct {
+		parm interface{}
+		want string
+	}{
+		{nil, "n:"},
+		{"abc", "s:abc"},
+		{"1", "s:1"},
+		{1, "i:1"},
+		{int64(-7), "i:-7"},
+		{uint8(7), "i:7"},
+		{float64(1), "i:1"},
+		{json.Number("42"), "i:42"},
+		{true, "b:true"},
+		{[]byte{0xde, 0xad}, "x:dead"},
+		{Multihash{0x12, 0x01, 0xad}, "h:1201ad"},
+	}
+	for _, c := range cases {
+		got, err := parmKey(c.parm)
+		if err != nil {
+			t.Errorf("parmKey(%#v) returned an error: %v", c.parm, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parmKey(%#v) = %q, want %q", c.parm, got, c.want)
+		}
+	}
+
+	// parms the kernel cannot encode cannot be routed either
+	for _, parm := range []interface{}{1.5, []interface{}{"a", 1}, map[string]interface{}{"a": 1}, make(chan int)} {
+		if _, err := parmKey(parm); err == nil {
+			t.Errorf("expected an error for parm %#v", parm)
+		}
+	}
+}
+
+func TestSyscallTreeRoute(t *testing.T) {
+	tree := NewSyscallTree()
+	add := func(name string, parms ...interface{}) {
+		if err := tree.Add(name, newStub(name), parms...); err != nil {
+			t.Fatalf("Add(%s) returned an error: %v", name, err)
+		}
+	}
+	add("fallback")
+	add("promise", "p1")
+	add("module", "p1", "m1")
+	add("args", "p1", "m1", "a", 1)
+	add("other", "p2")
+	add("int", 1)
+
+	cases := []struct {
+		name  string
+		parms []interface{}
+		want  []string
+	}{
+		{"empty parms", nil, []string{"fallback"}},
+		{"unknown promise", []interface{}{"p9", "m1"}, []string{"fallback"}},
+		{"promise only", []interface{}{"p1"}, []string{"promise", "fallback"}},
+		{"promise and unknown module", []interface{}{"p1", "m9"}, []string{"promise", "fallback"}},
+		{"promise and module", []interface{}{"p1", "m1"}, []string{"module", "promise", "fallback"}},
+		{"longer than any path", []interface{}{"p1", "m1", "zzz"}, []string{"module", "promise", "fallback"}},
+		{"full path", []interface{}{"p1", "m1", "a", 1}, []string{"args", "module", "promise", "fallback"}},
+		{"full path from JSON", []interface{}{"p1", "m1", "a", float64(1)}, []string{"args", "module", "promise", "fallback"}},
+		{"type mismatch", []interface{}{"p1", "m1", "a", "1"}, []string{"module", "promise", "fallback"}},
+		{"sibling", []interface{}{"p2", "m1"}, []string{"other", "fallback"}},
+		{"int is not string", []interface{}{"1"}, []string{"fallback"}},
+		{"int", []interface{}{1}, []string{"int", "fallback"}},
+	}
+	for _, c := range cases {
+		routes, err := tree.Route(c.parms...)
+		if err != nil {
+			t.Errorf("%s: Route returned an error: %v", c.name, err)
+			continue
+		}
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.Name)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Route(%v) = %v, want %v", c.name, c.parms, got, c.want)
+		}
+	}
+}
+
+func TestSyscallTreeRouteDedup(t *testing.T) {
+	tree := NewSyscallTree()
+	m := newStub("m")
+	tree.Add("m", m)
+	tree.Add("m", m, "p1", "x")
+	tree.Add("m", m, "p1", "x") // no-op
+	routes, err := tree.Route("p1", "x")
+	if err != nil {
+		t.Fatalf("Route returned an error: %v", err)
+	}
+	if len(routes) != 1 || routes[0].Depth != 2 {
+		t.Errorf("expected one route at depth 2, got %+v", routes)
+	}
+}
+
+func TestSyscallTreeRemove(t *testing.T) {
+	tree := NewSyscallTree()
+	tree.Add("a", newStub("a"), "p1", "m1")
+	tree.Add("b", newStub("b"), "p1")
+	tree.Remove("a")
+	routes, _ := tree.Route("p1", "m1")
+	if len(routes) != 1 || routes[0].Name != "b" {
+		t.Errorf("unexpected routes after Remove: %+v", routes)
+	}
+	if _, ok := tree.root.children["s:p1"].children["s:m1"]; ok {
+		t.Errorf("expected empty node to be pruned")
+	}
+}
+
+func TestSyscallTreeConcurrent(t *testing.T) {
+	tree := NewSyscallTree()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("m%d", i)
+			for j := 0; j < 100; j++ {
+				tree.Add(name, newStub(name), "p", j%10, i)
+				tree.Route("p", j%10, i)
+				if j%25 == 0 {
+					tree.Remove(name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,144 @@
+// Command pupid derives the PUP protocol identifier of each handler
+// package named on the command line, or of the package in the current
+// directory, from the package's canonical source.  It writes the
+// identifier to the package's protocol_id.go as the ProtocolID
+// constant and records it in the module's protocols.txt registry.  A
+// handler package runs it with
+//
+//	//go:generate go run pup6/cmd/pupid
+//
+// With -check, pupid changes nothing, and warns and exits non-zero if
+// a handler's source has changed without its ProtocolID being bumped.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pup6/protoid"
+)
+
+func main() {
+	check := flag.Bool("check", false, "warn about stale protocol IDs instead of updating them")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: pupid [-check] [dir ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	failed := false
+	for _, dir := range dirs {
+		err := run(dir, *check)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pupid: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func run(dir string, check bool) error {
+	if check {
+		err := protoid.Check(dir)
+		var stale *protoid.StaleError
+		if errors.As(err, &stale) && stale.Generated == "" {
+			return fmt.Errorf("%s: no ProtocolID; run pupid", dir)
+		}
+		return err
+	}
+	id, err := protoid.Hash(dir)
+	if err != nil {
+		return err
+	}
+	have, err := protoid.Generated(dir)
+	if err != nil {
+		return err
+	}
+	if have != id.HexString() {
+		pkg, err := packageName(dir)
+		if err != nil {
+			return err
+		}
+		err = protoid.Generate(dir, pkg, id.HexString())
+		if err != nil {
+			return err
+		}
+		if have != "" {
+			fmt.Fprintf(os.Stderr, "pupid: %s: protocol ID bumped from %s to %s\n", dir, have, id.HexString())
+		}
+	}
+	root, importPath, err := modulePath(dir)
+	if err != nil {
+		return err
+	}
+	_, err = protoid.Register(filepath.Join(root, protoid.RegistryFile), protoid.Entry{Package: importPath, ID: id.HexString()})
+	return err
+}
+
+// packageName returns the name of the package in dir.
+func packageName(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return "", err
+	}
+	for _, p := range paths {
+		if strings.HasSuffix(p, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return "", err
+		}
+		return f.Name.Name, nil
+	}
+	return "", fmt.Errorf("%s: no Go source files", dir)
+}
+
+// modulePath finds the root of the module containing dir, and the
+// import path of the package in dir.
+func modulePath(dir string) (root, importPath string, err error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for root = abs; ; root = filepath.Dir(root) {
+		buf, err := os.ReadFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			mod := modulePathOf(buf)
+			if mod == "" {
+				return "", "", fmt.Errorf("%s: no module directive", filepath.Join(root, "go.mod"))
+			}
+			rel, err := filepath.Rel(root, abs)
+			if err != nil {
+				return "", "", err
+			}
+			return root, path.Join(mod, filepath.ToSlash(rel)), nil
+		}
+		if filepath.Dir(root) == root {
+			return "", "", fmt.Errorf("%s: not in a module", dir)
+		}
+	}
+}
+
+// modulePathOf returns the module path declared in a go.mod file.
+func modulePathOf(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
@@ -1,79 +1,94 @@
+// Command dispatcher runs a PUP dispatcher with handlers for an echo
+// protocol and the upper protocol, on stdio by default or on a TCP,
+// UDP or WebSocket address.  To type messages at a terminal, use
+// newline-delimited text:
+//
+//	go run ./examples/dispatcher -text
 package main
 
 import (
-	"github.com/multiformats/go-multihash"
-	. "github.com/stevegt/goadapt"
-)
-
-// Message is a parsed PUP-pattern message.
-type Message struct {
-	// Id is the multihash prefix of the message.
-	Id      multihash.Multihash
-	Payload []byte
-}
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
 
-// Handler is an interface that must be implemented by all handlers
-// that register with the dispatcher.
-type Handler interface {
-	// Claim returns true if the handler claims the message.
-	Claim(msg *Message) bool
-	HandleMessage(msg *Message, responses chan *Message)
-}
+	"pup6/examples/upper"
+	"pup6/pup"
+)
 
-// Dispatcher is a PUP dispatcher that routes messages and streams to
-// the appropriate handler.
-type Dispatcher struct {
-	// Handlers is a list of handlers that are registered with the
-	// dispatcher.  Each incoming message is routed to all handlers
-	// that claim to be able to process it.
-	Handlers []Handler
-}
+// echoSpec is the canonical specification of the echo protocol; its
+// hash is the protocol's identifier.
+const echoSpec = `PUP echo protocol, version 1.
 
-// HandleMessage handles a message by routing it to all handlers that
-// claim it. Handlers return errors and responses in the responses
-// channel.
-func (d *Dispatcher) HandleMessage(msg *Message, responses chan *Message) {
-	claimed := false
-	for _, h := range d.Handlers {
-		if h.Claim(msg) {
-			claimed = true
-			go h.HandleMessage(msg, responses)
-		}
-	}
-	if !claimed {
-		responses <- NewErrorMessage(msg, "No handler claimed the message.")
-	}
-}
+The handler responds to each message with a message in the same
+protocol carrying the same payload.
+`
 
-// RegisterHandler registers a handler with the dispatcher.
-func (d *Dispatcher) RegisterHandler(h Handler) {
-	d.Handlers = append(d.Handlers, h)
-}
-
-// NewDispatcher creates a new dispatcher.
-func NewDispatcher() *Dispatcher {
-	return &Dispatcher{}
-}
+// EchoID identifies the echo protocol.
+var EchoID = pup.HashID([]byte(echoSpec))
 
 // EchoHandler is a handler that echos messages back to the sender.
 type EchoHandler struct{}
 
 // Claim returns true if the handler claims the message.
-func (h *EchoHandler) Claim(msg *Message) bool {
+func (h *EchoHandler) Claim(msg *pup.Message) bool {
+	return bytes.Equal(msg.Id, EchoID)
+}
+
+// Describe returns the echo protocol's specification.
+func (h *EchoHandler) Describe() string {
+	return echoSpec
+}
 
-	return msg.Type == "echo"
+// HandleMessage sends the message back unchanged.
+func (h *EchoHandler) HandleMessage(msg *pup.Message, responses chan<- *pup.Message) {
+	responses <- pup.NewMessage(msg.Id, msg.Payload)
 }
 
 func main() {
-	// Create a new dispatcher.
-	dispatcher := NewDispatcher()
+	text := flag.Bool("text", false, "read and write newline-delimited text instead of length-prefixed messages")
+	tcp := flag.String("tcp", "", "listen for length-prefixed messages on this TCP address")
+	udp := flag.String("udp", "", "listen for datagrams on this UDP address")
+	ws := flag.String("ws", "", "listen for WebSocket connections on this address")
+	flag.Parse()
 
-	// Register a handler that handles the "echo" message.
-	dispatcher.RegisterHandler(&EchoHandler{})
+	// Create a new dispatcher.
+	dispatcher := pup.NewDispatcher()
 
-	// receive messages from stdin and send responses to stdout.
-	dispatcher.Run()
+	// Register a handler for the echo protocol.
+	dispatcher.Register(EchoID, &EchoHandler{})
 
-	Pl("vim-go")
+	// Register the upper handler, whose protocol identifier is derived
+	// from its source.
+	dispatcher.Register(upper.ID, &upper.Handler{})
 
+	var err error
+	switch {
+	case *tcp != "":
+		var ln net.Listener
+		ln, err = net.Listen("tcp", *tcp)
+		if err == nil {
+			err = dispatcher.ServeListener(ln)
+		}
+	case *udp != "":
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", *udp)
+		if err == nil {
+			err = dispatcher.ServePacket(conn)
+		}
+	case *ws != "":
+		err = http.ListenAndServe(*ws, dispatcher.WebSocketHandler())
+	default:
+		// receive messages from stdin and send responses to stdout.
+		if *text {
+			dispatcher.NewFramer = pup.NewLineFramer
+		}
+		err = dispatcher.Run(os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -1,28 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"testing"
 
-	"github.com/multiformats/go-multihash"
-	. "github.com/stevegt/goadapt"
+	"pup6/pup"
 )
 
 // TestEchoHandler tests the EchoHandler.
 func TestEchoHandler(t *testing.T) {
 	// Create a new dispatcher.
-	d := NewDispatcher()
+	d := pup.NewDispatcher()
 
 	// Register the echo handler.
-	d.RegisterHandler(&EchoHandler{})
+	d.Register(EchoID, &EchoHandler{})
 
 	// Create a message.
-	m := &Message{
-		Id:      multihash.Multihash{},
-		Payload: []byte("Hello, world!"),
-	}
+	m := pup.NewMessage(EchoID, []byte("Hello, world!"))
 
 	// Create a channel for responses.
-	responses := make(chan *Message)
+	responses := make(chan *pup.Message, 1)
 
 	// Dispatch the message.
 	d.HandleMessage(m, responses)
@@ -31,7 +28,27 @@ func TestEchoHandler(t *testing.T) {
 	r := <-responses
 
 	// Check the response.
-	if string(r.Payload) != "Hello, world!" {
+	if string(r.Payload) != "Hello, world!" || !bytes.Equal(r.Id, EchoID) {
 		t.Error("EchoHandler failed to echo the message.")
 	}
 }
+
+// TestRun sends the echo message through the dispatcher's stdio loop.
+func TestRun(t *testing.T) {
+	d := pup.NewDispatcher()
+	d.Register(EchoID, &EchoHandler{})
+
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	req := pup.NewMessage(EchoID, []byte("Hello, world!")).Bytes()
+	pup.NewLengthFramer(nil, in).WriteFrame(req)
+	if err := d.Run(in, out); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	resp, err := pup.NewLengthFramer(out, nil).ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame returned an error: %v", err)
+	}
+	if !bytes.Equal(resp, req) {
+		t.Errorf("expected the message echoed, got %q", resp)
+	}
+}
@@ -0,0 +1,7 @@
+// Code generated by pupid; DO NOT EDIT.
+
+package upper
+
+// ProtocolID is the PUP protocol identifier of this package's handler:
+// the multihash of the package's canonical source.
+const ProtocolID = "12207adcdd6aa22c44f775ca3036c387ffbf707acf38c1a5ee2b4eb00ae7dafe55be"
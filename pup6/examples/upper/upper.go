@@ -0,0 +1,28 @@
+// Package upper is an example of a PUP handler whose protocol
+// identifier is derived from its own source code.  Run go generate
+// after changing it to bump ProtocolID.
+package upper
+
+//go:generate go run pup6/cmd/pupid
+
+import (
+	"bytes"
+
+	"pup6/pup"
+)
+
+// ID identifies the upper protocol.
+var ID = pup.MustParseID(ProtocolID)
+
+// Handler answers each message with its payload in upper case.
+type Handler struct{}
+
+// Claim returns true for messages in the upper protocol.
+func (h *Handler) Claim(msg *pup.Message) bool {
+	return bytes.Equal(msg.Id, ID)
+}
+
+// HandleMessage sends the payload back in upper case.
+func (h *Handler) HandleMessage(msg *pup.Message, responses chan<- *pup.Message) {
+	responses <- pup.NewMessage(ID, bytes.ToUpper(msg.Payload))
+}
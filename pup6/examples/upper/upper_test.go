@@ -0,0 +1,26 @@
+package upper
+
+import (
+	"testing"
+
+	"pup6/protoid"
+	"pup6/pup"
+)
+
+// TestProtocolID fails when the handler has changed without its
+// protocol identifier being regenerated.
+func TestProtocolID(t *testing.T) {
+	if err := protoid.Check("."); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	d := pup.NewDispatcher()
+	d.Register(ID, &Handler{})
+	responses := make(chan *pup.Message, 1)
+	d.HandleMessage(pup.NewMessage(ID, []byte("Hello, world!")), responses)
+	if r := <-responses; string(r.Payload) != "HELLO, WORLD!" {
+		t.Errorf("unexpected response %q", r.Payload)
+	}
+}
@@ -1,10 +1,10 @@
-module main
+module pup6
 
-go 1.19
+go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/multiformats/go-multihash v0.2.3
-	github.com/stevegt/goadapt v0.4.0
 )
 
 require (
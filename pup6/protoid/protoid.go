@@ -0,0 +1,215 @@
+// Package protoid derives PUP protocol identifiers from the source
+// code of handler packages, as the specification suggests.
+//
+// A package's canonical source is its top-level declarations, each
+// printed with go/printer as the splitter does and reduced to its
+// token sequence, then sorted.  Comments, layout, trailing commas and
+// the order of declarations across files do not contribute, so
+// reformatting a handler or moving code between its files leaves its
+// identifier unchanged; any change to the code itself, or to a build
+// constraint, yields a new identifier.
+//
+// The pupid command writes a package's identifier to the package as
+// its ProtocolID constant and records it in the module's
+// protocols.txt registry, from which Versions reads a protocol's
+// versions.  See examples/upper for a handler built this way.
+package protoid
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+
+	"pup6/pup"
+)
+
+// GeneratedFile is the file in a handler package that holds its
+// ProtocolID constant.  It is not part of the canonical source.
+const GeneratedFile = "protocol_id.go"
+
+// Canonical returns the canonical source of the Go package in dir,
+// excluding tests and GeneratedFile.
+func Canonical(dir string) ([]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	pkg := ""
+	var chunks []string
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if name == GeneratedFile || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		if pkg == "" {
+			pkg = f.Name.Name
+		} else if f.Name.Name != pkg {
+			return nil, fmt.Errorf("%s: found packages %s and %s", dir, pkg, f.Name.Name)
+		}
+		prefix := ""
+		if c := buildConstraint(f); c != "" {
+			prefix = c + "\n"
+		}
+		for _, decl := range f.Decls {
+			var buf bytes.Buffer
+			err = printer.Fprint(&buf, fset, decl)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, prefix+tokens(buf.Bytes()))
+		}
+	}
+	if pkg == "" {
+		return nil, fmt.Errorf("%s: no Go source files", dir)
+	}
+	sort.Strings(chunks)
+	return []byte("package " + pkg + "\n" + strings.Join(chunks, "\n") + "\n"), nil
+}
+
+// buildConstraint returns the //go:build line of f, if it has one.
+func buildConstraint(f *ast.File) string {
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "//go:build ") {
+				return strings.Join(strings.Fields(c.Text), " ")
+			}
+		}
+	}
+	return ""
+}
+
+// tokens reduces src to its tokens separated by single spaces,
+// dropping comments and the commas and semicolons that layout alone
+// puts before a closing bracket.
+func tokens(src []byte) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, 0)
+	var toks []string
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		switch tok {
+		case token.RPAREN, token.RBRACE, token.RBRACK:
+			if n := len(toks); n > 0 && (toks[n-1] == "," || toks[n-1] == ";") {
+				toks = toks[:n-1]
+			}
+		}
+		if lit == "" || tok == token.SEMICOLON {
+			lit = tok.String()
+		}
+		toks = append(toks, lit)
+	}
+	if n := len(toks); n > 0 && toks[n-1] == ";" {
+		toks = toks[:n-1]
+	}
+	return strings.Join(toks, " ")
+}
+
+// Hash returns the protocol identifier of the handler package in dir,
+// the multihash of its canonical source.
+func Hash(dir string) (multihash.Multihash, error) {
+	src, err := Canonical(dir)
+	if err != nil {
+		return nil, err
+	}
+	return pup.HashID(src), nil
+}
+
+// Generated returns the ProtocolID recorded in dir's GeneratedFile,
+// or "" if there is none.
+func Generated(dir string) (string, error) {
+	path := filepath.Join(dir, GeneratedFile)
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				if name.Name != "ProtocolID" || i >= len(vs.Values) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					return "", fmt.Errorf("%s: ProtocolID is not a string literal", path)
+				}
+				return strconv.Unquote(lit.Value)
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: no ProtocolID constant", path)
+}
+
+// Generate writes dir's GeneratedFile, declaring ProtocolID as the
+// hex identifier id in package pkg.
+func Generate(dir, pkg, id string) error {
+	src := fmt.Sprintf(`// Code generated by pupid; DO NOT EDIT.
+
+package %s
+
+// ProtocolID is the PUP protocol identifier of this package's handler:
+// the multihash of the package's canonical source.
+const ProtocolID = %q
+`, pkg, id)
+	return os.WriteFile(filepath.Join(dir, GeneratedFile), []byte(src), 0644)
+}
+
+// StaleError reports a handler package whose source has changed
+// without its protocol identifier being bumped.
+type StaleError struct {
+	Dir       string
+	Generated string // the recorded ProtocolID
+	Source    string // the identifier the source hashes to
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("%s: handler source changed without a protocol ID bump: ProtocolID is %s, source hashes to %s; run pupid", e.Dir, e.Generated, e.Source)
+}
+
+// Check returns a *StaleError if the ProtocolID recorded in dir does
+// not match the package's source.
+func Check(dir string) error {
+	id, err := Hash(dir)
+	if err != nil {
+		return err
+	}
+	have, err := Generated(dir)
+	if err != nil {
+		return err
+	}
+	if have != id.HexString() {
+		return &StaleError{Dir: dir, Generated: have, Source: id.HexString()}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package protoid
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pup6/pup"
+)
+
+// writePkg writes files, by name, to a new package directory.
+func writePkg(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, src := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func hash(t *testing.T, files map[string]string) string {
+	id, err := Hash(writePkg(t, files))
+	if err != nil {
+		t.Fatalf("Hash returned an error: %v", err)
+	}
+	return id.HexString()
+}
+
+const base = `package h
+
+import "strings"
+
+func Handle(s string) string { return strings.ToUpper(s) }
+
+var names = []string{"a", "b"}
+`
+
+func TestHashIgnoresFormatting(t *testing.T) {
+	want := hash(t, map[string]string{"h.go": base})
+	same := map[string]map[string]string{
+		"reformatted": {"h.go": `package h
+import "strings"
+// Handle upper-cases s.
+func Handle(s string) string {
+	// shout
+	return strings.ToUpper(s)
+}
+
+var names = []string{
+	"a",
+	"b",
+}
+`},
+		"split across files": {
+			"a.go": "package h\n\nvar names = []string{\"a\", \"b\"}\n",
+			"b.go": "package h\n\nimport \"strings\"\n\nfunc Handle(s string) string { return strings.ToUpper(s) }\n",
+		},
+		"with tests and generated file": {
+			"h.go":        base,
+			"h_test.go":   "package h\n\nfunc helper() {}\n",
+			GeneratedFile: "package h\n\nconst ProtocolID = \"1220\"\n",
+		},
+	}
+	for name, files := range same {
+		if got := hash(t, files); got != want {
+			t.Errorf("%s: hash changed", name)
+		}
+	}
+
+	different := map[string]map[string]string{
+		"changed code":     {"h.go": base + "\nfunc extra() {}\n"},
+		"changed literal":  {"h.go": base[:len(base)-len("\"b\"}\n")] + "\"c\"}\n"},
+		"build constraint": {"h.go": "//go:build linux\n\n" + base},
+	}
+	for name, files := range different {
+		if got := hash(t, files); got == want {
+			t.Errorf("%s: hash did not change", name)
+		}
+	}
+}
+
+func TestHashErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"empty":          {},
+		"syntax error":   {"h.go": "package h\n\nfunc {\n"},
+		"mixed packages": {"a.go": "package a\n", "b.go": "package b\n"},
+	} {
+		if _, err := Hash(writePkg(t, files)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := writePkg(t, map[string]string{"h.go": base})
+	var stale *StaleError
+	if err := Check(dir); !errors.As(err, &stale) || stale.Generated != "" {
+		t.Fatalf("expected a StaleError without a generated ID, got %v", err)
+	}
+	id, err := Hash(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Generate(dir, "h", id.HexString()); err != nil {
+		t.Fatalf("Generate returned an error: %v", err)
+	}
+	if got, err := Generated(dir); err != nil || got != id.HexString() {
+		t.Errorf("Generated returned %q, %v", got, err)
+	}
+	if err := Check(dir); err != nil {
+		t.Errorf("Check returned an error for a fresh ID: %v", err)
+	}
+
+	// the generated file is itself valid, hashable Go
+	if _, err := Hash(dir); err != nil {
+		t.Errorf("Hash failed with a generated file present: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "h.go"), []byte(base+"\nfunc extra() {}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(dir); !errors.As(err, &stale) || stale.Generated != id.HexString() {
+		t.Errorf("expected a StaleError after changing the source, got %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), RegistryFile)
+	a1 := Entry{Package: "m/a", ID: "1220aa"}
+	a2 := Entry{Package: "m/a", ID: "1220bb"}
+	for i, e := range []Entry{a1, a2, a1} {
+		added, err := Register(path, e)
+		if err != nil || added != (i < 2) {
+			t.Errorf("Register(%v) = %v, %v", e, added, err)
+		}
+	}
+	entries, err := ReadRegistry(path)
+	if err != nil || len(entries) != 2 || entries[0] != a1 || entries[1] != a2 {
+		t.Errorf("ReadRegistry returned %v, %v", entries, err)
+	}
+
+	os.WriteFile(path, []byte("m/a\n"), 0644)
+	if _, err := ReadRegistry(path); err == nil {
+		t.Errorf("expected an error for a malformed registry")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	v1, v2 := pup.HashID([]byte("v1")), pup.HashID([]byte("v2"))
+	entries := []Entry{
+		{Package: "m/a", ID: v1.HexString()},
+		{Package: "m/b", ID: pup.HashID([]byte("b")).HexString()},
+		{Package: "m/a", ID: v2.HexString()},
+	}
+	ids, err := Versions(entries, "m/a")
+	if err != nil || len(ids) != 2 || !bytes.Equal(ids[0], v1) || !bytes.Equal(ids[1], v2) {
+		t.Errorf("Versions returned %v, %v", ids, err)
+	}
+	if _, err := Versions([]Entry{{Package: "m/a", ID: "1220aa"}}, "m/a"); err == nil {
+		t.Errorf("expected an error for an invalid identifier")
+	}
+}
@@ -0,0 +1,85 @@
+package protoid
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+
+	"pup6/pup"
+)
+
+// RegistryFile is the registry's name at the root of a module.
+const RegistryFile = "protocols.txt"
+
+// Entry records one version of a handler package's protocol.
+type Entry struct {
+	Package string // import path of the handler package
+	ID      string // hex protocol identifier
+}
+
+// ReadRegistry reads a registry of protocol identifiers: lines of
+// "package id", oldest first.  Every version a package has had stays
+// in the registry, so that peers still speaking an old version can be
+// recognised.  A missing registry is empty.
+func ReadRegistry(path string) (entries []Entry, err error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"package id\"", path, i+1)
+		}
+		entries = append(entries, Entry{Package: fields[0], ID: fields[1]})
+	}
+	return entries, nil
+}
+
+// Register appends e to the registry at path unless it is already
+// there, and reports whether it was added.
+func Register(path string, e Entry) (added bool, err error) {
+	entries, err := ReadRegistry(path)
+	if err != nil {
+		return false, err
+	}
+	for _, x := range entries {
+		if x == e {
+			return false, nil
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", e.Package, e.ID)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// Versions returns the identifiers pkg has had in entries, oldest
+// first, as Negotiate expects them.
+func Versions(entries []Entry, pkg string) (ids []multihash.Multihash, err error) {
+	for _, e := range entries {
+		if e.Package != pkg {
+			continue
+		}
+		id, err := pup.ParseID(e.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pkg, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,360 @@
+package pup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// Handler is an interface that must be implemented by all handlers
+// that register with the dispatcher.
+type Handler interface {
+	// Claim returns true if the handler claims the message.
+	Claim(msg *Message) bool
+	// HandleMessage processes a claimed message, sending any
+	// responses and errors on responses, and returns when it is done.
+	HandleMessage(msg *Message, responses chan<- *Message)
+}
+
+// HandlerFunc is a Handler that claims every message it is given.
+type HandlerFunc func(msg *Message, responses chan<- *Message)
+
+func (f HandlerFunc) Claim(msg *Message) bool { return true }
+
+func (f HandlerFunc) HandleMessage(msg *Message, responses chan<- *Message) {
+	f(msg, responses)
+}
+
+// Dispatcher is a PUP dispatcher that routes messages to the handlers
+// registered for their protocol identifiers.  Handlers may be
+// registered and unregistered while it runs.
+//
+// Each registered handler runs on a pool of Workers goroutines fed by
+// queues of QueueLen messages.  When a handler's queue is full,
+// dispatching to it waits, which slows the reading of the stream the
+// message came from rather than letting work pile up without bound.
+type Dispatcher struct {
+	// NewFramer frames the streams given to Run.  It defaults to
+	// NewLengthFramer.
+	NewFramer NewFramerFunc
+
+	// Workers and QueueLen size the pool of each handler registered
+	// after they are set.  They default to DefaultWorkers and
+	// DefaultQueueLen.
+	Workers  int
+	QueueLen int
+
+	// Ordered makes each handler process the messages of a stream,
+	// such as one connection, in the order they arrived.  Messages
+	// from different streams are still handled in parallel.  It
+	// applies to streams started after it is set.
+	Ordered bool
+
+	// MaxPeers and PeerIdle bound the senders ServePacket serves at
+	// once and how long each is served after its last datagram.  They
+	// default to DefaultMaxPeers and DefaultPeerIdle.
+	MaxPeers int
+	PeerIdle time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string][]*registration // by protocol identifier bytes
+	any      []*registration            // offered every message
+	meta     *registration              // answers the meta protocol
+	streams  atomic.Uint64
+}
+
+// registration is one registered handler.  Handlers are removed by
+// their registration, since a Handler such as a HandlerFunc need not
+// be comparable.
+type registration struct {
+	id   multihash.Multihash // nil if offered every message
+	pool *pool
+}
+
+// NewDispatcher creates a new dispatcher, which answers the meta
+// protocol about the handlers registered with it.
+func NewDispatcher() *Dispatcher {
+	d := &Dispatcher{
+		NewFramer: NewLengthFramer,
+		Workers:   DefaultWorkers,
+		QueueLen:  DefaultQueueLen,
+		MaxPeers:  DefaultMaxPeers,
+		PeerIdle:  DefaultPeerIdle,
+		handlers:  make(map[string][]*registration),
+	}
+	d.meta = d.newRegistration(MetaID, &metaHandler{d})
+	return d
+}
+
+func (d *Dispatcher) newRegistration(id multihash.Multihash, h Handler) *registration {
+	return &registration{id: id, pool: newPool(h, d.Workers, d.QueueLen)}
+}
+
+// Register registers a handler for messages in protocol id, returning
+// a function that unregisters it.  Messages already queued for the
+// handler are still handled after it is unregistered.
+func (d *Dispatcher) Register(id multihash.Multihash, h Handler) (unregister func()) {
+	r := d.newRegistration(id, h)
+	key := string(id)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[key] = append(d.handlers[key], r)
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.handlers[key] = without(d.handlers[key], r)
+		if len(d.handlers[key]) == 0 {
+			delete(d.handlers, key)
+		}
+		r.pool.close()
+	}
+}
+
+// RegisterHandler registers a handler that is offered every message,
+// whatever its protocol, and takes the ones it claims.  It returns a
+// function that unregisters the handler.
+func (d *Dispatcher) RegisterHandler(h Handler) (unregister func()) {
+	r := d.newRegistration(nil, h)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.any = append(d.any, r)
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.any = without(d.any, r)
+		r.pool.close()
+	}
+}
+
+// Close unregisters every handler, including the one answering the
+// meta protocol, and stops their workers once they have finished the
+// messages already queued.  Messages dispatched after Close are
+// dropped.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	var rs []*registration
+	for _, hs := range d.handlers {
+		rs = append(rs, hs...)
+	}
+	rs = append(append(rs, d.any...), d.meta)
+	d.handlers = make(map[string][]*registration)
+	d.any = nil
+	d.mu.Unlock()
+	for _, r := range rs {
+		r.pool.close()
+	}
+	return nil
+}
+
+func without(rs []*registration, r *registration) []*registration {
+	out := rs[:0:0]
+	for _, x := range rs {
+		if x != r {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// Protocols returns the identifiers of the protocols with registered
+// handlers.  The built-in meta protocol is not among them.
+func (d *Dispatcher) Protocols() (ids []multihash.Multihash) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for id := range d.handlers {
+		ids = append(ids, multihash.Multihash(id))
+	}
+	return
+}
+
+// Stats returns the load on each registered handler, those
+// registered for a protocol ordered by protocol identifier, followed
+// by those offered every message.
+func (d *Dispatcher) Stats() (stats []HandlerStats) {
+	d.mu.RLock()
+	var rs []*registration
+	for _, hs := range d.handlers {
+		rs = append(rs, hs...)
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].id, rs[j].id) < 0
+	})
+	rs = append(rs, d.any...)
+	d.mu.RUnlock()
+	for _, r := range rs {
+		stats = append(stats, r.pool.stats(r.id))
+	}
+	return
+}
+
+// claimants returns the registrations whose handlers claim msg.
+func (d *Dispatcher) claimants(msg *Message) (rs []*registration) {
+	d.mu.RLock()
+	candidates := append(append([]*registration(nil), d.handlers[string(msg.Id)]...), d.any...)
+	d.mu.RUnlock()
+	if d.meta != nil {
+		candidates = append(candidates, d.meta)
+	}
+	for _, r := range candidates {
+		if r.pool.h.Claim(msg) {
+			rs = append(rs, r)
+		}
+	}
+	return
+}
+
+// dispatch queues msg for every handler that claims it, in the queues
+// for stream if it is not zero, and calls done once they have all
+// finished with it.  If no handler claims the message, an error
+// message is sent instead.  dispatch returns once the message is
+// queued, waiting for room in full queues unless ctx is cancelled.
+func (d *Dispatcher) dispatch(ctx context.Context, msg *Message, stream uint64, responses chan<- *Message, done func()) {
+	rs := d.claimants(msg)
+	if len(rs) == 0 {
+		// answer without waiting on the reader of responses, who
+		// may be waiting on the sender of msg
+		go func() {
+			responses <- NewErrorMessage(msg, "No handler claimed the message.")
+			done()
+		}()
+		return
+	}
+	remaining := int64(len(rs))
+	finish := func() {
+		if atomic.AddInt64(&remaining, -1) == 0 {
+			done()
+		}
+	}
+	for _, r := range rs {
+		j := &job{ctx: ctx, msg: msg, responses: responses, done: finish}
+		if err := r.pool.submit(j, stream); err != nil {
+			// the handler was unregistered or the message cancelled
+			// before it could be queued
+			finish()
+		}
+	}
+}
+
+// Dispatch routes msg to every handler that claims it and returns a
+// channel carrying their responses, which is closed once every
+// claiming handler has finished.  The caller must drain the channel.
+// Handlers do not start messages whose ctx has been cancelled.
+func (d *Dispatcher) Dispatch(ctx context.Context, msg *Message) <-chan *Message {
+	return d.dispatchChan(ctx, msg, 0)
+}
+
+func (d *Dispatcher) dispatchChan(ctx context.Context, msg *Message, stream uint64) <-chan *Message {
+	out := make(chan *Message, 1)
+	d.dispatch(ctx, msg, stream, out, func() { close(out) })
+	return out
+}
+
+// HandleMessage handles a message by routing it to all handlers that
+// claim it, which run concurrently, and returns when they are done.
+// Handlers return errors and responses in the responses channel; if
+// no handler claims the message, an error message is sent instead.
+// HandleMessage lets a Dispatcher be registered as a Handler.
+func (d *Dispatcher) HandleMessage(msg *Message, responses chan<- *Message) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	d.dispatch(context.Background(), msg, 0, responses, wg.Done)
+	wg.Wait()
+}
+
+// Stream dispatches a sequence of related messages, such as those
+// arriving on one connection.  If the dispatcher was Ordered when the
+// stream was made, each handler processes the stream's messages in
+// the order they were dispatched.
+type Stream struct {
+	d  *Dispatcher
+	id uint64 // zero if unordered
+}
+
+// NewStream returns a new stream of messages for d.
+func (d *Dispatcher) NewStream() *Stream {
+	s := &Stream{d: d}
+	if d.Ordered {
+		s.id = d.streams.Add(1)
+	}
+	return s
+}
+
+// Dispatch is Dispatcher.Dispatch for a message in the stream.
+func (s *Stream) Dispatch(ctx context.Context, msg *Message) <-chan *Message {
+	return s.d.dispatchChan(ctx, msg, s.id)
+}
+
+// Run receives messages from r and sends responses to w, framed by
+// the dispatcher's framer, until r is exhausted.  Messages are queued
+// for their handlers' workers as they arrive, so a slow handler does
+// not hold up receipt of the messages behind it until its queue
+// fills.  Messages that cannot be parsed are answered with an error
+// message.  Run returns once every response has been written.
+func (d *Dispatcher) Run(r io.Reader, w io.Writer) error {
+	newFramer := d.NewFramer
+	if newFramer == nil {
+		newFramer = NewLengthFramer
+	}
+	return d.Serve(newFramer(r, w))
+}
+
+// Serve is Run on an existing framer.
+func (d *Dispatcher) Serve(f Framer) error {
+	return d.ServeContext(context.Background(), f)
+}
+
+// ServeContext is Serve with a context for the messages it receives.
+// Once ctx is cancelled, messages still queued are dropped and
+// handlers implementing ContextHandler see the cancellation; Serve
+// still returns only when f's reader is exhausted.
+func (d *Dispatcher) ServeContext(ctx context.Context, f Framer) error {
+	stream := d.NewStream()
+	responses := make(chan *Message)
+	writeErr := make(chan error, 1)
+	go func() {
+		var err error
+		for resp := range responses {
+			if err == nil {
+				err = f.WriteFrame(resp.Bytes())
+			}
+		}
+		writeErr <- err
+	}()
+
+	var wg sync.WaitGroup
+	var readErr error
+	for {
+		frame, err := f.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		msg, err := Parse(frame)
+		if err != nil {
+			responses <- NewErrorMessage(nil, err.Error())
+			continue
+		}
+		wg.Add(1)
+		d.dispatch(ctx, msg, stream.id, responses, wg.Done)
+	}
+	wg.Wait()
+	close(responses)
+	err := <-writeErr
+	if readErr != nil {
+		return readErr
+	}
+	return err
+}
+
+// IsError returns true if msg is an error message.
+func IsError(msg *Message) bool {
+	return bytes.Equal(msg.Id, ErrorID)
+}
@@ -0,0 +1,360 @@
+package pup
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echo is a handler that sends each message back unchanged.
+var echo = HandlerFunc(func(msg *Message, responses chan<- *Message) {
+	responses <- NewMessage(msg.Id, msg.Payload)
+})
+
+// echoSpec is the canonical specification of a protocol whose
+// identifier is the hash of the document, as the README suggests.
+const echoSpec = `PUP echo protocol, version 1.
+
+The handler responds to each message with a message in the same
+protocol carrying the same payload.
+`
+
+// TestDispatcherEcho checks that a message framed as the README
+// specifies, a hex multihash, a newline and a payload, is routed to
+// the handler for its protocol.
+func TestDispatcherEcho(t *testing.T) {
+	echoID := HashID([]byte(echoSpec))
+	wire := echoID.HexString() + "\nHello,\nworld!"
+
+	d := NewDispatcher()
+	d.Register(echoID, echo)
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	NewLengthFramer(nil, in).WriteFrame([]byte(wire))
+	if err := d.Run(in, out); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	resp, err := NewLengthFramer(out, nil).ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame returned an error: %v", err)
+	}
+	if string(resp) != wire {
+		t.Errorf("expected the message echoed, got %q", resp)
+	}
+}
+
+// runFrames runs d over the given frames and returns the responses.
+func runFrames(t *testing.T, d *Dispatcher, frames ...[]byte) (resps []*Message) {
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	w := NewLengthFramer(nil, in)
+	for _, f := range frames {
+		w.WriteFrame(f)
+	}
+	if err := d.Run(in, out); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	r := NewLengthFramer(out, nil)
+	for {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			return
+		}
+		msg, err := Parse(frame)
+		if err != nil {
+			t.Fatalf("dispatcher sent an invalid message %q: %v", frame, err)
+		}
+		resps = append(resps, msg)
+	}
+}
+
+func TestDispatcherErrors(t *testing.T) {
+	d := NewDispatcher()
+	unknown := NewMessage(HashID([]byte("unknown")), []byte("x"))
+	resps := runFrames(t, d, unknown.Bytes(), []byte("garbage"))
+	if len(resps) != 2 {
+		t.Fatalf("expected two error messages, got %d", len(resps))
+	}
+	var refs []string
+	for _, r := range resps {
+		ref, _, err := ParseError(r)
+		if err != nil {
+			t.Fatalf("expected an error message, got %x %q", r.Id, r.Payload)
+		}
+		refs = append(refs, ref)
+	}
+	if !(refs[0] == "" && refs[1] == unknown.ProtocolID() || refs[1] == "" && refs[0] == unknown.ProtocolID()) {
+		t.Errorf("unexpected error references %q", refs)
+	}
+}
+
+func TestDispatcherRegistry(t *testing.T) {
+	d := NewDispatcher()
+	a, b := HashID([]byte("a")), HashID([]byte("b"))
+	unregister := d.Register(a, echo)
+	if ids := d.Protocols(); len(ids) != 1 || !bytes.Equal(ids[0], a) {
+		t.Errorf("unexpected protocols %v", ids)
+	}
+
+	resps := runFrames(t, d, NewMessage(a, []byte("1")).Bytes(), NewMessage(b, []byte("2")).Bytes())
+	var echoed, errs int
+	for _, r := range resps {
+		if IsError(r) {
+			errs++
+		} else if bytes.Equal(r.Id, a) {
+			echoed++
+		}
+	}
+	if echoed != 1 || errs != 1 {
+		t.Errorf("expected a's message echoed and b's refused, got %d and %d", echoed, errs)
+	}
+
+	unregister()
+	if ids := d.Protocols(); len(ids) != 0 {
+		t.Errorf("expected no protocols after unregistering, got %v", ids)
+	}
+	resps = runFrames(t, d, NewMessage(a, []byte("1")).Bytes())
+	if len(resps) != 1 || !IsError(resps[0]) {
+		t.Errorf("expected the unregistered protocol to be refused")
+	}
+
+	// a catch-all handler takes only what it claims
+	claimB := &claimer{id: b}
+	d.RegisterHandler(claimB)
+	resps = runFrames(t, d, NewMessage(b, []byte("2")).Bytes())
+	if len(resps) != 1 || IsError(resps[0]) {
+		t.Errorf("expected the catch-all handler to answer, got %v", resps)
+	}
+}
+
+// claimer claims and echoes messages in one protocol.
+type claimer struct {
+	id []byte
+}
+
+func (c *claimer) Claim(msg *Message) bool { return bytes.Equal(msg.Id, c.id) }
+
+func (c *claimer) HandleMessage(msg *Message, responses chan<- *Message) {
+	responses <- NewMessage(msg.Id, msg.Payload)
+}
+
+// TestDispatcherParallel checks that a slow handler does not block
+// receipt of later messages.
+func TestDispatcherParallel(t *testing.T) {
+	d := NewDispatcher()
+	slow, fast := HashID([]byte("slow")), HashID([]byte("fast"))
+	gate := make(chan struct{})
+	var once sync.Once
+	d.Register(slow, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+		select {
+		case <-gate:
+		case <-time.After(5 * time.Second):
+		}
+		responses <- NewMessage(msg.Id, []byte("slow"))
+	}))
+	d.Register(fast, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+		responses <- NewMessage(msg.Id, []byte("fast"))
+		once.Do(func() { close(gate) })
+	}))
+
+	start := time.Now()
+	resps := runFrames(t, d, NewMessage(slow, nil).Bytes(), NewMessage(fast, nil).Bytes())
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("the slow handler held up the fast one")
+	}
+	if len(resps) != 2 || string(resps[0].Payload) != "fast" {
+		t.Errorf("expected the fast response first, got %v", resps)
+	}
+}
+
+// TestDispatcherWorkers checks that a handler runs no more messages
+// at once than its pool has workers.
+func TestDispatcherWorkers(t *testing.T) {
+	d := NewDispatcher()
+	d.Workers = 2
+	id := HashID([]byte("bounded"))
+	var mu sync.Mutex
+	var running, peak int
+	d.Register(id, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		responses <- NewMessage(msg.Id, msg.Payload)
+	}))
+	var frames [][]byte
+	for i := 0; i < 10; i++ {
+		frames = append(frames, NewMessage(id, nil).Bytes())
+	}
+	if resps := runFrames(t, d, frames...); len(resps) != 10 {
+		t.Fatalf("expected 10 responses, got %d", len(resps))
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 messages at once, got %d", peak)
+	}
+	stats := d.Stats()
+	if len(stats) != 1 || stats[0].Handled != 10 || stats[0].Queued != 0 || stats[0].MeanLatency() < 10*time.Millisecond {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestDispatcherClose checks that unregistering a handler does not
+// wait on a message blocked for room in its queue, and that Close
+// stops the dispatcher's pools.
+func TestDispatcherClose(t *testing.T) {
+	d := NewDispatcher()
+	d.Workers = 1
+	d.QueueLen = 1
+	id := HashID([]byte("blocked"))
+	release := make(chan struct{})
+	unregister := d.Register(id, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+		<-release
+		responses <- NewMessage(msg.Id, msg.Payload)
+	}))
+	// one message running, one queued and one waiting for room
+	var outs []<-chan *Message
+	for i := 0; i < 2; i++ {
+		outs = append(outs, d.Dispatch(context.Background(), NewMessage(id, nil)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	blocked := make(chan (<-chan *Message))
+	go func() { blocked <- d.Dispatch(context.Background(), NewMessage(id, nil)) }()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		unregister()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unregister waited on a full queue")
+	}
+	if _, ok := <-<-blocked; ok {
+		t.Errorf("expected the blocked message to be dropped")
+	}
+	close(release)
+	for _, out := range outs {
+		for range out {
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+	out := d.Dispatch(context.Background(), NewMessage(MetaID, nil))
+	if _, ok := <-out; ok {
+		t.Errorf("expected a message dispatched after Close to be dropped")
+	}
+}
+
+// TestDispatcherOrdered checks that an ordered dispatcher hands a
+// stream's messages to a handler in the order they arrived.
+func TestDispatcherOrdered(t *testing.T) {
+	d := NewDispatcher()
+	d.Ordered = true
+	id := HashID([]byte("ordered"))
+	d.Register(id, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+		// later messages finish faster, so would overtake earlier
+		// ones if they were handled in parallel
+		time.Sleep(time.Duration(10-int(msg.Payload[0]-'0')) * time.Millisecond)
+		responses <- NewMessage(msg.Id, msg.Payload)
+	}))
+	var frames [][]byte
+	for i := 0; i < 10; i++ {
+		frames = append(frames, NewMessage(id, []byte{byte('0' + i)}).Bytes())
+	}
+	resps := runFrames(t, d, frames...)
+	var got string
+	for _, r := range resps {
+		got += string(r.Payload)
+	}
+	if got != "0123456789" {
+		t.Errorf("expected responses in order, got %q", got)
+	}
+}
+
+// TestDispatchAggregate checks that Dispatch closes its channel once
+// every claiming handler has finished.
+func TestDispatchAggregate(t *testing.T) {
+	d := NewDispatcher()
+	id := HashID([]byte("many"))
+	for i := 0; i < 3; i++ {
+		d.Register(id, HandlerFunc(func(msg *Message, responses chan<- *Message) {
+			time.Sleep(5 * time.Millisecond)
+			responses <- NewMessage(msg.Id, []byte("a"))
+			responses <- NewMessage(msg.Id, []byte("b"))
+		}))
+	}
+	var n int
+	for range d.Dispatch(context.Background(), NewMessage(id, nil)) {
+		n++
+	}
+	if n != 6 {
+		t.Errorf("expected 6 responses before the channel closed, got %d", n)
+	}
+
+	var errs int
+	for r := range d.Dispatch(context.Background(), NewMessage(HashID([]byte("none")), nil)) {
+		if IsError(r) {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("expected an unclaimed message to get one error, got %d", errs)
+	}
+}
+
+// TestDispatchCancel checks that cancelled messages are not started
+// and that context handlers see the cancellation.
+func TestDispatchCancel(t *testing.T) {
+	d := NewDispatcher()
+	d.Workers = 1
+	id := HashID([]byte("cancel"))
+	started := make(chan struct{})
+	h := &ctxHandler{started: started}
+	d.Register(id, h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := d.Dispatch(ctx, NewMessage(id, []byte("1")))
+	<-started
+	second := d.Dispatch(ctx, NewMessage(id, []byte("2")))
+	cancel()
+	for r := range first {
+		if !IsError(r) {
+			t.Errorf("expected the running handler to report cancellation, got %q", r.Payload)
+		}
+	}
+	for r := range second {
+		t.Errorf("expected the queued message to be dropped, got %q", r.Payload)
+	}
+	if h.calls.Load() != 1 {
+		t.Errorf("expected one call, got %d", h.calls.Load())
+	}
+}
+
+// ctxHandler waits for its message to be cancelled.
+type ctxHandler struct {
+	started chan struct{}
+	calls   atomic.Int64
+}
+
+func (h *ctxHandler) Claim(msg *Message) bool { return true }
+
+func (h *ctxHandler) HandleMessage(msg *Message, responses chan<- *Message) {
+	panic("HandleMessage called on a ContextHandler")
+}
+
+func (h *ctxHandler) HandleMessageContext(ctx context.Context, msg *Message, responses chan<- *Message) {
+	h.calls.Add(1)
+	close(h.started)
+	<-ctx.Done()
+	responses <- NewErrorMessage(msg, ctx.Err().Error())
+}
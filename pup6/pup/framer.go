@@ -0,0 +1,145 @@
+package pup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxFrame bounds the size of a frame a framer will read.
+const MaxFrame = 16 << 20
+
+// Framer reads and writes whole messages over a lower-level protocol.
+// PUP leaves framing to the layer below it, so the dispatcher works
+// over anything a Framer can be written for.  WriteFrame must be safe
+// to call concurrently with ReadFrame.
+type Framer interface {
+	// ReadFrame returns the next frame, or io.EOF when there are no
+	// more.
+	ReadFrame() ([]byte, error)
+	WriteFrame(frame []byte) error
+}
+
+// NewFramerFunc returns a Framer reading from r and writing to w.
+type NewFramerFunc func(r io.Reader, w io.Writer) Framer
+
+// LengthFramer frames each message with its length, as a 4-byte
+// big-endian integer, for byte streams such as stdio or TCP.
+type LengthFramer struct {
+	r  *bufio.Reader
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLengthFramer returns a length-prefixed framer on r and w.
+func NewLengthFramer(r io.Reader, w io.Writer) Framer {
+	return &LengthFramer{r: bufio.NewReader(r), w: w}
+}
+
+func (f *LengthFramer) ReadFrame() ([]byte, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(f.r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MaxFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit", n)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(f.r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+func (f *LengthFramer) WriteFrame(frame []byte) error {
+	if len(frame) > MaxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds limit", len(frame))
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.w.Write(append(hdr[:], frame...))
+	return err
+}
+
+// LineFramer frames each message as one line of text, for debugging
+// at a terminal.  Newlines, carriage returns and backslashes within a
+// frame are escaped as \n, \r and \\, and a bare carriage return
+// ending a line is dropped, so the echo example's message is typed as
+//
+//	122086641da07cb55b9564a166d91d083b68c1489840870caf206cc6a5ae66830398\nHello, world!
+type LineFramer struct {
+	s  *bufio.Scanner
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLineFramer returns a newline-delimited text framer on r and w.
+func NewLineFramer(r io.Reader, w io.Writer) Framer {
+	f := &LineFramer{w: w}
+	if r != nil {
+		f.s = bufio.NewScanner(r)
+		f.s.Buffer(nil, 2*MaxFrame+1)
+	}
+	return f
+}
+
+func (f *LineFramer) ReadFrame() ([]byte, error) {
+	if !f.s.Scan() {
+		if err := f.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	line := bytes.TrimSuffix(f.s.Bytes(), []byte("\r"))
+	frame := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			i++
+			switch line[i] {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case '\\':
+				c = '\\'
+			default:
+				return nil, fmt.Errorf("invalid escape \\%c", line[i])
+			}
+		}
+		frame = append(frame, c)
+	}
+	return frame, nil
+}
+
+func (f *LineFramer) WriteFrame(frame []byte) error {
+	if len(frame) > MaxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds limit", len(frame))
+	}
+	line := make([]byte, 0, len(frame)+1)
+	for _, c := range frame {
+		switch c {
+		case '\n':
+			line = append(line, '\\', 'n')
+		case '\r':
+			line = append(line, '\\', 'r')
+		case '\\':
+			line = append(line, '\\', '\\')
+		default:
+			line = append(line, c)
+		}
+	}
+	line = append(line, '\n')
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.w.Write(line)
+	return err
+}
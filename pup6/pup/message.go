@@ -0,0 +1,173 @@
+// Package pup implements the Pattern for Universal Protocols: messages
+// prefixed with the multihash of their protocol, and a dispatcher that
+// routes them to handlers registered for each protocol.  See the
+// README for the specification.
+//
+// PUP leaves framing to the layer below it.  This package provides
+// framers for length-prefixed byte streams such as stdio or TCP, UDP
+// datagrams, binary WebSocket messages, and newline-delimited text
+// with escaped newlines, which is handy for typing messages at a
+// terminal.
+//
+// The Dispatcher runs each handler on a bounded pool of workers fed by
+// a bounded queue.  When a handler falls behind, its full queue slows
+// the reading of new messages instead of letting work pile up.  Set
+// Ordered to have each handler see the messages of one connection in
+// the order they arrived.  Dispatch returns a channel of a message's
+// responses that closes once every handler claiming the message has
+// finished, and Stats reports each handler's queue depth and latency.
+//
+// Because each version of a protocol has its own identifier, a sender
+// needs to know which identifiers a peer supports before it can pick
+// one.  A Dispatcher answers the meta protocol identified by MetaID: a
+// list request returns the identifiers of every protocol it handles,
+// and describe returns a handler's description of its protocol.
+// Negotiate lists a peer's protocols and picks the newest of a
+// protocol's versions that both sides support.
+package pup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// maxIDLen bounds the length of a protocol identifier, in bytes
+// before hex encoding, so that parsing a message without a newline
+// does not scan its whole payload.
+const maxIDLen = 128
+
+// ErrNoNewline is returned when a message has no newline after its
+// protocol identifier.
+var ErrNoNewline = errors.New("no newline after protocol identifier")
+
+// Message is a parsed PUP message.
+type Message struct {
+	// Id is the multihash prefix of the message: the identifier of
+	// the protocol the payload is written in.
+	Id      multihash.Multihash
+	Payload []byte
+}
+
+// NewMessage returns a message in protocol id.
+func NewMessage(id multihash.Multihash, payload []byte) *Message {
+	return &Message{Id: id, Payload: payload}
+}
+
+// HashID returns the protocol identifier for a protocol defined by
+// code, such as the source of its handler or its specification
+// document: the sha2-256 multihash of code.
+func HashID(code []byte) multihash.Multihash {
+	id, err := multihash.Sum(code, multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err) // sha2-256 is always available
+	}
+	return id
+}
+
+// ParseID decodes a hex-encoded protocol identifier.
+func ParseID(s string) (multihash.Multihash, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol identifier: %w", err)
+	}
+	return castID(buf)
+}
+
+// MustParseID is ParseID for identifiers known to be valid, such as
+// generated ProtocolID constants.  It panics on an invalid identifier.
+func MustParseID(s string) multihash.Multihash {
+	id, err := ParseID(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func castID(buf []byte) (multihash.Multihash, error) {
+	if len(buf) > maxIDLen {
+		return nil, fmt.Errorf("protocol identifier longer than %d bytes", maxIDLen)
+	}
+	id, err := multihash.Cast(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol identifier: %w", err)
+	}
+	return id, nil
+}
+
+// Parse decodes a message: a hex-encoded multihash, a newline, and
+// the payload.  The payload shares buf's memory.
+func Parse(buf []byte) (*Message, error) {
+	head := buf
+	if len(head) > 2*maxIDLen+1 {
+		head = head[:2*maxIDLen+1]
+	}
+	i := bytes.IndexByte(head, '\n')
+	if i < 0 {
+		return nil, ErrNoNewline
+	}
+	raw := make([]byte, hex.DecodedLen(i))
+	_, err := hex.Decode(raw, buf[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol identifier: %w", err)
+	}
+	id, err := castID(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Id: id, Payload: buf[i+1:]}, nil
+}
+
+// Bytes encodes the message for the wire, with its protocol
+// identifier in lowercase hex.
+func (m *Message) Bytes() []byte {
+	buf := make([]byte, hex.EncodedLen(len(m.Id))+1+len(m.Payload))
+	n := hex.Encode(buf, m.Id)
+	buf[n] = '\n'
+	copy(buf[n+1:], m.Payload)
+	return buf
+}
+
+// ProtocolID returns the message's protocol identifier in hex.
+func (m *Message) ProtocolID() string {
+	return m.Id.HexString()
+}
+
+// errorSpec is the canonical specification of the error protocol;
+// ErrorID is its hash.
+const errorSpec = `PUP error protocol, version 1.
+
+A dispatcher or handler sends an error message when it cannot process
+a message.  The payload is the hex protocol identifier of the message
+that failed, a newline, and a UTF-8 description of the error.  The
+identifier is empty if the failed message could not be parsed.
+`
+
+// ErrorID identifies the error protocol.
+var ErrorID = HashID([]byte(errorSpec))
+
+// NewErrorMessage returns an error message reporting that msg, which
+// may be nil if it could not be parsed, failed for the reason text.
+func NewErrorMessage(msg *Message, text string) *Message {
+	var ref string
+	if msg != nil {
+		ref = msg.ProtocolID()
+	}
+	return &Message{Id: ErrorID, Payload: []byte(ref + "\n" + text)}
+}
+
+// ParseError decodes an error message's payload, returning the
+// protocol identifier of the message that failed and the reason.
+func ParseError(msg *Message) (ref, text string, err error) {
+	if !bytes.Equal(msg.Id, ErrorID) {
+		return "", "", fmt.Errorf("not an error message")
+	}
+	r, t, ok := bytes.Cut(msg.Payload, []byte{'\n'})
+	if !ok {
+		return "", "", ErrNoNewline
+	}
+	return string(r), string(t), nil
+}
@@ -0,0 +1,96 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	id := HashID([]byte("test protocol"))
+	msg, err := Parse([]byte(id.HexString() + "\nhello\nworld"))
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	if !bytes.Equal(msg.Id, id) || string(msg.Payload) != "hello\nworld" {
+		t.Errorf("unexpected message %x %q", msg.Id, msg.Payload)
+	}
+
+	// hex is case-insensitive on the way in, lowercase on the way out
+	upper := strings.ToUpper(id.HexString()) + "\nhello"
+	msg, err = Parse([]byte(upper))
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	if string(msg.Bytes()) != id.HexString()+"\nhello" {
+		t.Errorf("unexpected encoding %q", msg.Bytes())
+	}
+
+	msg, err = Parse([]byte(id.HexString() + "\n"))
+	if err != nil || len(msg.Payload) != 0 {
+		t.Errorf("expected an empty payload, got %q, %v", msg.Payload, err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	id := HashID([]byte("test protocol")).HexString()
+	cases := map[string]string{
+		"no newline":      id,
+		"not hex":         "xyz\npayload",
+		"odd hex":         id[:len(id)-1] + "\npayload",
+		"not a multihash": "1220ab\npayload",
+		"empty":           "",
+		"long prefix":     strings.Repeat("12", maxIDLen+1) + "\npayload",
+	}
+	for name, in := range cases {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := Parse([]byte(id)); !errors.Is(err, ErrNoNewline) {
+		t.Errorf("expected ErrNoNewline, got %v", err)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	msg := NewMessage(HashID([]byte("test protocol")), []byte("x"))
+	e := NewErrorMessage(msg, "went wrong")
+	if !IsError(e) {
+		t.Fatalf("expected an error message")
+	}
+	ref, text, err := ParseError(e)
+	if err != nil || ref != msg.ProtocolID() || text != "went wrong" {
+		t.Errorf("ParseError returned %q, %q, %v", ref, text, err)
+	}
+	if _, _, err := ParseError(msg); err == nil {
+		t.Errorf("expected an error parsing a non-error message")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	id := HashID([]byte("test protocol")).HexString()
+	f.Add([]byte(id + "\nhello"))
+	f.Add([]byte(id + "\n"))
+	f.Add([]byte("\n"))
+	f.Add([]byte("1220\n"))
+	f.Add([]byte(ErrorID.HexString() + "\n\nreason"))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		msg, err := Parse(buf)
+		if err != nil {
+			return
+		}
+		// a parsed message re-encodes to itself, modulo hex case
+		enc := msg.Bytes()
+		again, err := Parse(enc)
+		if err != nil {
+			t.Fatalf("Parse of re-encoded %q failed: %v", enc, err)
+		}
+		if !bytes.Equal(again.Id, msg.Id) || !bytes.Equal(again.Payload, msg.Payload) {
+			t.Fatalf("round trip changed %q to %q", buf, enc)
+		}
+		if !bytes.EqualFold(enc, buf) {
+			t.Fatalf("re-encoding %q gave %q", buf, enc)
+		}
+	})
+}
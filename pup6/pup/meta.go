@@ -0,0 +1,191 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// metaSpec is the canonical specification of the meta protocol;
+// MetaID is its hash.
+const metaSpec = `PUP meta protocol, version 1.
+
+A dispatcher answers meta messages with what it knows of the
+protocols it handles, so that a sender can learn which protocol
+identifiers a peer supports before using them.  A request payload is
+one of:
+
+list
+    The response payload is "protocols", then a newline and the hex
+    identifier of each supported protocol, including this one.
+
+describe ID
+    The response payload is "protocol ID", a newline, and a UTF-8
+    description of the protocol with hex identifier ID, which may be
+    empty.  An unsupported ID is answered with an error message.
+
+Responses are in this protocol.  Any other request is answered with
+an error message.
+`
+
+// MetaID identifies the meta protocol, which every dispatcher made by
+// NewDispatcher answers.
+var MetaID = HashID([]byte(metaSpec))
+
+// ErrNoCommonVersion is returned by Negotiate when the peer supports
+// none of the offered protocol versions.
+var ErrNoCommonVersion = errors.New("no protocol version supported by both peers")
+
+// Describer is implemented by handlers that can describe their
+// protocol, for instance by returning its specification document.
+// The meta protocol's describe request returns the description.
+type Describer interface {
+	Describe() string
+}
+
+// metaHandler answers meta protocol requests about its dispatcher.
+type metaHandler struct {
+	d *Dispatcher
+}
+
+func (h *metaHandler) Claim(msg *Message) bool { return bytes.Equal(msg.Id, MetaID) }
+
+func (h *metaHandler) HandleMessage(msg *Message, responses chan<- *Message) {
+	verb, arg, _ := strings.Cut(strings.TrimSpace(string(msg.Payload)), " ")
+	switch verb {
+	case "list":
+		var b strings.Builder
+		b.WriteString("protocols")
+		for _, id := range append(h.d.Protocols(), MetaID) {
+			b.WriteString("\n" + id.HexString())
+		}
+		responses <- NewMessage(MetaID, []byte(b.String()))
+	case "describe":
+		id, err := ParseID(arg)
+		if err != nil {
+			responses <- NewErrorMessage(msg, err.Error())
+			return
+		}
+		desc, ok := h.d.describe(id)
+		if !ok {
+			responses <- NewErrorMessage(msg, "Protocol "+id.HexString()+" is not supported.")
+			return
+		}
+		responses <- NewMessage(MetaID, []byte("protocol "+id.HexString()+"\n"+desc))
+	default:
+		responses <- NewErrorMessage(msg, fmt.Sprintf("Unknown meta request %q.", verb))
+	}
+}
+
+// Describe returns the meta protocol's specification.
+func (h *metaHandler) Describe() string { return metaSpec }
+
+// describe returns the description of protocol id from the first of
+// its handlers that has one, and whether the protocol is supported.
+func (d *Dispatcher) describe(id multihash.Multihash) (desc string, ok bool) {
+	if bytes.Equal(id, MetaID) && d.meta != nil {
+		return metaSpec, true
+	}
+	d.mu.RLock()
+	rs := d.handlers[string(id)]
+	d.mu.RUnlock()
+	for _, r := range rs {
+		if dr, isDescriber := r.pool.h.(Describer); isDescriber {
+			return dr.Describe(), true
+		}
+	}
+	return "", len(rs) > 0
+}
+
+// metaRequest sends a meta request over f and returns the payload of
+// the peer's meta response.  Messages in other protocols arriving
+// first are discarded, so f should not be shared while it waits.
+func metaRequest(f Framer, req string) ([]byte, error) {
+	if err := f.WriteFrame(NewMessage(MetaID, []byte(req)).Bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := f.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := Parse(frame)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Equal(msg.Id, MetaID):
+			return msg.Payload, nil
+		case IsError(msg):
+			ref, text, err := ParseError(msg)
+			if err == nil && ref == MetaID.HexString() {
+				return nil, errors.New(text)
+			}
+		}
+	}
+}
+
+// ListProtocols asks the peer on the other end of f which protocols
+// it supports.
+func ListProtocols(f Framer) (ids []multihash.Multihash, err error) {
+	payload, err := metaRequest(f, "list")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(payload), "\n")
+	if lines[0] != "protocols" {
+		return nil, fmt.Errorf("unexpected meta response %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		id, err := ParseID(line)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// DescribeProtocol asks the peer on the other end of f to describe
+// protocol id.
+func DescribeProtocol(f Framer, id multihash.Multihash) (string, error) {
+	payload, err := metaRequest(f, "describe "+id.HexString())
+	if err != nil {
+		return "", err
+	}
+	head, desc, _ := strings.Cut(string(payload), "\n")
+	if head != "protocol "+id.HexString() {
+		return "", fmt.Errorf("unexpected meta response %q", head)
+	}
+	return desc, nil
+}
+
+// Negotiate picks the newest of versions, the identifiers of one
+// protocol's versions from oldest to newest, that the peer on the
+// other end of f supports.  It returns ErrNoCommonVersion if the peer
+// supports none of them.
+func Negotiate(f Framer, versions []multihash.Multihash) (multihash.Multihash, error) {
+	ids, err := ListProtocols(f)
+	if err != nil {
+		return nil, err
+	}
+	return Newest(versions, ids)
+}
+
+// Newest returns the newest of versions, ordered oldest first, that
+// is among supported, or ErrNoCommonVersion.
+func Newest(versions, supported []multihash.Multihash) (multihash.Multihash, error) {
+	have := make(map[string]bool, len(supported))
+	for _, id := range supported {
+		have[string(id)] = true
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if have[string(versions[i])] {
+			return versions[i], nil
+		}
+	}
+	return nil, ErrNoCommonVersion
+}
@@ -0,0 +1,92 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// describedEcho is an echo handler that describes its protocol.
+type describedEcho struct{}
+
+func (describedEcho) Claim(msg *Message) bool { return true }
+
+func (describedEcho) HandleMessage(msg *Message, responses chan<- *Message) {
+	echo(msg, responses)
+}
+
+func (describedEcho) Describe() string { return "echo, newer" }
+
+// metaPeer returns a framer connected to a dispatcher with v1 and v2
+// of a protocol registered, v2 described.
+func metaPeer(t *testing.T) (f Framer, v1, v2 multihash.Multihash) {
+	d := NewDispatcher()
+	v1, v2 = HashID([]byte("echo v1")), HashID([]byte("echo v2"))
+	d.Register(v1, echo)
+	d.Register(v2, describedEcho{})
+	cr, cw, sr, sw := pipes()
+	done := make(chan error)
+	go func() { done <- d.Run(sr, sw) }()
+	t.Cleanup(func() {
+		cw.Close()
+		<-done
+	})
+	return NewLengthFramer(cr, cw), v1, v2
+}
+
+func TestListProtocols(t *testing.T) {
+	f, v1, v2 := metaPeer(t)
+	ids, err := ListProtocols(f)
+	if err != nil {
+		t.Fatalf("ListProtocols returned an error: %v", err)
+	}
+	want := map[string]bool{string(v1): true, string(v2): true, string(MetaID): true}
+	if len(ids) != len(want) {
+		t.Fatalf("expected %d protocols, got %v", len(want), ids)
+	}
+	for _, id := range ids {
+		if !want[string(id)] {
+			t.Errorf("unexpected protocol %s", id.HexString())
+		}
+	}
+}
+
+func TestDescribeProtocol(t *testing.T) {
+	f, v1, v2 := metaPeer(t)
+	if desc, err := DescribeProtocol(f, v2); err != nil || desc != "echo, newer" {
+		t.Errorf("DescribeProtocol(v2) = %q, %v", desc, err)
+	}
+	if desc, err := DescribeProtocol(f, v1); err != nil || desc != "" {
+		t.Errorf("DescribeProtocol(v1) = %q, %v", desc, err)
+	}
+	if desc, err := DescribeProtocol(f, MetaID); err != nil || desc != metaSpec {
+		t.Errorf("DescribeProtocol(MetaID) = %q, %v", desc, err)
+	}
+	if _, err := DescribeProtocol(f, HashID([]byte("unknown"))); err == nil {
+		t.Errorf("expected an error describing an unsupported protocol")
+	}
+	if _, err := metaRequest(f, "frobnicate"); err == nil {
+		t.Errorf("expected an error for an unknown meta request")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	f, v1, v2 := metaPeer(t)
+	v3 := HashID([]byte("echo v3"))
+
+	// the peer is behind us, so we fall back to its newest version
+	id, err := Negotiate(f, []multihash.Multihash{v1, v2, v3})
+	if err != nil || !bytes.Equal(id, v2) {
+		t.Errorf("expected v2, got %v, %v", id, err)
+	}
+	id, err = Negotiate(f, []multihash.Multihash{v1})
+	if err != nil || !bytes.Equal(id, v1) {
+		t.Errorf("expected v1, got %v, %v", id, err)
+	}
+	_, err = Negotiate(f, []multihash.Multihash{v3})
+	if !errors.Is(err, ErrNoCommonVersion) {
+		t.Errorf("expected ErrNoCommonVersion, got %v", err)
+	}
+}
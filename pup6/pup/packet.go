@@ -0,0 +1,180 @@
+package pup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxDatagram is the largest frame that fits in one UDP datagram.
+const MaxDatagram = 65507
+
+// PacketFramer frames each message as one datagram exchanged with a
+// single peer over a packet connection such as UDP.  Datagrams from
+// other addresses are dropped.  UDP does not promise delivery or
+// order, so protocols used over it must provide for loss themselves;
+// see the Framing section of the specification.
+type PacketFramer struct {
+	conn net.PacketConn
+	peer net.Addr
+}
+
+// NewPacketFramer returns a framer exchanging datagrams with peer
+// over conn.  ReadFrame returns io.EOF once conn is closed.
+func NewPacketFramer(conn net.PacketConn, peer net.Addr) Framer {
+	return &PacketFramer{conn: conn, peer: peer}
+}
+
+func (f *PacketFramer) ReadFrame() ([]byte, error) {
+	buf := make([]byte, MaxDatagram+1)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if addr.String() != f.peer.String() {
+			continue
+		}
+		if n > MaxDatagram {
+			return nil, fmt.Errorf("datagram exceeds %d bytes", MaxDatagram)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (f *PacketFramer) WriteFrame(frame []byte) error {
+	return writeDatagram(f.conn, f.peer, frame)
+}
+
+func writeDatagram(conn net.PacketConn, addr net.Addr, frame []byte) error {
+	if len(frame) > MaxDatagram {
+		return fmt.Errorf("frame of %d bytes exceeds datagram limit", len(frame))
+	}
+	_, err := conn.WriteTo(frame, addr)
+	return err
+}
+
+// Defaults for the peers served by ServePacket.
+const (
+	DefaultMaxPeers = 1024
+	DefaultPeerIdle = time.Minute
+)
+
+// ServePacket runs the dispatcher on datagrams arriving on conn, such
+// as a UDP socket, answering each sender at its own address.  Each
+// sender is served as a stream of its own, so that its messages are
+// handled as they would be over a connection.  A sender's stream ends
+// once it has sent nothing for PeerIdle, and while MaxPeers senders
+// are being served, datagrams from new senders are dropped.
+// ServePacket returns when conn is closed, once every response has
+// been sent.
+func (d *Dispatcher) ServePacket(conn net.PacketConn) error {
+	maxPeers, idle := d.MaxPeers, d.PeerIdle
+	if maxPeers <= 0 {
+		maxPeers = DefaultMaxPeers
+	}
+	if idle <= 0 {
+		idle = DefaultPeerIdle
+	}
+	var mu sync.Mutex
+	peers := make(map[string]*peerFramer)
+	// expire ends the streams of senders idle since before t.
+	expire := func(t time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		for addr, p := range peers {
+			if p.seen.Before(t) {
+				close(p.frames)
+				delete(peers, addr)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(idle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				expire(now.Add(-idle))
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		mu.Lock()
+		for _, p := range peers {
+			close(p.frames)
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+	buf := make([]byte, MaxDatagram+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if n > MaxDatagram {
+			continue
+		}
+		frame := append([]byte(nil), buf[:n]...)
+		mu.Lock()
+		p, ok := peers[addr.String()]
+		if !ok && len(peers) < maxPeers {
+			p = &peerFramer{conn: conn, addr: addr, frames: make(chan []byte, 64)}
+			peers[addr.String()] = p
+			ok = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.Serve(p)
+			}()
+		}
+		if ok {
+			p.seen = time.Now()
+			select {
+			case p.frames <- frame:
+			default:
+				// the peer's queue is full; drop the datagram as the
+				// network might have
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// peerFramer is the stream of datagrams from one sender to
+// ServePacket.
+type peerFramer struct {
+	conn   net.PacketConn
+	addr   net.Addr
+	frames chan []byte
+	seen   time.Time // when the last datagram arrived
+}
+
+func (p *peerFramer) ReadFrame() ([]byte, error) {
+	frame, ok := <-p.frames
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+func (p *peerFramer) WriteFrame(frame []byte) error {
+	return writeDatagram(p.conn, p.addr, frame)
+}
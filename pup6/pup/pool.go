@@ -0,0 +1,227 @@
+package pup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// Defaults for the dispatcher's worker pools.
+const (
+	DefaultWorkers  = 8
+	DefaultQueueLen = 64
+)
+
+// ContextHandler is a Handler that is also given the context of the
+// message it handles, so that it can stop early when the message is
+// cancelled.  The dispatcher calls HandleMessageContext instead of
+// HandleMessage on handlers that implement it.
+type ContextHandler interface {
+	Handler
+	HandleMessageContext(ctx context.Context, msg *Message, responses chan<- *Message)
+}
+
+// errUnregistered is returned when a message is queued for a handler
+// that has been unregistered since it claimed the message.
+var errUnregistered = errors.New("handler unregistered")
+
+// job is a message queued for one handler.
+type job struct {
+	ctx       context.Context
+	msg       *Message
+	responses chan<- *Message
+	done      func()
+	queued    time.Time
+}
+
+// pool is the bounded set of workers running one registered handler.
+// Unordered messages go to a queue shared by all the workers; the
+// messages of an ordered stream all go to the queue of one worker, so
+// that the handler sees them in the order they were queued.
+type pool struct {
+	h Handler
+
+	mu      sync.RWMutex
+	closed  bool
+	quit    chan struct{} // closed by close
+	senders sync.WaitGroup
+	shared  chan *job
+	ordered []chan *job
+
+	running    atomic.Int64
+	handled    atomic.Uint64
+	latency    atomic.Int64 // total, in nanoseconds
+	maxLatency atomic.Int64
+	wait       atomic.Int64
+}
+
+func newPool(h Handler, workers, queueLen int) *pool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueLen <= 0 {
+		queueLen = DefaultQueueLen
+	}
+	p := &pool{
+		h:       h,
+		quit:    make(chan struct{}),
+		shared:  make(chan *job, queueLen),
+		ordered: make([]chan *job, workers),
+	}
+	for i := range p.ordered {
+		p.ordered[i] = make(chan *job, queueLen)
+		go p.work(p.ordered[i])
+	}
+	return p
+}
+
+// submit queues j for the handler, in the queue for stream if it is
+// not zero, waiting for room in the queue unless j's context is
+// cancelled or the pool closed first.
+func (p *pool) submit(j *job, stream uint64) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return errUnregistered
+	}
+	// the queues stay open until every sender counted here is done;
+	// the lock is not held while waiting, so close need not wait for
+	// room in a queue
+	p.senders.Add(1)
+	p.mu.RUnlock()
+	defer p.senders.Done()
+	q := p.shared
+	if stream != 0 {
+		q = p.ordered[stream%uint64(len(p.ordered))]
+	}
+	j.queued = time.Now()
+	select {
+	case q <- j:
+		return nil
+	case <-j.ctx.Done():
+		return j.ctx.Err()
+	case <-p.quit:
+		return errUnregistered
+	}
+}
+
+// close stops the pool's workers once they have finished the messages
+// already queued.
+func (p *pool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.quit)
+	p.mu.Unlock()
+	p.senders.Wait()
+	close(p.shared)
+	for _, q := range p.ordered {
+		close(q)
+	}
+}
+
+func (p *pool) work(own chan *job) {
+	shared := p.shared
+	for own != nil || shared != nil {
+		var j *job
+		var ok bool
+		select {
+		case j, ok = <-own:
+			if !ok {
+				own = nil
+				continue
+			}
+		case j, ok = <-shared:
+			if !ok {
+				shared = nil
+				continue
+			}
+		}
+		p.run(j)
+	}
+}
+
+// run handles one job, skipping it if its context has been cancelled
+// while it was queued.
+func (p *pool) run(j *job) {
+	defer j.done()
+	start := time.Now()
+	p.wait.Add(int64(start.Sub(j.queued)))
+	if j.ctx.Err() != nil {
+		return
+	}
+	p.running.Add(1)
+	if ch, ok := p.h.(ContextHandler); ok {
+		ch.HandleMessageContext(j.ctx, j.msg, j.responses)
+	} else {
+		p.h.HandleMessage(j.msg, j.responses)
+	}
+	p.running.Add(-1)
+	elapsed := int64(time.Since(start))
+	p.handled.Add(1)
+	p.latency.Add(elapsed)
+	for {
+		max := p.maxLatency.Load()
+		if elapsed <= max || p.maxLatency.CompareAndSwap(max, elapsed) {
+			break
+		}
+	}
+}
+
+// depth returns the number of messages waiting in the pool's queues.
+func (p *pool) depth() (n int) {
+	n = len(p.shared)
+	for _, q := range p.ordered {
+		n += len(q)
+	}
+	return
+}
+
+// HandlerStats describes the load on one registered handler.
+type HandlerStats struct {
+	// Protocol is the protocol the handler is registered for, or nil
+	// for a handler registered with RegisterHandler.
+	Protocol multihash.Multihash
+	Handler  Handler
+	// Queued is the number of messages waiting for a worker, and
+	// Running the number being handled.
+	Queued  int
+	Running int
+	// Handled is the number of messages the handler has finished.
+	Handled uint64
+	// Latency and MaxLatency are the total and longest time the
+	// handler took over a message; Wait is the total time messages
+	// spent queued.
+	Latency    time.Duration
+	MaxLatency time.Duration
+	Wait       time.Duration
+}
+
+// MeanLatency returns the average time the handler took over a
+// message.
+func (s HandlerStats) MeanLatency() time.Duration {
+	if s.Handled == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Handled)
+}
+
+func (p *pool) stats(id multihash.Multihash) HandlerStats {
+	return HandlerStats{
+		Protocol:   id,
+		Handler:    p.h,
+		Queued:     p.depth(),
+		Running:    int(p.running.Load()),
+		Handled:    p.handled.Load(),
+		Latency:    time.Duration(p.latency.Load()),
+		MaxLatency: time.Duration(p.maxLatency.Load()),
+		Wait:       time.Duration(p.wait.Load()),
+	}
+}
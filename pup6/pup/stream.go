@@ -0,0 +1,30 @@
+package pup
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ServeListener accepts connections on ln, such as a TCP listener,
+// and runs the dispatcher on each, framed by the dispatcher's framer.
+// It returns when ln is closed, once every connection is done.
+func (d *Dispatcher) ServeListener(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			d.Run(conn, conn)
+		}()
+	}
+}
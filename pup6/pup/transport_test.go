@@ -0,0 +1,210 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoDispatcher returns a dispatcher running the handlers each
+// transport is tested with.
+func newEchoDispatcher() (*Dispatcher, []byte) {
+	d := NewDispatcher()
+	id := HashID([]byte("echo"))
+	d.Register(id, echo)
+	return d, id
+}
+
+// exchange sends an echo message, a message no handler claims and an
+// unparseable frame over f, and checks the responses.
+func exchange(t *testing.T, f Framer, id []byte) {
+	t.Helper()
+	hello := NewMessage(id, []byte("hello\nwith \\ newline"))
+	unknown := NewMessage(HashID([]byte("unknown")), []byte("x"))
+	for _, frame := range [][]byte{hello.Bytes(), unknown.Bytes(), []byte("garbage")} {
+		if err := f.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame returned an error: %v", err)
+		}
+	}
+	var echoed, errs int
+	for i := 0; i < 3; i++ {
+		frame, err := f.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame returned an error: %v", err)
+		}
+		msg, err := Parse(frame)
+		if err != nil {
+			t.Fatalf("received an invalid message %q: %v", frame, err)
+		}
+		switch {
+		case IsError(msg):
+			errs++
+		case bytes.Equal(msg.Bytes(), hello.Bytes()):
+			echoed++
+		default:
+			t.Errorf("unexpected response %q", frame)
+		}
+	}
+	if echoed != 1 || errs != 2 {
+		t.Errorf("expected one echo and two errors, got %d and %d", echoed, errs)
+	}
+}
+
+// pipes returns the two ends of a bidirectional in-memory stream.
+func pipes() (clientR io.Reader, clientW io.WriteCloser, serverR io.Reader, serverW io.Writer) {
+	serverR, clientW = io.Pipe()
+	clientR, serverW = io.Pipe()
+	return
+}
+
+func testStream(t *testing.T, newFramer NewFramerFunc) {
+	d, id := newEchoDispatcher()
+	d.NewFramer = newFramer
+	cr, cw, sr, sw := pipes()
+	done := make(chan error)
+	go func() { done <- d.Run(sr, sw) }()
+	exchange(t, newFramer(cr, cw), id)
+	cw.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned an error: %v", err)
+	}
+}
+
+func TestLengthStdio(t *testing.T) { testStream(t, NewLengthFramer) }
+
+func TestLineStdio(t *testing.T) { testStream(t, NewLineFramer) }
+
+func TestTCP(t *testing.T) {
+	d, id := newEchoDispatcher()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- d.ServeListener(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial returned an error: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	exchange(t, NewLengthFramer(conn, conn), id)
+	conn.Close()
+	ln.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeListener returned an error: %v", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	d, id := newEchoDispatcher()
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket returned an error: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- d.ServePacket(server) }()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket returned an error: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	f := NewPacketFramer(client, server.LocalAddr())
+	exchange(t, f, id)
+
+	err = f.WriteFrame(make([]byte, MaxDatagram+1))
+	if err == nil {
+		t.Errorf("expected an oversized datagram to be refused")
+	}
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServePacket returned an error: %v", err)
+	}
+}
+
+func TestUDPPeers(t *testing.T) {
+	d, id := newEchoDispatcher()
+	d.MaxPeers = 1
+	d.PeerIdle = 100 * time.Millisecond
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket returned an error: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- d.ServePacket(server) }()
+	var clients []Framer
+	for i := 0; i < 2; i++ {
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket returned an error: %v", err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		clients = append(clients, NewPacketFramer(client, server.LocalAddr()))
+	}
+	exchange(t, clients[0], id)
+
+	// a second sender is dropped while the first is served
+	for i := 0; i < 5; i++ {
+		if err := clients[1].WriteFrame(NewMessage(id, []byte("x")).Bytes()); err != nil {
+			t.Fatalf("WriteFrame returned an error: %v", err)
+		}
+	}
+	// and is served once the first has gone idle
+	time.Sleep(300 * time.Millisecond)
+	exchange(t, clients[1], id)
+
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServePacket returned an error: %v", err)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	d, id := newEchoDispatcher()
+	server := httptest.NewServer(d.WebSocketHandler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial returned an error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	f := NewWebSocketFramer(conn)
+	exchange(t, f, id)
+
+	// text messages are not frames
+	conn.WriteMessage(websocket.TextMessage, NewMessage(id, nil).Bytes())
+	if _, err := f.ReadFrame(); err == nil {
+		t.Errorf("expected the server to drop a connection sending text")
+	}
+}
+
+func TestLineFramerEscapes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frame := []byte("a\nb\\n\r")
+	if err := NewLineFramer(nil, buf).WriteFrame(frame); err != nil {
+		t.Fatalf("WriteFrame returned an error: %v", err)
+	}
+	if buf.String() != "a\\nb\\\\n\\r\n" {
+		t.Errorf("unexpected line %q", buf.String())
+	}
+	got, err := NewLineFramer(buf, nil).ReadFrame()
+	if err != nil || !bytes.Equal(got, frame) {
+		t.Errorf("ReadFrame returned %q, %v", got, err)
+	}
+	got, err = NewLineFramer(strings.NewReader("typed\\nat a terminal\r\n"), nil).ReadFrame()
+	if err != nil || string(got) != "typed\nat a terminal" {
+		t.Errorf("ReadFrame returned %q, %v", got, err)
+	}
+	if _, err := NewLineFramer(strings.NewReader("a\\tb\n"), nil).ReadFrame(); err == nil {
+		t.Errorf("expected an error for an unknown escape")
+	}
+}
@@ -0,0 +1,60 @@
+package pup
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketFramer frames each message as one binary WebSocket
+// message.
+type WebSocketFramer struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+// NewWebSocketFramer returns a framer on an open WebSocket
+// connection.  ReadFrame returns io.EOF when the peer closes the
+// connection normally.
+func NewWebSocketFramer(conn *websocket.Conn) Framer {
+	conn.SetReadLimit(MaxFrame)
+	return &WebSocketFramer{conn: conn}
+}
+
+func (f *WebSocketFramer) ReadFrame() ([]byte, error) {
+	mt, frame, err := f.conn.ReadMessage()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if mt != websocket.BinaryMessage {
+		return nil, fmt.Errorf("expected a binary message, got type %d", mt)
+	}
+	return frame, nil
+}
+
+func (f *WebSocketFramer) WriteFrame(frame []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// WebSocketHandler returns an HTTP handler that upgrades each request
+// to a WebSocket connection and runs the dispatcher on it.
+func (d *Dispatcher) WebSocketHandler() http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		d.Serve(NewWebSocketFramer(conn))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	})
+}
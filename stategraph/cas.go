@@ -0,0 +1,203 @@
+package stategraph
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrNotFound is returned when content is not in a CAS.
+var ErrNotFound = errors.New("not found")
+
+// Hash returns the address of data: its sha2-256 multihash.
+func Hash(data []byte) Address {
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err) // sha2-256 is always available
+	}
+	return Address(mh)
+}
+
+// ParseAddress checks that buf is a multihash and returns it as an
+// address.
+func ParseAddress(buf []byte) (Address, error) {
+	mh, err := multihash.Cast(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	return Address(mh), nil
+}
+
+// String returns the address in base58, as multihashes are usually
+// written.
+func (a Address) String() string {
+	return multihash.Multihash(a).B58String()
+}
+
+// Equal reports whether a and b are the same address.
+func (a Address) Equal(b Address) bool {
+	return bytes.Equal(a, b)
+}
+
+// CAS is the content-addressable storage for the runtime.  Content is
+// stored under its Hash.
+type CAS interface {
+	// Put stores data and returns its address.
+	Put(data []byte) (Address, error)
+	// Get returns the data stored at addr, or ErrNotFound.
+	Get(addr Address) ([]byte, error)
+	// Has reports whether addr is stored.
+	Has(addr Address) bool
+	// Delete removes the data stored at addr, if any.
+	Delete(addr Address) error
+	// Addrs returns the addresses of everything stored.
+	Addrs() ([]Address, error)
+}
+
+// MemCAS is a CAS held in memory.
+type MemCAS struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemCAS returns an empty in-memory CAS.
+func NewMemCAS() *MemCAS {
+	return &MemCAS{data: make(map[string][]byte)}
+}
+
+func (c *MemCAS) Put(data []byte) (Address, error) {
+	addr := Hash(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[string(addr)] = append([]byte(nil), data...)
+	return addr, nil
+}
+
+func (c *MemCAS) Get(addr Address) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.data[string(addr)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (c *MemCAS) Has(addr Address) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.data[string(addr)]
+	return ok
+}
+
+func (c *MemCAS) Delete(addr Address) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, string(addr))
+	return nil
+}
+
+func (c *MemCAS) Addrs() (addrs []Address, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for addr := range c.data {
+		addrs = append(addrs, Address(addr))
+	}
+	return addrs, nil
+}
+
+// Chunk is content written by Runtime.Write.  The origin and a random
+// nonce are stored with the data, so that two runtimes writing the
+// same data get different addresses, and the origin signs the hash
+// of the three.
+type Chunk struct {
+	Origin    ed25519.PublicKey
+	Nonce     []byte
+	Data      []byte
+	Signature []byte
+}
+
+// nonceLen is the length of a chunk's nonce in bytes.
+const nonceLen = 16
+
+// signedHash returns the hash of the parts of the chunk its origin
+// signs.
+func (c *Chunk) signedHash() Address {
+	return Hash(encode(kindChunk, c.Origin, c.Nonce, c.Data))
+}
+
+// Bytes returns the chunk's canonical encoding, which is stored in
+// the CAS.
+func (c *Chunk) Bytes() []byte {
+	return encode(kindChunk, c.Origin, c.Nonce, c.Data, c.Signature)
+}
+
+// Verify checks the chunk's signature.
+func (c *Chunk) Verify() error {
+	if len(c.Origin) != ed25519.PublicKeySize {
+		return fmt.Errorf("chunk origin is not an ed25519 public key")
+	}
+	if !ed25519.Verify(c.Origin, c.signedHash(), c.Signature) {
+		return fmt.Errorf("bad chunk signature")
+	}
+	return nil
+}
+
+func decodeChunk(buf []byte) (*Chunk, error) {
+	f, err := decodeKind(buf, kindChunk, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &Chunk{Origin: f[0], Nonce: f[1], Data: f[2], Signature: f[3]}, nil
+}
+
+// Write stores data in the local CAS as a chunk originating from r,
+// and returns its address.  It does not create a new state: a later
+// transition that reads the chunk brings it into the state graph.
+func (r *Runtime) Write(data []byte) (Address, error) {
+	c, err := r.chunk(data)
+	if err != nil {
+		return nil, err
+	}
+	return r.keep(c.Bytes())
+}
+
+// chunk returns a chunk of data originating from r, without storing
+// it.
+func (r *Runtime) chunk(data []byte) (*Chunk, error) {
+	c := &Chunk{
+		Origin: r.PublicKey(),
+		Nonce:  make([]byte, nonceLen),
+		Data:   data,
+	}
+	if _, err := rand.Read(c.Nonce); err != nil {
+		return nil, err
+	}
+	c.Signature = ed25519.Sign(r.signKey, c.signedHash())
+	return c, nil
+}
+
+// content decodes a CAS object holding content, a blob or a verified
+// chunk, and returns the content.
+func content(buf []byte) ([]byte, error) {
+	if len(buf) > 0 && buf[0] == kindChunk {
+		c, err := decodeChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Verify(); err != nil {
+			return nil, err
+		}
+		return c.Data, nil
+	}
+	f, err := decodeKind(buf, kindBlob, 1)
+	if err != nil {
+		return nil, err
+	}
+	return f[0], nil
+}
@@ -0,0 +1,180 @@
+package stategraph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRejected is returned when a runtime's consensus test rejects a
+// transition.
+var ErrRejected = errors.New("transition rejected")
+
+// ConsensusTest decides whether a transition may execute.  Test is
+// called before the transition function runs, with a Tx over the old
+// state for reading its entries and the content the arguments refer
+// to; changes made through tx are discarded, and content written
+// through it is not stored.  The author is the runtime that executed
+// the transition first: this runtime for Exec and Read, and for a
+// replayed transition the runtime that signed its authorship chunk,
+// however many peers relayed it.  A non-nil error rejects the
+// transition.
+type ConsensusTest interface {
+	Test(tx *Tx, author, state, fn Address, args []Address) error
+}
+
+// ConsensusFunc adapts a function to a ConsensusTest.
+type ConsensusFunc func(tx *Tx, author, state, fn Address, args []Address) error
+
+func (f ConsensusFunc) Test(tx *Tx, author, state, fn Address, args []Address) error {
+	return f(tx, author, state, fn, args)
+}
+
+// All returns a test that accepts a transition only if every one of
+// tests does.
+func All(tests ...ConsensusTest) ConsensusTest {
+	return ConsensusFunc(func(tx *Tx, author, state, fn Address, args []Address) error {
+		for _, t := range tests {
+			if err := t.Test(tx, author, state, fn, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SingleAuthor returns a test that accepts only transitions authored
+// by the runtime at author, whether executed here or replayed.
+func SingleAuthor(author Address) ConsensusTest {
+	return ConsensusFunc(func(tx *Tx, by, state, fn Address, args []Address) error {
+		if !by.Equal(author) {
+			return fmt.Errorf("%s is not the author %s", by, author)
+		}
+		return nil
+	})
+}
+
+// AllowFuncs returns a test that accepts only transitions by one of
+// the functions at fns.
+func AllowFuncs(fns ...Address) ConsensusTest {
+	allowed := make(map[string]bool)
+	for _, fn := range fns {
+		allowed[string(fn)] = true
+	}
+	return ConsensusFunc(func(tx *Tx, author, state, fn Address, args []Address) error {
+		if !allowed[string(fn)] {
+			return fmt.Errorf("function %s is not allowed", fn)
+		}
+		return nil
+	})
+}
+
+// Signers returns a test that accepts only transitions approved by at
+// least k of the runtimes at signers.  Approvals are chunks written by
+// Approve and passed to the transition among its arguments; the
+// transition function sees them too.
+func Signers(k int, signers ...Address) ConsensusTest {
+	set := make(map[string]bool)
+	for _, s := range signers {
+		set[string(s)] = true
+	}
+	return ConsensusFunc(func(tx *Tx, author, state, fn Address, args []Address) error {
+		var rest []Address
+		var approvals []*Chunk
+		for _, a := range args {
+			if c, err := tx.ReadChunk(a); err == nil && len(c.Data) > 0 && c.Data[0] == kindApproval {
+				approvals = append(approvals, c)
+			} else {
+				rest = append(rest, a)
+			}
+		}
+		want := approval(state, fn, rest)
+		approved := make(map[string]bool)
+		for _, c := range approvals {
+			signer := Hash(c.Origin)
+			if set[string(signer)] && string(c.Data) == string(want) {
+				approved[string(signer)] = true
+			}
+		}
+		if len(approved) < k {
+			return fmt.Errorf("approved by %d of the signers, %d needed", len(approved), k)
+		}
+		return nil
+	})
+}
+
+// approval returns the data of a chunk approving the transition by fn
+// on args in state.
+func approval(state, fn Address, args []Address) []byte {
+	return encode(kindApproval, state, fn, encodeAddrs(args))
+}
+
+// Approve writes a chunk approving the transition by fn on args in
+// state, and returns its address, to be added to the transition's
+// arguments for a Signers test.
+func (r *Runtime) Approve(state, fn Address, args ...Address) (Address, error) {
+	return r.Write(approval(state, fn, args))
+}
+
+// Rejection is a peer's rejection of a transition this runtime
+// published.
+type Rejection struct {
+	// By is the address of the rejecting runtime.
+	By       Address
+	From, To Address
+	Func     Address
+	Reason   string
+}
+
+// reject sends the peer that published a transition that failed this
+// runtime's consensus test a signed rejection message.
+func (r *Runtime) reject(m *Message, reason error) error {
+	return r.send(&Message{
+		To:      m.From,
+		States:  m.States,
+		Opcode:  MSG_REJECT,
+		Operand: m.Operand,
+		Payload: []byte(reason.Error()),
+	})
+}
+
+// recordRejection records a rejection message from a peer of a
+// transition this runtime recorded.  A peer's later rejection of the
+// same transition replaces its earlier one.
+func (r *Runtime) recordRejection(m *Message) error {
+	if len(m.States) != 2 {
+		return fmt.Errorf("rejection message has %d states, expected 2", len(m.States))
+	}
+	t, err := r.Transition(m.States[1])
+	if err != nil {
+		return fmt.Errorf("rejection from %s: %w", m.From, err)
+	}
+	if !t.From.Equal(m.States[0]) || !t.Func.Equal(m.Operand) {
+		return fmt.Errorf("rejection from %s does not match the transition to %s", m.From, t.To)
+	}
+	rej := &Rejection{
+		By:     m.From,
+		From:   t.From,
+		To:     t.To,
+		Func:   t.Func,
+		Reason: string(m.Payload),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rejs := r.rejections[string(rej.To)]
+	for i, old := range rejs {
+		if old.By.Equal(rej.By) {
+			rejs[i] = rej
+			return nil
+		}
+	}
+	r.rejections[string(rej.To)] = append(rejs, rej)
+	return nil
+}
+
+// Rejections returns the rejections peers have sent of the transition
+// that produced state.
+func (r *Runtime) Rejections(state Address) []*Rejection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Rejection(nil), r.rejections[string(state)]...)
+}
@@ -0,0 +1,217 @@
+package stategraph
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// setFirst sets the "value" entry to the first argument.
+func setFirst(tx *Tx, args []Address) error {
+	if len(args) == 0 {
+		return errors.New("set takes at least one address")
+	}
+	tx.Set("value", args[0])
+	return nil
+}
+
+func TestConsensusPolicies(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 2)
+	a, b := rs[0], rs[1]
+	ctx := context.Background()
+	hello, err := a.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+
+	a.Consensus = AllowFuncs(a.ReadFunc)
+	_, err = a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected for a function not allowed, got %v", err)
+	_, _, err = a.Read(ctx, a.Genesis(), hello)
+	Tassert(t, err == nil, "Read: %v", err)
+
+	a.Consensus = All(AllowFuncs(appendFn), SingleAuthor(b.Addr()))
+	_, err = a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected for another author, got %v", err)
+	a.Consensus = All(AllowFuncs(appendFn), SingleAuthor(a.Addr()))
+	_, err = a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, err == nil, "Exec: %v", err)
+
+	// a consensus test cannot change the new state
+	a.Consensus = ConsensusFunc(func(tx *Tx, author, state, fn Address, args []Address) error {
+		tx.Set("sneaky", state)
+		return nil
+	})
+	s, err := a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, err == nil, "Exec: %v", err)
+	st, err := a.State(s)
+	Tassert(t, err == nil, "State: %v", err)
+	_, ok := st.Entries["sneaky"]
+	Tassert(t, !ok, "the consensus test changed the state")
+}
+
+func TestConsensusSigners(t *testing.T) {
+	_, rs, _ := newRuntimes(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+	ctx := context.Background()
+	var setFn Address
+	for _, r := range rs {
+		var err error
+		setFn, err = r.Define([]byte("set the value entry to the first argument"), setFirst)
+		Tassert(t, err == nil, "Define: %v", err)
+	}
+	a.Consensus = Signers(2, a.Addr(), b.Addr())
+	value, err := a.Write([]byte("value"))
+	Tassert(t, err == nil, "Write: %v", err)
+	other, err := a.Write([]byte("other"))
+	Tassert(t, err == nil, "Write: %v", err)
+	approve := func(r *Runtime, args ...Address) Address {
+		addr, err := r.Approve(a.Genesis(), setFn, args...)
+		Tassert(t, err == nil, "Approve: %v", err)
+		return addr
+	}
+
+	byA, byB, byC := approve(a, value), approve(b, value), approve(c, value)
+	_, err = a.Exec(ctx, a.Genesis(), setFn, value, byA)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected with one approval, got %v", err)
+	_, err = a.Exec(ctx, a.Genesis(), setFn, value, byA, byC)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected with an approval from outside the set, got %v", err)
+	_, err = a.Exec(ctx, a.Genesis(), setFn, other, byA, byB)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected with approvals of other arguments, got %v", err)
+
+	// b's approval is fetched from b
+	s, err := a.Exec(ctx, a.Genesis(), setFn, value, byA, byB)
+	Tassert(t, err == nil, "Exec: %v", err)
+	st, err := a.State(s)
+	Tassert(t, err == nil, "State: %v", err)
+	Tassert(t, st.Entries["value"].Equal(value), "unexpected entries %v", st.Entries)
+}
+
+// TestRejection checks that a subscriber whose consensus test rejects
+// a published transition tells the publisher.
+func TestRejection(t *testing.T) {
+	net, rs, appendFn := newRuntimes(t, 2)
+	a, b := rs[0], rs[1]
+	ctx := context.Background()
+	b.Consensus = AllowFuncs(b.ReadFunc)
+	Tassert(t, b.Subscribe(a.Addr(), a.Genesis()) == nil, "Subscribe failed")
+	waitSubscribed(t, a, b, a.Genesis())
+
+	hello, err := a.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s1, err := a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, err == nil, "Exec: %v", err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.Rejections(s1)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	rejs := a.Rejections(s1)
+	Tassert(t, len(rejs) == 1, "expected one rejection, got %v", rejs)
+	rej := rejs[0]
+	Tassert(t, rej.By.Equal(b.Addr()) && rej.From.Equal(a.Genesis()) && rej.Func.Equal(appendFn), "unexpected rejection %+v", rej)
+	Tassert(t, rej.Reason != "", "expected a reason for the rejection")
+	_, err = b.Transition(s1)
+	Tassert(t, err != nil, "expected the subscriber not to record the rejected transition")
+
+	var rejected bool
+	for _, err := range net.Errors() {
+		rejected = rejected || errors.Is(err, ErrRejected)
+	}
+	Tassert(t, rejected, "expected the subscriber's replay to fail with ErrRejected")
+
+	// only rejections of a recorded transition, once per peer
+	reject := func(states []Address, fn Address) error {
+		m := &Message{To: a.Addr(), States: states, Opcode: MSG_REJECT, Operand: fn, Payload: []byte("no")}
+		b.sign(m)
+		return a.OnMessage(*m)
+	}
+	Tassert(t, reject([]Address{a.Genesis(), s1}, appendFn) == nil, "expected a repeated rejection to be accepted")
+	Tassert(t, len(a.Rejections(s1)) == 1, "expected a repeated rejection to replace the first, got %v", a.Rejections(s1))
+	Tassert(t, reject([]Address{a.Genesis(), s1}, a.ReadFunc) != nil, "expected a rejection naming the wrong function to be refused")
+	Tassert(t, reject([]Address{a.Genesis(), hello}, appendFn) != nil, "expected a rejection of an unknown transition to be refused")
+}
+
+// TestConsensusDryWrite checks that content a consensus test writes is
+// not stored.
+func TestConsensusDryWrite(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	var written Address
+	r.Consensus = ConsensusFunc(func(tx *Tx, author, state, fn Address, args []Address) (err error) {
+		written, err = tx.Write([]byte("scratch"))
+		return err
+	})
+	x, err := r.Write([]byte("x"))
+	Tassert(t, err == nil, "Write: %v", err)
+	_, err = r.Exec(context.Background(), r.Genesis(), appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+	Tassert(t, written.Equal(Hash(encode(kindBlob, []byte("scratch")))), "unexpected address %s", written)
+	Tassert(t, !r.cas.Has(written), "expected the consensus test's write not to be stored")
+}
+
+// TestConsensusRelayedAuthor checks that a transition relayed by a
+// subscriber is tested as one by its author, not by the relay.
+func TestConsensusRelayedAuthor(t *testing.T) {
+	net, rs, appendFn := newRuntimes(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+	gen := a.Genesis()
+	c.Consensus = SingleAuthor(a.Addr())
+	Tassert(t, b.Subscribe(a.Addr(), gen) == nil, "Subscribe failed")
+	Tassert(t, c.Subscribe(b.Addr(), gen) == nil, "Subscribe failed")
+	waitSubscribed(t, a, b, gen)
+	waitSubscribed(t, b, c, gen)
+
+	x, err := a.Write([]byte("x"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s1, err := a.Exec(context.Background(), gen, appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+	waitFor(t, c, s1)
+	errs := net.Errors()
+	Tassert(t, len(errs) == 0, "runtimes returned errors: %v", errs)
+
+	// b cannot pass off its own transition as a's
+	y, err := b.Write([]byte("y"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s2, err := b.Exec(context.Background(), gen, appendFn, y)
+	Tassert(t, err == nil, "Exec: %v", err)
+	signed, err := b.authorship(gen, s2, appendFn, []Address{y})
+	Tassert(t, err == nil, "authorship: %v", err)
+	chunk, err := decodeChunk(signed)
+	Tassert(t, err == nil, "decodeChunk: %v", err)
+	chunk.Origin = a.PublicKey()
+	m := &Message{To: c.Addr(), States: []Address{gen, s2}, Opcode: MSG_TRANSITION, Operand: appendFn, Payload: chunk.Bytes()}
+	b.sign(m)
+	Tassert(t, c.OnMessage(*m) != nil, "expected a forged authorship to be refused")
+	_, err = c.Transition(s2)
+	Tassert(t, errors.Is(err, ErrNotFound), "expected c not to record b's transition, got %v", err)
+}
+
+// TestConsensusSubscribeFunc checks that a peer cannot slip a
+// transition past the consensus test by naming the subscribe
+// function.
+func TestConsensusSubscribeFunc(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 2)
+	a, b := rs[0], rs[1]
+	gen := a.Genesis()
+	a.Consensus = AllowFuncs(appendFn)
+
+	// a subscription chunk applied to the main graph instead of the
+	// subscriber branch
+	sub, err := b.Write(encode(kindSubscription, gen, []byte(subAdd), encodeTime(time.Now())))
+	Tassert(t, err == nil, "Write: %v", err)
+	tr, err := b.exec(context.Background(), b.Addr(), gen, b.SubscribeFunc, []Address{sub}, false)
+	Tassert(t, err == nil, "exec: %v", err)
+	signed, err := b.authorship(gen, tr.To, b.SubscribeFunc, []Address{sub})
+	Tassert(t, err == nil, "authorship: %v", err)
+	m := &Message{To: a.Addr(), States: []Address{gen, tr.To}, Opcode: MSG_TRANSITION, Operand: b.SubscribeFunc, Payload: signed}
+	b.sign(m)
+	err = a.OnMessage(*m)
+	Tassert(t, errors.Is(err, ErrRejected), "expected ErrRejected, got %v", err)
+	Tassert(t, len(a.Children(gen)) == 0, "expected nothing to be recorded, got %v", a.Children(gen))
+
+	// a's own subscription changes still apply
+	Tassert(t, b.Subscribe(a.Addr(), gen) == nil, "Subscribe failed")
+	waitSubscribed(t, a, b, gen)
+}
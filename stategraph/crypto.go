@@ -0,0 +1,145 @@
+package stategraph
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrUnknownSender is returned for a message from a runtime whose
+// keys this runtime does not know.
+var ErrUnknownSender = errors.New("unknown sender")
+
+// Identity is the public half of a runtime's keys: the ed25519 key it
+// signs with, and the X25519 key others encrypt to it with, signed by
+// the first to bind the two.  A runtime's address is the hash of its
+// signing key.
+type Identity struct {
+	SignKey   ed25519.PublicKey
+	BoxKey    *[32]byte
+	Signature []byte
+}
+
+// Addr returns the address of the runtime with this identity.
+func (id *Identity) Addr() Address {
+	return Hash(id.SignKey)
+}
+
+// Bytes returns the identity's canonical encoding.
+func (id *Identity) Bytes() []byte {
+	return encode(kindIdentity, id.SignKey, id.BoxKey[:], id.Signature)
+}
+
+// ParseIdentity decodes an identity and checks that its signing key
+// vouches for its encryption key.
+func ParseIdentity(buf []byte) (*Identity, error) {
+	f, err := decodeKind(buf, kindIdentity, 3)
+	if err != nil {
+		return nil, err
+	}
+	if len(f[0]) != ed25519.PublicKeySize || len(f[1]) != 32 {
+		return nil, fmt.Errorf("identity keys have the wrong length")
+	}
+	id := &Identity{SignKey: f[0], BoxKey: new([32]byte), Signature: f[2]}
+	copy(id.BoxKey[:], f[1])
+	if !ed25519.Verify(id.SignKey, id.BoxKey[:], id.Signature) {
+		return nil, fmt.Errorf("identity %s: bad signature on encryption key", id.Addr())
+	}
+	return id, nil
+}
+
+// newIdentity generates the keys of a new runtime.
+func newIdentity() (signKey ed25519.PrivateKey, boxKey *[32]byte, id *Identity, err error) {
+	signPub, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	boxPub, boxKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	id = &Identity{
+		SignKey:   signPub,
+		BoxKey:    boxPub,
+		Signature: ed25519.Sign(signKey, boxPub[:]),
+	}
+	return signKey, boxKey, id, nil
+}
+
+// Identity returns the runtime's public keys.
+func (r *Runtime) Identity() *Identity {
+	return r.id
+}
+
+// AddKey adds id to the keys the runtime verifies messages and
+// encrypts replies with.
+func (r *Runtime) AddKey(id *Identity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[string(id.Addr())] = id
+}
+
+// key returns the identity of the runtime at addr, if known.
+func (r *Runtime) key(addr Address) (*Identity, bool) {
+	if addr.Equal(r.Addr()) {
+		return r.id, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.keys[string(addr)]
+	return id, ok
+}
+
+// Encrypt seals payload so that only the runtime with identity to can
+// read it.  The sender is anonymous: messages are signed separately.
+func (r *Runtime) Encrypt(payload []byte, to *Identity) ([]byte, error) {
+	return box.SealAnonymous(nil, payload, to.BoxKey, rand.Reader)
+}
+
+// Decrypt opens a payload sealed for this runtime by Encrypt.
+func (r *Runtime) Decrypt(sealed []byte) ([]byte, error) {
+	payload, ok := box.OpenAnonymous(nil, sealed, r.id.BoxKey, r.boxKey)
+	if !ok {
+		return nil, fmt.Errorf("cannot decrypt payload")
+	}
+	return payload, nil
+}
+
+// Verify checks m's signature against the signing key of its sender,
+// from the runtime's keys or, failing that, from keys the message
+// carries: the identity in a read request or the origin of a
+// subscription chunk.
+func (r *Runtime) Verify(m *Message) error {
+	key, err := r.senderKey(m)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, m.Bytes(), m.Signature) {
+		return fmt.Errorf("bad signature on %s message from %s", m.Opcode, m.From)
+	}
+	return nil
+}
+
+func (r *Runtime) senderKey(m *Message) (ed25519.PublicKey, error) {
+	if id, ok := r.key(m.From); ok {
+		return id.SignKey, nil
+	}
+	var key ed25519.PublicKey
+	switch m.Opcode {
+	case MSG_READ:
+		if id, err := ParseIdentity(m.Payload); err == nil {
+			key = id.SignKey
+		}
+	case MSG_SUBSCRIBE:
+		if c, err := decodeChunk(m.Payload); err == nil {
+			key = c.Origin
+		}
+	}
+	if key == nil || !Hash(key).Equal(m.From) {
+		return nil, fmt.Errorf("%w %s", ErrUnknownSender, m.From)
+	}
+	return key, nil
+}
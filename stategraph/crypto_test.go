@@ -0,0 +1,198 @@
+package stategraph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// tap is a transport that records the messages it carries.
+type tap struct {
+	Transport
+	mu   sync.Mutex
+	seen []*Message
+}
+
+func (t *tap) Send(m *Message) error {
+	t.mu.Lock()
+	t.seen = append(t.seen, m)
+	t.mu.Unlock()
+	return t.Transport.Send(m)
+}
+
+func TestIdentity(t *testing.T) {
+	r, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	id, err := ParseIdentity(r.Identity().Bytes())
+	Tassert(t, err == nil, "ParseIdentity: %v", err)
+	Tassert(t, id.Addr().Equal(r.Addr()), "identity address %s is not the runtime's", id.Addr())
+
+	other, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	forged := *r.Identity()
+	forged.BoxKey = other.Identity().BoxKey
+	_, err = ParseIdentity(forged.Bytes())
+	Tassert(t, err != nil, "expected an error for an identity with a swapped encryption key")
+
+	sealed, err := other.Encrypt([]byte("secret"), r.Identity())
+	Tassert(t, err == nil, "Encrypt: %v", err)
+	plain, err := r.Decrypt(sealed)
+	Tassert(t, err == nil && string(plain) == "secret", "Decrypt returned %q, %v", plain, err)
+	_, err = other.Decrypt(sealed)
+	Tassert(t, err != nil, "expected only the recipient to decrypt")
+}
+
+func TestVerify(t *testing.T) {
+	_, rs, _ := newRuntimes(t, 2)
+	a, b := rs[0], rs[1]
+	m := &Message{To: b.Addr(), Opcode: MSG_TRANSITION, Operand: Hash([]byte("f"))}
+	a.sign(m)
+	Tassert(t, b.Verify(m) == nil, "expected a's signature to verify")
+
+	m.Operand = Hash([]byte("g"))
+	Tassert(t, b.Verify(m) != nil, "expected a tampered message to fail verification")
+
+	stranger, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	m = &Message{To: b.Addr(), Opcode: MSG_TRANSITION}
+	stranger.sign(m)
+	err = b.OnMessage(*m)
+	Tassert(t, errors.Is(err, ErrUnknownSender), "expected ErrUnknownSender, got %v", err)
+
+	// a read request carries its sender's keys
+	m = &Message{To: b.Addr(), Opcode: MSG_READ, Operand: Hash([]byte("x")), Payload: stranger.Identity().Bytes()}
+	stranger.sign(m)
+	Tassert(t, b.Verify(m) == nil, "expected a stranger's read request to verify")
+}
+
+// TestForwardedRead checks that a read reaches content two hops away,
+// and that the runtime in the middle cannot read the reply.
+func TestForwardedRead(t *testing.T) {
+	net := NewMemNetwork()
+	var rs []*Runtime
+	for i := 0; i < 3; i++ {
+		r, err := NewRuntime(NewMemCAS())
+		Tassert(t, err == nil, "NewRuntime: %v", err)
+		net.Join(r)
+		rs = append(rs, r)
+	}
+	a, b, c := rs[0], rs[1], rs[2]
+	a.AddPeer(b.Identity())
+	b.AddPeer(a.Identity())
+	b.AddPeer(c.Identity())
+	c.AddPeer(b.Identity())
+	wire := &tap{Transport: net}
+	b.Transport = wire
+	c.Transport = wire
+
+	secret, err := c.Write([]byte("the secret"))
+	Tassert(t, err == nil, "Write: %v", err)
+	_, data, err := a.Read(context.Background(), a.Genesis(), secret)
+	Tassert(t, err == nil && string(data) == "the secret", "Read returned %q, %v", data, err)
+	Tassert(t, !b.cas.Has(secret), "expected the middle runtime not to store the content")
+
+	var replies int
+	wire.mu.Lock()
+	for _, m := range wire.seen {
+		if m.Opcode != MSG_REPLY {
+			continue
+		}
+		replies++
+		Tassert(t, !bytes.Contains(m.Payload, []byte("the secret")), "reply payload is in the clear")
+		f, err := decodeKind(m.Payload, kindReply, 2)
+		Tassert(t, err == nil, "bad reply payload: %v", err)
+		_, err = b.Decrypt(f[1])
+		Tassert(t, err != nil, "expected the middle runtime not to decrypt the reply")
+	}
+	wire.mu.Unlock()
+	Tassert(t, replies == 2, "expected the reply to take two hops, saw %d", replies)
+
+	errs := net.Errors()
+	Tassert(t, len(errs) == 0, "runtimes returned errors: %v", errs)
+}
+
+// failing is a transport that drops every message, returning err.
+type failing struct{ err error }
+
+func (f failing) Send(m *Message) error { return f.err }
+
+// TestReadPromise checks that a read request that cannot be sent
+// fails every read waiting on it, and that a read giving up does not
+// abandon the request of another read still waiting on it.
+func TestReadPromise(t *testing.T) {
+	r, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	peer, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	r.AddPeer(peer.Identity())
+	addr := Hash([]byte("missing"))
+	pending := func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, ok := r.pending[string(addr)]
+		return ok
+	}
+
+	down := errors.New("network down")
+	r.Transport = failing{down}
+	_, err = r.read(context.Background(), addr)
+	Tassert(t, errors.Is(err, down), "expected the send error, got %v", err)
+	Tassert(t, !pending(), "expected a failed request not to stay pending")
+
+	// nothing answers, so both reads wait until they give up
+	r.Transport = failing{}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err := r.read(first, addr); errs <- err }()
+	go func() { _, err := r.read(second, addr); errs <- err }()
+	for {
+		r.mu.Lock()
+		p := r.pending[string(addr)]
+		joined := p != nil && p.waiters == 2
+		r.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancelFirst()
+	Tassert(t, errors.Is(<-errs, context.Canceled), "expected the first read to be cancelled")
+	Tassert(t, pending(), "expected the request to stay pending for the second read")
+	cancelSecond()
+	Tassert(t, errors.Is(<-errs, context.Canceled), "expected the second read to be cancelled")
+	Tassert(t, !pending(), "expected the last read to give up to clear the request")
+}
+
+// TestForwardLimits checks that a runtime bounds the reads it
+// forwards for a requester, and forgets forwards once their replies
+// are overdue.
+func TestForwardLimits(t *testing.T) {
+	_, rs, _ := newRuntimes(t, 2)
+	b := rs[1]
+	stranger, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	read := func(i int) error {
+		m := &Message{To: b.Addr(), Opcode: MSG_READ, Operand: Hash([]byte{byte(i)}), Payload: stranger.Identity().Bytes()}
+		stranger.sign(m)
+		return b.OnMessage(*m)
+	}
+	for i := 0; i < MaxForwardsPerRequester; i++ {
+		Tassert(t, read(i) == nil, "read %d was refused", i)
+	}
+	err = read(MaxForwardsPerRequester)
+	Tassert(t, errors.Is(err, errForwardLimit), "expected errForwardLimit, got %v", err)
+
+	// once overdue, forwards and the requester's count are dropped
+	b.mu.Lock()
+	Tassert(t, len(b.forwards) == MaxForwardsPerRequester, "expected %d forwards, got %d", MaxForwardsPerRequester, len(b.forwards))
+	b.expireForwards(time.Now().Add(DefaultTimeout))
+	Tassert(t, len(b.forwards) == 0 && len(b.requesters) == 0, "expected overdue forwards to be dropped")
+	b.mu.Unlock()
+	Tassert(t, read(MaxForwardsPerRequester) == nil, "expected the requester to be served again")
+}
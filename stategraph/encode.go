@@ -0,0 +1,112 @@
+package stategraph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Objects in the CAS, and the bytes peers sign, are encoded
+// canonically so that every runtime computes the same hash for the
+// same object: a kind byte followed by a sequence of fields, each a
+// uvarint length and that many bytes.  Lists of addresses are a field
+// holding their own sequence of fields.
+
+// Kinds of CAS object.
+const (
+	kindBlob         byte = 'b' // raw content written by a transition
+	kindChunk        byte = 'c' // content written by Runtime.Write
+	kindState        byte = 's'
+	kindTransition   byte = 't'
+	kindSubscription byte = 'u' // data of a subscription chunk
+	kindApproval     byte = 'a' // data of an approval chunk
+	kindAuthorship   byte = 'w' // data of a transition's authorship chunk
+	kindIdentity     byte = 'i' // a runtime's public keys; never stored
+	kindReply        byte = 'r' // payload of a read reply; never stored
+	kindMessage      byte = 'm' // signed bytes of a Message; never stored
+)
+
+// encode returns the canonical encoding of an object of kind with the
+// given fields.
+func encode(kind byte, fields ...[]byte) []byte {
+	buf := []byte{kind}
+	for _, f := range fields {
+		buf = binary.AppendUvarint(buf, uint64(len(f)))
+		buf = append(buf, f...)
+	}
+	return buf
+}
+
+// decode splits the canonical encoding of an object into its kind and
+// fields.  The fields share buf's memory.
+func decode(buf []byte) (kind byte, fields [][]byte, err error) {
+	if len(buf) == 0 {
+		return 0, nil, fmt.Errorf("empty object")
+	}
+	kind, fields, err = buf[0], nil, nil
+	rest := buf[1:]
+	for len(rest) > 0 {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || n > uint64(len(rest)-size) {
+			return 0, nil, fmt.Errorf("truncated field in %q object", kind)
+		}
+		rest = rest[size:]
+		fields = append(fields, rest[:n])
+		rest = rest[n:]
+	}
+	return
+}
+
+// decodeKind is decode for an object that must be of kind with n
+// fields.
+func decodeKind(buf []byte, kind byte, n int) (fields [][]byte, err error) {
+	k, fields, err := decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if k != kind {
+		return nil, fmt.Errorf("expected a %q object, got %q", kind, k)
+	}
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d fields in %q object, got %d", n, kind, len(fields))
+	}
+	return fields, nil
+}
+
+// encodeAddrs returns a field holding a list of addresses.
+func encodeAddrs(addrs []Address) []byte {
+	fields := make([][]byte, len(addrs))
+	for i, a := range addrs {
+		fields[i] = a
+	}
+	return encode(0, fields...)[1:]
+}
+
+// decodeAddrs decodes a field made by encodeAddrs.
+func decodeAddrs(field []byte) (addrs []Address, err error) {
+	_, fields, err := decode(append([]byte{0}, field...))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		a, err := ParseAddress(f)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// encodeTime returns a field holding t to the nanosecond.
+func encodeTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+// decodeTime decodes a field made by encodeTime.
+func decodeTime(field []byte) (time.Time, error) {
+	if len(field) != 8 {
+		return time.Time{}, fmt.Errorf("expected an 8-byte time, got %d bytes", len(field))
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(field))), nil
+}
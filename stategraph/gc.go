@@ -0,0 +1,452 @@
+package stategraph
+
+import (
+	"time"
+)
+
+// DefaultGrace is how long GC keeps content that no state refers to
+// yet, such as a chunk written for a transition that has not run.
+const DefaultGrace = time.Minute
+
+// squashSource is the source of the squash pseudo-function.  No
+// runtime defines it, so a squashed transition cannot be replayed
+// directly; its arguments list the function and argument set of each
+// transition it replaced, so the steps can be.
+const squashSource = `stategraph squash, version 1.
+
+Marks a transition that replaced a linear chain of transitions during
+garbage collection.  The argument set lists, for each replaced
+transition in order, the address of its function and the address of
+its argument set.
+`
+
+// SquashFunc is the address of the squash pseudo-function.
+var SquashFunc = Hash(encode(kindBlob, []byte(squashSource)))
+
+// GCOptions configures a garbage collection.
+type GCOptions struct {
+	// Roots are states to keep, along with everything they were
+	// derived from.  The genesis state, the subscriber branch, the
+	// sources of defined functions and pinned states are always
+	// roots.
+	Roots []Address
+	// HeadAge, if not zero, keeps only heads of the state graph --
+	// states nothing has been derived from -- recorded within HeadAge;
+	// older heads are pruned unless something else keeps them.  If
+	// zero, every head is kept.
+	HeadAge time.Duration
+	// Grace keeps content written or fetched within Grace that no
+	// state refers to.  It defaults to DefaultGrace.
+	Grace time.Duration
+	// Squash replaces each linear chain of transitions through states
+	// that are not roots with a single transition, removing the
+	// states in between.  The squashed transition lists the function
+	// and argument set of every step so that the chain can be
+	// replayed, so the arguments of every step are kept even if no
+	// kept state refers to them: squashing reclaims states, not the
+	// content the chain read.
+	Squash bool
+	// DryRun reports what GC would do without doing it.
+	DryRun bool
+}
+
+// GCReport describes a garbage collection.
+type GCReport struct {
+	Roots []Address
+	// Kept is the number of CAS objects kept.
+	Kept int
+	// Removed lists the CAS objects removed, or that would have been
+	// in a dry run.
+	Removed []Address
+	// Squashed lists the transitions that replaced chains.
+	Squashed []Squash
+}
+
+// Squash describes a chain of transitions replaced by one.
+type Squash struct {
+	From, To Address
+	// Steps is the number of transitions replaced.
+	Steps int
+}
+
+// Pin makes state a root of every garbage collection until it is
+// unpinned.
+func (r *Runtime) Pin(state Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pins[string(state)] = true
+}
+
+// Unpin undoes Pin.
+func (r *Runtime) Unpin(state Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pins, string(state))
+}
+
+// hold makes addrs roots of garbage collection, as executing
+// transitions need them, until they are released.  An address may be
+// held more than once.
+func (r *Runtime) hold(addrs ...Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range addrs {
+		r.held[string(a)]++
+	}
+}
+
+// release undoes hold.
+func (r *Runtime) release(addrs ...Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range addrs {
+		if r.held[string(a)]--; r.held[string(a)] <= 0 {
+			delete(r.held, string(a))
+		}
+	}
+}
+
+// keep stores data in the CAS, noting the time so that GC leaves it
+// alone for a grace period even if no state refers to it.  The time
+// is noted first, so a GC that finds the data finds it a root; keep
+// does not wait for GC, as a read reply may be kept while a
+// transition waiting on it holds GC off.
+func (r *Runtime) keep(data []byte) (Address, error) {
+	addr := Hash(data)
+	r.mu.Lock()
+	r.stored[string(addr)] = time.Now()
+	r.mu.Unlock()
+	return r.cas.Put(data)
+}
+
+// GC prunes the state graph and removes the CAS objects no root can
+// reach: stale branches, the content only they referred to, and the
+// states in between squashed chains.  Transitions wait to start and
+// to be recorded while GC runs.  GC does not wait for transitions
+// already executing, which may be waiting on peers, but keeps the
+// states they run from, their arguments and what they write.
+func (r *Runtime) GC(opts GCOptions) (*GCReport, error) {
+	if opts.Grace == 0 {
+		opts.Grace = DefaultGrace
+	}
+	r.gcMu.Lock()
+	defer r.gcMu.Unlock()
+
+	roots := r.gcRoots(opts)
+	g := newMarker(r, nil)
+	for _, root := range roots {
+		g.mark(root)
+	}
+	report := &GCReport{Roots: roots}
+	var squashes map[string]*squash
+	if opts.Squash {
+		squashes, report.Squashed = g.planSquashes(roots)
+		// mark again with the chains replaced
+		g = newMarker(r, squashes)
+		for _, root := range roots {
+			g.mark(root)
+		}
+	}
+
+	addrs, err := r.cas.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	r.mu.Lock()
+	for _, addr := range addrs {
+		// content kept or written by a transition since the roots
+		// were gathered is in stored or held
+		if g.marked[string(addr)] || r.spared(addr, now, opts.Grace) {
+			report.Kept++
+		} else {
+			report.Removed = append(report.Removed, addr)
+		}
+	}
+	r.mu.Unlock()
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, sq := range squashes {
+		if _, err := r.cas.Put(encode(kindBlob, encodeAddrs(sq.steps))); err != nil {
+			return nil, err
+		}
+		addr, err := r.cas.Put(sq.t.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.transitions[string(sq.t.To)] = addr
+		r.mu.Unlock()
+	}
+	// check again under the lock, since content is noted as stored
+	// or held before it is put
+	r.mu.Lock()
+	for _, addr := range report.Removed {
+		if r.spared(addr, time.Now(), opts.Grace) {
+			continue
+		}
+		if err := r.cas.Delete(addr); err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+	}
+	r.mu.Unlock()
+	r.pruneIndexes(g.marked, opts.Grace)
+	return report, nil
+}
+
+// spared returns true if addr was stored within grace of now or is
+// held by an executing transition.  The caller holds r.mu.
+func (r *Runtime) spared(addr Address, now time.Time, grace time.Duration) bool {
+	return now.Sub(r.stored[string(addr)]) < grace || r.held[string(addr)] > 0
+}
+
+// gcRoots returns the roots of a garbage collection.
+func (r *Runtime) gcRoots(opts GCOptions) (roots []Address) {
+	roots = append(roots, opts.Roots...)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	roots = append(roots, r.genesis, r.subsHead)
+	for fn := range r.funcs {
+		roots = append(roots, Address(fn))
+	}
+	for state := range r.pins {
+		roots = append(roots, Address(state))
+	}
+	for addr := range r.held {
+		roots = append(roots, Address(addr))
+	}
+	for state := range r.transitions {
+		if len(r.children[state]) > 0 {
+			continue
+		}
+		if opts.HeadAge == 0 || now.Sub(r.recorded[state]) < opts.HeadAge {
+			roots = append(roots, Address(state))
+		}
+	}
+	for addr, at := range r.stored {
+		if now.Sub(at) < opts.Grace {
+			roots = append(roots, Address(addr))
+		}
+	}
+	return
+}
+
+// pruneIndexes drops unmarked states from the runtime's indexes of
+// the state graph, and rebuilds the index of children from the
+// transitions that remain.
+func (r *Runtime) pruneIndexes(marked map[string]bool, grace time.Duration) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.children = make(map[string][]Address)
+	for state, addr := range r.transitions {
+		if !marked[state] {
+			delete(r.transitions, state)
+			delete(r.recorded, state)
+			continue
+		}
+		buf, err := r.cas.Get(addr)
+		if err != nil {
+			continue
+		}
+		t, err := decodeTransition(buf)
+		if err != nil {
+			continue
+		}
+		r.children[string(t.From)] = append(r.children[string(t.From)], t.To)
+	}
+	for state := range r.following {
+		if !marked[state] {
+			delete(r.following, state)
+		}
+	}
+	for state := range r.rejections {
+		if !marked[state] {
+			delete(r.rejections, state)
+		}
+	}
+	for addr, at := range r.stored {
+		if now.Sub(at) >= grace {
+			delete(r.stored, addr)
+		}
+	}
+	r.expireForwards(now)
+}
+
+// squash is a planned replacement of a chain of transitions.
+type squash struct {
+	t     *Transition
+	steps []Address // function and argument set of each replaced step
+}
+
+// marker marks the CAS objects reachable from the roots of a garbage
+// collection.  A state reaches the states and content its transition
+// refers to, or its parents if the runtime did not record how it was
+// produced.  Planned squashes, by the state they produce, stand in
+// for the transitions the runtime recorded.
+type marker struct {
+	r        *Runtime
+	marked   map[string]bool
+	squashes map[string]*squash
+}
+
+func newMarker(r *Runtime, squashes map[string]*squash) *marker {
+	return &marker{r: r, marked: make(map[string]bool), squashes: squashes}
+}
+
+// transition returns the transition that produced state, and its
+// address, or nil.
+func (g *marker) transition(state Address) (t *Transition, addr Address) {
+	if sq, ok := g.squashes[string(state)]; ok {
+		return sq.t, Hash(sq.t.Bytes())
+	}
+	g.r.mu.Lock()
+	addr, ok := g.r.transitions[string(state)]
+	g.r.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	buf, err := g.r.cas.Get(addr)
+	if err != nil {
+		return nil, nil
+	}
+	t, err = decodeTransition(buf)
+	if err != nil {
+		return nil, nil
+	}
+	return t, addr
+}
+
+// mark marks addr and what it reaches.
+func (g *marker) mark(addr Address) {
+	if g.marked[string(addr)] {
+		return
+	}
+	g.marked[string(addr)] = true
+	buf, err := g.r.cas.Get(addr)
+	if err != nil || len(buf) == 0 || buf[0] != kindState {
+		// content, or an object this runtime does not have
+		return
+	}
+	s, err := decodeState(buf)
+	if err != nil {
+		return
+	}
+	for _, a := range s.Entries {
+		g.mark(a)
+	}
+	t, taddr := g.transition(addr)
+	if t == nil {
+		for _, p := range s.Parents {
+			g.mark(p)
+		}
+		return
+	}
+	g.marked[string(taddr)] = true
+	g.mark(t.Func)
+	g.marked[string(t.Args)] = true
+	if t.Func.Equal(SquashFunc) {
+		for i := 0; i+1 < len(g.steps(t)); i += 2 {
+			g.mark(g.steps(t)[i])
+			g.markArgSet(g.steps(t)[i+1])
+		}
+	} else {
+		g.markArgSet(t.Args)
+	}
+	g.mark(t.From)
+}
+
+// steps returns the steps of squashed transition t.
+func (g *marker) steps(t *Transition) []Address {
+	if sq, ok := g.squashes[string(t.To)]; ok && sq.t == t {
+		return sq.steps
+	}
+	steps, _ := g.argSet(t.Args)
+	return steps
+}
+
+// markArgSet marks an argument set and the arguments in it.
+func (g *marker) markArgSet(addr Address) {
+	g.marked[string(addr)] = true
+	args, _ := g.argSet(addr)
+	for _, a := range args {
+		g.mark(a)
+	}
+}
+
+// argSet returns the addresses in the argument set at addr.
+func (g *marker) argSet(addr Address) ([]Address, error) {
+	buf, err := g.r.cas.Get(addr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := decodeKind(buf, kindBlob, 1)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAddrs(f[0])
+}
+
+// planSquashes finds the linear chains among the marked states and
+// plans a transition to replace each, by the state at the end of the
+// chain.  A chain runs back from a state through states that are not
+// roots and have exactly one marked child.
+func (g *marker) planSquashes(roots []Address) (squashes map[string]*squash, report []Squash) {
+	isRoot := make(map[string]bool)
+	for _, r := range roots {
+		isRoot[string(r)] = true
+	}
+	children := make(map[string]int)
+	produced := make(map[string]*Transition)
+	for addr := range g.marked {
+		t, _ := g.transition(Address(addr))
+		if t == nil {
+			continue
+		}
+		produced[addr] = t
+		children[string(t.From)]++
+	}
+	interior := func(state string) bool {
+		return !isRoot[state] && children[state] == 1 && produced[state] != nil
+	}
+
+	squashes = make(map[string]*squash)
+	for end, t := range produced {
+		if interior(end) {
+			continue
+		}
+		var chain []*Transition
+		for {
+			chain = append([]*Transition{t}, chain...)
+			if !interior(string(t.From)) {
+				break
+			}
+			t = produced[string(t.From)]
+		}
+		if len(chain) < 2 {
+			continue
+		}
+		sq := &squash{}
+		for _, step := range chain {
+			if step.Func.Equal(SquashFunc) {
+				// squashed before: take its steps
+				sq.steps = append(sq.steps, g.steps(step)...)
+				continue
+			}
+			sq.steps = append(sq.steps, step.Func, step.Args)
+		}
+		sq.t = &Transition{
+			From: chain[0].From,
+			To:   Address(end),
+			Func: SquashFunc,
+			Args: Hash(encode(kindBlob, encodeAddrs(sq.steps))),
+		}
+		squashes[end] = sq
+		report = append(report, Squash{From: sq.t.From, To: sq.t.To, Steps: len(sq.steps) / 2})
+	}
+	return squashes, report
+}
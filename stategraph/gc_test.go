@@ -0,0 +1,219 @@
+package stategraph
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// logOf returns the content of state's "log" entry.
+func logOf(t *testing.T, r *Runtime, state Address) string {
+	t.Helper()
+	st, err := r.State(state)
+	Tassert(t, err == nil, "State: %v", err)
+	buf, err := r.cas.Get(st.Entries["log"])
+	Tassert(t, err == nil, "Get: %v", err)
+	log, err := content(buf)
+	Tassert(t, err == nil, "content: %v", err)
+	return string(log)
+}
+
+// TestGC checks that GC removes a stale branch and the content only
+// it refers to, and keeps roots, pinned states and fresh writes.
+func TestGC(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	ctx := context.Background()
+	write := func(data string) Address {
+		addr, err := r.Write([]byte(data))
+		Tassert(t, err == nil, "Write: %v", err)
+		return addr
+	}
+	exec := func(state Address, arg Address) Address {
+		s, err := r.Exec(ctx, state, appendFn, arg)
+		Tassert(t, err == nil, "Exec: %v", err)
+		return s
+	}
+	x, y, z := write("x"), write("y"), write("z")
+	s1 := exec(r.Genesis(), x)
+	kept := exec(s1, y)
+	stale := exec(s1, z)
+	pinned := exec(kept, z)
+	r.Pin(pinned)
+	time.Sleep(10 * time.Millisecond)
+	fresh := write("fresh")
+
+	opts := GCOptions{Roots: []Address{kept}, HeadAge: 5 * time.Millisecond, Grace: 5 * time.Millisecond, DryRun: true}
+	report, err := r.GC(opts)
+	Tassert(t, err == nil, "GC: %v", err)
+	Tassert(t, len(report.Removed) > 0, "expected the dry run to find garbage")
+	_, err = r.State(stale)
+	Tassert(t, err == nil, "dry run removed the stale branch: %v", err)
+
+	opts.DryRun = false
+	report, err = r.GC(opts)
+	Tassert(t, err == nil, "GC: %v", err)
+	_, err = r.State(stale)
+	Tassert(t, err != nil, "expected the stale branch to be removed")
+	_, err = r.Transition(stale)
+	Tassert(t, err != nil, "expected the stale transition to be forgotten")
+	kids := r.Children(s1)
+	Tassert(t, len(kids) == 1 && kids[0].Equal(kept), "unexpected children %v", kids)
+	Tassert(t, logOf(t, r, kept) == "xy", "log of the kept state is %q", logOf(t, r, kept))
+	Tassert(t, logOf(t, r, pinned) == "xyz", "log of the pinned state is %q", logOf(t, r, pinned))
+	Tassert(t, r.cas.Has(z), "expected the pinned state's argument to be kept")
+	Tassert(t, r.cas.Has(fresh), "expected a fresh write to be kept")
+
+	// with nothing left to remove, the next GC keeps everything
+	again, err := r.GC(opts)
+	Tassert(t, err == nil, "GC: %v", err)
+	Tassert(t, len(again.Removed) == 0 && again.Kept == report.Kept, "second GC removed %v", again.Removed)
+
+	time.Sleep(10 * time.Millisecond)
+	r.Unpin(pinned)
+	_, err = r.GC(opts)
+	Tassert(t, err == nil, "GC: %v", err)
+	_, err = r.State(pinned)
+	Tassert(t, err != nil, "expected the unpinned state to be removed")
+	Tassert(t, !r.cas.Has(fresh), "expected the unreferenced write to be removed after its grace")
+	Tassert(t, logOf(t, r, kept) == "xy", "log of the kept state is %q", logOf(t, r, kept))
+}
+
+// TestGCSquash checks that GC replaces a chain with one transition
+// that still leads to the state at its end.
+func TestGCSquash(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	ctx := context.Background()
+	state := r.Genesis()
+	var states, args []Address
+	for _, data := range []string{"a", "b", "c", "d"} {
+		addr, err := r.Write([]byte(data))
+		Tassert(t, err == nil, "Write: %v", err)
+		state, err = r.Exec(ctx, state, appendFn, addr)
+		Tassert(t, err == nil, "Exec: %v", err)
+		states = append(states, state)
+		args = append(args, addr)
+	}
+	end := states[len(states)-1]
+
+	report, err := r.GC(GCOptions{Squash: true})
+	Tassert(t, err == nil, "GC: %v", err)
+	var sq *Squash
+	for i := range report.Squashed {
+		if report.Squashed[i].To.Equal(end) {
+			sq = &report.Squashed[i]
+		}
+	}
+	Tassert(t, sq != nil, "expected the chain to be squashed, got %v", report.Squashed)
+	Tassert(t, sq.From.Equal(r.Genesis()) && sq.Steps == 4, "unexpected squash %+v", sq)
+	for _, s := range states[:len(states)-1] {
+		_, err := r.State(s)
+		Tassert(t, err != nil, "expected intermediate state %s to be removed", s)
+	}
+	tr, err := r.Transition(end)
+	Tassert(t, err == nil, "Transition: %v", err)
+	Tassert(t, tr.Func.Equal(SquashFunc) && tr.From.Equal(r.Genesis()), "unexpected transition %+v", tr)
+	Tassert(t, logOf(t, r, end) == "abcd", "log is %q", logOf(t, r, end))
+	for _, a := range args {
+		Tassert(t, r.cas.Has(a), "expected the arguments of the squashed steps to be kept")
+	}
+	kids := r.Children(r.Genesis())
+	Tassert(t, len(kids) == 1 && kids[0].Equal(end), "unexpected children %v", kids)
+
+	// the graph keeps growing from the squashed state
+	addr, err := r.Write([]byte("e"))
+	Tassert(t, err == nil, "Write: %v", err)
+	next, err := r.Exec(ctx, end, appendFn, addr)
+	Tassert(t, err == nil, "Exec: %v", err)
+	Tassert(t, logOf(t, r, next) == "abcde", "log is %q", logOf(t, r, next))
+}
+
+// TestGCConcurrent runs GC while transitions execute.
+func TestGCConcurrent(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	ctx := context.Background()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := r.GC(GCOptions{Squash: true})
+			Tassert(t, err == nil, "GC: %v", err)
+		}
+	}()
+
+	state, want := r.Genesis(), ""
+	for i := 0; i < 50; i++ {
+		data := string(rune('a' + i%26))
+		addr, err := r.Write([]byte(data))
+		Tassert(t, err == nil, "Write: %v", err)
+		state, err = r.Exec(ctx, state, appendFn, addr)
+		Tassert(t, err == nil, "Exec: %v", err)
+		want += data
+	}
+	close(done)
+	wg.Wait()
+	Tassert(t, logOf(t, r, state) == want, "log is %q", logOf(t, r, state))
+}
+
+// TestGCWhileReading checks that GC does not wait for a transition
+// waiting on peers, and keeps what that transition needs.
+func TestGCWhileReading(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 2)
+	r := rs[0]
+	r.Transport = failing{} // nothing answers
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	x, err := r.Write([]byte("x"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s1, err := r.Exec(ctx, r.Genesis(), appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+
+	missing := Hash([]byte("missing"))
+	done := make(chan error)
+	go func() {
+		_, err := r.Exec(ctx, s1, appendFn, missing)
+		done <- err
+	}()
+	for {
+		r.mu.Lock()
+		_, waiting := r.pending[string(missing)]
+		r.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	gcDone := make(chan error)
+	go func() {
+		_, err := r.GC(GCOptions{Roots: []Address{r.Genesis()}, HeadAge: time.Nanosecond, Grace: time.Nanosecond})
+		gcDone <- err
+	}()
+	select {
+	case err := <-gcDone:
+		Tassert(t, err == nil, "GC: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("GC waited on a transition waiting on peers")
+	}
+	Tassert(t, logOf(t, r, s1) == "x", "expected GC to keep the state the transition runs from")
+
+	// other transitions are not held up either
+	y, err := r.Write([]byte("y"))
+	Tassert(t, err == nil, "Write: %v", err)
+	_, err = r.Exec(ctx, s1, appendFn, y)
+	Tassert(t, err == nil, "Exec: %v", err)
+	cancel()
+	Tassert(t, <-done != nil, "expected the waiting transition to fail once cancelled")
+}
@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/multiformats/go-multihash v0.2.3
 	github.com/stevegt/goadapt v0.4.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
 
 require (
@@ -13,7 +14,6 @@ require (
 	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/multiformats/go-varint v0.0.6 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
 	golang.org/x/sys v0.1.0 // indirect
 	lukechampine.com/blake3 v1.1.6 // indirect
 )
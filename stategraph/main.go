@@ -1,7 +1,12 @@
 package stategraph
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/multiformats/go-multihash"
 	. "github.com/stevegt/goadapt"
@@ -63,8 +68,26 @@ const (
 	MSG_TRANSITION MessageType = iota
 	MSG_READ
 	MSG_REPLY
+	MSG_SUBSCRIBE
+	MSG_REJECT
 )
 
+func (t MessageType) String() string {
+	switch t {
+	case MSG_TRANSITION:
+		return "transition"
+	case MSG_READ:
+		return "read"
+	case MSG_REPLY:
+		return "reply"
+	case MSG_SUBSCRIBE:
+		return "subscribe"
+	case MSG_REJECT:
+		return "reject"
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
 // Message is a message sent between peers.
 // XXX message is a program
 // XXX transition is a hyperedge
@@ -79,19 +102,142 @@ type Message struct {
 	To Address
 	// signature of the message
 	Signature []byte
-	// Address of the starting state nodes
+	// Address of the starting state nodes; a transition also carries
+	// the address of the state it produced
 	States []Address
 	// message type
 	Opcode MessageType
 	// - address of the function to execute if this is a transition
 	// - address of the content to read if this is a read request
+	// - address of the subscription chunk if this is a subscription
+	// - address of the function of the transition if this is a rejection
 	Operand Address
-	// byte array of the encrypted message if this is a reply to a read
+	// - the transition's authorship chunk if this is a transition
+	// - byte array of the encrypted message if this is a reply to a read
+	// - the subscription chunk if this is a subscription
+	// - the reason for the rejection if this is a rejection
 	Payload []byte
 }
 
+// DefaultTimeout bounds how long a runtime waits for peers while
+// replaying a transition it was sent.
+const DefaultTimeout = 10 * time.Second
+
+// Transport delivers messages to other runtimes, by their To address.
+type Transport interface {
+	Send(m *Message) error
+}
+
 // Runtime is the main object that manages the state graph.
 type Runtime struct {
+	// Transport carries the runtime's messages to its peers and
+	// subscribers.  A runtime with no transport works alone.
+	Transport Transport
+	// ReadFunc and SubscribeFunc are the addresses of the built-in
+	// read and subscribe functions.
+	ReadFunc      Address
+	SubscribeFunc Address
+	// Consensus, if not nil, tests each transition before it
+	// executes.  Changes to the subscriber branch are not tested: the
+	// branch is the runtime's own.
+	Consensus ConsensusTest
+
+	cas     CAS
+	signKey ed25519.PrivateKey
+	boxKey  *[32]byte
+	id      *Identity
+	genesis Address
+
+	mu          sync.Mutex
+	funcs       map[string]Func
+	peers       []Address
+	keys        map[string]*Identity    // of other runtimes, by address
+	forwards    map[string]forward      // reads forwarded for others
+	requesters  map[string]forwardRate  // reads forwarded, by requester
+	pending     map[string]*promise     // reads waiting on peers, by address
+	transitions map[string]Address      // by the state they produced
+	children    map[string][]Address    // states derived from each state
+	following   map[string][]Address    // publishers subscribed at, by state
+	rejections  map[string][]*Rejection // by the state rejected
+	recorded    map[string]time.Time    // when each transition was recorded, by state
+	pins        map[string]bool
+	held        map[string]int       // needed by executing transitions
+	stored      map[string]time.Time // content stored outside transitions
+	subsHead    Address
+	subsChanged map[string]time.Time // latest subscription change applied, by entry
+
+	gcMu sync.RWMutex // held by GC, and shared by transitions starting or being recorded
+
+	subsMu sync.Mutex // serializes changes to the subscriber branch
+}
+
+// NewRuntime returns a runtime storing its content in cas, with new
+// keys.
+func NewRuntime(cas CAS) (r *Runtime, err error) {
+	defer Return(&err)
+	signKey, boxKey, id, err := newIdentity()
+	Ck(err)
+	r = &Runtime{
+		cas:         cas,
+		signKey:     signKey,
+		boxKey:      boxKey,
+		id:          id,
+		funcs:       make(map[string]Func),
+		keys:        make(map[string]*Identity),
+		forwards:    make(map[string]forward),
+		requesters:  make(map[string]forwardRate),
+		pending:     make(map[string]*promise),
+		transitions: make(map[string]Address),
+		children:    make(map[string][]Address),
+		following:   make(map[string][]Address),
+		rejections:  make(map[string][]*Rejection),
+		recorded:    make(map[string]time.Time),
+		pins:        make(map[string]bool),
+		held:        make(map[string]int),
+		stored:      make(map[string]time.Time),
+		subsChanged: make(map[string]time.Time),
+	}
+	r.genesis, err = cas.Put((&State{}).Bytes())
+	Ck(err)
+	r.ReadFunc, err = r.Define([]byte(readSource), readFunc)
+	Ck(err)
+	r.SubscribeFunc, err = r.Define([]byte(subscribeSource), subscribeFunc)
+	Ck(err)
+	r.subsHead, err = cas.Put(subscribersRoot.Bytes())
+	Ck(err)
+	return r, nil
+}
+
+// Addr returns the runtime's address: the hash of its public key.
+func (r *Runtime) Addr() Address {
+	return Hash(r.PublicKey())
+}
+
+// PublicKey returns the key the runtime signs with.
+func (r *Runtime) PublicKey() ed25519.PublicKey {
+	return r.id.SignKey
+}
+
+// Genesis returns the address of the empty state every state graph
+// starts from.
+func (r *Runtime) Genesis() Address {
+	return r.genesis
+}
+
+// AddPeer adds the runtime with identity id to those this runtime
+// asks for content it does not have, and adds its keys.
+func (r *Runtime) AddPeer(id *Identity) {
+	r.AddKey(id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = appendAddr(r.peers, id.Addr())
+}
+
+// Peers returns the runtime's peers.
+func (r *Runtime) Peers() []Address {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Address(nil), r.peers...)
 }
 
 /*
@@ -108,30 +254,126 @@ OnMessage is called when a message is received from a peer.
   - fulfill promise
 */
 func (r *Runtime) OnMessage(m Message) (err error) {
-	typ := m.Type()
-	switch typ {
-	case "transition":
-		r.exec(m.State(), m.Func(), m.Args())
-	case "read":
-		payload := r.read(m.State(), m.Hash())
-		clearMsg := r.MkMsg("reply", m.Sender(), payload)
-		cryptMsg := r.Encrypt(clearMsg)
-		r.Send(cryptMsg)
-	case "reply":
-		clearMsg := r.Decrypt(m)
-		r.Fulfill(clearMsg)
+	if err := r.Verify(&m); err != nil {
+		return err
+	}
+	switch m.Opcode {
+	case MSG_TRANSITION:
+		err = r.replay(&m)
+	case MSG_READ:
+		err = r.serveRead(&m)
+	case MSG_REPLY:
+		err = r.fulfill(&m)
+	case MSG_SUBSCRIBE:
+		err = r.applySubscription(&m)
+	case MSG_REJECT:
+		err = r.recordRejection(&m)
 	default:
-		err = fmt.Errorf("unknown message type: %s", typ)
+		err = fmt.Errorf("unknown message type: %s", m.Opcode)
 	}
 	return
 }
 
-// State is a node in the state graph.
-type State struct {
+// replay executes a transition a peer published, checking that it
+// arrives at the state the peer did, and passes it on to this
+// runtime's own subscribers.  The transition is tested as one by the
+// runtime that signed its authorship chunk, whichever peer relayed
+// it.  A transition the runtime's consensus test rejects is rejected
+// back to the peer.
+func (r *Runtime) replay(m *Message) error {
+	if len(m.States) != 2 {
+		return fmt.Errorf("transition message has %d states, expected 2", len(m.States))
+	}
+	if r.cas.Has(m.States[1]) {
+		return nil // already executed or replayed
+	}
+	author, args, err := authorship(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	// the old state may itself be one we have yet to fetch
+	if _, err := r.read(ctx, m.States[0]); err != nil {
+		return err
+	}
+	t, err := r.exec(ctx, author, m.States[0], m.Operand, args, true)
+	if errors.Is(err, ErrRejected) {
+		if err := r.reject(m, err); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !t.To.Equal(m.States[1]) {
+		return fmt.Errorf("replaying transition from %s gave state %s, peer %s got %s", m.States[0], t.To, m.From, m.States[1])
+	}
+	if err := r.follow(t); err != nil {
+		return err
+	}
+	return r.publish(t, m.Payload, m.From)
+}
+
+// authorship returns a chunk, signed by r, saying that r authored the
+// transition by fn on args from state from to state to.
+func (r *Runtime) authorship(from, to, fn Address, args []Address) ([]byte, error) {
+	c, err := r.chunk(encode(kindAuthorship, from, to, fn, encodeAddrs(args)))
+	if err != nil {
+		return nil, err
+	}
+	return c.Bytes(), nil
 }
 
-// Transition is an edge in the state graph.
-type Transition struct {
+// authorship returns the author and the arguments of the transition
+// described by transition message m, from its authorship chunk.
+func authorship(m *Message) (author Address, args []Address, err error) {
+	c, err := decodeChunk(m.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transition from %s: %w", m.From, err)
+	}
+	if err := c.Verify(); err != nil {
+		return nil, nil, fmt.Errorf("transition from %s: %w", m.From, err)
+	}
+	f, err := decodeKind(c.Data, kindAuthorship, 4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transition from %s: %w", m.From, err)
+	}
+	if !m.States[0].Equal(f[0]) || !m.States[1].Equal(f[1]) || !m.Operand.Equal(f[2]) {
+		return nil, nil, fmt.Errorf("transition from %s does not match its authorship", m.From)
+	}
+	args, err = decodeAddrs(f[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	return Hash(c.Origin), args, nil
 }
 
-// CAS is the content-addressable storage for the runtime.
+// publish sends a signed message describing transition t, with its
+// authorship chunk, to the subscribers of the state it started from,
+// other than the runtime it came from, if any.
+func (r *Runtime) publish(t *Transition, authorship []byte, from Address) error {
+	if r.Transport == nil {
+		return nil
+	}
+	subs, err := r.Subscribers(t.From)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if sub.Equal(from) || sub.Equal(r.Addr()) {
+			continue
+		}
+		m := &Message{
+			To:      sub,
+			States:  []Address{t.From, t.To},
+			Opcode:  MSG_TRANSITION,
+			Operand: t.Func,
+			Payload: authorship,
+		}
+		if err := r.send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
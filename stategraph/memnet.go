@@ -0,0 +1,53 @@
+package stategraph
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemNetwork is a Transport connecting runtimes in one process.  Each
+// message is delivered in a goroutine of its own, as a network would
+// deliver it, and the errors recipients return are collected.
+type MemNetwork struct {
+	mu       sync.Mutex
+	runtimes map[string]*Runtime
+	errs     []error
+}
+
+// NewMemNetwork returns an empty in-memory network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{runtimes: make(map[string]*Runtime)}
+}
+
+// Join connects r to the network, making it the runtime's transport.
+func (n *MemNetwork) Join(r *Runtime) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.runtimes[string(r.Addr())] = r
+	r.Transport = n
+}
+
+// Send delivers m to the runtime at m.To.
+func (n *MemNetwork) Send(m *Message) error {
+	n.mu.Lock()
+	r, ok := n.runtimes[string(m.To)]
+	n.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no runtime %s on the network", m.To)
+	}
+	go func() {
+		if err := r.OnMessage(*m); err != nil {
+			n.mu.Lock()
+			n.errs = append(n.errs, err)
+			n.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Errors returns the errors runtimes have returned from OnMessage.
+func (n *MemNetwork) Errors() []error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]error(nil), n.errs...)
+}
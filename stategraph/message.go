@@ -0,0 +1,26 @@
+package stategraph
+
+import (
+	"crypto/ed25519"
+)
+
+// Bytes returns the canonical encoding of the message without its
+// signature: the bytes the sender signs.
+func (m *Message) Bytes() []byte {
+	return encode(kindMessage, m.From, m.To, encodeAddrs(m.States), []byte{byte(m.Opcode)}, m.Operand, m.Payload)
+}
+
+// sign sets the message's sender to r and signs it.
+func (r *Runtime) sign(m *Message) {
+	m.From = r.Addr()
+	m.Signature = ed25519.Sign(r.signKey, m.Bytes())
+}
+
+// send signs m and hands it to the runtime's transport.
+func (r *Runtime) send(m *Message) error {
+	if r.Transport == nil {
+		return nil
+	}
+	r.sign(m)
+	return r.Transport.Send(m)
+}
@@ -0,0 +1,256 @@
+package stategraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A read request carries the identity of the runtime that wants the
+// content.  A peer that has the content seals it for the requester
+// and replies to whichever runtime sent it the request; a peer that
+// does not forwards the request to its own peers, remembering where
+// it came from, and passes back the sealed reply when it arrives.
+// Peers along the way see which content was asked for and by whom,
+// but cannot read it.
+
+// promise is a read waiting on a reply from a peer.  waiters counts
+// the reads sharing it, so that the last of them to give up lets a
+// later read ask again.
+type promise struct {
+	done    chan struct{}
+	err     error // set before done is closed if the request failed
+	waiters int
+}
+
+// Limits on the reads a runtime forwards for others.  A forward is
+// remembered for DefaultTimeout, while its reply may arrive.
+const (
+	MaxForwards             = 4096 // remembered at once
+	MaxForwardsPerRequester = 64   // per requester per DefaultTimeout
+)
+
+// errForwardLimit is returned for a read request the runtime drops
+// rather than forward.
+var errForwardLimit = errors.New("too many forwarded reads")
+
+// forward records a read request this runtime passed on for another.
+type forward struct {
+	via Address // the runtime the request came from
+	at  time.Time
+}
+
+// forwardRate counts the reads forwarded for one requester since
+// start.
+type forwardRate struct {
+	start time.Time
+	n     int
+}
+
+// forwardKey returns the key of the forward of requester's read of
+// addr.
+func forwardKey(addr, requester Address) string {
+	return string(addr) + "/" + string(requester)
+}
+
+// read returns the CAS object at addr.  If it is not in the local
+// CAS, read asks the runtime's peers for it and waits for the first
+// reply, storing the object locally.
+func (r *Runtime) read(ctx context.Context, addr Address) ([]byte, error) {
+	if buf, err := r.cas.Get(addr); err == nil {
+		return buf, nil
+	}
+	peers := r.Peers()
+	if r.Transport == nil || len(peers) == 0 {
+		return nil, fmt.Errorf("%s: %w", addr, ErrNotFound)
+	}
+
+	r.mu.Lock()
+	p, waiting := r.pending[string(addr)]
+	if !waiting {
+		p = &promise{done: make(chan struct{})}
+		r.pending[string(addr)] = p
+	}
+	p.waiters++
+	r.mu.Unlock()
+	if !waiting {
+		for _, peer := range peers {
+			m := &Message{To: peer, Opcode: MSG_READ, Operand: addr, Payload: r.id.Bytes()}
+			if err := r.send(m); err != nil {
+				// fail the reads sharing the promise and let a later
+				// read ask again
+				r.mu.Lock()
+				if r.pending[string(addr)] == p {
+					delete(r.pending, string(addr))
+					p.err = err
+					close(p.done)
+				}
+				r.mu.Unlock()
+				break
+			}
+		}
+	}
+
+	select {
+	case <-p.done:
+		if p.err != nil {
+			return nil, fmt.Errorf("reading %s: %w", addr, p.err)
+		}
+		return r.cas.Get(addr)
+	case <-ctx.Done():
+		// the last read to give up lets a later read ask again
+		r.mu.Lock()
+		p.waiters--
+		if p.waiters == 0 && r.pending[string(addr)] == p {
+			delete(r.pending, string(addr))
+		}
+		r.mu.Unlock()
+		return nil, fmt.Errorf("reading %s: %w", addr, ctx.Err())
+	}
+}
+
+// serveRead answers a read request with the object from the local
+// CAS, sealed for the requester, or forwards the request to this
+// runtime's peers if it does not have the object.
+func (r *Runtime) serveRead(m *Message) error {
+	requester, err := ParseIdentity(m.Payload)
+	if err != nil {
+		return err
+	}
+	buf, err := r.cas.Get(m.Operand)
+	if err != nil {
+		return r.forwardRead(m, requester)
+	}
+	sealed, err := r.Encrypt(buf, requester)
+	if err != nil {
+		return err
+	}
+	reply := &Message{
+		To:      m.From,
+		States:  m.States,
+		Opcode:  MSG_REPLY,
+		Operand: m.Operand,
+		Payload: encode(kindReply, requester.Addr(), sealed),
+	}
+	return r.send(reply)
+}
+
+// forwardRead passes a read request on to the runtime's peers, other
+// than the one it came from and the requester, unless this runtime
+// has recently done so already.  A request is dropped while
+// MaxForwards forwards are outstanding, or once MaxForwardsPerRequester
+// have been forwarded for its requester within DefaultTimeout.
+func (r *Runtime) forwardRead(m *Message, requester *Identity) error {
+	key := forwardKey(m.Operand, requester.Addr())
+	now := time.Now()
+	r.mu.Lock()
+	if f, ok := r.forwards[key]; ok && now.Sub(f.at) < DefaultTimeout {
+		r.mu.Unlock()
+		return nil
+	}
+	if len(r.forwards) >= MaxForwards {
+		r.expireForwards(now)
+	}
+	rate := r.requesters[string(requester.Addr())]
+	if now.Sub(rate.start) >= DefaultTimeout {
+		rate = forwardRate{start: now}
+	}
+	if len(r.forwards) >= MaxForwards || rate.n >= MaxForwardsPerRequester {
+		r.mu.Unlock()
+		return fmt.Errorf("read of %s for %s: %w", m.Operand, requester.Addr(), errForwardLimit)
+	}
+	rate.n++
+	r.requesters[string(requester.Addr())] = rate
+	r.forwards[key] = forward{via: m.From, at: now}
+	r.mu.Unlock()
+	for _, peer := range r.Peers() {
+		if peer.Equal(m.From) || peer.Equal(requester.Addr()) {
+			continue
+		}
+		fwd := &Message{
+			To:      peer,
+			States:  m.States,
+			Opcode:  MSG_READ,
+			Operand: m.Operand,
+			Payload: m.Payload,
+		}
+		if err := r.send(fwd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fulfill handles a read reply.  A reply for this runtime is
+// decrypted and checked against the address it was read from, stored,
+// and the reads waiting on it woken; a reply for another runtime is
+// passed back towards it.
+func (r *Runtime) fulfill(m *Message) error {
+	f, err := decodeKind(m.Payload, kindReply, 2)
+	if err != nil {
+		return err
+	}
+	requester, err := ParseAddress(f[0])
+	if err != nil {
+		return err
+	}
+	if !requester.Equal(r.Addr()) {
+		return r.forwardReply(m, requester)
+	}
+	buf, err := r.Decrypt(f[1])
+	if err != nil {
+		return fmt.Errorf("reply from %s: %w", m.From, err)
+	}
+	if !Hash(buf).Equal(m.Operand) {
+		return fmt.Errorf("reply from %s does not hash to %s", m.From, m.Operand)
+	}
+	if _, err := r.keep(buf); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	p, ok := r.pending[string(m.Operand)]
+	delete(r.pending, string(m.Operand))
+	r.mu.Unlock()
+	if ok {
+		close(p.done)
+	}
+	return nil
+}
+
+// forwardReply passes a reply for requester back to the runtime this
+// runtime received requester's read request from.  Later replies to
+// the same request are dropped.
+func (r *Runtime) forwardReply(m *Message, requester Address) error {
+	key := forwardKey(m.Operand, requester)
+	r.mu.Lock()
+	f, ok := r.forwards[key]
+	delete(r.forwards, key)
+	r.mu.Unlock()
+	if !ok || time.Since(f.at) >= DefaultTimeout {
+		return nil
+	}
+	fwd := &Message{
+		To:      f.via,
+		States:  m.States,
+		Opcode:  MSG_REPLY,
+		Operand: m.Operand,
+		Payload: m.Payload,
+	}
+	return r.send(fwd)
+}
+
+// expireForwards drops the forwards and requester counts older than
+// DefaultTimeout.  The caller holds r.mu.
+func (r *Runtime) expireForwards(now time.Time) {
+	for key, f := range r.forwards {
+		if now.Sub(f.at) >= DefaultTimeout {
+			delete(r.forwards, key)
+		}
+	}
+	for requester, rate := range r.requesters {
+		if now.Sub(rate.start) >= DefaultTimeout {
+			delete(r.requesters, requester)
+		}
+	}
+}
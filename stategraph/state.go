@@ -0,0 +1,333 @@
+package stategraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrUnknownFunc is returned when a transition names a function the
+// runtime has not defined.
+var ErrUnknownFunc = errors.New("unknown transition function")
+
+// State is a node in the state graph: named content, and the states
+// it was derived from.  A state's address is the hash of its
+// canonical encoding, so runtimes that execute the same transitions
+// from the same state arrive at the same address.
+type State struct {
+	Parents []Address
+	Entries map[string]Address
+}
+
+// Bytes returns the state's canonical encoding, which is stored in
+// the CAS.
+func (s *State) Bytes() []byte {
+	names := make([]string, 0, len(s.Entries))
+	for name := range s.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries [][]byte
+	for _, name := range names {
+		entries = append(entries, []byte(name), s.Entries[name])
+	}
+	return encode(kindState, encodeAddrs(s.Parents), encode(0, entries...)[1:])
+}
+
+func decodeState(buf []byte) (*State, error) {
+	f, err := decodeKind(buf, kindState, 2)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{Entries: make(map[string]Address)}
+	if s.Parents, err = decodeAddrs(f[0]); err != nil {
+		return nil, err
+	}
+	_, entries, err := decode(append([]byte{0}, f[1]...))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("odd number of fields in state entries")
+	}
+	for i := 0; i < len(entries); i += 2 {
+		addr, err := ParseAddress(entries[i+1])
+		if err != nil {
+			return nil, err
+		}
+		s.Entries[string(entries[i])] = addr
+	}
+	return s, nil
+}
+
+// Transition is an edge in the state graph: the execution of Func on
+// the arguments stored at Args, taking the graph from state From to
+// state To.
+type Transition struct {
+	From Address
+	To   Address
+	Func Address
+	Args Address
+}
+
+// Bytes returns the transition's canonical encoding, which is stored
+// in the CAS.
+func (t *Transition) Bytes() []byte {
+	return encode(kindTransition, t.From, t.To, t.Func, t.Args)
+}
+
+func decodeTransition(buf []byte) (*Transition, error) {
+	f, err := decodeKind(buf, kindTransition, 4)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transition{}
+	for i, p := range []*Address{&t.From, &t.To, &t.Func, &t.Args} {
+		if *p, err = ParseAddress(f[i]); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Func is a transition function.  It derives a new state from an old
+// one through tx, which confines it to reading and writing the CAS
+// and the entries of the state, so that replaying it anywhere gives
+// the same result.
+type Func func(tx *Tx, args []Address) error
+
+// Tx is the sandbox a transition function runs in.
+type Tx struct {
+	ctx     context.Context
+	r       *Runtime
+	entries map[string]Address
+	held    []Address // written, and kept from GC until the transition is done
+	dry     bool      // writes are not stored, as for a consensus test
+}
+
+// Get returns the address of the named entry in the state.
+func (tx *Tx) Get(name string) (Address, bool) {
+	addr, ok := tx.entries[name]
+	return addr, ok
+}
+
+// Set binds name to addr in the new state.
+func (tx *Tx) Set(name string, addr Address) {
+	tx.entries[name] = addr
+}
+
+// Delete removes the named entry from the new state.
+func (tx *Tx) Delete(name string) {
+	delete(tx.entries, name)
+}
+
+// Read returns the content at addr, fetching it from peers if it is
+// not local.
+func (tx *Tx) Read(addr Address) ([]byte, error) {
+	buf, err := tx.r.read(tx.ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return content(buf)
+}
+
+// ReadChunk returns the chunk at addr, verified, fetching it from
+// peers if it is not local.  Unlike Read, it tells the transition who
+// wrote the content.
+func (tx *Tx) ReadChunk(addr Address) (*Chunk, error) {
+	buf, err := tx.r.read(tx.ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := decodeChunk(buf)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Verify()
+}
+
+// Write stores data in the CAS and returns its address.  Unlike
+// Runtime.Write, the address depends only on data, as a replay must
+// arrive at the same state.  The Tx given to a consensus test returns
+// the address without storing data.
+func (tx *Tx) Write(data []byte) (Address, error) {
+	buf := encode(kindBlob, data)
+	addr := Hash(buf)
+	if tx.dry {
+		return addr, nil
+	}
+	tx.r.hold(addr)
+	tx.held = append(tx.held, addr)
+	return tx.r.cas.Put(buf)
+}
+
+// Define makes fn available to transitions as the function with the
+// given source, such as its code or a specification of what it does,
+// and returns its address: the address of the source in the CAS.
+// Runtimes that replay each other's transitions must define the same
+// functions.
+func (r *Runtime) Define(source []byte, fn Func) (Address, error) {
+	addr, err := r.keep(encode(kindBlob, source))
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs[string(addr)] = fn
+	return addr, nil
+}
+
+// Exec executes transition function fn on args in state, records the
+// new state and the transition in the state graph, and publishes a
+// signed message describing the transition.  It returns the address
+// of the new state.
+func (r *Runtime) Exec(ctx context.Context, state, fn Address, args ...Address) (Address, error) {
+	t, err := r.exec(ctx, r.Addr(), state, fn, args, true)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := r.authorship(t.From, t.To, t.Func, args)
+	if err != nil {
+		return nil, err
+	}
+	return t.To, r.publish(t, signed, nil)
+}
+
+// exec executes and records a transition by author without
+// publishing it.  If check is set, the runtime's consensus test must
+// accept it first; only the subscription changes the runtime applies
+// to its own subscriber branch go unchecked.
+//
+// GC is held off only while the transition starts and while it is
+// recorded, not while the function waits on peers; in between, GC
+// keeps the state, the arguments and what the function writes.
+func (r *Runtime) exec(ctx context.Context, author, state, fn Address, args []Address, check bool) (t *Transition, err error) {
+	held := append([]Address{state}, args...)
+	r.gcMu.RLock()
+	r.hold(held...)
+	r.gcMu.RUnlock()
+	defer r.release(held...)
+	old, err := r.State(state)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	f, ok := r.funcs[string(fn)]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownFunc, fn)
+	}
+	if check && r.Consensus != nil {
+		// the test gets its own copy of the entries
+		dry := &Tx{ctx: ctx, r: r, entries: make(map[string]Address), dry: true}
+		for name, addr := range old.Entries {
+			dry.entries[name] = addr
+		}
+		if err := r.Consensus.Test(dry, author, state, fn, args); err != nil {
+			return nil, fmt.Errorf("%w: %s from %s by %s: %v", ErrRejected, fn, state, author, err)
+		}
+	}
+
+	tx := &Tx{ctx: ctx, r: r, entries: make(map[string]Address)}
+	for name, addr := range old.Entries {
+		tx.entries[name] = addr
+	}
+	defer func() { r.release(tx.held...) }()
+	if err := f(tx, args); err != nil {
+		return nil, fmt.Errorf("transition %s failed: %w", fn, err)
+	}
+
+	r.gcMu.RLock()
+	defer r.gcMu.RUnlock()
+
+	t = &Transition{From: state, Func: fn}
+	if t.To, err = r.cas.Put((&State{Parents: []Address{state}, Entries: tx.entries}).Bytes()); err != nil {
+		return nil, err
+	}
+	if t.Args, err = r.cas.Put(encode(kindBlob, encodeAddrs(args))); err != nil {
+		return nil, err
+	}
+	addr, err := r.cas.Put(t.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.transitions[string(t.To)]; !ok {
+		r.transitions[string(t.To)] = addr
+		r.recorded[string(t.To)] = time.Now()
+		r.children[string(state)] = append(r.children[string(state)], t.To)
+	}
+	return t, nil
+}
+
+// State returns the state at addr from the local CAS.
+func (r *Runtime) State(addr Address) (*State, error) {
+	buf, err := r.cas.Get(addr)
+	if err != nil {
+		return nil, fmt.Errorf("state %s: %w", addr, err)
+	}
+	return decodeState(buf)
+}
+
+// Transition returns the transition that produced state, if this
+// runtime has recorded it.
+func (r *Runtime) Transition(state Address) (*Transition, error) {
+	r.mu.Lock()
+	addr, ok := r.transitions[string(state)]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("transition to %s: %w", state, ErrNotFound)
+	}
+	buf, err := r.cas.Get(addr)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTransition(buf)
+}
+
+// Children returns the states this runtime has derived from state.
+func (r *Runtime) Children(state Address) []Address {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Address(nil), r.children[string(state)]...)
+}
+
+// readSource is the source of the built-in read function.
+const readSource = `stategraph read, version 1.
+
+Reads the content at the address given as the only argument, fetching
+it from peers if need be, and records the read in the new state as the
+entry "read/" followed by the address.
+`
+
+// readFunc is the built-in read function.
+func readFunc(tx *Tx, args []Address) error {
+	if len(args) != 1 {
+		return fmt.Errorf("read takes one address, got %d", len(args))
+	}
+	if _, err := tx.Read(args[0]); err != nil {
+		return err
+	}
+	tx.Set("read/"+args[0].String(), args[0])
+	return nil
+}
+
+// Read reads the content at addr in state.  Reads are the only way
+// content reaches the world outside the state graph, so a read is
+// itself a transition, by the built-in ReadFunc, and Read returns the
+// new state along with the content.
+func (r *Runtime) Read(ctx context.Context, state, addr Address) (newState Address, data []byte, err error) {
+	newState, err = r.Exec(ctx, state, r.ReadFunc, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := r.cas.Get(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = content(buf)
+	return newState, data, err
+}
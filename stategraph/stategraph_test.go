@@ -0,0 +1,335 @@
+package stategraph
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// newRuntimes returns n runtimes on an in-memory network, each the
+// peer of every other, with the append function defined.
+func newRuntimes(t *testing.T, n int) (net *MemNetwork, rs []*Runtime, appendFn Address) {
+	net = NewMemNetwork()
+	for i := 0; i < n; i++ {
+		r, err := NewRuntime(NewMemCAS())
+		Tassert(t, err == nil, "NewRuntime: %v", err)
+		net.Join(r)
+		appendFn, err = r.Define([]byte("append the content of each argument to the log entry"), appendLog)
+		Tassert(t, err == nil, "Define: %v", err)
+		rs = append(rs, r)
+	}
+	for _, r := range rs {
+		for _, p := range rs {
+			if p != r {
+				r.AddPeer(p.Identity())
+			}
+		}
+	}
+	return
+}
+
+// appendLog appends the content of each argument to the "log" entry.
+func appendLog(tx *Tx, args []Address) error {
+	var log []byte
+	if addr, ok := tx.Get("log"); ok {
+		var err error
+		if log, err = tx.Read(addr); err != nil {
+			return err
+		}
+	}
+	for _, a := range args {
+		data, err := tx.Read(a)
+		if err != nil {
+			return err
+		}
+		log = append(log, data...)
+	}
+	addr, err := tx.Write(log)
+	if err != nil {
+		return err
+	}
+	tx.Set("log", addr)
+	return nil
+}
+
+// waitSubscribed polls until sub is subscribed to state at pub, or
+// fails.
+func waitSubscribed(t *testing.T, pub, sub *Runtime, state Address) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		subs, err := pub.Subscribers(state)
+		Tassert(t, err == nil, "Subscribers: %v", err)
+		for _, s := range subs {
+			if s.Equal(sub.Addr()) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("runtime never subscribed to %s", state)
+}
+
+// waitFor polls until r has state, or fails.
+func waitFor(t *testing.T, r *Runtime, state Address) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := r.Transition(state); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("runtime never reached state %s", state)
+}
+
+func TestEncode(t *testing.T) {
+	a, b := Hash([]byte("a")), Hash([]byte("b"))
+	s := &State{Parents: []Address{a}, Entries: map[string]Address{"y": b, "x": a}}
+	got, err := decodeState(s.Bytes())
+	Tassert(t, err == nil, "decodeState: %v", err)
+	Tassert(t, len(got.Parents) == 1 && got.Parents[0].Equal(a), "parents %v", got.Parents)
+	Tassert(t, got.Entries["x"].Equal(a) && got.Entries["y"].Equal(b), "entries %v", got.Entries)
+	Tassert(t, string(got.Bytes()) == string(s.Bytes()), "encoding is not canonical")
+
+	_, _, err = decode([]byte{kindBlob, 5, 'x'})
+	Tassert(t, err != nil, "expected an error for a truncated field")
+	_, err = decodeTransition(s.Bytes())
+	Tassert(t, err != nil, "expected an error decoding a state as a transition")
+}
+
+func TestWrite(t *testing.T) {
+	r, err := NewRuntime(NewMemCAS())
+	Tassert(t, err == nil, "NewRuntime: %v", err)
+	a1, err := r.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	a2, err := r.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	Tassert(t, !a1.Equal(a2), "expected writes of the same data to get different addresses")
+
+	buf, err := r.cas.Get(a1)
+	Tassert(t, err == nil, "Get: %v", err)
+	data, err := content(buf)
+	Tassert(t, err == nil && string(data) == "hello", "content returned %q, %v", data, err)
+	c, err := decodeChunk(buf)
+	Tassert(t, err == nil, "decodeChunk: %v", err)
+	Tassert(t, c.Origin.Equal(r.PublicKey()), "expected the runtime as the chunk's origin")
+
+	c.Data = []byte("jello")
+	_, err = content(c.Bytes())
+	Tassert(t, err != nil, "expected a tampered chunk to fail verification")
+}
+
+func TestExec(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	ctx := context.Background()
+	hello, err := r.Write([]byte("hello, "))
+	Tassert(t, err == nil, "Write: %v", err)
+	world, err := r.Write([]byte("world"))
+	Tassert(t, err == nil, "Write: %v", err)
+
+	s1, err := r.Exec(ctx, r.Genesis(), appendFn, hello)
+	Tassert(t, err == nil, "Exec: %v", err)
+	s2, err := r.Exec(ctx, s1, appendFn, world)
+	Tassert(t, err == nil, "Exec: %v", err)
+
+	st, err := r.State(s2)
+	Tassert(t, err == nil, "State: %v", err)
+	Tassert(t, len(st.Parents) == 1 && st.Parents[0].Equal(s1), "expected s2 to follow s1")
+	buf, err := r.cas.Get(st.Entries["log"])
+	Tassert(t, err == nil, "Get: %v", err)
+	log, err := content(buf)
+	Tassert(t, err == nil && string(log) == "hello, world", "log is %q, %v", log, err)
+
+	tr, err := r.Transition(s2)
+	Tassert(t, err == nil, "Transition: %v", err)
+	Tassert(t, tr.From.Equal(s1) && tr.Func.Equal(appendFn), "unexpected transition %+v", tr)
+	kids := r.Children(r.Genesis())
+	Tassert(t, len(kids) == 1 && kids[0].Equal(s1), "unexpected children %v", kids)
+
+	// executing the same transition again arrives at the same state
+	again, err := r.Exec(ctx, r.Genesis(), appendFn, hello)
+	Tassert(t, err == nil && again.Equal(s1), "re-executing gave %s, %v", again, err)
+
+	_, err = r.Exec(ctx, s1, Hash([]byte("undefined")))
+	Tassert(t, errors.Is(err, ErrUnknownFunc), "expected ErrUnknownFunc, got %v", err)
+	_, err = r.Exec(ctx, s1, appendFn, Hash([]byte("missing")))
+	Tassert(t, errors.Is(err, ErrNotFound), "expected ErrNotFound, got %v", err)
+}
+
+// TestReplay checks that subscribers replay a published transition,
+// fetching the content it read from its author, and arrive at the
+// same state.
+func TestReplay(t *testing.T) {
+	net, rs, appendFn := newRuntimes(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+	ctx := context.Background()
+	for _, r := range []*Runtime{b, c} {
+		Tassert(t, r.Subscribe(a.Addr(), a.Genesis()) == nil, "Subscribe failed")
+		waitSubscribed(t, a, r, a.Genesis())
+	}
+	hello, err := a.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s1, err := a.Exec(ctx, a.Genesis(), appendFn, hello)
+	Tassert(t, err == nil, "Exec: %v", err)
+	waitFor(t, b, s1)
+	waitFor(t, c, s1)
+
+	// a subscriber reads the content in the new state, recording the
+	// read, and a runtime subscribed to it there hears of the read
+	Tassert(t, a.Subscribe(b.Addr(), s1) == nil, "Subscribe failed")
+	waitSubscribed(t, b, a, s1)
+	s2, data, err := b.Read(ctx, s1, hello)
+	Tassert(t, err == nil && string(data) == "hello", "Read returned %q, %v", data, err)
+	st, err := b.State(s2)
+	Tassert(t, err == nil, "State: %v", err)
+	Tassert(t, st.Entries["read/"+hello.String()].Equal(hello), "the read is not recorded in %v", st.Entries)
+	waitFor(t, a, s2)
+
+	errs := net.Errors()
+	Tassert(t, len(errs) == 0, "runtimes returned errors: %v", errs)
+}
+
+// TestSubscribe checks subscription changes, that subscribers follow
+// the states they replay, and that transitions are relayed to the
+// subscribers of subscribers.
+func TestSubscribe(t *testing.T) {
+	net, rs, appendFn := newRuntimes(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+	ctx := context.Background()
+	gen := a.Genesis()
+
+	// b subscribes at a, and c at b
+	Tassert(t, b.Subscribe(a.Addr(), gen) == nil, "Subscribe failed")
+	Tassert(t, c.Subscribe(b.Addr(), gen) == nil, "Subscribe failed")
+	waitSubscribed(t, a, b, gen)
+	waitSubscribed(t, b, c, gen)
+	subs, err := a.Subscribers(gen)
+	Tassert(t, err == nil && len(subs) == 1, "Subscribers returned %v, %v", subs, err)
+	branch, err := a.State(a.SubscriberBranch())
+	Tassert(t, err == nil, "State: %v", err)
+	Tassert(t, branch.Entries[subscriptionKey(gen, b.Addr())] != nil, "no subscription entry in %v", branch.Entries)
+
+	x, err := a.Write([]byte("x"))
+	Tassert(t, err == nil, "Write: %v", err)
+	s1, err := a.Exec(ctx, gen, appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+	waitFor(t, b, s1)
+	waitFor(t, c, s1)
+
+	// b followed a to s1, so hears of the next transition too, and
+	// left gen
+	waitSubscribed(t, a, b, s1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subs, err := a.Subscribers(gen)
+		Tassert(t, err == nil, "Subscribers: %v", err)
+		if len(subs) == 0 {
+			break
+		}
+		Tassert(t, time.Now().Before(deadline), "b is still subscribed to gen: %v", subs)
+		time.Sleep(time.Millisecond)
+	}
+	s2, err := a.Exec(ctx, s1, appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+	waitFor(t, b, s2)
+
+	// once b unsubscribes, it hears no more
+	waitSubscribed(t, a, b, s2)
+	Tassert(t, b.Unsubscribe(a.Addr(), s2) == nil, "Unsubscribe failed")
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		subs, err := a.Subscribers(s2)
+		Tassert(t, err == nil, "Subscribers: %v", err)
+		if len(subs) == 0 {
+			break
+		}
+		Tassert(t, time.Now().Before(deadline), "b is still subscribed: %v", subs)
+		time.Sleep(time.Millisecond)
+	}
+	s3, err := a.Exec(ctx, s2, appendFn, x)
+	Tassert(t, err == nil, "Exec: %v", err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = b.Transition(s3)
+	Tassert(t, errors.Is(err, ErrNotFound), "expected b not to hear of s3, got %v", err)
+
+	errs := net.Errors()
+	Tassert(t, len(errs) == 0, "runtimes returned errors: %v", errs)
+}
+
+// subscriptionMessage returns a subscription message from r to pub
+// carrying a chunk written by origin with the given change and time.
+func subscriptionMessage(t *testing.T, r, origin, pub *Runtime, state Address, change string, at time.Time) Message {
+	t.Helper()
+	addr, err := origin.Write(encode(kindSubscription, state, []byte(change), encodeTime(at)))
+	Tassert(t, err == nil, "Write: %v", err)
+	buf, err := origin.cas.Get(addr)
+	Tassert(t, err == nil, "Get: %v", err)
+	m := &Message{To: pub.Addr(), States: []Address{state}, Opcode: MSG_SUBSCRIBE, Operand: addr, Payload: buf}
+	r.sign(m)
+	return *m
+}
+
+// TestSubscriptionReplay checks that a publisher refuses subscription
+// chunks that did not originate from their sender, that are stale,
+// or that are older than the last change to the same subscription.
+func TestSubscriptionReplay(t *testing.T) {
+	_, rs, _ := newRuntimes(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+	gen := a.Genesis()
+	subscribed := func() bool {
+		subs, err := a.Subscribers(gen)
+		Tassert(t, err == nil, "Subscribers: %v", err)
+		return len(subs) > 0
+	}
+
+	before := time.Now()
+	Tassert(t, a.OnMessage(subscriptionMessage(t, b, b, a, gen, subAdd, before.Add(time.Millisecond))) == nil, "subscribing failed")
+	Tassert(t, a.OnMessage(subscriptionMessage(t, b, b, a, gen, subRemove, before.Add(2*time.Millisecond))) == nil, "unsubscribing failed")
+	Tassert(t, !subscribed(), "expected b to be unsubscribed")
+
+	err := a.OnMessage(subscriptionMessage(t, b, b, a, gen, subAdd, before))
+	Tassert(t, err != nil, "expected a change older than the last to be refused")
+	err = a.OnMessage(subscriptionMessage(t, b, b, a, gen, subAdd, time.Now().Add(-2*MaxSubscriptionAge)))
+	Tassert(t, err != nil, "expected a stale change to be refused")
+	err = a.OnMessage(subscriptionMessage(t, b, c, a, gen, subAdd, time.Now()))
+	Tassert(t, err != nil, "expected a change made by another runtime to be refused")
+	Tassert(t, !subscribed(), "expected b to stay unsubscribed")
+}
+
+// TestReplayMismatch checks that a transition message claiming the
+// wrong new state is rejected.
+func TestReplayMismatch(t *testing.T) {
+	_, rs, appendFn := newRuntimes(t, 1)
+	r := rs[0]
+	hello, err := r.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	bogus := Hash([]byte("bogus"))
+	signed, err := r.authorship(r.Genesis(), bogus, appendFn, []Address{hello})
+	Tassert(t, err == nil, "authorship: %v", err)
+	m := Message{
+		States:  []Address{r.Genesis(), bogus},
+		Opcode:  MSG_TRANSITION,
+		Operand: appendFn,
+		Payload: signed,
+	}
+	r.sign(&m)
+	err = r.OnMessage(m)
+	Tassert(t, err != nil, "expected an error replaying to the wrong state")
+	m.Operand = r.ReadFunc
+	r.sign(&m)
+	err = r.OnMessage(m)
+	Tassert(t, err != nil, "expected an error for a transition that does not match its authorship")
+	m.Operand, m.Payload = appendFn, encodeAddrs([]Address{hello})
+	r.sign(&m)
+	err = r.OnMessage(m)
+	Tassert(t, err != nil, "expected an error for a transition without an authorship chunk")
+	m = Message{Opcode: 99}
+	r.sign(&m)
+	err = r.OnMessage(m)
+	Tassert(t, err != nil, "expected an error for an unknown message type")
+}
@@ -0,0 +1,250 @@
+package stategraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// Each runtime keeps the subscribers of its states on a branch of the
+// state graph of its own, rooted at subscribersRoot rather than the
+// genesis state.  A subscriber adds or removes itself by writing a
+// chunk naming the state and the change, and sending it to the
+// runtime, which applies it to the branch with the built-in subscribe
+// function.  The branch has an entry for each subscription, named by
+// the state and the subscriber's address, holding the address of the
+// subscriber's chunk.
+
+// Subscription changes.
+const (
+	subAdd    = "add"
+	subRemove = "remove"
+)
+
+// MaxSubscriptionAge bounds how old a subscription chunk may be when
+// it arrives.
+const MaxSubscriptionAge = time.Minute
+
+// subscribersRoot is the first state of every subscriber branch.
+var subscribersRoot = &State{Entries: map[string]Address{"branch": Hash([]byte("subscribers"))}}
+
+// subscribeSource is the source of the built-in subscribe function.
+const subscribeSource = `stategraph subscribe, version 1.
+
+Applies the subscription chunk given as the only argument to the
+subscriber branch.  The chunk's data names a state, "add" or
+"remove", and the time of the change; the entry for the chunk's
+origin's subscription to the state is set to the chunk's address or
+removed.
+`
+
+// subscriptionKey returns the name of the entry for subscriber's
+// subscription to state.
+func subscriptionKey(state, subscriber Address) string {
+	return state.String() + "/" + subscriber.String()
+}
+
+// subscribeFunc is the built-in subscribe function.
+func subscribeFunc(tx *Tx, args []Address) error {
+	if len(args) != 1 {
+		return fmt.Errorf("subscribe takes one chunk address, got %d", len(args))
+	}
+	c, err := tx.ReadChunk(args[0])
+	if err != nil {
+		return err
+	}
+	f, err := decodeKind(c.Data, kindSubscription, 3)
+	if err != nil {
+		return err
+	}
+	state, err := ParseAddress(f[0])
+	if err != nil {
+		return err
+	}
+	key := subscriptionKey(state, Hash(c.Origin))
+	switch string(f[1]) {
+	case subAdd:
+		tx.Set(key, args[0])
+	case subRemove:
+		tx.Delete(key)
+	default:
+		return fmt.Errorf("unknown subscription change %q", f[1])
+	}
+	return nil
+}
+
+// Subscribe asks the runtime at publisher to send this runtime the
+// transitions it executes from state.  While subscribed, the runtime
+// follows the transitions it replays, subscribing to each new state
+// at the same publisher.
+func (r *Runtime) Subscribe(publisher, state Address) error {
+	if err := r.changeSubscription(publisher, state, subAdd); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.following[string(state)] = appendAddr(r.following[string(state)], publisher)
+	return nil
+}
+
+// Unsubscribe asks the runtime at publisher to stop sending this
+// runtime the transitions it executes from state.
+func (r *Runtime) Unsubscribe(publisher, state Address) error {
+	r.mu.Lock()
+	var keep []Address
+	for _, p := range r.following[string(state)] {
+		if !p.Equal(publisher) {
+			keep = append(keep, p)
+		}
+	}
+	r.following[string(state)] = keep
+	r.mu.Unlock()
+	return r.changeSubscription(publisher, state, subRemove)
+}
+
+// changeSubscription writes a subscription chunk and sends it to
+// publisher.
+func (r *Runtime) changeSubscription(publisher, state Address, change string) error {
+	addr, err := r.Write(encode(kindSubscription, state, []byte(change), encodeTime(time.Now())))
+	if err != nil {
+		return err
+	}
+	buf, err := r.cas.Get(addr)
+	if err != nil {
+		return err
+	}
+	m := &Message{
+		To:      publisher,
+		States:  []Address{state},
+		Opcode:  MSG_SUBSCRIBE,
+		Operand: addr,
+		Payload: buf,
+	}
+	if publisher.Equal(r.Addr()) {
+		r.sign(m)
+		return r.OnMessage(*m)
+	}
+	return r.send(m)
+}
+
+// applySubscription applies the subscription chunk a peer sent to
+// the subscriber branch.  The chunk must originate from the peer and
+// be newer than the last change to the same entry.
+func (r *Runtime) applySubscription(m *Message) error {
+	if !Hash(m.Payload).Equal(m.Operand) {
+		return fmt.Errorf("subscription from %s does not hash to %s", m.From, m.Operand)
+	}
+	c, err := decodeChunk(m.Payload)
+	if err != nil {
+		return err
+	}
+	if !Hash(c.Origin).Equal(m.From) {
+		return fmt.Errorf("subscription from %s was made by another runtime", m.From)
+	}
+	f, err := decodeKind(c.Data, kindSubscription, 3)
+	if err != nil {
+		return err
+	}
+	state, err := ParseAddress(f[0])
+	if err != nil {
+		return err
+	}
+	at, err := decodeTime(f[2])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Sub(at) > MaxSubscriptionAge || at.Sub(now) > MaxSubscriptionAge {
+		return fmt.Errorf("subscription from %s is stale", m.From)
+	}
+	if _, err := r.keep(m.Payload); err != nil {
+		return err
+	}
+	key := subscriptionKey(state, m.From)
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+	r.mu.Lock()
+	last, ok := r.subsChanged[key]
+	r.mu.Unlock()
+	if ok && !at.After(last) {
+		return fmt.Errorf("subscription from %s is older than its last change", m.From)
+	}
+	t, err := r.exec(context.Background(), m.From, r.SubscriberBranch(), r.SubscribeFunc, []Address{m.Operand}, false)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subsHead = t.To
+	// changes older than MaxSubscriptionAge are refused anyway
+	for k, changed := range r.subsChanged {
+		if now.Sub(changed) > MaxSubscriptionAge {
+			delete(r.subsChanged, k)
+		}
+	}
+	r.subsChanged[key] = at
+	return nil
+}
+
+// SubscriberBranch returns the current head of the runtime's
+// subscriber branch.
+func (r *Runtime) SubscriberBranch() Address {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subsHead
+}
+
+// Subscribers returns the addresses of the runtimes subscribed to
+// state, in a stable order.
+func (r *Runtime) Subscribers(state Address) (subs []Address, err error) {
+	head, err := r.State(r.SubscriberBranch())
+	if err != nil {
+		return nil, err
+	}
+	prefix := state.String() + "/"
+	for name := range head.Entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		mh, err := multihash.FromB58String(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			return nil, fmt.Errorf("bad subscription entry %q: %w", name, err)
+		}
+		subs = append(subs, Address(mh))
+	}
+	sort.Slice(subs, func(i, j int) bool { return bytes.Compare(subs[i], subs[j]) < 0 })
+	return subs, nil
+}
+
+// follow moves this runtime's subscriptions to the old state of a
+// replayed transition over to the state it produced, at each
+// publisher this runtime follows the old state at.
+func (r *Runtime) follow(t *Transition) error {
+	r.mu.Lock()
+	publishers := append([]Address(nil), r.following[string(t.From)]...)
+	r.mu.Unlock()
+	for _, p := range publishers {
+		if err := r.Subscribe(p, t.To); err != nil {
+			return err
+		}
+		if err := r.Unsubscribe(p, t.From); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendAddr appends addr to addrs unless it is already there.
+func appendAddr(addrs []Address, addr Address) []Address {
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}